@@ -0,0 +1,393 @@
+/*
+Package client accesses a kv.BTree served over the network by a
+server.RESPServer.
+
+A Client offers the same operations as the tree itself, each taking a context
+whose deadline and cancellation apply to the round trip to the server. Clients
+may be used concurrently, in which case each operation in progress uses its own
+connection out of a pool of connections.
+*/
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+// Config provides parameters used to connect to a server.
+type Config struct {
+	Network string // Network of the address, "tcp" by default, or "unix"
+	Address string // Address of the server, e.g. "localhost:6379"
+
+	MaxConns     int           // Maximum number of connections in use at once, unlimited by default
+	MaxIdleConns int           // Maximum number of idle connections kept open, 2 by default
+	DialTimeout  time.Duration // Timeout of establishing a connection, 5s by default
+
+	MaxRetries   int           // Number of times an operation is retried after transient errors, 3 by default, or none if negative
+	RetryBackoff time.Duration // Delay before the first retry, doubled for each one after, 10ms by default
+}
+
+const (
+	defaultMaxIdleConns = 2
+	defaultDialTimeout  = 5 * time.Second
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 10 * time.Millisecond
+
+	// scanBatchSize is the number of items fetched at once by an Iterator.
+	scanBatchSize = 100
+)
+
+/*
+Client is a client of a server.RESPServer, implementing the operations of a
+kv.BTree over the network.
+
+Operations failing due to a broken connection are retried on a new connection,
+if repeating them cannot change their outcome. This is the case for reading
+items as well as Upsert and Update, but not for Put and Delete, which may have
+been applied by the server before the connection broke. Those are only retried
+if connecting to the server fails in the first place.
+
+Errors of the tree such as kv.ErrKeyNotFound are returned just like the tree
+does. Other errors reported by the server are returned as ServerError.
+*/
+type Client struct {
+	config Config
+	pool   *pool
+}
+
+// Dial creates a client, and connects to the server to ensure it is
+// reachable. The connection is kept open for the first operation.
+func Dial(ctx context.Context, config Config) (*Client, error) {
+	if config.Address == "" {
+		return nil, errors.New("No server address given")
+	}
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = defaultMaxIdleConns
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+
+	c := &Client{config: config}
+	dialer := net.Dialer{Timeout: config.DialTimeout}
+	c.pool = newPool(func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, config.Network, config.Address)
+	}, config.MaxConns, config.MaxIdleConns)
+
+	if err := c.Ping(ctx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Could not connect to %s: %v", config.Address, err)
+	}
+
+	return c, nil
+}
+
+// Close closes all connections of the client. Operations in progress are not
+// interrupted, but their connections are closed once they completed.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+/*
+do sends the commands to the server at once, and returns their replies. If the
+commands are idempotent, they are sent again on a new connection after
+transient errors.
+*/
+func (c *Client) do(ctx context.Context, idempotent bool, cmds ...[][]byte) ([]interface{}, error) {
+	backoff := c.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := c.pool.get(ctx)
+		sent := false
+		if err == nil {
+			var replies []interface{}
+			replies, err = conn.roundTrip(ctx, cmds)
+			c.pool.put(conn, err != nil)
+			if err == nil {
+				return replies, nil
+			}
+			sent = true
+		}
+
+		if !isTransient(err) || (sent && !idempotent) || attempt >= c.config.MaxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// doOne sends a single command, and returns its reply.
+func (c *Client) doOne(ctx context.Context, idempotent bool, args ...[]byte) (interface{}, error) {
+	replies, err := c.do(ctx, idempotent, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return replies[0], nil
+}
+
+// Ping checks that the server is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	reply, err := c.doOne(ctx, true, []byte("PING"))
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return unexpectedReply(reply)
+	}
+
+	return nil
+}
+
+// Put stores a new item with given key and value. If an item with the
+// requested key already exists, kv.ErrKeyExists is returned.
+func (c *Client) Put(ctx context.Context, key uint64, value [10]byte) error {
+	return c.PutBytes(ctx, key, value[:])
+}
+
+// Upsert stores an item with given key and value, replacing the value of any
+// existing item.
+func (c *Client) Upsert(ctx context.Context, key uint64, value [10]byte) error {
+	return c.UpsertBytes(ctx, key, value[:])
+}
+
+// Update replaces the value of the item with given key. If no item with the
+// requested key exists, kv.ErrKeyNotFound is returned.
+func (c *Client) Update(ctx context.Context, key uint64, value [10]byte) error {
+	return c.UpdateBytes(ctx, key, value[:])
+}
+
+// Get retrieves the value of the item with given key. If no item with the
+// requested key exists, kv.ErrKeyNotFound is returned. If the value does not
+// fit into 10 bytes, kv.ErrValueTooLarge is returned.
+func (c *Client) Get(ctx context.Context, key uint64) ([10]byte, error) {
+	value, err := c.GetBytes(ctx, key)
+	if err != nil {
+		return [10]byte{}, err
+	}
+
+	return fixedValue(value)
+}
+
+// PutBytes, UpsertBytes, UpdateBytes and GetBytes are equivalent to their
+// fixed-size counterparts, but support values of arbitrary size.
+func (c *Client) PutBytes(ctx context.Context, key uint64, value []byte) error {
+	reply, err := c.doOne(ctx, false, setCommand(key, value, "NX")...)
+	if err != nil {
+		return err
+	}
+
+	return setResult(reply, kv.ErrKeyExists)
+}
+
+func (c *Client) UpsertBytes(ctx context.Context, key uint64, value []byte) error {
+	reply, err := c.doOne(ctx, true, setCommand(key, value, "")...)
+	if err != nil {
+		return err
+	}
+
+	return setResult(reply, nil)
+}
+
+func (c *Client) UpdateBytes(ctx context.Context, key uint64, value []byte) error {
+	reply, err := c.doOne(ctx, true, setCommand(key, value, "XX")...)
+	if err != nil {
+		return err
+	}
+
+	return setResult(reply, kv.ErrKeyNotFound)
+}
+
+func (c *Client) GetBytes(ctx context.Context, key uint64) ([]byte, error) {
+	reply, err := c.doOne(ctx, true, []byte("GET"), formatKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	return valueResult(reply)
+}
+
+// Delete removes the item with given key. If no item with the requested key
+// exists, kv.ErrKeyNotFound is returned.
+func (c *Client) Delete(ctx context.Context, key uint64) error {
+	reply, err := c.doOne(ctx, false, []byte("DEL"), formatKey(key))
+	if err != nil {
+		return err
+	}
+
+	switch reply {
+	case int64(1):
+		return nil
+	case int64(0):
+		return kv.ErrKeyNotFound
+	}
+	return unexpectedReply(reply)
+}
+
+/*
+PutBatch stores new items just like calling Put for each of them, but sends
+all of them to the server at once.
+
+The returned slice holds the error of each item at its index, or is nil if all
+items were stored. If the connection breaks, every item fails with its error,
+although the server may have stored some of them.
+*/
+func (c *Client) PutBatch(ctx context.Context, items []kv.BatchItem) []error {
+	cmds := make([][][]byte, len(items))
+	for i := range items {
+		cmds[i] = setCommand(items[i].Key, items[i].Value[:], "NX")
+	}
+
+	errs := make([]error, len(items))
+	replies, err := c.do(ctx, false, cmds...)
+	for i := range errs {
+		if err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = setResult(replies[i], kv.ErrKeyExists)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+/*
+GetBatch retrieves the values of multiple items at once, returning them at the
+index of their key. The returned slice of errors holds kv.ErrKeyNotFound or
+kv.ErrValueTooLarge at the index of each key whose value could not be
+retrieved, or is nil if all could.
+
+If the request to the server fails, its error is returned for every key.
+*/
+func (c *Client) GetBatch(ctx context.Context, keys []uint64) ([][10]byte, []error) {
+	values := make([][10]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	raw, err := c.getMany(ctx, keys)
+	failed := false
+	for i := range keys {
+		if err != nil {
+			errs[i] = err
+		} else if raw[i] == nil {
+			errs[i] = kv.ErrKeyNotFound
+		} else {
+			values[i], errs[i] = fixedValue(raw[i])
+		}
+		failed = failed || errs[i] != nil
+	}
+
+	if !failed {
+		errs = nil
+	}
+	return values, errs
+}
+
+// getMany retrieves the values of multiple keys with a single MGET command.
+// The value of each key not found is nil.
+func (c *Client) getMany(ctx context.Context, keys []uint64) ([][]byte, error) {
+	args := make([][]byte, 0, len(keys)+1)
+	args = append(args, []byte("MGET"))
+	for _, key := range keys {
+		args = append(args, formatKey(key))
+	}
+
+	reply, err := c.doOne(ctx, true, args...)
+	if err != nil {
+		return nil, err
+	}
+	elements, ok := reply.([]interface{})
+	if !ok || len(elements) != len(keys) {
+		return nil, unexpectedReply(reply)
+	}
+
+	values := make([][]byte, len(keys))
+	for i, element := range elements {
+		if element == nil {
+			continue
+		}
+		if values[i], ok = element.([]byte); !ok {
+			return nil, unexpectedReply(element)
+		}
+	}
+
+	return values, nil
+}
+
+// setCommand returns the SET command storing an item, with the given option
+// unless empty.
+func setCommand(key uint64, value []byte, option string) [][]byte {
+	args := [][]byte{[]byte("SET"), formatKey(key), value}
+	if option != "" {
+		args = append(args, []byte(option))
+	}
+
+	return args
+}
+
+// setResult returns the result of a SET command, which replies with null if
+// the item was not stored due to its NX or XX option.
+func setResult(reply interface{}, notStored error) error {
+	switch {
+	case reply == nil && notStored != nil:
+		return notStored
+	case reply == "OK":
+		return nil
+	}
+	return unexpectedReply(reply)
+}
+
+// valueResult returns the value replied by GET, which is null if the key was
+// not found.
+func valueResult(reply interface{}) ([]byte, error) {
+	if reply == nil {
+		return nil, kv.ErrKeyNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, unexpectedReply(reply)
+	}
+
+	return value, nil
+}
+
+// fixedValue returns a value as fixed-size array, zero-padded like the tree
+// does.
+func fixedValue(value []byte) ([10]byte, error) {
+	if len(value) > kv.MaxInlineValueSize {
+		return [10]byte{}, kv.ErrValueTooLarge
+	}
+
+	fixed := [10]byte{}
+	copy(fixed[:], value)
+
+	return fixed, nil
+}
+
+func formatKey(key uint64) []byte {
+	return strconv.AppendUint(nil, key, 10)
+}
@@ -0,0 +1,333 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tobiasfamos/KVStore/kv"
+	"github.com/tobiasfamos/KVStore/server"
+)
+
+var helper = kv.TestHelper{}
+
+func TestMain(m *testing.M) {
+	// Initialze helper before running test, and call its cleanup before
+	// terminating.
+	helper.Initialize()
+	result := m.Run()
+	helper.Cleanup()
+
+	os.Exit(result)
+}
+
+// serve serves the tree with a RESP server on the address, until the returned
+// function is called or the test finished.
+func serve(t *testing.T, tree *kv.BTree, network, address string) func() {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+
+	s := server.NewRESPServer(tree)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			s.Close()
+			if err := <-done; !errors.Is(err, server.ErrServerClosed) {
+				t.Errorf("Expected ErrServerClosed from Serve; got %v", err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+
+	return stop
+}
+
+// dial serves a new tree on the network of the config, and connects a client
+// to it.
+func dial(t *testing.T, config Config) *Client {
+	config.Address = "127.0.0.1:0"
+	if config.Network == "unix" {
+		config.Address = filepath.Join(t.TempDir(), "kv.sock")
+	}
+	l, err := net.Listen(config.Network, config.Address)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	config.Address = l.Addr().String()
+	l.Close()
+	tree, _ := helper.GetInstance(t, kv.KvStoreConfig{MemorySize: 64 * kv.PageSize})
+	t.Cleanup(func() { tree.Close() })
+	serve(t, tree, config.Network, config.Address)
+
+	return dialConfig(t, config)
+}
+
+func dialConfig(t *testing.T, config Config) *Client {
+	c, err := Dial(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestClientOperations(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			c := dial(t, Config{Network: network})
+			ctx := context.Background()
+			value := [10]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+			if err := c.Put(ctx, 1, value); err != nil {
+				t.Fatalf("Error putting item: %v", err)
+			}
+			if err := c.Put(ctx, 1, value); !errors.Is(err, kv.ErrKeyExists) {
+				t.Errorf("Expected ErrKeyExists putting existing item; got %v", err)
+			}
+			if got, err := c.Get(ctx, 1); err != nil || got != value {
+				t.Errorf("Expected %v; got %v (%v)", value, got, err)
+			}
+			if _, err := c.Get(ctx, 2); !errors.Is(err, kv.ErrKeyNotFound) {
+				t.Errorf("Expected ErrKeyNotFound getting missing item; got %v", err)
+			}
+
+			if err := c.Update(ctx, 2, value); !errors.Is(err, kv.ErrKeyNotFound) {
+				t.Errorf("Expected ErrKeyNotFound updating missing item; got %v", err)
+			}
+			if err := c.Upsert(ctx, 2, [10]byte{2}); err != nil {
+				t.Errorf("Error upserting item: %v", err)
+			}
+			if err := c.Update(ctx, 2, [10]byte{3}); err != nil {
+				t.Errorf("Error updating item: %v", err)
+			}
+			if got, _ := c.Get(ctx, 2); got != [10]byte{3} {
+				t.Errorf("Expected updated value; got %v", got)
+			}
+
+			large := bytes.Repeat([]byte("0123456789"), kv.PageSize)
+			if err := c.PutBytes(ctx, 3, large); err != nil {
+				t.Fatalf("Error putting large item: %v", err)
+			}
+			if got, err := c.GetBytes(ctx, 3); err != nil || !bytes.Equal(got, large) {
+				t.Errorf("Got wrong large value of %dB (%v)", len(got), err)
+			}
+			if _, err := c.Get(ctx, 3); !errors.Is(err, kv.ErrValueTooLarge) {
+				t.Errorf("Expected ErrValueTooLarge getting large item; got %v", err)
+			}
+			if err := c.PutBytes(ctx, 4, []byte("short")); err != nil {
+				t.Errorf("Error putting short item: %v", err)
+			}
+			if got, _ := c.Get(ctx, 4); got != [10]byte{'s', 'h', 'o', 'r', 't'} {
+				t.Errorf("Expected zero-padded short value; got %v", got)
+			}
+
+			if err := c.Delete(ctx, 1); err != nil {
+				t.Errorf("Error deleting item: %v", err)
+			}
+			if err := c.Delete(ctx, 1); !errors.Is(err, kv.ErrKeyNotFound) {
+				t.Errorf("Expected ErrKeyNotFound deleting missing item; got %v", err)
+			}
+		})
+	}
+}
+
+func TestClientBatch(t *testing.T) {
+	c := dial(t, Config{Network: "unix"})
+	ctx := context.Background()
+
+	items := make([]kv.BatchItem, 2_000)
+	for i := range items {
+		items[i] = kv.BatchItem{Key: uint64(i), Value: [10]byte{byte(i)}}
+	}
+	if errs := c.PutBatch(ctx, items); errs != nil {
+		t.Fatalf("Error putting batch: %v", errs)
+	}
+
+	errs := c.PutBatch(ctx, []kv.BatchItem{{Key: 5_000}, {Key: 10}})
+	if len(errs) != 2 || errs[0] != nil || !errors.Is(errs[1], kv.ErrKeyExists) {
+		t.Errorf("Expected only existing item to fail; got %v", errs)
+	}
+
+	if err := c.PutBytes(ctx, 6_000, bytes.Repeat([]byte("x"), 20)); err != nil {
+		t.Fatalf("Error putting large item: %v", err)
+	}
+	values, errs := c.GetBatch(ctx, []uint64{7, 1_999, 3_000, 6_000})
+	if values[0] != [10]byte{7} || values[1] != [10]byte{1_999 % 256} {
+		t.Errorf("Got wrong values %v", values)
+	}
+	if len(errs) != 4 || errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], kv.ErrKeyNotFound) || !errors.Is(errs[3], kv.ErrValueTooLarge) {
+		t.Errorf("Expected errors for missing and large item; got %v", errs)
+	}
+	if _, errs := c.GetBatch(ctx, []uint64{1, 2}); errs != nil {
+		t.Errorf("Expected no errors; got %v", errs)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	c := dial(t, Config{Network: "tcp"})
+	ctx := context.Background()
+
+	for key := uint64(1); key <= 250; key++ {
+		if err := c.Put(ctx, key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting item: %v", err)
+		}
+	}
+	c.PutBytes(ctx, 300, []byte(strings.Repeat("x", 100)))
+
+	it := c.Scan(ctx, 10, 210)
+	expected := uint64(10)
+	for it.Next() {
+		if it.Key() != expected || it.Value() != [10]byte{byte(expected)} {
+			t.Fatalf("Expected item %d; got %d = %v", expected, it.Key(), it.Value())
+		}
+		expected++
+	}
+	it.Close()
+	if it.Err() != nil || expected != 211 {
+		t.Errorf("Expected items up to 210; stopped before %d (%v)", expected, it.Err())
+	}
+
+	it = c.Scan(ctx, 250, 1_000)
+	count := 0
+	for it.Next() {
+		count++
+		if it.Key() == 300 && len(it.ValueBytes()) != 100 {
+			t.Errorf("Expected large value; got %dB", len(it.ValueBytes()))
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 items; got %d", count)
+	}
+
+	if c.Scan(ctx, 20, 10).Next() {
+		t.Errorf("Expected empty range to yield no items")
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	c := dial(t, Config{Network: "tcp", MaxConns: 4})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := uint64(g*100 + i)
+				if err := c.Put(ctx, key, [10]byte{byte(g)}); err != nil {
+					t.Errorf("Error putting item %d: %v", key, err)
+				}
+				if value, err := c.Get(ctx, key); err != nil || value != [10]byte{byte(g)} {
+					t.Errorf("Got wrong value %v for item %d (%v)", value, key, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	count := 0
+	for it := c.Scan(ctx, 0, 10_000); it.Next(); {
+		count++
+	}
+	if count != 1_600 {
+		t.Errorf("Expected 1600 items; got %d", count)
+	}
+}
+
+// silentServer accepts connections, and replies only to the PING sent by Dial
+// on the first of them.
+func silentServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for first := true; ; first = false {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(first bool) {
+				defer conn.Close()
+				if first {
+					ping := make([]byte, len("*1\r\n$4\r\nPING\r\n"))
+					if _, err := io.ReadFull(conn, ping); err != nil {
+						return
+					}
+					conn.Write([]byte("+PONG\r\n"))
+				}
+				io.Copy(io.Discard, conn)
+			}(first)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClientContext(t *testing.T) {
+	c := dialConfig(t, Config{Address: silentServer(t)})
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline to be exceeded; got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := c.Put(ctx, 1, [10]byte{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context to be canceled; got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected operations to stop with their context; took %v", elapsed)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	tree, _ := helper.GetInstance(t, kv.KvStoreConfig{MemorySize: 64 * kv.PageSize})
+	t.Cleanup(func() { tree.Close() })
+	address := filepath.Join(t.TempDir(), "kv.sock")
+	stop := serve(t, tree, "unix", address)
+	c := dialConfig(t, Config{Network: "unix", Address: address})
+	ctx := context.Background()
+
+	if err := c.Put(ctx, 1, [10]byte{1}); err != nil {
+		t.Fatalf("Error putting item: %v", err)
+	}
+
+	// The idle connection breaks as the server restarts, after which the
+	// item is read again on a new connection.
+	stop()
+	serve(t, tree, "unix", address)
+	if value, err := c.Get(ctx, 1); err != nil || value != [10]byte{1} {
+		t.Errorf("Expected item to be read after restart; got %v (%v)", value, err)
+	}
+
+	c.Close()
+	if _, err := c.Get(ctx, 1); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("Expected ErrClientClosed; got %v", err)
+	}
+
+	if _, err := Dial(ctx, Config{Network: "unix", Address: address + ".missing", MaxRetries: -1}); err == nil {
+		t.Errorf("Expected dialing missing server to fail")
+	}
+}
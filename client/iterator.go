@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"strconv"
+)
+
+/*
+Iterator iterates over the items of the server in ascending key order, as
+returned by Client.Scan.
+
+Items are fetched in batches, each requiring two round trips to the server:
+SCAN for the keys of the batch, and MGET for their values. Items modified in
+between batches are seen as of when their batch is fetched, and items deleted
+between fetching the keys and the values of a batch are skipped.
+
+Next must be called before the first item is available.
+*/
+type Iterator struct {
+	client *Client
+	ctx    context.Context
+	to     uint64
+
+	// Key to fetch the next batch from, unless done.
+	cursor uint64
+	done   bool
+
+	keys   []uint64
+	values [][]byte
+	idx    int
+
+	err error
+}
+
+// Scan returns an iterator over the items with a key in the inclusive range
+// [from, to]. The context applies to all requests of the iterator.
+func (c *Client) Scan(ctx context.Context, from, to uint64) *Iterator {
+	return &Iterator{
+		client: c,
+		ctx:    ctx,
+		to:     to,
+		cursor: from,
+		done:   from > to,
+		idx:    -1,
+	}
+}
+
+// Next moves to the next item, and returns whether there is one. Once it
+// returns false, Err reports whether fetching any item failed.
+func (it *Iterator) Next() bool {
+	it.idx++
+	for it.idx >= len(it.keys) {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.err = it.fetch()
+	}
+
+	return true
+}
+
+// fetch fetches the next batch of items.
+func (it *Iterator) fetch() error {
+	it.keys, it.values, it.idx = nil, nil, 0
+
+	reply, err := it.client.doOne(it.ctx, true,
+		[]byte("SCAN"), formatKey(it.cursor), []byte("COUNT"), []byte(strconv.Itoa(scanBatchSize)))
+	if err != nil {
+		return err
+	}
+	elements, ok := reply.([]interface{})
+	if !ok || len(elements) != 2 {
+		return unexpectedReply(reply)
+	}
+	cursor, ok := elements[0].([]byte)
+	if !ok {
+		return unexpectedReply(elements[0])
+	}
+	if it.cursor, err = strconv.ParseUint(string(cursor), 10, 64); err != nil {
+		return unexpectedReply(elements[0])
+	}
+	names, ok := elements[1].([]interface{})
+	if !ok {
+		return unexpectedReply(elements[1])
+	}
+
+	// A cursor of 0 marks the end, as 0 cannot follow any key returned.
+	it.done = it.cursor == 0 || it.cursor > it.to
+	keys := make([]uint64, 0, len(names))
+	for _, name := range names {
+		b, ok := name.([]byte)
+		if !ok {
+			return unexpectedReply(name)
+		}
+		key, err := strconv.ParseUint(string(b), 10, 64)
+		if err != nil {
+			return unexpectedReply(name)
+		}
+		if key > it.to {
+			it.done = true
+			break
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	values, err := it.client.getMany(it.ctx, keys)
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		if value != nil {
+			it.keys = append(it.keys, keys[i])
+			it.values = append(it.values, value)
+		}
+	}
+
+	return nil
+}
+
+// Key returns the key of the current item.
+func (it *Iterator) Key() uint64 {
+	return it.keys[it.idx]
+}
+
+// Value returns the value of the current item as fixed-size array. Values
+// which do not fit into 10 bytes are returned as zero array, ValueBytes must
+// be used for those.
+func (it *Iterator) Value() [10]byte {
+	value, _ := fixedValue(it.values[it.idx])
+	return value
+}
+
+// ValueBytes returns the value of the current item, regardless of its size.
+func (it *Iterator) ValueBytes() []byte {
+	return it.values[it.idx]
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the batch held by the iterator. The iterator must not be used
+// afterwards. No connection is held in between batches.
+func (it *Iterator) Close() {
+	it.keys, it.values = nil, nil
+	it.done = true
+}
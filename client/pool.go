@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrClientClosed is returned by operations on a client which has been closed.
+var ErrClientClosed = errors.New("client closed")
+
+// aLongTimeAgo is a deadline in the past, interrupting any pending read or
+// write on a connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// conn is a connection to the server.
+type conn struct {
+	netConn net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+}
+
+func newConn(netConn net.Conn) *conn {
+	return &conn{
+		netConn: netConn,
+		r:       bufio.NewReader(netConn),
+		w:       bufio.NewWriter(netConn),
+	}
+}
+
+/*
+roundTrip sends the commands at once, and reads one reply for each of them.
+Commands are written while replies are read, so the server never blocks on
+sending replies to a large pipeline.
+
+The deadline of the context applies to the whole round trip, and cancelling the
+context interrupts it. In either case the error of the context is returned. The
+connection must not be used any further after any error.
+*/
+func (c *conn) roundTrip(ctx context.Context, cmds [][][]byte) ([]interface{}, error) {
+	deadline, _ := ctx.Deadline()
+	if err := c.netConn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-done:
+				c.netConn.SetDeadline(aLongTimeAgo)
+			case <-stop:
+			}
+		}()
+		// The deadline must not be changed once the connection is
+		// returned to the pool.
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		for _, args := range cmds {
+			writeCommand(c.w, args...)
+		}
+		err := c.w.Flush()
+		if err != nil {
+			// Unblocks the reader, as replies to commands not
+			// written will never arrive.
+			c.netConn.SetDeadline(aLongTimeAgo)
+		}
+		written <- err
+	}()
+
+	replies := make([]interface{}, len(cmds))
+	var err error
+	for i := range replies {
+		if replies[i], err = readReply(c.r); err != nil {
+			// Unblocks the writer if the server stopped reading.
+			c.netConn.SetDeadline(aLongTimeAgo)
+			break
+		}
+	}
+	// Either side failing interrupts the other one, so the error of the
+	// side not interrupted is reported.
+	if writeErr := <-written; err == nil || (writeErr != nil && !errors.Is(writeErr, os.ErrDeadlineExceeded)) {
+		err = writeErr
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) && !deadline.IsZero() && !time.Now().Before(deadline) {
+		// The connection may time out before the context notices.
+		return nil, context.DeadlineExceeded
+	}
+	return replies, err
+}
+
+// isTransient returns whether an error is due to a failed connection, so the
+// operation might succeed on a new one.
+func isTransient(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+/*
+pool keeps idle connections to the server for reuse, and dials new ones if none
+are idle.
+
+If maxConns is positive, at most as many connections are in use at once, and
+getting another one waits for one to be put back.
+*/
+type pool struct {
+	dial func(ctx context.Context) (net.Conn, error)
+
+	// Idle connections, and a token for each connection in use if their
+	// number is limited.
+	idle  chan *conn
+	slots chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newPool(dial func(ctx context.Context) (net.Conn, error), maxConns, maxIdleConns int) *pool {
+	p := &pool{
+		dial: dial,
+		idle: make(chan *conn, maxIdleConns),
+	}
+	if maxConns > 0 {
+		p.slots = make(chan struct{}, maxConns)
+	}
+
+	return p
+}
+
+// get returns an idle connection, or dials a new one.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		p.release()
+		return nil, ErrClientClosed
+	}
+
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	netConn, err := p.dial(ctx)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	return newConn(netConn), nil
+}
+
+// put returns a connection gotten before. Broken connections are closed, as
+// are those exceeding the number of idle connections kept.
+func (p *pool) put(c *conn, broken bool) {
+	defer p.release()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if broken || p.closed {
+		c.netConn.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.netConn.Close()
+	}
+}
+
+func (p *pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// close closes all idle connections. Connections in use are closed once they
+// are put back.
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var err error
+	for {
+		select {
+		case c := <-p.idle:
+			if e := c.netConn.Close(); e != nil && err == nil {
+				err = e
+			}
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxReplyLength is the maximum size of a bulk string or array accepted in
+// replies of the server.
+const maxReplyLength = 512 << 20
+
+// ServerError is an error reply of the server, such as for a malformed key.
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+// errProtocol is returned if the server replies with malformed or unexpected
+// data, after which the connection is no longer usable.
+var errProtocol = errors.New("Protocol error in reply of server")
+
+// writeCommand writes a command as array of bulk strings.
+func writeCommand(w *bufio.Writer, args ...[]byte) {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.Write(arg)
+		w.WriteString("\r\n")
+	}
+}
+
+/*
+readReply reads the next reply of the server. Simple strings are returned as
+string, bulk strings as []byte, integers as int64, arrays as []interface{}, and
+null as nil.
+
+An error reply is returned as ServerError in place of the reply, so the
+connection remains usable. Any other error leaves the connection unusable.
+*/
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, errProtocol
+		}
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	kind, payload := line[0], string(line[1:len(line)-2])
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return ServerError(payload), nil
+	case ':':
+		n, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size > maxReplyLength {
+			return nil, errProtocol
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n")) {
+			return nil, errProtocol
+		}
+		return data[:size], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n > maxReplyLength {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			// Errors nested in arrays are kept as elements.
+			if elements[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+
+	return nil, errProtocol
+}
+
+// replyError returns the reply if it is an error reply.
+func replyError(reply interface{}) error {
+	if err, ok := reply.(ServerError); ok {
+		return err
+	}
+
+	return nil
+}
+
+// unexpectedReply returns the error for a reply of unexpected type.
+func unexpectedReply(reply interface{}) error {
+	if err := replyError(reply); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("Unexpected reply %v of server", reply)
+}
@@ -2,11 +2,12 @@ module github.com/tobiasfamos/KVStore
 
 go 1.18
 
+require golang.org/x/exp v0.0.0-20220325121720-054d8573a5d8
+
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.1.0 // indirect
 	github.com/stretchr/testify v1.7.1 // indirect
-	golang.org/x/exp v0.0.0-20220325121720-054d8573a5d8 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,180 @@
+package kv
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+/*
+ARCCache implements the Adaptive Replacement Cache algorithm.
+
+Resident pages are kept in two LRU queues: T1 holds pages referenced once since
+being loaded, T2 those referenced at least twice. The IDs of pages evicted from
+either queue are remembered in the ghost queues B1 and B2 respectively. Loading
+a page remembered in B1 means T1 was too small, so its target size p grows,
+while loading a page remembered in B2 shrinks it. Victims are taken from T1 if
+it exceeds p, from T2 otherwise. Pages loaded while remembered in either ghost
+queue enter T2 right away.
+
+Unlike the original algorithm, the victim is elected before the page to load
+is known, so p is adapted when loading rather than when electing the victim.
+*/
+type ARCCache struct {
+	mu sync.Mutex
+
+	size int
+	// Target size of t1.
+	p int
+
+	// Resident frames as queuedFrame, most recently referenced in front.
+	t1, t2 *list.List
+	// Remembered page IDs, most recently evicted in front.
+	b1, b2 *list.List
+	ghosts map[PageID]*list.Element
+
+	frames map[FrameID]*queuedFrame
+}
+
+// NewARCCache creates a new ARCCache for a buffer pool with the given number
+// of frames.
+func NewARCCache(size uint) ARCCache {
+	return ARCCache{
+		size:   int(size),
+		t1:     list.New(),
+		t2:     list.New(),
+		b1:     list.New(),
+		b2:     list.New(),
+		ghosts: make(map[PageID]*list.Element, 2*size),
+		frames: make(map[FrameID]*queuedFrame, size),
+	}
+}
+
+// arcGhost is a page remembered in one of the ghost queues of ARCCache.
+type arcGhost struct {
+	page  PageID
+	queue *list.List
+}
+
+func (c *ARCCache) Victim() *FrameID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	queues := []*list.List{c.t2, c.t1}
+	if c.t1.Len() > 0 && c.t1.Len() > c.p {
+		queues = []*list.List{c.t1, c.t2}
+	}
+
+	for _, queue := range queues {
+		f := oldestEligible(queue)
+		if f == nil {
+			continue
+		}
+
+		c.forget(f)
+		if f.loaded {
+			ghosts := c.b1
+			if queue == c.t2 {
+				ghosts = c.b2
+			}
+			c.remember(f.page, ghosts)
+		}
+
+		id := f.id
+		return &id
+	}
+
+	return nil
+}
+
+func (c *ARCCache) Remove(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.frames[frameID]
+	if !ok {
+		return
+	}
+
+	// Any further reference moves the page to the front of t2.
+	f.eligible = false
+	f.queue.Remove(f.element)
+	f.queue = c.t2
+	f.element = c.t2.PushFront(f)
+}
+
+func (c *ARCCache) Add(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.frames[frameID]
+	if !ok {
+		// The frame was added without a page having been loaded,
+		// treat it as a fresh page.
+		f = c.enqueue(frameID, c.t1)
+	}
+	f.eligible = true
+}
+
+func (c *ARCCache) Load(frameID FrameID, pageID PageID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.frames[frameID]; ok {
+		c.forget(f)
+	}
+
+	queue := c.t1
+	if e, ok := c.ghosts[pageID]; ok {
+		ghost := e.Value.(arcGhost)
+		b1, b2 := c.b1.Len(), c.b2.Len()
+		if ghost.queue == c.b1 {
+			c.p = util.Min(c.size, c.p+util.Max(b2/b1, 1))
+		} else {
+			c.p = util.Max(0, c.p-util.Max(b1/b2, 1))
+		}
+
+		ghost.queue.Remove(e)
+		delete(c.ghosts, pageID)
+		queue = c.t2
+	}
+
+	f := c.enqueue(frameID, queue)
+	f.page, f.loaded = pageID, true
+}
+
+// enqueue starts tracking a frame at the front of the given queue.
+func (c *ARCCache) enqueue(frameID FrameID, queue *list.List) *queuedFrame {
+	f := &queuedFrame{id: frameID, queue: queue}
+	f.element = queue.PushFront(f)
+	c.frames[frameID] = f
+
+	return f
+}
+
+// forget stops tracking a frame.
+func (c *ARCCache) forget(f *queuedFrame) {
+	f.queue.Remove(f.element)
+	delete(c.frames, f.id)
+}
+
+// remember remembers the ID of an evicted page in a ghost queue. The ghost
+// queues are trimmed such that t1 and b1 as well as all queues together hold
+// at most size and twice size pages respectively.
+func (c *ARCCache) remember(page PageID, queue *list.List) {
+	c.ghosts[page] = queue.PushFront(arcGhost{page, queue})
+
+	for c.t1.Len()+c.b1.Len() > c.size && c.b1.Len() > 0 {
+		c.dropOldestGhost(c.b1)
+	}
+	for c.t1.Len()+c.t2.Len()+c.b1.Len()+c.b2.Len() > 2*c.size && c.b2.Len() > 0 {
+		c.dropOldestGhost(c.b2)
+	}
+}
+
+// dropOldestGhost forgets the least recently evicted page of a ghost queue.
+func (c *ARCCache) dropOldestGhost(queue *list.List) {
+	ghost := queue.Remove(queue.Back()).(arcGhost)
+	delete(c.ghosts, ghost.page)
+}
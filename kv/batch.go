@@ -0,0 +1,184 @@
+package kv
+
+import "sort"
+
+// BatchItem is a key-value pair stored by PutBatch.
+type BatchItem struct {
+	Key   uint64
+	Value [10]byte
+}
+
+/*
+PutBatch stores new items just like calling Put for each of them, but descends
+the tree only once for all consecutive items landing in the same leaf.
+
+The items are processed in ascending key order, such that each leaf is fetched
+and latched once per batch rather than once per item. Items with equal keys are
+processed in the order given, so all but the first fail with ErrKeyExists.
+
+The returned slice holds the error of each item at its index, or is nil if all
+items were stored. If the tree has a write-ahead log, the items stored in each
+leaf are logged as one record. Otherwise, the batch is made durable as a whole.
+*/
+func (t *BTree) PutBatch(items []BatchItem) []error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	order := sortedOrder(len(items), func(i int) uint64 { return items[i].Key })
+	errs := make([]error, len(items))
+
+	for pos := 0; pos < len(order); {
+		start := pos
+		err := t.runLogged(func() error {
+			pos = t.putLeafRun(items, order, pos, errs)
+			return nil
+		})
+		if err != nil {
+			// The items of the run are not durable, and neither will
+			// any item after them be.
+			failRemaining(errs, order[start:], err)
+			return errs
+		}
+	}
+
+	if err := t.commit(); err != nil {
+		failRemaining(errs, order, err)
+	}
+
+	return collectErrors(errs)
+}
+
+// putLeafRun inserts the items in the given order starting at pos, as long as
+// they land in the same leaf and no split is required. The error of each
+// item gets recorded in errs. Returns the position of the next item to insert.
+func (t *BTree) putLeafRun(items []BatchItem, order []int, pos int, errs []error) int {
+	tr, leaf, bounds, err := t.traceWithBounds(items[order[pos]].Key, latchInsert)
+	if err != nil {
+		errs[order[pos]] = err
+		return pos + 1
+	}
+
+	isDirty := false
+	for ; pos < len(order); pos++ {
+		item := items[order[pos]]
+		if !bounds.contains(item.Key) {
+			break
+		}
+
+		if leaf.contains(item.Key) {
+			errs[order[pos]] = ErrKeyExists
+			continue
+		}
+
+		if leaf.isFull() {
+			if len(tr.nodes) == 0 {
+				// The leaf was safe when descending to it, so its
+				// parents were released. Descending again keeps
+				// them latched, as required to split.
+				break
+			}
+
+			// Releases both the trace and the leaf.
+			errs[order[pos]] = t.splitLeaf(tr, leaf, item.Key, inlineValue(item.Value))
+			return pos + 1
+		}
+
+		leaf.insert(item.Key, inlineValue(item.Value))
+		isDirty = true
+	}
+
+	t.release(tr, false)
+	t.releaseLeaf(leaf, isDirty)
+
+	return pos
+}
+
+/*
+GetBatch retrieves the values of the items with the given keys just like
+calling Get for each of them, but descends the tree only once for all
+consecutive keys landing in the same leaf.
+
+The returned values are at the index of their key. The returned errors hold
+the error of each key at its index, or are nil if all values were retrieved.
+*/
+func (t *BTree) GetBatch(keys []uint64) ([][10]byte, []error) {
+	if !t.open {
+		panic("Cannot read from closed tree")
+	}
+
+	t.isolation.RLock()
+	defer t.isolation.RUnlock()
+
+	values := make([][10]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	var leaf *LNodePage
+	var bounds leafBounds
+	for _, idx := range sortedOrder(len(keys), func(i int) uint64 { return keys[i] }) {
+		key := keys[idx]
+		if leaf != nil && !bounds.contains(key) {
+			t.bufferPool.UnpinPage(*leaf.id, false)
+			leaf.latch.RUnlock()
+			leaf = nil
+		}
+
+		if leaf == nil {
+			var err error
+			leaf, bounds, err = t.descendTo(key)
+			if err != nil {
+				errs[idx] = err
+				continue
+			}
+		}
+
+		value, found := leaf.get(key)
+		if !found {
+			errs[idx] = ErrKeyNotFound
+			continue
+		}
+		values[idx], errs[idx] = fixedValue(value)
+	}
+
+	if leaf != nil {
+		t.bufferPool.UnpinPage(*leaf.id, false)
+		leaf.latch.RUnlock()
+	}
+
+	return values, collectErrors(errs)
+}
+
+// sortedOrder returns the indices of n keys in ascending key order. Indices
+// of equal keys keep their order.
+func sortedOrder(n int, key func(i int) uint64) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return key(order[a]) < key(order[b])
+	})
+
+	return order
+}
+
+// failRemaining records err for all items at the given indices which did not
+// fail already.
+func failRemaining(errs []error, indices []int, err error) {
+	for _, idx := range indices {
+		if errs[idx] == nil {
+			errs[idx] = err
+		}
+	}
+}
+
+// collectErrors returns the errors of a batch, or nil if none failed.
+func collectErrors(errs []error) []error {
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+
+	return nil
+}
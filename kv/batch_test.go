@@ -0,0 +1,188 @@
+package kv
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// batchOf returns items for the given keys, with the values expected by
+// assertTreeKeys.
+func batchOf(keys []uint64) []BatchItem {
+	items := make([]BatchItem, len(keys))
+	for i, key := range keys {
+		items[i] = BatchItem{key, [10]byte{byte(key)}}
+	}
+
+	return items
+}
+
+func TestPutBatch(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	keys := make([]uint64, 20_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+
+	// Several batches, such that later ones insert into leaves filled by
+	// earlier ones.
+	for i := 0; i < len(keys); i += 5_000 {
+		if errs := tree.PutBatch(batchOf(keys[i : i+5_000])); errs != nil {
+			t.Fatalf("Expected no errors putting batch; got %v", errs)
+		}
+	}
+
+	util.FillAsc(keys, 1)
+	assertTreeKeys(t, tree, keys)
+}
+
+func TestPutBatchReportsErrorsPerItem(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	if err := tree.Put(5, [10]byte{5}); err != nil {
+		t.Fatalf("Error putting key: %v", err)
+	}
+
+	items := batchOf([]uint64{7, 5, 3, 7, 1})
+	items[3].Value = [10]byte{42}
+	errs := tree.PutBatch(items)
+
+	expected := []error{nil, ErrKeyExists, nil, ErrKeyExists, nil}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors; got %v", len(expected), errs)
+	}
+	for i, err := range expected {
+		if errs[i] != err {
+			t.Errorf("Expected error %v for item %d; got %v", err, i, errs[i])
+		}
+	}
+
+	// The first of equal keys wins.
+	assertTreeKeys(t, tree, []uint64{1, 3, 5, 7})
+}
+
+func TestGetBatch(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	keys := make([]uint64, 5_000)
+	util.FillAsc(keys, 1)
+	if errs := tree.PutBatch(batchOf(keys)); errs != nil {
+		t.Fatalf("Expected no errors putting batch; got %v", errs)
+	}
+	if err := tree.PutBytes(10_000, randomBytes(2*OverflowDataSize, 1)); err != nil {
+		t.Fatalf("Error putting large value: %v", err)
+	}
+
+	requested := make([]uint64, 0, len(keys)+1)
+	for _, key := range keys {
+		// Every other key is missing.
+		requested = append(requested, 2*key)
+	}
+	requested = append(requested, 10_000)
+	util.Shuffle(requested)
+
+	values, errs := tree.GetBatch(requested)
+	for i, key := range requested {
+		switch {
+		case key == 10_000:
+			if errs[i] != ErrValueTooLarge {
+				t.Errorf("Expected ErrValueTooLarge for key %d; got %v", key, errs[i])
+			}
+		case key > 5_000:
+			if errs[i] != ErrKeyNotFound {
+				t.Errorf("Expected ErrKeyNotFound for key %d; got %v", key, errs[i])
+			}
+		default:
+			if errs[i] != nil {
+				t.Errorf("Error getting key %d: %v", key, errs[i])
+			}
+			if values[i] != [10]byte{byte(key)} {
+				t.Errorf("Expected value %d for key %d; got %v", byte(key), key, values[i])
+			}
+		}
+	}
+
+	if _, errs := tree.GetBatch(keys); errs != nil {
+		t.Errorf("Expected no errors getting existing keys; got %v", errs)
+	}
+}
+
+func TestPutBatchConcurrently(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 64 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	const writers, batches, perBatch = 8, 10, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for b := 0; b < batches; b++ {
+				keys := make([]uint64, perBatch)
+				for i := range keys {
+					// Interleave the keys of all writers, such that
+					// they contend for the same leaves.
+					keys[i] = uint64((b*perBatch+i)*writers + w + 1)
+				}
+				if errs := tree.PutBatch(batchOf(keys)); errs != nil {
+					t.Errorf("Expected no errors putting batch; got %v", errs)
+					return
+				}
+				if _, errs := tree.GetBatch(keys); errs != nil {
+					t.Errorf("Expected no errors getting batch; got %v", errs)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	keys := make([]uint64, writers*batches*perBatch)
+	util.FillAsc(keys, 1)
+	assertTreeKeys(t, tree, keys)
+}
+
+func TestPutBatchWithWAL(t *testing.T) {
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: false})
+
+	keys := make([]uint64, 10_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	if errs := tree.PutBatch(batchOf(keys)); errs != nil {
+		t.Fatalf("Expected no errors putting batch; got %v", errs)
+	}
+
+	tree = crashAndRecover(t, tree, config)
+	defer tree.Close()
+
+	util.FillAsc(keys, 1)
+	assertTreeKeys(t, tree, keys)
+}
+
+func BenchmarkPutBatch(b *testing.B) {
+	keys := make([]uint64, 100_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	items := batchOf(keys)
+
+	b.Run("Put", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			kv, _ := helper.GetEmptyInstanceWithMemoryLimit(1024 * PageSize)
+			for _, item := range items {
+				kv.Put(item.Key, item.Value)
+			}
+			kv.Close()
+		}
+	})
+	b.Run("PutBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			kv, _ := helper.GetEmptyInstanceWithMemoryLimit(1024 * PageSize)
+			kv.(*BTree).PutBatch(items)
+			kv.Close()
+		}
+	})
+}
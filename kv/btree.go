@@ -2,22 +2,42 @@ package kv
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"sync"
+
+	"github.com/tobiasfamos/KVStore/util"
 )
 
 // treeMetaDataFile specifies the name of the file used by the tree to store
 // its meta data.
 const treeMetaDataFile = "tree.meta"
 
+/*
+BTree is a B+ tree mapping uint64 keys to values.
+
+A BTree is safe for concurrent use. Its nodes are latched following the
+protocol described in latch.go, such that operations on different parts of the
+tree run concurrently. If the tree has a write-ahead log, modifications are
+serialised though, as each of them is captured and logged separately. Reads
+still run concurrently to them.
+*/
 type BTree struct {
 	bufferPool BufferPool
 	root       *INodePage
 	rootPage   *Page
 
+	// Latch of the root, used instead of the latch of its page. Guards
+	// root and rootPage.
+	rootLatch sync.RWMutex
+	// Held shared by all operations on the tree, and exclusively by
+	// committing transactions, which must not be observed half-applied.
+	isolation sync.RWMutex
+	// Serialises modifications if the tree has a write-ahead log.
+	logging sync.Mutex
+
 	// root directory where tree is persisted to. Will be empty in case of
 	// a memory store.
 	directory string
@@ -25,6 +45,21 @@ type BTree struct {
 	// Whether the tree can be read from. If set to false, all read/write
 	// operations will panic.
 	open bool
+
+	// Fraction of each node filled by BulkLoad, or 0 for the default.
+	fillFactor float64
+
+	// Write-ahead log of all modifications since the last checkpoint. Will
+	// be nil if the tree is not logged.
+	wal *WAL
+	// Root page as of the last record appended to the write-ahead log.
+	loggedRootID PageID
+	loggedRoot   [PageDataSize]byte
+
+	// When modifications are synced to stable storage, and the group
+	// commit syncing them if it's DurabilityGroupCommit.
+	durability Durability
+	group      *groupCommit
 }
 
 func (t *BTree) createInitialTree() error {
@@ -38,13 +73,16 @@ func (t *BTree) createInitialTree() error {
 	if err != nil {
 		return fmt.Errorf("Error allocating page for left node: %v", err)
 	}
-	_ = RawLNodeFrom(leftPage) // automatically sets isLeaf flag
+	left := RawLNodeFrom(leftPage) // automatically sets isLeaf flag
 
 	rightPage, err := t.bufferPool.NewPage()
 	if err != nil {
 		return fmt.Errorf("Error allocating page for right node: %v", err)
 	}
-	_ = RawLNodeFrom(rightPage) // automatically sets isLeaf flag
+	right := RawLNodeFrom(rightPage) // automatically sets isLeaf flag
+
+	*left.rightSibling = rightPage.id
+	*right.leftSibling = leftPage.id
 
 	t.root = RawINodeFrom(t.rootPage)
 	*t.root.isDirty = true
@@ -64,26 +102,15 @@ func (t *BTree) TraverseAll() ([]uint64, [][10]byte) {
 	keys := make([]uint64, 0, 1000)
 	values := make([][10]byte, 0, 1000)
 
-	keys, values = t.traverseNode(t.rootPage, keys, values)
+	c := t.Cursor()
+	defer c.Close()
 
-	return keys, values
-}
-
-func (t *BTree) traverseNode(current *Page, keys []uint64, values [][10]byte) ([]uint64, [][10]byte) {
-	l, n := RawNodeFrom(current)
-	if l != nil {
-		keys = append(keys, l.keys[:*l.numKeys]...)
-		values = append(values, l.values[:*l.numKeys]...)
-	} else {
-		for i := 0; i < int(*n.numKeys)+1; i++ {
-			id := n.pages[i]
-			page, err := t.bufferPool.FetchPage(id)
-			if err != nil {
-				panic(err)
-			}
-			keys, values = t.traverseNode(page, keys, values)
-			t.bufferPool.UnpinPage(page.id, false)
-		}
+	for ok := c.First(); ok; ok = c.Next() {
+		keys = append(keys, c.Key())
+		values = append(values, c.Value())
+	}
+	if c.Err() != nil {
+		panic(c.Err())
 	}
 
 	return keys, values
@@ -102,18 +129,6 @@ func (t *BTree) loadExistingTree() error {
 		return err
 	}
 
-	leftPage, err := t.bufferPool.NewPage()
-	if err != nil {
-		return err
-	}
-	_ = RawLNodeFrom(leftPage) // automatically sets isLeaf flag
-
-	rightPage, err := t.bufferPool.NewPage()
-	if err != nil {
-		return err
-	}
-	_ = RawLNodeFrom(rightPage) // automatically sets isLeaf flag
-
 	t.root = RawINodeFrom(t.rootPage)
 	*t.root.isDirty = false // We just read it from disk
 
@@ -130,21 +145,32 @@ func (t *BTree) Create(config KvStoreConfig) error {
 			numberOfPages,
 		)
 	}
-	newCacheEviction := NewLRUCache(numberOfPages)
+	cacheEviction, err := NewCacheEviction(config.Eviction, numberOfPages)
+	if err != nil {
+		return err
+	}
 
 	t.directory = config.WorkingDirectory
 
-	persistentDisk, err := NewPersistentDisk(config.WorkingDirectory)
+	disk, err := NewDisk(config.Storage, config.WorkingDirectory)
 	if err != nil {
 		return err
 	}
 
-	t.bufferPool = NewBufferPool(numberOfPages, persistentDisk, &newCacheEviction)
+	t.bufferPool = NewBufferPool(numberOfPages, disk, cacheEviction)
 
 	if err := t.createInitialTree(); err != nil {
 		return fmt.Errorf("Unable to initialize tree: %v", err)
 	}
 
+	if !config.DisableWriteAheadLog {
+		if err := t.openWAL(false); err != nil {
+			return err
+		}
+	}
+	t.startDurability(config)
+	t.fillFactor = config.BulkLoadFillFactor
+
 	// Tree initialized successfully
 	t.directory = config.WorkingDirectory
 	t.open = true
@@ -154,32 +180,63 @@ func (t *BTree) Create(config KvStoreConfig) error {
 
 func (t *BTree) Open(config KvStoreConfig) error {
 	numberOfPages := config.MemorySize / PageSize
-	newCacheEviction := NewLRUCache(numberOfPages)
+	cacheEviction, err := NewCacheEviction(config.Eviction, numberOfPages)
+	if err != nil {
+		return err
+	}
 
-	persistentDisk, err := NewPersistentDisk(config.WorkingDirectory)
+	disk, err := NewDisk(config.Storage, config.WorkingDirectory)
 	if err != nil {
 		return err
 	}
 
-	t.bufferPool = NewBufferPool(numberOfPages, persistentDisk, &newCacheEviction)
+	t.bufferPool = NewBufferPool(numberOfPages, disk, cacheEviction)
 
 	// Must be set before we load the tree, as it's used by it
 	t.directory = config.WorkingDirectory
 
+	if !config.DisableWriteAheadLog {
+		// Recovery must happen before we load the tree, as it may
+		// change the root.
+		if err := t.openWAL(true); err != nil {
+			return err
+		}
+	}
+
 	if err := t.loadExistingTree(); err != nil {
 		return err
 	}
+	if t.wal != nil {
+		t.loggedRootID = t.rootPage.id
+		t.loggedRoot = *t.rootPage.data
+	}
+	t.startDurability(config)
+	t.fillFactor = config.BulkLoadFillFactor
 
 	// Tree loaded successfully
 	t.open = true
 	return nil
 }
 
-func (t *BTree) Delete() error {
+func (t *BTree) Destroy() error {
 	if !t.open {
-		panic("Cannot delete closed tree")
+		panic("Cannot destroy closed tree")
 	}
 
+	if t.group != nil {
+		t.group.close()
+		t.group = nil
+	}
+	if t.wal != nil {
+		t.wal.Close()
+		t.wal = nil
+	}
+
+	// The disk releases its files, and the lock of a single store file,
+	// before they are removed. Its pages are not flushed, as they are
+	// removed anyway.
+	closeErr := t.bufferPool.disk.Close()
+
 	err := os.RemoveAll(t.directory)
 	if err != nil {
 		return fmt.Errorf("IO error while deleting store directory: %v", err)
@@ -187,6 +244,10 @@ func (t *BTree) Delete() error {
 
 	t.open = false
 
+	if closeErr != nil {
+		return fmt.Errorf("Error closing disk: %v", closeErr)
+	}
+
 	return nil
 }
 
@@ -195,16 +256,46 @@ func (t *BTree) Close() error {
 		panic("Cannot close closed tree")
 	}
 
+	if t.group != nil {
+		if err := t.group.close(); err != nil {
+			return err
+		}
+		t.group = nil
+	}
+
+	if t.wal != nil {
+		// Once everything logged is persisted, the log can be
+		// discarded.
+		if err := t.checkpoint(); err != nil {
+			return err
+		}
+		t.wal.Close()
+		t.wal = nil
+	} else if t.durability != DurabilityNone {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	}
+
+	// Our own meta data is persisted before closing the buffer pool, as
+	// the disk might be storing it.
+	if err := t.storeMetaData(); err != nil {
+		return err
+	}
+
 	err := t.bufferPool.Close()
 	if err != nil {
 		return fmt.Errorf("Error closing buffer pool: %v", err)
 	}
 
-	// Now we'll only need to persist our own meta data, and we're golden.
-	return t.storeMetaData()
+	return nil
 }
 
 func (t *BTree) loadMetaData() (rootPageID PageID, err error) {
+	if disk, ok := t.bufferPool.disk.(rootStore); ok {
+		return disk.root()
+	}
+
 	data := make([]byte, 4)
 
 	metaFilePath := filepath.Join(t.directory, treeMetaDataFile)
@@ -225,24 +316,13 @@ func (t *BTree) loadMetaData() (rootPageID PageID, err error) {
 }
 
 func (t *BTree) storeMetaData() error {
-	data := make([]byte, 4)
-	// Root page ID
-	binary.BigEndian.PutUint32(data[0:4], uint32(t.rootPage.id))
-
-	metaFilePath := filepath.Join(t.directory, treeMetaDataFile)
-	// We can simply truncate it
-	file, err := os.Create(metaFilePath)
-	if err != nil {
-		return fmt.Errorf("IO error while opening tree meta data file: %v", err)
-	}
-	defer file.Close()
-
-	_, err = file.Write(data)
-	if err != nil {
-		return fmt.Errorf("IO error while writing tree meta data: %v", err)
-	}
+	return t.writeMetaData(t.rootPage.id, false)
+}
 
-	return nil
+// writeMetaData persists the ID of the root page, and syncs it to stable
+// storage if durable is set.
+func (t *BTree) writeMetaData(rootPageID PageID, durable bool) error {
+	return storeRoot(t.bufferPool.disk, filepath.Join(t.directory, treeMetaDataFile), rootPageID, durable)
 }
 
 func (t *BTree) GetDebugInformation() string {
@@ -254,101 +334,235 @@ func (t *BTree) GetDebugInformation() string {
 	)
 }
 
+// Get retrieves the value of the item with given key. If no item with the
+// requested key exists, ErrKeyNotFound is returned. If the value does not fit
+// into 10 bytes, ErrValueTooLarge is returned.
 func (t *BTree) Get(key uint64) ([10]byte, error) {
 	if !t.open {
 		panic("Cannot read from closed tree")
 	}
 
-	lastNode := t.root
-	var leaf *LNodePage
+	t.isolation.RLock()
+	defer t.isolation.RUnlock()
 
-	// find leaf
-	for leaf == nil {
-		id := lastNode.get(key)
-		page, err := t.bufferPool.FetchPage(id)
-		if err != nil {
-			return [10]byte{}, err
-		}
+	var value [10]byte
+	err := t.lookup(key, func(v leafValue) (err error) {
+		value, err = fixedValue(v)
+		return err
+	})
 
-		l, i := RawNodeFrom(page)
-		if l != nil {
-			leaf = l
-		} else {
-			lastNode = i
-		}
-	}
+	return value, err
+}
 
-	value, found := leaf.get(key)
-	if !found {
-		return value, errors.New("value not found")
-	} else {
-		return value, nil
+// GetBytes retrieves the value of the item with given key, regardless of its
+// size. If no item with the requested key exists, ErrKeyNotFound is returned.
+func (t *BTree) GetBytes(key uint64) ([]byte, error) {
+	if !t.open {
+		panic("Cannot read from closed tree")
 	}
+
+	t.isolation.RLock()
+	defer t.isolation.RUnlock()
+
+	var value []byte
+	err := t.lookup(key, func(v leafValue) (err error) {
+		// Overflow pages are read while the leaf is latched, as they
+		// might be freed by a concurrent update otherwise.
+		value, err = t.bufferPool.loadValue(v)
+		return err
+	})
+
+	return value, err
 }
 
+// Put stores a new item with given key and value. If an item with the
+// requested key already exists, ErrKeyExists is returned.
 func (t *BTree) Put(key uint64, value [10]byte) error {
 	if !t.open {
 		panic("Cannot write to closed tree")
 	}
 
-	trace, leaf, err := t.traceTo(key)
+	return t.logged(func() error {
+		return t.insert(key, inlineValue(value), false)
+	})
+}
+
+// PutBytes stores a new item with given key and a value of arbitrary size.
+// If an item with the requested key already exists, ErrKeyExists is returned.
+func (t *BTree) PutBytes(key uint64, value []byte) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	return t.logged(func() error {
+		return t.storeAndInsert(key, value, false)
+	})
+}
+
+// Upsert stores an item with given key and value, replacing the value in
+// place if an item with the requested key already exists.
+func (t *BTree) Upsert(key uint64, value [10]byte) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	return t.logged(func() error {
+		return t.insert(key, inlineValue(value), true)
+	})
+}
+
+// UpsertBytes stores an item with given key and a value of arbitrary size,
+// replacing the value if an item with the requested key already exists.
+func (t *BTree) UpsertBytes(key uint64, value []byte) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	return t.logged(func() error {
+		return t.storeAndInsert(key, value, true)
+	})
+}
+
+// Update replaces the value of an existing item with given key. If no item
+// with the requested key exists, ErrKeyNotFound is returned.
+func (t *BTree) Update(key uint64, value [10]byte) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	return t.logged(func() error {
+		return t.update(key, inlineValue(value))
+	})
+}
+
+// UpdateBytes replaces the value of an existing item with given key by a
+// value of arbitrary size. If no item with the requested key exists,
+// ErrKeyNotFound is returned.
+func (t *BTree) UpdateBytes(key uint64, value []byte) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	return t.logged(func() error {
+		return t.storeAndUpdate(key, value)
+	})
+}
+
+// storeAndUpdate stores a value of arbitrary size, and replaces the value of
+// an existing item with it. If updating fails, the stored value gets freed
+// again.
+func (t *BTree) storeAndUpdate(key uint64, value []byte) error {
+	stored, err := t.bufferPool.storeValue(value)
 	if err != nil {
 		return err
 	}
 
-	if leaf.isFull() {
-		return t.splitLeaf(trace, leaf, key, value)
-	} else {
-		if !leaf.insert(key, value) {
-			return errors.New("unable to re-insert existing key")
-		}
+	err = t.update(key, stored)
+	if err != nil {
+		t.bufferPool.freeValue(stored)
+	}
 
-		// Cleanup
-		for _, internal := range trace {
-			if *internal.id != *t.root.id {
-				t.bufferPool.UnpinPage(*internal.id, false)
-			}
-		}
-		t.bufferPool.UnpinPage(*leaf.id, true)
+	return err
+}
+
+// update replaces the value slot of an existing item with given key,
+// freeing the overflow pages of the replaced value.
+func (t *BTree) update(key uint64, value leafValue) error {
+	trace, leaf, err := t.traceTo(key, latchUpdate)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	old, updated := leaf.update(key, value)
+
+	// Cleanup
+	t.release(trace, false)
+	t.releaseLeaf(leaf, updated)
+
+	if !updated {
+		return ErrKeyNotFound
+	}
+
+	return t.bufferPool.freeValue(old)
 }
 
-func (t *BTree) traceTo(key uint64) ([]*INodePage, *LNodePage, error) {
-	trace := []*INodePage{t.root}
-	var leaf *LNodePage
+// storeAndInsert stores a value of arbitrary size, and inserts it into the
+// tree. If inserting fails, the stored value gets freed again.
+func (t *BTree) storeAndInsert(key uint64, value []byte, overwrite bool) error {
+	stored, err := t.bufferPool.storeValue(value)
+	if err != nil {
+		return err
+	}
 
-	// find leaf
-	for leaf == nil {
-		id := trace[len(trace)-1].get(key)
-		page, err := t.bufferPool.FetchPage(id)
-		if err != nil {
-			return nil, nil, err
+	err = t.insert(key, stored, overwrite)
+	if err != nil {
+		t.bufferPool.freeValue(stored)
+	}
+
+	return err
+}
+
+// insert inserts a key-value pair into the tree, splitting nodes as
+// required. If the key exists already, its value is either replaced or
+// ErrKeyExists is returned, depending on overwrite.
+func (t *BTree) insert(key uint64, value leafValue, overwrite bool) error {
+	trace, leaf, err := t.traceTo(key, latchInsert)
+	if err != nil {
+		return err
+	}
+
+	if leaf.contains(key) {
+		var old leafValue
+		if overwrite {
+			old, _ = leaf.update(key, value)
 		}
 
-		l, i := RawNodeFrom(page)
-		if l != nil {
-			leaf = l
-		} else {
-			trace = append(trace, i)
+		// Cleanup
+		t.release(trace, false)
+		t.releaseLeaf(leaf, overwrite)
+
+		if !overwrite {
+			return ErrKeyExists
 		}
+		return t.bufferPool.freeValue(old)
 	}
 
-	return trace, leaf, nil
+	if leaf.isFull() {
+		return t.splitLeaf(trace, leaf, key, value)
+	} else {
+		leaf.insert(key, value)
+
+		// Cleanup
+		t.release(trace, false)
+		t.releaseLeaf(leaf, true)
+	}
+
+	return nil
 }
 
-func (t *BTree) splitLeaf(trace []*INodePage, leaf *LNodePage, key uint64, value [10]byte) error {
+// splitLeaf splits a full leaf, inserting the key-value pair into either
+// half. Both the trace and the leaf get released.
+func (t *BTree) splitLeaf(trace trace, leaf *LNodePage, key uint64, value leafValue) error {
 	// create new page for right node, current leaf will be reused for left node.
-	rightPage, err := t.bufferPool.NewPage()
+	rightPage, err := t.newLatched()
 	if err != nil {
+		t.release(trace, false)
+		t.releaseLeaf(leaf, false)
 		return err
 	}
 
+	oldRightSibling := *leaf.rightSibling
 	separator, right := leaf.splitRight(rightPage)
 	// leaf is the new left node.
 	left := leaf
 
+	if err := t.relinkLeftSibling(oldRightSibling, *right.id); err != nil {
+		t.release(trace, false)
+		t.releaseLeaf(left, true)
+		t.releaseLeaf(right, true)
+		return err
+	}
+
 	// insert key accordingly
 	if key <= separator {
 		left.insert(key, value)
@@ -359,19 +573,20 @@ func (t *BTree) splitLeaf(trace []*INodePage, leaf *LNodePage, key uint64, value
 	newRightID := *right.id
 
 	// Cleanup
-	t.bufferPool.UnpinPage(*left.id, true)
-	t.bufferPool.UnpinPage(*right.id, true)
+	t.releaseLeaf(left, true)
+	t.releaseLeaf(right, true)
 
 	// insert right node to parent.
 	return t.insertToParent(trace, separator, newRightID)
 }
 
-func (t *BTree) insertToParent(trace []*INodePage, separator uint64, newRight PageID) error {
-	last := len(trace) - 1
-	parent := trace[last]
+// insertToParent inserts a separator and the node right of it into the last
+// node of the trace, splitting nodes as required. The trace gets released.
+func (t *BTree) insertToParent(trace trace, separator uint64, newRight PageID) error {
+	parent := trace.last()
 
 	if parent.isFull() {
-		left, right, newParentSeparator, err := t.splitInternal(trace[:last], parent)
+		left, right, newParentSeparator, err := t.splitInternal(trace)
 		if err != nil {
 			return err
 		}
@@ -384,29 +599,33 @@ func (t *BTree) insertToParent(trace []*INodePage, separator uint64, newRight Pa
 		// have to be inserted.
 		if separator <= newParentSeparator {
 			left.rightInsert(separator, newRight)
-			t.bufferPool.UnpinPage(*left.id, true)   // override left as dirty
-			t.bufferPool.UnpinPage(*right.id, false) // may still be dirty
 		} else {
 			right.rightInsert(separator, newRight)
-			t.bufferPool.UnpinPage(*left.id, false)
-			t.bufferPool.UnpinPage(*right.id, true)
 		}
+		// Both halves were modified by the split.
+		t.releaseInternal(left, false, true)
+		t.releaseInternal(right, false, true)
 	} else {
 		parent.rightInsert(separator, newRight)
 		// Cleanup
-		for _, internal := range trace {
-			if *internal.id != *t.root.id {
-				t.bufferPool.UnpinPage(*internal.id, true)
-			}
-		}
+		t.release(trace, true)
 	}
 
 	return nil
 }
 
-func (t *BTree) splitInternal(trace []*INodePage, splittingNode *INodePage) (*INodePage, *INodePage, uint64, error) {
-	rightPage, err := t.bufferPool.NewPage()
+// splitInternal splits the last node of the trace, and inserts the resulting
+// separator into its parent. All nodes above the split node get released, the
+// two halves are returned latched. If an error occurs, everything gets
+// released.
+func (t *BTree) splitInternal(trace trace) (*INodePage, *INodePage, uint64, error) {
+	splittingNode := trace.last()
+	isRoot := trace.isRoot(len(trace.nodes) - 1)
+	parents := trace.parents()
+
+	rightPage, err := t.newLatched()
 	if err != nil {
+		t.release(trace, false)
 		return nil, nil, 0, err
 	}
 
@@ -414,24 +633,33 @@ func (t *BTree) splitInternal(trace []*INodePage, splittingNode *INodePage) (*IN
 	left := splittingNode
 
 	// create new root if needed and make it the trace
-	if *splittingNode.id == *t.root.id {
-		if len(trace) != 0 {
+	if isRoot {
+		if len(parents.nodes) != 0 {
 			panic("DEV: logic error")
 		}
 		if err = t.createNewRoot(separator, *left.id, *right.id); err != nil {
+			t.releaseInternal(left, true, true)
+			t.releaseInternal(right, false, true)
 			return nil, nil, separator, err
 		}
-		trace = []*INodePage{t.root}
+		parents = trace.parents()
+		parents.nodes = []*INodePage{t.root}
 	}
 
 	// add the split to the parent
-	if err = t.insertToParent(trace, separator, *right.id); err != nil {
+	if err = t.insertToParent(parents, separator, *right.id); err != nil {
+		// The previous root is an ordinary node by now.
+		t.releaseInternal(left, false, true)
+		t.releaseInternal(right, false, true)
 		return nil, nil, separator, err
 	}
 
 	return left, right, separator, nil
 }
 
+// createNewRoot creates a new root above the current one, which got split.
+// The previous root becomes an ordinary node, and is thus latched by its page
+// from now on. Its pin is kept, to be released along with its latch.
 func (t *BTree) createNewRoot(separator uint64, leftID PageID, rightID PageID) error {
 	newRootPage, err := t.bufferPool.NewPage()
 	if err != nil {
@@ -445,7 +673,9 @@ func (t *BTree) createNewRoot(separator uint64, leftID PageID, rightID PageID) e
 	newRoot.pages[0] = leftID
 	newRoot.pages[1] = rightID
 
-	t.bufferPool.UnpinPage(t.rootPage.id, false)
+	// Nobody can have latched the page of the previous root, as it was
+	// latched by the rootLatch, which is still held.
+	t.rootPage.latch.Lock()
 
 	t.root = newRoot
 	t.rootPage = newRootPage
@@ -453,6 +683,279 @@ func (t *BTree) createNewRoot(separator uint64, leftID PageID, rightID PageID) e
 	return nil
 }
 
+// Delete removes the item with the given key from the tree. If no item with
+// the requested key exists, an error is returned.
+//
+// Leaves and internal nodes which fall below their minimum occupancy borrow
+// from or get merged with a sibling. Pages freed by merging are returned to
+// the buffer pool, such that the disk may recycle them.
+func (t *BTree) Delete(key uint64) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	return t.logged(func() error {
+		return t.delete(key)
+	})
+}
+
+// delete removes the item with the given key from the tree, rebalancing
+// nodes as required.
+func (t *BTree) delete(key uint64) error {
+	trace, leaf, err := t.traceTo(key, latchDelete)
+	if err != nil {
+		return err
+	}
+
+	value, found := leaf.remove(key)
+	if !found {
+		t.release(trace, false)
+		t.releaseLeaf(leaf, false)
+		return ErrKeyNotFound
+	}
+
+	if err := t.rebalanceLeaf(trace, leaf); err != nil {
+		return err
+	}
+
+	return t.bufferPool.freeValue(value)
+}
+
+// siblingOf fetches a sibling of the child at idx of the given parent, and
+// latches it exclusively.
+// The left sibling is preferred, the right one is only used for the leftmost child.
+//
+// Returns the fetched sibling page and whether it is the left sibling.
+func (t *BTree) siblingOf(parent *INodePage, idx uint16) (*Page, bool, error) {
+	isLeft := idx > 0
+	siblingIdx := idx + 1
+	if isLeft {
+		siblingIdx = idx - 1
+	}
+
+	page, err := t.fetchLatched(parent.pages[siblingIdx])
+
+	return page, isLeft, err
+}
+
+// rebalanceLeaf restores the minimum occupancy of a leaf after a deletion.
+// All nodes of the trace and the leaf itself get released.
+func (t *BTree) rebalanceLeaf(trace trace, leaf *LNodePage) error {
+	if !leaf.isUnderflowing() {
+		t.release(trace, false)
+		t.releaseLeaf(leaf, true)
+		return nil
+	}
+
+	last := len(trace.nodes) - 1
+	parent := trace.last()
+
+	idx, found := parent.indexOf(*leaf.id)
+	if !found {
+		panic("DEV: logic error, leaf is no child of its parent")
+	}
+
+	siblingPage, isLeft, err := t.siblingOf(parent, idx)
+	if err != nil {
+		t.release(trace, false)
+		t.releaseLeaf(leaf, true)
+		return err
+	}
+	sibling := RawLNodeFrom(siblingPage)
+
+	if *sibling.numKeys > MinLeafKeys {
+		if isLeft {
+			// Move the largest key of the left sibling to the front.
+			lastIdx := *sibling.numKeys - 1
+			leaf.insert(sibling.keys[lastIdx], sibling.values[lastIdx])
+			sibling.remove(sibling.keys[lastIdx])
+			parent.keys[idx-1] = sibling.keys[*sibling.numKeys-1]
+		} else {
+			// Move the smallest key of the right sibling to the end.
+			leaf.insert(sibling.keys[0], sibling.values[0])
+			sibling.remove(sibling.keys[0])
+			parent.keys[idx] = leaf.keys[*leaf.numKeys-1]
+		}
+		*parent.isDirty = true
+
+		t.release(trace, true)
+		t.releaseLeaf(leaf, true)
+		t.releaseLeaf(sibling, true)
+		return nil
+	}
+
+	// The root must always keep at least one separator, as the tree
+	// relies on it being an internal node. Its last two leaves thus never
+	// get merged.
+	if trace.isRoot(last) && *parent.numKeys == 1 {
+		t.release(trace, false)
+		t.releaseLeaf(leaf, true)
+		t.releaseLeaf(sibling, false)
+		return nil
+	}
+
+	// Merge the right node into the left one, and drop the right one.
+	left, right, sepIdx := leaf, sibling, idx
+	if isLeft {
+		left, right, sepIdx = sibling, leaf, idx-1
+	}
+	left.mergeFrom(right)
+	parent.remove(sepIdx)
+
+	if err := t.relinkLeftSibling(*left.rightSibling, *left.id); err != nil {
+		t.release(trace, true)
+		t.releaseLeaf(left, true)
+		t.releaseLeaf(right, true)
+		return err
+	}
+
+	t.releaseLeaf(left, true)
+	err = t.bufferPool.UnpinAndDeletePage(*right.id)
+	right.latch.Unlock()
+	if err != nil {
+		t.release(trace, true)
+		return err
+	}
+
+	return t.rebalanceInternal(trace)
+}
+
+// relinkLeftSibling sets the left sibling of the given leaf, unless the leaf
+// is NoSibling.
+func (t *BTree) relinkLeftSibling(id PageID, leftSibling PageID) error {
+	if id == NoSibling {
+		return nil
+	}
+
+	page, err := t.fetchLatched(id)
+	if err != nil {
+		return err
+	}
+
+	leaf := RawLNodeFrom(page)
+	*leaf.leftSibling = leftSibling
+	t.releaseLeaf(leaf, true)
+
+	return nil
+}
+
+// rebalanceInternal restores the minimum occupancy of the last node of the
+// trace after one of its children got merged away. If the root is left with a
+// single child, the child becomes the new root.
+// All nodes of the trace get released.
+func (t *BTree) rebalanceInternal(trace trace) error {
+	last := len(trace.nodes) - 1
+	node := trace.last()
+
+	if trace.isRoot(last) {
+		var err error
+		if *node.numKeys == 0 {
+			err = t.collapseRoot()
+		}
+		t.rootLatch.Unlock()
+		return err
+	}
+
+	if !node.isUnderflowing() {
+		t.release(trace, true)
+		return nil
+	}
+
+	parents := trace.parents()
+	parent := parents.last()
+
+	idx, found := parent.indexOf(*node.id)
+	if !found {
+		panic("DEV: logic error, node is no child of its parent")
+	}
+
+	siblingPage, isLeft, err := t.siblingOf(parent, idx)
+	if err != nil {
+		t.release(trace, true)
+		return err
+	}
+	sibling := RawINodeFrom(siblingPage)
+
+	if *sibling.numKeys > MinInternalKeys {
+		if isLeft {
+			// Rotate right: The parent separator moves down to the
+			// front of the node, the largest key of the sibling
+			// moves up as new separator.
+			lastIdx := *sibling.numKeys - 1
+			util.ShiftRight(node.keys, uint16(0), *node.numKeys, parent.keys[idx-1])
+			util.ShiftRight(node.pages, uint16(0), *node.numKeys+1, sibling.pages[lastIdx+1])
+			*node.numKeys++
+			parent.keys[idx-1] = sibling.keys[lastIdx]
+			sibling.keys[lastIdx] = 0
+			sibling.pages[lastIdx+1] = 0
+			*sibling.numKeys--
+		} else {
+			// Rotate left: The parent separator moves down to the
+			// end of the node, the smallest key of the sibling moves
+			// up as new separator.
+			node.keys[*node.numKeys] = parent.keys[idx]
+			node.pages[*node.numKeys+1] = sibling.pages[0]
+			*node.numKeys++
+			parent.keys[idx] = sibling.keys[0]
+			util.ShiftLeft(sibling.keys, uint16(1), *sibling.numKeys, 0)
+			util.ShiftLeft(sibling.pages, uint16(1), *sibling.numKeys+1, PageID(0))
+			*sibling.numKeys--
+		}
+		*node.isDirty = true
+		*sibling.isDirty = true
+		*parent.isDirty = true
+
+		t.release(trace, true)
+		t.releaseInternal(sibling, false, true)
+		return nil
+	}
+
+	left, right, sepIdx := node, sibling, idx
+	if isLeft {
+		left, right, sepIdx = sibling, node, idx-1
+	}
+	// Unlike leaves, internal nodes below the root may be merged even if
+	// the root is left without separator, as the root then gets collapsed.
+	left.mergeFrom(parent.keys[sepIdx], right)
+	parent.remove(sepIdx)
+
+	t.releaseInternal(left, false, true)
+	err = t.bufferPool.UnpinAndDeletePage(*right.id)
+	right.latch.Unlock()
+	if err != nil {
+		t.release(parents, true)
+		return err
+	}
+
+	return t.rebalanceInternal(parents)
+}
+
+// collapseRoot replaces a root with a single child by that child, reducing
+// the height of the tree by one. The rootLatch must be held.
+func (t *BTree) collapseRoot() error {
+	newRootPage, err := t.bufferPool.FetchPage(t.root.pages[0])
+	if err != nil {
+		return err
+	}
+
+	l, newRoot := RawNodeFrom(newRootPage)
+	if l != nil {
+		panic("DEV: logic error, root must not collapse onto a leaf")
+	}
+
+	// Readers which latched the child before the rootLatch got taken
+	// might still be reading it. Once they are done, it's only reachable
+	// through the rootLatch.
+	newRootPage.latch.Lock()
+	newRootPage.latch.Unlock()
+
+	oldRootID := t.rootPage.id
+	t.root = newRoot
+	t.rootPage = newRootPage
+
+	return t.bufferPool.UnpinAndDeletePage(oldRootID)
+}
+
 //func (t *BTree) splitInternal(visited []*INodePage, splittingNode *INodePage) (*INodePage, *INodePage, error) {
 //	leftPage, err := t.bufferPool.NewPage()
 //	if err != nil {
@@ -3,6 +3,8 @@ package kv
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 )
 
 // FrameID is the cache frame ID (index) associated with a Page.
@@ -10,37 +12,103 @@ type FrameID uint
 
 /*
 BufferPool is a cache-like structure that buffers Pages from a Disk.
+
+A BufferPool is safe for concurrent use. Cached pages are looked up in a
+sharded page table, such that fetching, pinning and unpinning cached pages of
+different shards never contend. Pin counts are maintained atomically. A page is
+only evicted once its pin count dropped to zero, and never while anyone pinned
+it in the meantime.
+
+The buffer pool only guards its own bookkeeping though, the data of a page must
+be guarded by its latch.
+
+Pages are cached as returned by the disk. Disks such as MmapDisk hand out pages
+whose data points into memory managed by the disk, in which case caching them
+costs no additional memory until they are modified.
 */
 type BufferPool struct {
-	disk       Disk
+	disk      Disk
+	pageTable *pageTable
+	eviction  CacheEviction
+
+	// mu guards all fields below. It must not be taken while holding the
+	// lock of a shard of the page table.
+	mu         sync.Mutex
 	pages      []*Page
-	pageLookup map[PageID]FrameID
-	eviction   CacheEviction
 	freeFrames []FrameID
+
+	// capture tracks the pages modified by the current operation, if
+	// capturing. See beginCapture.
+	capture *pageCapture
+	// Whether capture is set, such that operations which aren't affected by
+	// a capture needn't take the mutex. Must only be accessed atomically.
+	capturing int32
+
+	// Counters of the buffer pool's activity, reported by Stats.
+	counters *bufferPoolCounters
+}
+
+// bufferPoolCounters counts the activity of a buffer pool. All counters must
+// only be accessed atomically.
+type bufferPoolCounters struct {
+	hits         uint64
+	misses       uint64
+	evictions    uint64
+	dirtyFlushes uint64
+}
+
+// BufferPoolStats describes the state and activity of a buffer pool since it
+// was created.
+type BufferPoolStats struct {
+	// Number of frames, and how many of them hold a page.
+	Frames      uint
+	CachedPages uint
+	// Number of fetched pages which were cached, and which had to be read
+	// from disk.
+	Hits   uint64
+	Misses uint64
+	// Number of pages evicted to make room for other pages.
+	Evictions uint64
+	// Number of modified pages written to disk.
+	DirtyFlushes uint64
+}
+
+// HitRatio returns the fraction of fetched pages which were cached, or 0 if
+// no page was fetched yet.
+func (s BufferPoolStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
 }
 
 func (b *BufferPool) GetDebugInfo() string {
+	pages := b.pageTable.all()
+
 	debug := fmt.Sprintf("%T {"+
 		"\n\tdisk:              %T"+
 		"\n\teviction:          %T"+
 		"\n\t# of pages:        %d"+
 		"\n\t# of cached pages: %d"+
 		"\n\tpages:\n",
-		b, b.disk, b.eviction, len(b.pages), len(b.pageLookup),
+		b, b.disk, b.eviction, len(b.pages), len(pages),
 	)
 
-	for _, page := range b.pages {
-		if page == nil {
+	for _, page := range pages {
+		if isOverflowPage(page) {
+			debug += fmt.Sprintf("Overflow {\n\tid: %d\n}", page.id)
 			continue
 		}
-
-		if _, ok := b.pageLookup[page.id]; ok {
-			lnode, inode := RawNodeFrom(page)
-			if lnode != nil {
-				debug += lnode.GetDebugInfo()
-			} else {
-				debug += inode.GetDebugInfo()
-			}
+		if isSlottedPage(page) {
+			debug += rawSlottedFrom(page).GetDebugInfo()
+			continue
+		}
+		lnode, inode := RawNodeFrom(page)
+		if lnode != nil {
+			debug += lnode.GetDebugInfo()
+		} else {
+			debug += inode.GetDebugInfo()
 		}
 	}
 
@@ -57,10 +125,23 @@ func NewBufferPool(size uint, disk Disk, eviction CacheEviction) BufferPool {
 	}
 	return BufferPool{
 		disk:       disk,
-		pages:      make([]*Page, size),
-		pageLookup: make(map[PageID]FrameID, size),
+		pageTable:  newPageTable(size),
 		eviction:   eviction,
+		pages:      make([]*Page, size),
 		freeFrames: freeFrames,
+		counters:   &bufferPoolCounters{},
+	}
+}
+
+// Stats returns the state of the buffer pool, and counters of its activity.
+func (b *BufferPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Frames:       uint(len(b.pages)),
+		CachedPages:  uint(len(b.pageTable.all())),
+		Hits:         atomic.LoadUint64(&b.counters.hits),
+		Misses:       atomic.LoadUint64(&b.counters.misses),
+		Evictions:    atomic.LoadUint64(&b.counters.evictions),
+		DirtyFlushes: atomic.LoadUint64(&b.counters.dirtyFlushes),
 	}
 }
 
@@ -73,22 +154,29 @@ This method returns an error if there are
 */
 func (b *BufferPool) NewPage() (*Page, error) {
 	// get next free frame or evict from cache
-	fh := b.getFrame()
-	if fh.err != nil {
-		return nil, fmt.Errorf("Error getting frame: %v", fh.err)
+	frameID, err := b.getFrame()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting frame: %v", err)
 	}
 
 	// allocate new page from disk
-	fh.AllocatePage()
-	if fh.err != nil {
-		return nil, fmt.Errorf("Error allocating page on frame: %v", fh.err)
+	page, err := b.disk.AllocatePage()
+	if err != nil {
+		b.freeFrame(frameID)
+		return nil, fmt.Errorf("Error allocating page on frame: %v", err)
 	}
 
-	fh.page.pinCount = 1
-	b.pageLookup[fh.page.id] = *fh.frameID
-	b.pages[*fh.frameID] = fh.page
+	// Nobody else knows about the page yet, so it's always inserted.
+	b.pageTable.insert(page, frameID)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	return fh.page, nil
+	b.pages[frameID] = page
+	b.eviction.Load(frameID, page.id)
+	b.recordAllocation(page)
+
+	return page, nil
 }
 
 /*
@@ -100,31 +188,48 @@ This method returns ans error if there are
 */
 func (b *BufferPool) FetchPage(pageID PageID) (*Page, error) {
 	// try fetch from cache
-	if frameID, ok := b.pageLookup[pageID]; ok {
-		page := b.pages[frameID]
-		page.pinCount++
-		b.eviction.Remove(frameID)
+	if page, first, ok := b.pageTable.pin(pageID); ok {
+		if first {
+			b.eviction.Remove(page.frameID)
+		}
+		b.recordUndo(page)
+		atomic.AddUint64(&b.counters.hits, 1)
 
 		return page, nil
 	}
+	atomic.AddUint64(&b.counters.misses, 1)
 
 	// get next free frame or evict from cache
-	fh := b.getFrame()
-	if fh.err != nil {
-		return nil, fh.err
+	frameID, err := b.getFrame()
+	if err != nil {
+		return nil, err
 	}
 
 	// try fetch from disk
-	fh.ReadPage(pageID)
-	if fh.err != nil {
-		return nil, fh.err
+	page, err := b.disk.ReadPage(pageID)
+	if err != nil {
+		b.freeFrame(frameID)
+		return nil, err
+	}
+
+	cached, inserted := b.pageTable.insert(page, frameID)
+	if !inserted {
+		// Someone else fetched the page in the meantime.
+		b.freeFrame(frameID)
+		b.eviction.Remove(cached.frameID)
+		b.recordUndo(cached)
+
+		return cached, nil
 	}
 
-	fh.page.pinCount++
-	b.pageLookup[pageID] = *fh.frameID
-	b.pages[*fh.frameID] = fh.page
+	b.mu.Lock()
+	b.pages[frameID] = page
+	b.mu.Unlock()
+	b.eviction.Load(frameID, page.id)
+
+	b.recordUndo(page)
 
-	return fh.page, nil
+	return page, nil
 }
 
 /*
@@ -133,8 +238,8 @@ If writing to disk fails, the page gets reset and the error is returned.
 If the pageID cannot be found, an error is returned.
 */
 func (b *BufferPool) FlushPage(pageID PageID) error {
-	if frameID, ok := b.pageLookup[pageID]; ok {
-		return b.FlushFrame(frameID)
+	if page, ok := b.pageTable.get(pageID); ok {
+		return b.pageTable.locked(page, b.flush)
 	}
 
 	return errors.New("page not found")
@@ -145,7 +250,20 @@ FlushFrame flushes a page associated to the frameID to disk.
 If writing to disk fails, the page gets reset and the error is returned.
 */
 func (b *BufferPool) FlushFrame(frameID FrameID) error {
+	b.mu.Lock()
 	page := b.pages[frameID]
+	b.mu.Unlock()
+
+	if page == nil {
+		return errors.New("frame is empty")
+	}
+
+	return b.pageTable.locked(page, b.flush)
+}
+
+// flush writes a page to disk. Pages which are cached must only be flushed
+// while locked in the page table.
+func (b *BufferPool) flush(page *Page) error {
 	wasDirty := page.isDirty
 	page.isDirty = false
 
@@ -153,6 +271,9 @@ func (b *BufferPool) FlushFrame(frameID FrameID) error {
 		page.isDirty = wasDirty
 		return err
 	}
+	if wasDirty {
+		atomic.AddUint64(&b.counters.dirtyFlushes, 1)
+	}
 
 	return nil
 }
@@ -164,8 +285,8 @@ Return an array of potential errors that happened.
 */
 func (b *BufferPool) FlushAllPages() []error {
 	var errs []error
-	for pageID := range b.pageLookup {
-		err := b.FlushPage(pageID)
+	for _, page := range b.pageTable.all() {
+		err := b.pageTable.locked(page, b.flush)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -200,27 +321,7 @@ Returns an error only if
 - inconsistent state was detected (debugging only)
 */
 func (b *BufferPool) DeletePage(pageID PageID) error {
-	var frameID FrameID
-	var ok bool
-
-	// remove from buffer when in buffer
-	if frameID, ok = b.pageLookup[pageID]; ok {
-		page := b.pages[frameID]
-		if page.pinCount > 0 {
-			return errors.New("page cannot be deleted from buffer: pin count > 0")
-		}
-		if page.id != pageID {
-			return fmt.Errorf("incostent state: page.id (%d) != pageID (%d)", page.id, pageID) // good to catch logic bugs
-		}
-
-		delete(b.pageLookup, pageID)
-		b.eviction.Remove(frameID)
-	}
-
-	b.disk.DeallocatePage(pageID)
-	b.freeFrames = append(b.freeFrames, frameID)
-
-	return nil
+	return b.delete(pageID, false)
 }
 
 /*
@@ -231,30 +332,53 @@ Returns an error only if
 - inconsistent state was detected (debugging only)
 */
 func (b *BufferPool) UnpinAndDeletePage(pageID PageID) error {
-	var frameID FrameID
-	var ok bool
+	return b.delete(pageID, true)
+}
+
+// delete deletes a page from the buffer pool and disk, unpinning it first if
+// requested.
+func (b *BufferPool) delete(pageID PageID, unpin bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	// remove from buffer when in buffer
-	if frameID, ok = b.pageLookup[pageID]; ok {
-		page := b.pages[frameID]
-		page.decrementPinCount()
-		if page.pinCount > 0 {
-			return errors.New("page cannot be deleted from buffer: pin count > 0")
+	if page, ok := b.pageTable.get(pageID); ok {
+		// The frame must be read while the page is still pinned.
+		frameID := page.frameID
+		b.releaseHeld(page)
+		if unpin {
+			page.decrementPinCount()
 		}
 		if page.id != pageID {
 			return fmt.Errorf("incostent state: page.id (%d) != pageID (%d)", page.id, pageID) // good to catch logic bugs
 		}
 
-		delete(b.pageLookup, pageID)
-		b.eviction.Remove(frameID)
+		removed, _ := b.pageTable.remove(page, frameID, nil)
+		if !removed && page.pins() > 0 {
+			return errors.New("page cannot be deleted from buffer: pin count > 0")
+		}
+		if removed {
+			b.eviction.Remove(frameID)
+			b.pages[frameID] = nil
+			b.freeFrames = append(b.freeFrames, frameID)
+		}
 	}
 
-	b.disk.DeallocatePage(pageID)
-	b.freeFrames = append(b.freeFrames, frameID)
+	b.deallocate(pageID)
 
 	return nil
 }
 
+// drop removes the page of a frame from the buffer pool, regardless of whether
+// it is pinned. The page is neither flushed nor deallocated. The caller must
+// hold the mutex.
+func (b *BufferPool) drop(frameID FrameID) {
+	b.pageTable.drop(b.pages[frameID].id)
+	b.eviction.Remove(frameID)
+	b.pages[frameID] = nil
+	b.freeFrames = append(b.freeFrames, frameID)
+}
+
 /*
 UnpinPage unpins a page from the buffer pool for the current thread, potentially flagging the page as dirty.
 If there are no more references to the page, the page is eligible for cache eviction.
@@ -262,15 +386,39 @@ If there are no more references to the page, the page is eligible for cache evic
 If the page was not found this is a noop.
 */
 func (b *BufferPool) UnpinPage(pageID PageID, isDirty bool) {
-	if frameID, ok := b.pageLookup[pageID]; ok {
-		page := b.pages[frameID]
-		page.decrementPinCount()
-		page.isDirty = page.isDirty || isDirty
+	page, ok := b.pageTable.get(pageID)
+	if !ok {
+		return
+	}
+
+	if isDirty && b.isCapturing() {
+		b.mu.Lock()
+		held := b.hold(page)
+		b.mu.Unlock()
 
-		if page.pinCount == 0 {
-			b.eviction.Add(frameID)
+		if held {
+			// The capture keeps the pin of the caller.
+			page.isDirty = true
+			return
 		}
 	}
+
+	b.unpin(page, isDirty)
+}
+
+// unpin unpins a cached page, making it eligible for eviction once nobody
+// pins it anymore.
+func (b *BufferPool) unpin(page *Page, isDirty bool) {
+	// The page must be flagged before being unpinned, as it might get
+	// evicted and cached in another frame right away.
+	if isDirty {
+		page.isDirty = true
+	}
+	frameID := page.frameID
+
+	if page.decrementPinCount() == 0 {
+		b.eviction.Add(frameID)
+	}
 }
 
 /*
@@ -282,23 +430,17 @@ If the page was not found this is a noop.
 Returns an error only if flushing the page failed.
 */
 func (b *BufferPool) UnpinAndFlushPage(pageID PageID) error {
-	if frameID, ok := b.pageLookup[pageID]; ok {
-		page := b.pages[frameID]
-		page.decrementPinCount()
-		wasDirty := page.isDirty
-		page.isDirty = false
-
-		if err := b.disk.WritePage(page); err != nil {
-			page.isDirty = wasDirty
-			return err
-		}
-		if page.pinCount == 0 {
-			b.eviction.Add(frameID)
-		}
-
+	page, ok := b.pageTable.get(pageID)
+	if !ok {
+		return nil
 	}
 
-	return nil
+	// Flushing while still pinned ensures the page isn't evicted in the
+	// meantime.
+	err := b.pageTable.locked(page, b.flush)
+	b.unpin(page, false)
+
+	return err
 }
 
 /*
@@ -306,76 +448,80 @@ getFrame returns a frame.
 The frame may either be from the
 - free frames list, or from
 - cache eviction
-If evicted, the frame gets removed from cache, potentially flushing to disk if the associated page was dirty.
+If evicted, the page of the frame gets removed from cache, potentially flushing
+to disk if it was dirty. Pages which got pinned again since becoming eligible
+for eviction are skipped.
 
-The 2nd returned value indicates if the FrameID was evicted from eviction.
-The 3rd returned value indicates an error if no frame could be allocated or flushing to disk failed.
+Returns an error if no frame could be allocated or flushing to disk failed, in
+which case the evicted frame is eligible for eviction again.
 
-Upon ANY error, the caller must make sure to re-add the FrameID into the eviction.
+The frame must either get a page assigned or be returned with freeFrame.
 */
-func (b *BufferPool) getFrame() FrameHelper {
-	var frameID *FrameID
-	isEvicted := false
-
-	// get next free frame or evict from cache
+func (b *BufferPool) getFrame() (FrameID, error) {
+	b.mu.Lock()
 	if len(b.freeFrames) > 0 {
-		frameID = &b.freeFrames[0]
+		frameID := b.freeFrames[0]
 		b.freeFrames = b.freeFrames[1:]
-	} else {
+		b.mu.Unlock()
+
+		return frameID, nil
+	}
+	b.mu.Unlock()
+
+	for {
 		// no free frame found
-		if frameID = b.eviction.Victim(); frameID == nil {
-			return newFrameHelper(b, frameID, nil, errors.New("unable to reserve buffer frame"), false)
+		frameID := b.eviction.Victim()
+		if frameID == nil {
+			return 0, b.noFrameError()
 		}
-		isEvicted = true
-	}
 
-	// if evicted from cache, update the table and write to disk when dirty
-	if isEvicted {
+		b.mu.Lock()
 		page := b.pages[*frameID]
-		if page != nil {
-			if page.isDirty {
-				page.isDirty = false
-				if err := b.disk.WritePage(page); err != nil {
-					page.isDirty = true
-
-					return newFrameHelper(b, frameID, nil, err, true)
-				}
-			}
+		b.mu.Unlock()
 
-			delete(b.pageLookup, page.id)
+		// The frame is either free, or was added for eviction by an
+		// unpin which raced with it being reassigned.
+		if page == nil {
+			continue
 		}
-	}
 
-	return newFrameHelper(b, frameID, nil, nil, true)
-}
+		// write to disk when dirty
+		removed, err := b.pageTable.remove(page, *frameID, func(page *Page) error {
+			if !page.isDirty {
+				return nil
+			}
 
-// FrameHelper helps on
-type FrameHelper struct {
-	bufferPool *BufferPool
-	frameID    *FrameID
-	page       *Page
-	err        error
-	isEvicted  bool
-}
+			return b.flush(page)
+		})
+		if err != nil {
+			b.eviction.Add(*frameID)
+			return 0, err
+		}
+		if !removed {
+			// The page got pinned or moved since, so the frame
+			// will be added again once it's eligible.
+			continue
+		}
 
-func newFrameHelper(b *BufferPool, frameID *FrameID, page *Page, err error, isEvicted bool) FrameHelper {
-	fh := FrameHelper{b, frameID, page, err, isEvicted}
-	fh.rollBackOnErr()
-	return fh
-}
+		b.mu.Lock()
+		b.pages[*frameID] = nil
+		b.mu.Unlock()
+		atomic.AddUint64(&b.counters.evictions, 1)
 
-func (f *FrameHelper) rollBackOnErr() {
-	if f.err != nil && f.isEvicted {
-		f.bufferPool.eviction.Add(*f.frameID)
+		return *frameID, nil
 	}
 }
 
-func (f *FrameHelper) AllocatePage() {
-	f.page, f.err = f.bufferPool.disk.AllocatePage()
-	f.rollBackOnErr()
+// freeFrame returns a frame obtained from getFrame which did not get a page
+// assigned.
+func (b *BufferPool) freeFrame(frameID FrameID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.freeFrames = append(b.freeFrames, frameID)
 }
 
-func (f *FrameHelper) ReadPage(id PageID) {
-	f.page, f.err = f.bufferPool.disk.ReadPage(id)
-	f.rollBackOnErr()
+// isCapturing returns whether the buffer pool is currently capturing.
+func (b *BufferPool) isCapturing() bool {
+	return atomic.LoadInt32(&b.capturing) != 0
 }
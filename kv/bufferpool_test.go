@@ -1,6 +1,10 @@
 package kv
 
 import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -27,13 +31,13 @@ func TestBufferPool_NewPage(t *testing.T) {
 		if page.id != PageID(i) {
 			t.Errorf("Actual pageID = %d, Expected == %d", page.id, i)
 		}
-		if page.pinCount != 1 {
-			t.Errorf("Actual pinCount = %d, Expected == 1", page.pinCount)
+		if page.pins() != 1 {
+			t.Errorf("Actual pinCount = %d, Expected == 1", page.pins())
 		}
 		if page.isDirty {
 			t.Errorf("Actual isDirty = true, Expected == false")
 		}
-		if page.data != [PageDataSize]byte{} {
+		if *page.data != [PageDataSize]byte{} {
 			t.Errorf("NewPage data should be zeroed")
 		}
 
@@ -172,6 +176,82 @@ func TestBufferPool_UnpinAndDeletePage(t *testing.T) {
 	}
 }
 
+func TestBufferPool_Concurrent(t *testing.T) {
+	const numWorkers, numPages, numFetches = 4, 64, 5_000
+
+	bufferPool := emptyBufferPool()
+	for i := 0; i < numPages; i++ {
+		page, _ := bufferPool.NewPage()
+		binary.BigEndian.PutUint32(page.data[:], uint32(page.id))
+		bufferPool.UnpinPage(page.id, true)
+	}
+
+	// A page pinned throughout must never be evicted.
+	pinned, _ := bufferPool.FetchPage(0)
+
+	errs := make(chan error, numWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+
+			for i := 0; i < numFetches; i++ {
+				id := PageID(1 + rng.Intn(numPages-1))
+				page, err := bufferPool.FetchPage(id)
+				if err != nil {
+					errs <- fmt.Errorf("Error fetching page %d: %v", id, err)
+					return
+				}
+
+				page.latch.Lock()
+				if stored := PageID(binary.BigEndian.Uint32(page.data[:])); page.id != id || stored != id {
+					errs <- fmt.Errorf("Fetched page %d holding %d; expected %d", page.id, stored, id)
+				}
+				counter := binary.BigEndian.Uint32(page.data[4:])
+				binary.BigEndian.PutUint32(page.data[4:], counter+1)
+
+				if cached, ok := bufferPool.pageTable.get(id); !ok || cached != page {
+					errs <- fmt.Errorf("Page %d got evicted while pinned", id)
+				}
+				bufferPool.UnpinPage(id, true)
+				page.latch.Unlock()
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if cached, ok := bufferPool.pageTable.get(0); !ok || cached != pinned {
+		t.Errorf("Pinned page got evicted")
+	}
+	bufferPool.UnpinPage(0, false)
+
+	// All increments must have been persisted, none lost by evicting a
+	// page while it was in use.
+	total := uint32(0)
+	for i := 1; i < numPages; i++ {
+		page, err := bufferPool.FetchPage(PageID(i))
+		if err != nil {
+			t.Fatalf("Error fetching page %d: %v", i, err)
+		}
+		total += binary.BigEndian.Uint32(page.data[4:])
+		bufferPool.UnpinPage(page.id, false)
+	}
+	if total != numWorkers*numFetches {
+		t.Errorf("Counted %d fetches; expected %d", total, numWorkers*numFetches)
+	}
+	for _, page := range bufferPool.pageTable.all() {
+		if page.pins() != 0 {
+			t.Errorf("Expected page %d to be unpinned; pin count is %d", page.id, page.pins())
+		}
+	}
+}
+
 func TestBufferPool_UnpinPage(t *testing.T) {
 	// TODO: Implement and test UnpinAndFlushPage as well.
 }
@@ -0,0 +1,388 @@
+package kv
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// defaultFillFactor is the fill factor of bulk loaded nodes if the config
+// does not specify one.
+const defaultFillFactor = 1.0
+
+// KeyValueIterator iterates over items to be loaded into a tree with
+// BulkLoad, in ascending key order.
+type KeyValueIterator interface {
+	// Next advances to the next item. It returns false once there are no
+	// more items, or iterating failed.
+	Next() bool
+	// Key returns the key of the current item.
+	Key() uint64
+	// Value returns the value of the current item. It may be of arbitrary
+	// size.
+	Value() []byte
+	// Err returns the error which stopped iterating, if any.
+	Err() error
+}
+
+/*
+BulkLoad loads the items of an iterator into an empty tree, building the tree
+bottom-up rather than inserting each item separately.
+
+Leaves are filled one after another in key order, and internal nodes are built
+on top of them level by level. Each node is filled to the fill factor of the
+config, such that later insertions do not split every node right away if it's
+below 1. Only the last two nodes of each level may hold fewer items, such that
+neither of them underflows.
+
+Keys must be strictly ascending. If they are not, or iterating fails, nothing
+is loaded and an error is returned. An error is returned as well if the tree is
+not empty.
+
+Other operations on the tree block until loading is done. If the tree has a
+write-ahead log, the loaded tree is checkpointed rather than logged.
+*/
+func (t *BTree) BulkLoad(iter KeyValueIterator) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	fillFactor := t.fillFactor
+	if fillFactor == 0 {
+		fillFactor = defaultFillFactor
+	}
+	if fillFactor < 0.5 || fillFactor > 1 {
+		return fmt.Errorf("Fill factor must be between 0.5 and 1; got %v", fillFactor)
+	}
+
+	t.isolation.Lock()
+	defer t.isolation.Unlock()
+
+	old, empty, err := t.pagesBelow(t.root, nil)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("Bulk loading requires an empty tree")
+	}
+
+	l := bulkLoader{
+		bufferPool: &t.bufferPool,
+		// Nodes must not underflow, which rounding down the fill factor
+		// might otherwise cause.
+		leafKeys: util.Max(uint16(fillFactor*NumLeafKeys), MinLeafKeys),
+		children: util.Max(int(fillFactor*NumInternalPages), MinInternalKeys+1),
+	}
+	rootPage, err := l.load(iter)
+	if err != nil {
+		l.abort()
+		return err
+	}
+	if rootPage == nil {
+		// Nothing to load, so the tree stays as it is.
+		return nil
+	}
+
+	oldRootID := t.rootPage.id
+	t.rootPage = rootPage
+	t.root = RawINodeFrom(rootPage)
+
+	for _, id := range old {
+		if err := t.bufferPool.DeletePage(id); err != nil {
+			return err
+		}
+	}
+	if err := t.bufferPool.UnpinAndDeletePage(oldRootID); err != nil {
+		return err
+	}
+
+	if t.wal != nil {
+		return t.checkpoint()
+	}
+	if t.durability == DurabilityPerWrite || t.durability == DurabilityGroupCommit {
+		return t.flush()
+	}
+
+	return nil
+}
+
+// pagesBelow appends the IDs of all pages below an internal node to ids, and
+// returns whether all leaves among them are empty. It stops early at the
+// first leaf which is not.
+func (t *BTree) pagesBelow(node *INodePage, ids []PageID) ([]PageID, bool, error) {
+	for _, id := range node.pages[:*node.numKeys+1] {
+		page, err := t.bufferPool.FetchPage(id)
+		if err != nil {
+			return nil, false, err
+		}
+
+		empty := true
+		leaf, child := RawNodeFrom(page)
+		if leaf != nil {
+			empty = leaf.isEmpty()
+		} else {
+			ids, empty, err = t.pagesBelow(child, ids)
+		}
+		t.bufferPool.UnpinPage(id, false)
+		if err != nil || !empty {
+			return nil, false, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, true, nil
+}
+
+// bulkEntry is a node written by a bulkLoader, to be referenced from the
+// level above.
+type bulkEntry struct {
+	id PageID
+	// Greatest key within the node, used as separator in its parent.
+	maxKey uint64
+}
+
+/*
+bulkLoader builds a tree bottom-up from items in ascending key order.
+
+Leaves are written as items arrive, keeping only the last two pinned, such that
+the last one may take over items of the one before if it would underflow.
+Internal nodes are built once all leaves are written.
+*/
+type bulkLoader struct {
+	bufferPool *BufferPool
+	// Number of keys per leaf, and of children per internal node.
+	leafKeys uint16
+	children int
+
+	// All leaves written so far, and the last two of them.
+	leaves            []bulkEntry
+	previous, current *LNodePage
+	// All pages written so far, which are freed again if loading fails.
+	written []PageID
+}
+
+// load writes all items of the iterator, and returns the page of the root,
+// which stays pinned. If the iterator holds no items, nil is returned.
+func (l *bulkLoader) load(iter KeyValueIterator) (*Page, error) {
+	for iter.Next() {
+		key := iter.Key()
+		if l.current != nil && *l.current.numKeys > 0 && key <= l.current.keys[*l.current.numKeys-1] {
+			return nil, fmt.Errorf(
+				"Keys must be strictly ascending for bulk loading; got %d after %d",
+				key,
+				l.current.keys[*l.current.numKeys-1],
+			)
+		}
+
+		value, err := l.bufferPool.storeValue(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if err := l.append(key, value); err != nil {
+			l.bufferPool.freeValue(value)
+			return nil, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("Error iterating items to bulk load: %v", err)
+	}
+
+	if l.current == nil {
+		return nil, nil
+	}
+	if err := l.finishLeaves(); err != nil {
+		return nil, err
+	}
+
+	return l.buildInternal(l.leaves)
+}
+
+// append appends an item to the current leaf, starting a new leaf if it's
+// filled already.
+func (l *bulkLoader) append(key uint64, value leafValue) error {
+	if l.current == nil || *l.current.numKeys == l.leafKeys {
+		if err := l.newLeaf(); err != nil {
+			return err
+		}
+	}
+
+	idx := *l.current.numKeys
+	l.current.keys[idx] = key
+	l.current.values[idx] = value
+	*l.current.numKeys++
+
+	return nil
+}
+
+// newLeaf starts a new leaf to the right of the current one, releasing the
+// one before.
+func (l *bulkLoader) newLeaf() error {
+	page, err := l.bufferPool.NewPage()
+	if err != nil {
+		return err
+	}
+	l.written = append(l.written, page.id)
+
+	leaf := RawLNodeFrom(page) // automatically sets isLeaf flag
+	*leaf.isDirty = true
+	if l.current != nil {
+		*l.current.rightSibling = page.id
+		*leaf.leftSibling = *l.current.id
+	}
+
+	if l.previous != nil {
+		l.releaseLeaf(l.previous, len(l.leaves)-2)
+	}
+	l.previous, l.current = l.current, leaf
+	l.leaves = append(l.leaves, bulkEntry{id: page.id})
+
+	return nil
+}
+
+// finishLeaves makes sure there are at least two leaves, as the root must be
+// an internal node, and that the last one does not underflow unless there are
+// too few items for two leaves. The remaining leaves get released.
+func (l *bulkLoader) finishLeaves() error {
+	if l.previous == nil {
+		if err := l.newLeaf(); err != nil {
+			return err
+		}
+	}
+
+	left, right := *l.previous.numKeys, *l.current.numKeys
+	if l.current.isUnderflowing() && left+right <= NumLeafKeys && len(l.leaves) > 2 {
+		// The last leaf fits into the one before, which would underflow
+		// if they shared their items.
+		l.previous.mergeFrom(l.current)
+		if err := l.bufferPool.UnpinAndDeletePage(*l.current.id); err != nil {
+			return err
+		}
+		l.written = l.written[:len(l.written)-1]
+		l.leaves = l.leaves[:len(l.leaves)-1]
+
+		l.releaseLeaf(l.previous, len(l.leaves)-1)
+		l.previous, l.current = nil, nil
+
+		return nil
+	}
+
+	if l.current.isUnderflowing() {
+		// The last leaf takes over items from the one before, such that
+		// both hold half of them.
+		moved := (left+right)/2 - right
+
+		copy(l.current.keys[moved:moved+right], l.current.keys[:right])
+		copy(l.current.values[moved:moved+right], l.current.values[:right])
+		util.MoveSlice(l.current.keys[:moved], l.previous.keys[left-moved:left], 0)
+		util.MoveSlice(l.current.values[:moved], l.previous.values[left-moved:left], leafValue{})
+		*l.previous.numKeys -= moved
+		*l.current.numKeys += moved
+	}
+
+	l.releaseLeaf(l.previous, len(l.leaves)-2)
+	l.releaseLeaf(l.current, len(l.leaves)-1)
+	l.previous, l.current = nil, nil
+
+	return nil
+}
+
+// releaseLeaf records the greatest key of a written leaf, and unpins it.
+func (l *bulkLoader) releaseLeaf(leaf *LNodePage, idx int) {
+	if leaf.isEmpty() {
+		// Only the rightmost leaf may be empty, whose greatest key is
+		// never used as separator.
+		l.leaves[idx].maxKey = math.MaxUint64
+	} else {
+		l.leaves[idx].maxKey = leaf.keys[*leaf.numKeys-1]
+	}
+
+	l.bufferPool.UnpinPage(*leaf.id, true)
+}
+
+// buildInternal builds the levels of internal nodes on top of the given
+// nodes, up to the root. The page of the root is returned pinned.
+func (l *bulkLoader) buildInternal(level []bulkEntry) (*Page, error) {
+	for {
+		sizes := chunkSizes(len(level), l.children, MinInternalKeys+1, NumInternalPages)
+		parents := make([]bulkEntry, 0, len(sizes))
+
+		for _, size := range sizes {
+			children := level[:size]
+			level = level[size:]
+
+			page, err := l.bufferPool.NewPage()
+			if err != nil {
+				return nil, err
+			}
+			l.written = append(l.written, page.id)
+
+			node := RawINodeFrom(page)
+			*node.isDirty = true
+			*node.numKeys = uint16(size - 1)
+			for i, child := range children {
+				node.pages[i] = child.id
+				if i < size-1 {
+					node.keys[i] = child.maxKey
+				}
+			}
+
+			if len(sizes) == 1 {
+				return page, nil
+			}
+			l.bufferPool.UnpinPage(page.id, true)
+			parents = append(parents, bulkEntry{page.id, children[size-1].maxKey})
+		}
+
+		level = parents
+	}
+}
+
+// abort frees all pages written so far, including the overflow pages of
+// values stored in leaves.
+func (l *bulkLoader) abort() {
+	for _, leaf := range []*LNodePage{l.previous, l.current} {
+		if leaf != nil {
+			l.bufferPool.UnpinPage(*leaf.id, true)
+		}
+	}
+
+	for _, id := range l.written {
+		page, err := l.bufferPool.FetchPage(id)
+		if err != nil {
+			continue
+		}
+		if leaf, _ := RawNodeFrom(page); leaf != nil {
+			for _, value := range leaf.values[:*leaf.numKeys] {
+				l.bufferPool.freeValue(value)
+			}
+		}
+		l.bufferPool.UnpinAndDeletePage(id)
+	}
+}
+
+// chunkSizes divides a number of nodes into parents of per nodes each. If the
+// last parent would hold less than minimum nodes, it shares the nodes of the
+// one before, or takes all of them if they fit into maximum.
+func chunkSizes(total, per, minimum, maximum int) []int {
+	n := (total + per - 1) / per
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = per
+	}
+	sizes[n-1] = total - (n-1)*per
+
+	if n > 1 && sizes[n-1] < minimum {
+		combined := sizes[n-2] + sizes[n-1]
+		if combined <= maximum {
+			sizes = sizes[:n-1]
+			sizes[n-2] = combined
+		} else {
+			sizes[n-2] = combined - combined/2
+			sizes[n-1] = combined / 2
+		}
+	}
+
+	return sizes
+}
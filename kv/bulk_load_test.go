@@ -0,0 +1,255 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// sliceIterator iterates over items given as slices, for BulkLoad.
+type sliceIterator struct {
+	keys   []uint64
+	values [][]byte
+	idx    int
+	err    error
+}
+
+func newSliceIterator(keys []uint64, values [][]byte) *sliceIterator {
+	return &sliceIterator{keys: keys, values: values, idx: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	it.idx++
+	return it.idx < len(it.keys)
+}
+
+func (it *sliceIterator) Key() uint64 {
+	return it.keys[it.idx]
+}
+
+func (it *sliceIterator) Value() []byte {
+	return it.values[it.idx]
+}
+
+func (it *sliceIterator) Err() error {
+	return it.err
+}
+
+// bulkItems returns ascending keys starting at 1, with the values expected by
+// assertTreeKeys.
+func bulkItems(n int) ([]uint64, [][]byte) {
+	keys := make([]uint64, n)
+	util.FillAsc(keys, 1)
+	values := make([][]byte, n)
+	for i, key := range keys {
+		value := [10]byte{byte(key)}
+		values[i] = value[:]
+	}
+
+	return keys, values
+}
+
+// assertMinFill asserts that no node below the given internal node underflows.
+func assertMinFill(t *testing.T, tree *BTree, node *INodePage) {
+	t.Helper()
+
+	for _, id := range node.pages[:*node.numKeys+1] {
+		page, err := tree.bufferPool.FetchPage(id)
+		if err != nil {
+			t.Fatalf("Error fetching page %d: %v", id, err)
+		}
+
+		leaf, child := RawNodeFrom(page)
+		if leaf != nil && leaf.isUnderflowing() {
+			t.Errorf("Expected leaf %d to hold at least %d keys; got %d", id, MinLeafKeys, *leaf.numKeys)
+		}
+		if child != nil {
+			if child.isUnderflowing() {
+				t.Errorf("Expected internal node %d to hold at least %d keys; got %d", id, MinInternalKeys, *child.numKeys)
+			}
+			assertMinFill(t, tree, child)
+		}
+		tree.bufferPool.UnpinPage(id, false)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	sizes := []int{1, 2, NumLeafKeys, NumLeafKeys + 1, 3*NumLeafKeys - 1, 50_000}
+	for _, fillFactor := range []float64{0.5, 0.7, 1} {
+		for _, n := range sizes {
+			t.Run(fmt.Sprintf("%v/%d", fillFactor, n), func(t *testing.T) {
+				tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, BulkLoadFillFactor: fillFactor})
+
+				keys, values := bulkItems(n)
+				if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+					t.Fatalf("Error bulk loading: %v", err)
+				}
+				assertTreeKeys(t, tree, keys)
+				if n >= 2*MinLeafKeys {
+					// Fewer items don't fill the two leaves
+					// below the root.
+					assertMinFill(t, tree, tree.root)
+				}
+
+				// The loaded tree must be modifiable as any other.
+				for _, key := range keys[:n/2] {
+					if err := tree.Delete(key); err != nil {
+						t.Fatalf("Error deleting key %d: %v", key, err)
+					}
+				}
+				extra := uint64(n + 1)
+				if err := tree.Put(extra, [10]byte{byte(extra)}); err != nil {
+					t.Fatalf("Error putting key %d: %v", extra, err)
+				}
+				if err := tree.Close(); err != nil {
+					t.Fatalf("Error closing tree: %v", err)
+				}
+
+				tree = &BTree{}
+				if err := tree.Open(config); err != nil {
+					t.Fatalf("Error opening tree: %v", err)
+				}
+				defer tree.Close()
+				assertTreeKeys(t, tree, append(keys[n/2:], extra))
+			})
+		}
+	}
+}
+
+func TestBulkLoadFillsNodes(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, BulkLoadFillFactor: 1})
+	defer tree.Close()
+
+	keys, values := bulkItems(10 * NumLeafKeys)
+	if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+		t.Fatalf("Error bulk loading: %v", err)
+	}
+
+	// Ten full leaves below the root, all pages of the initial tree
+	// having been freed.
+	if *tree.root.numKeys != 9 {
+		t.Errorf("Expected root with 9 keys; got %d", *tree.root.numKeys)
+	}
+	if occupied := tree.bufferPool.disk.Occupied(); occupied != 11 {
+		t.Errorf("Expected 11 occupied pages; got %d", occupied)
+	}
+}
+
+func TestBulkLoadOverflowValues(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, BulkLoadFillFactor: 0})
+	defer tree.Close()
+
+	keys, values := bulkItems(1_000)
+	for i := range values {
+		if i%100 == 0 {
+			values[i] = randomBytes(2*OverflowDataSize, int64(i))
+		}
+	}
+	if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+		t.Fatalf("Error bulk loading: %v", err)
+	}
+
+	for i, key := range keys {
+		value, err := tree.GetBytes(key)
+		if err != nil {
+			t.Fatalf("Error getting key %d: %v", key, err)
+		}
+		if !bytes.Equal(value, values[i]) {
+			t.Fatalf("Got wrong value for key %d", key)
+		}
+	}
+}
+
+func TestBulkLoadRejectsInvalidInput(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []uint64
+		err  error
+	}{
+		{"Unsorted", []uint64{1, 2, 4, 3}, nil},
+		{"Duplicate", []uint64{1, 2, 2, 3}, nil},
+		{"IteratorError", []uint64{1, 2, 3}, errors.New("broken")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, BulkLoadFillFactor: 0})
+			defer tree.Close()
+			occupied := tree.bufferPool.disk.Occupied()
+
+			// Enough items to span multiple leaves, followed by the
+			// invalid ones, some of them stored in overflow pages.
+			keys, values := bulkItems(3 * NumLeafKeys)
+			for _, key := range test.keys {
+				keys = append(keys, uint64(3*NumLeafKeys)+key)
+				values = append(values, randomBytes(OverflowDataSize, int64(key)))
+			}
+			iter := newSliceIterator(keys, values)
+			iter.err = test.err
+
+			if err := tree.BulkLoad(iter); err == nil {
+				t.Fatalf("Expected error bulk loading invalid input; got none")
+			}
+			assertTreeKeys(t, tree, nil)
+			if tree.bufferPool.disk.Occupied() != occupied {
+				t.Errorf("Expected %d occupied pages after failing; got %d", occupied, tree.bufferPool.disk.Occupied())
+			}
+		})
+	}
+}
+
+func TestBulkLoadRequiresEmptyTree(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, BulkLoadFillFactor: 0})
+	defer tree.Close()
+
+	if err := tree.Put(42, [10]byte{42}); err != nil {
+		t.Fatalf("Error putting key: %v", err)
+	}
+	keys, values := bulkItems(10)
+	if err := tree.BulkLoad(newSliceIterator(keys, values)); err == nil {
+		t.Errorf("Expected error bulk loading non-empty tree; got none")
+	}
+
+	// Once emptied again, it may be loaded.
+	if err := tree.Delete(42); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+	if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+		t.Errorf("Error bulk loading emptied tree: %v", err)
+	}
+	assertTreeKeys(t, tree, keys)
+}
+
+func TestBulkLoadWithWAL(t *testing.T) {
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: false})
+
+	keys, values := bulkItems(20_000)
+	if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+		t.Fatalf("Error bulk loading: %v", err)
+	}
+	extra := uint64(20_001)
+	if err := tree.Put(extra, [10]byte{byte(extra)}); err != nil {
+		t.Fatalf("Error putting key: %v", err)
+	}
+
+	tree = crashAndRecover(t, tree, config)
+	defer tree.Close()
+
+	assertTreeKeys(t, tree, append(keys, extra))
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	keys, values := bulkItems(100_000)
+
+	for i := 0; i < b.N; i++ {
+		kv, _ := helper.GetEmptyInstanceWithMemoryLimit(1024 * PageSize)
+		tree := kv.(*BTree)
+		if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+			b.Fatalf("Error bulk loading: %v", err)
+		}
+		tree.Close()
+	}
+}
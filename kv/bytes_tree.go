@@ -0,0 +1,713 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// bytesTreeMetaDataFile specifies the name of the file used by the BytesTree
+// to store its meta data.
+const bytesTreeMetaDataFile = "bytestree.meta"
+
+/*
+BytesTree is a B+ tree mapping keys of arbitrary bytes to values of arbitrary
+size, ordered lexicographically by key.
+
+Its nodes are SlottedPages, such that each node holds as many keys as fit into
+a page. Keys may be at most MaxKeySize bytes long, values larger than
+MaxInlineValueSize are stored in overflow pages just like those of BTree.
+
+Other than BTree, the root of a BytesTree starts as leaf and only becomes an
+internal node once the first leaf gets split. It is not kept pinned, but
+fetched for every operation.
+
+Unlike BTree, a BytesTree is not safe for concurrent use.
+*/
+type BytesTree struct {
+	bufferPool BufferPool
+	rootID     PageID
+
+	// root directory where tree is persisted to.
+	directory string
+
+	// Whether the tree can be read from. If set to false, all read/write
+	// operations will panic.
+	open bool
+
+	// When modifications are synced to stable storage, and the group
+	// commit syncing them if it's DurabilityGroupCommit.
+	durability Durability
+	group      *groupCommit
+}
+
+// Create initializes a new, empty tree in the working directory of the
+// config.
+func (t *BytesTree) Create(config KvStoreConfig) error {
+	if err := t.initBufferPool(config); err != nil {
+		return err
+	}
+
+	rootPage, err := t.bufferPool.NewPage()
+	if err != nil {
+		return fmt.Errorf("Unable to initialize tree: %v", err)
+	}
+	RawSlottedFrom(rootPage, true)
+	t.rootID = rootPage.id
+	t.bufferPool.UnpinPage(rootPage.id, true)
+
+	t.startDurability(config)
+	t.open = true
+
+	return nil
+}
+
+// Open loads an existing tree from the working directory of the config.
+func (t *BytesTree) Open(config KvStoreConfig) error {
+	if err := t.initBufferPool(config); err != nil {
+		return err
+	}
+
+	rootID, err := t.loadMetaData()
+	if err != nil {
+		return err
+	}
+	t.rootID = rootID
+
+	t.startDurability(config)
+	t.open = true
+
+	return nil
+}
+
+func (t *BytesTree) initBufferPool(config KvStoreConfig) error {
+	numberOfPages := config.MemorySize / PageSize
+	// Splitting requires the whole path from the root to a leaf pinned,
+	// plus the pages being split.
+	if numberOfPages < 5 {
+		return fmt.Errorf(
+			"Allowed memory limit of %dB only allows for %d pages; we require at least 5 concurrent pages for operation.",
+			config.MemorySize,
+			numberOfPages,
+		)
+	}
+	cacheEviction, err := NewCacheEviction(config.Eviction, numberOfPages)
+	if err != nil {
+		return err
+	}
+
+	disk, err := NewDisk(config.Storage, config.WorkingDirectory)
+	if err != nil {
+		return err
+	}
+
+	t.bufferPool = NewBufferPool(numberOfPages, disk, cacheEviction)
+	t.directory = config.WorkingDirectory
+
+	return nil
+}
+
+// Destroy deletes the directory of the tree.
+func (t *BytesTree) Destroy() error {
+	if !t.open {
+		panic("Cannot destroy closed tree")
+	}
+
+	if t.group != nil {
+		t.group.close()
+		t.group = nil
+	}
+
+	// The disk releases its files, and the lock of a single store file,
+	// before they are removed. Its pages are not flushed, as they are
+	// removed anyway.
+	closeErr := t.bufferPool.disk.Close()
+
+	err := os.RemoveAll(t.directory)
+	if err != nil {
+		return fmt.Errorf("IO error while deleting store directory: %v", err)
+	}
+
+	t.open = false
+
+	if closeErr != nil {
+		return fmt.Errorf("Error closing disk: %v", closeErr)
+	}
+
+	return nil
+}
+
+// Close persists all pages and the meta data of the tree.
+func (t *BytesTree) Close() error {
+	if !t.open {
+		panic("Cannot close closed tree")
+	}
+
+	if t.group != nil {
+		if err := t.group.close(); err != nil {
+			return err
+		}
+		t.group = nil
+	}
+
+	// Our meta data is persisted before closing the buffer pool, as the
+	// disk might be storing it.
+	if t.durability != DurabilityNone {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	} else if err := t.storeMetaData(); err != nil {
+		return err
+	}
+
+	err := t.bufferPool.Close()
+	if err != nil {
+		return fmt.Errorf("Error closing buffer pool: %v", err)
+	}
+	t.open = false
+
+	return nil
+}
+
+func (t *BytesTree) loadMetaData() (PageID, error) {
+	if disk, ok := t.bufferPool.disk.(rootStore); ok {
+		return disk.root()
+	}
+
+	data, err := os.ReadFile(filepath.Join(t.directory, bytesTreeMetaDataFile))
+	if err != nil {
+		return 0, fmt.Errorf("IO error while reading tree meta data file: %v", err)
+	}
+	if len(data) != 4 {
+		return 0, fmt.Errorf("tree meta data file has invalid size of %dB", len(data))
+	}
+
+	return PageID(binary.BigEndian.Uint32(data)), nil
+}
+
+func (t *BytesTree) storeMetaData() error {
+	return t.writeMetaData(false)
+}
+
+// writeMetaData persists the ID of the root page, and syncs it to stable
+// storage if durable is set.
+func (t *BytesTree) writeMetaData(durable bool) error {
+	return storeRoot(t.bufferPool.disk, filepath.Join(t.directory, bytesTreeMetaDataFile), t.rootID, durable)
+}
+
+func (t *BytesTree) GetDebugInformation() string {
+	return fmt.Sprintf("%T {"+
+		"\n\trootID: %d"+
+		"\n\tbufferPool:\n%s"+
+		"}",
+		t, t.rootID, t.bufferPool.GetDebugInfo(),
+	)
+}
+
+// Get retrieves the value of the item with given key. If no item with the
+// requested key exists, ErrKeyNotFound is returned.
+func (t *BytesTree) Get(key []byte) ([]byte, error) {
+	if !t.open {
+		panic("Cannot read from closed tree")
+	}
+
+	trace, leaf, err := t.traceTo(key)
+	if err != nil {
+		return nil, err
+	}
+	t.unpinTrace(trace, false)
+
+	idx, found := leaf.search(key)
+	var value leafValue
+	if found {
+		value = leaf.value(idx)
+	}
+	t.bufferPool.UnpinPage(*leaf.id, false)
+
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+
+	return t.bufferPool.loadValue(value)
+}
+
+// Put stores a new item with given key and value. If an item with the
+// requested key already exists, ErrKeyExists is returned.
+func (t *BytesTree) Put(key []byte, value []byte) error {
+	return t.storeAndInsert(key, value, false)
+}
+
+// Upsert stores an item with given key and value. If an item with the
+// requested key already exists, its value is replaced.
+func (t *BytesTree) Upsert(key []byte, value []byte) error {
+	return t.storeAndInsert(key, value, true)
+}
+
+// storeAndInsert stores a value of arbitrary size, and inserts it into the
+// tree. If inserting fails, the stored value gets freed again.
+func (t *BytesTree) storeAndInsert(key []byte, value []byte, overwrite bool) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	stored, err := t.bufferPool.storeValue(value)
+	if err != nil {
+		return err
+	}
+
+	err = t.insert(key, stored, overwrite)
+	if err != nil {
+		t.bufferPool.freeValue(stored)
+		return err
+	}
+
+	return t.commit()
+}
+
+// insert inserts a key-value pair into the tree, splitting nodes as
+// required. If the key exists already, its value is either replaced or
+// ErrKeyExists is returned, depending on overwrite.
+func (t *BytesTree) insert(key []byte, value leafValue, overwrite bool) error {
+	trace, leaf, err := t.traceTo(key)
+	if err != nil {
+		return err
+	}
+
+	idx, found := leaf.search(key)
+	if found {
+		var old leafValue
+		if overwrite {
+			old = leaf.value(idx)
+			leaf.setValue(idx, value)
+		}
+
+		// Cleanup
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*leaf.id, overwrite)
+
+		if !overwrite {
+			return ErrKeyExists
+		}
+		return t.bufferPool.freeValue(old)
+	}
+
+	cell := leafCell(key, value)
+	if leaf.insertCell(idx, cell) {
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*leaf.id, true)
+		return nil
+	}
+
+	return t.split(trace, leaf, idx, cell)
+}
+
+// traceTo finds the leaf which may contain the given key. All internal nodes
+// on the way from the root to the leaf are returned as trace, and stay pinned
+// along with the leaf.
+func (t *BytesTree) traceTo(key []byte) ([]*SlottedPage, *SlottedPage, error) {
+	var trace []*SlottedPage
+
+	for id := t.rootID; ; {
+		page, err := t.bufferPool.FetchPage(id)
+		if err != nil {
+			t.unpinTrace(trace, false)
+			return nil, nil, err
+		}
+
+		node, err := RawSlottedNodeFrom(page)
+		if err != nil {
+			t.bufferPool.UnpinPage(page.id, false)
+			t.unpinTrace(trace, false)
+			return nil, nil, err
+		}
+
+		if node.isLeaf() {
+			return trace, node, nil
+		}
+
+		trace = append(trace, node)
+		id = node.child(node.childIndex(key))
+	}
+}
+
+// unpinTrace unpins all internal nodes of a trace.
+func (t *BytesTree) unpinTrace(trace []*SlottedPage, isDirty bool) {
+	for _, internal := range trace {
+		t.bufferPool.UnpinPage(*internal.id, isDirty)
+	}
+}
+
+// split inserts a cell which does not fit into a full node at the given
+// index, by moving the lower half of its cells into a new left sibling.
+// The node itself keeps the upper half, such that the reference of its parent
+// remains valid, and only a separator for the new left sibling has to be
+// inserted into the parent. This may split the parent in turn.
+//
+// All pages of the trace and the node itself get unpinned.
+func (t *BytesTree) split(trace []*SlottedPage, node *SlottedPage, idx uint16, cell []byte) error {
+	cells := node.cells()
+	cells = append(cells, nil)
+	copy(cells[idx+1:], cells[idx:])
+	cells[idx] = cell
+
+	leftPage, err := t.bufferPool.NewPage()
+	if err != nil {
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*node.id, false)
+		return err
+	}
+	// Link the left sibling to the new node before modifying any other,
+	// such that failing to do so leaves the tree unchanged.
+	if node.isLeaf() && *node.leftSibling != NoSibling {
+		if err := t.relink(*node.leftSibling, leftPage.id); err != nil {
+			t.bufferPool.UnpinAndDeletePage(leftPage.id)
+			t.unpinTrace(trace, false)
+			t.bufferPool.UnpinPage(*node.id, false)
+			return err
+		}
+	}
+	left := RawSlottedFrom(leftPage, node.isLeaf())
+
+	m := splitPoint(cells, node.isLeaf())
+	var separator []byte
+	if node.isLeaf() {
+		left.appendCells(cells[:m])
+		node.reset()
+		node.appendCells(cells[m:])
+		separator = cellKey(cells[m-1])
+
+		*left.leftSibling = *node.leftSibling
+		*left.link = *node.id
+		*node.leftSibling = *left.id
+	} else {
+		// The middle cell moves up, its child becoming the rightmost
+		// child of the left node.
+		left.appendCells(cells[:m])
+		*left.link = cellChild(cells[m])
+		separator = cellKey(cells[m])
+		node.reset()
+		node.appendCells(cells[m+1:])
+	}
+
+	separatorCell := internalCell(separator, *left.id)
+	t.bufferPool.UnpinPage(*left.id, true)
+
+	if len(trace) == 0 {
+		return t.createNewRoot(separatorCell, node)
+	}
+
+	last := len(trace) - 1
+	parent := trace[last]
+	parentIdx, ok := parent.indexOf(*node.id)
+	t.bufferPool.UnpinPage(*node.id, true)
+	if !ok {
+		t.unpinTrace(trace, false)
+		return fmt.Errorf("page %d is not referenced by its parent %d", *node.id, *parent.id)
+	}
+
+	if parent.insertCell(parentIdx, separatorCell) {
+		t.unpinTrace(trace, true)
+		return nil
+	}
+
+	return t.split(trace[:last], parent, parentIdx, separatorCell)
+}
+
+// splitPoint returns the index at which cells get split into two nodes of
+// roughly equal size. Leaf cells at and above the index go right. For
+// internal nodes, the cell at the index moves up to the parent, such that
+// both nodes keep at least one cell.
+func splitPoint(cells [][]byte, isLeaf bool) int {
+	total := 0
+	for _, cell := range cells {
+		total += slotSize + len(cell)
+	}
+
+	m, size := 0, 0
+	for size < total/2 {
+		size += slotSize + len(cells[m])
+		m++
+	}
+
+	upper := len(cells) - 1
+	if !isLeaf {
+		upper--
+	}
+	if m < 1 {
+		m = 1
+	}
+	if m > upper {
+		m = upper
+	}
+
+	return m
+}
+
+// relink sets the right sibling of the leaf with the given PageID.
+func (t *BytesTree) relink(id PageID, rightSibling PageID) error {
+	page, err := t.bufferPool.FetchPage(id)
+	if err != nil {
+		return err
+	}
+
+	*RawSlottedFrom(page, true).link = rightSibling
+	t.bufferPool.UnpinPage(id, true)
+
+	return nil
+}
+
+// createNewRoot creates a new root above the split previous root, which keeps
+// the upper half of the cells. The previous root gets unpinned.
+func (t *BytesTree) createNewRoot(separatorCell []byte, previous *SlottedPage) error {
+	t.bufferPool.UnpinPage(*previous.id, true)
+
+	rootPage, err := t.bufferPool.NewPage()
+	if err != nil {
+		return err
+	}
+
+	root := RawSlottedFrom(rootPage, false)
+	root.insertCell(0, separatorCell)
+	*root.link = *previous.id
+	t.rootID = rootPage.id
+	t.bufferPool.UnpinPage(rootPage.id, true)
+
+	return nil
+}
+
+// Delete removes the item with given key. If no item with the requested key
+// exists, ErrKeyNotFound is returned.
+//
+// Nodes using less than a quarter of their page after the deletion get merged
+// with a sibling if both fit into a single page, or balanced with it otherwise. Pages freed by merging are
+// returned to the buffer pool, such that the disk may recycle them.
+func (t *BytesTree) Delete(key []byte) error {
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+
+	trace, leaf, err := t.traceTo(key)
+	if err != nil {
+		return err
+	}
+
+	idx, found := leaf.search(key)
+	if !found {
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*leaf.id, false)
+		return ErrKeyNotFound
+	}
+
+	value := leaf.value(idx)
+	leaf.removeCell(idx)
+
+	if err := t.rebalance(trace, leaf); err != nil {
+		return err
+	}
+	if err := t.bufferPool.freeValue(value); err != nil {
+		return err
+	}
+
+	return t.commit()
+}
+
+// rebalance merges an underflowing node with a sibling, if both fit into a
+// single page. Otherwise, the cells of both get redistributed. The cells of the left one of both nodes are moved into the
+// right one, such that only the separator of the left node has to be removed
+// from the parent. This may in turn cause the parent to underflow.
+//
+// All pages of the trace and the node itself get unpinned.
+func (t *BytesTree) rebalance(trace []*SlottedPage, node *SlottedPage) error {
+	if len(trace) == 0 {
+		return t.collapseRoot(node)
+	}
+
+	if !node.isUnderflowing() {
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*node.id, true)
+		return nil
+	}
+
+	last := len(trace) - 1
+	parent := trace[last]
+	idx, ok := parent.indexOf(*node.id)
+	if !ok {
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*node.id, true)
+		return fmt.Errorf("page %d is not referenced by its parent %d", *node.id, *parent.id)
+	}
+
+	if *parent.numSlots == 0 {
+		// The node has no sibling to merge with.
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*node.id, true)
+		return nil
+	}
+
+	// Pick the pair of adjacent children to merge, left being at leftIdx.
+	leftIdx := idx
+	if idx == *parent.numSlots {
+		leftIdx = idx - 1
+	}
+	siblingIdx := leftIdx
+	if siblingIdx == idx {
+		siblingIdx = idx + 1
+	}
+
+	siblingPage, err := t.bufferPool.FetchPage(parent.child(siblingIdx))
+	if err != nil {
+		t.unpinTrace(trace, false)
+		t.bufferPool.UnpinPage(*node.id, true)
+		return err
+	}
+	sibling := RawSlottedFrom(siblingPage, node.isLeaf())
+
+	left, right := node, sibling
+	if siblingIdx < idx {
+		left, right = sibling, node
+	}
+
+	cells := left.cells()
+	if !node.isLeaf() {
+		cells = append(cells, internalCell(parent.key(leftIdx), *left.link))
+	}
+	cells = append(cells, right.cells()...)
+
+	size := 0
+	for _, cell := range cells {
+		size += slotSize + len(cell)
+	}
+	if size > SlottedCapacity {
+		// Both nodes are too large to be merged, balance them instead.
+		t.redistribute(parent, leftIdx, left, right, cells)
+		t.unpinTrace(trace, true)
+		t.bufferPool.UnpinPage(*left.id, true)
+		t.bufferPool.UnpinPage(*right.id, true)
+		return nil
+	}
+
+	// Link the left sibling to the merged node before modifying any other,
+	// such that failing to do so leaves the tree unchanged.
+	if node.isLeaf() && *left.leftSibling != NoSibling {
+		if err := t.relink(*left.leftSibling, *right.id); err != nil {
+			t.unpinTrace(trace, false)
+			t.bufferPool.UnpinPage(*left.id, left == node)
+			t.bufferPool.UnpinPage(*right.id, right == node)
+			return err
+		}
+	}
+
+	right.reset()
+	right.appendCells(cells)
+	if node.isLeaf() {
+		*right.leftSibling = *left.leftSibling
+	}
+	parent.removeCell(leftIdx)
+
+	t.bufferPool.UnpinPage(*right.id, true)
+	if err := t.bufferPool.UnpinAndDeletePage(*left.id); err != nil {
+		return err
+	}
+
+	return t.rebalance(trace[:last], parent)
+}
+
+// redistribute spreads the combined cells of two adjacent nodes evenly
+// between both, replacing their separator in the parent. If the new separator
+// does not fit into the parent, the nodes are left as they are.
+func (t *BytesTree) redistribute(parent *SlottedPage, leftIdx uint16, left, right *SlottedPage, cells [][]byte) {
+	m := splitPoint(cells, left.isLeaf())
+	separator := cellKey(cells[m])
+	if left.isLeaf() {
+		separator = cellKey(cells[m-1])
+	}
+
+	separatorCell := internalCell(separator, *left.id)
+	if parent.usedSpace()-len(parent.cell(leftIdx))+len(separatorCell) > SlottedCapacity {
+		return
+	}
+	parent.removeCell(leftIdx)
+	parent.insertCell(leftIdx, separatorCell)
+
+	left.reset()
+	right.reset()
+	if left.isLeaf() {
+		left.appendCells(cells[:m])
+		right.appendCells(cells[m:])
+	} else {
+		left.appendCells(cells[:m])
+		*left.link = cellChild(cells[m])
+		right.appendCells(cells[m+1:])
+	}
+}
+
+// collapseRoot replaces an internal root without any keys by its only child.
+// The root gets unpinned.
+func (t *BytesTree) collapseRoot(root *SlottedPage) error {
+	if root.isLeaf() || *root.numSlots > 0 {
+		t.bufferPool.UnpinPage(*root.id, true)
+		return nil
+	}
+
+	t.rootID = *root.link
+
+	return t.bufferPool.UnpinAndDeletePage(*root.id)
+}
+
+// Scan calls fn for each item with a key in the inclusive range [from, to], in
+// ascending key order. If to is nil, the range has no upper bound. Scanning
+// stops early if fn returns false.
+//
+// Only the current leaf is pinned while scanning, leaves being walked via
+// their sibling links. The key passed to fn must not be retained.
+func (t *BytesTree) Scan(from, to []byte, fn func(key []byte, value []byte) bool) error {
+	if !t.open {
+		panic("Cannot read from closed tree")
+	}
+
+	trace, leaf, err := t.traceTo(from)
+	if err != nil {
+		return err
+	}
+	t.unpinTrace(trace, false)
+
+	idx, _ := leaf.search(from)
+	for {
+		for ; idx < *leaf.numSlots; idx++ {
+			key := leaf.key(idx)
+			if to != nil && bytes.Compare(key, to) > 0 {
+				t.bufferPool.UnpinPage(*leaf.id, false)
+				return nil
+			}
+
+			value, err := t.bufferPool.loadValue(leaf.value(idx))
+			if err != nil {
+				t.bufferPool.UnpinPage(*leaf.id, false)
+				return err
+			}
+
+			if !fn(key, value) {
+				t.bufferPool.UnpinPage(*leaf.id, false)
+				return nil
+			}
+		}
+
+		next := *leaf.link
+		t.bufferPool.UnpinPage(*leaf.id, false)
+		if next == NoSibling {
+			return nil
+		}
+
+		page, err := t.bufferPool.FetchPage(next)
+		if err != nil {
+			return err
+		}
+		leaf = RawSlottedFrom(page, true)
+		idx = 0
+	}
+}
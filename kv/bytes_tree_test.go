@@ -0,0 +1,278 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// emptyBytesTree creates a new BytesTree with the given memory limit. It
+// also returns its working directory.
+func emptyBytesTree(t *testing.T, memoryLimit uint) (*BytesTree, string) {
+	dir := helper.GetTempDir(t, "bytes_tree_")
+
+	tree := &BytesTree{}
+	err := tree.Create(KvStoreConfig{
+		MemorySize:       memoryLimit,
+		WorkingDirectory: dir,
+	})
+	if err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+
+	return tree, dir
+}
+
+// stringKeys returns n distinct keys of varying length in random order.
+func stringKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("user:%d:%s", i, bytes.Repeat([]byte{'x'}, i%37)))
+	}
+	rand.New(rand.NewSource(int64(n))).Shuffle(n, func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+
+	return keys
+}
+
+// valueOf returns a short value derived from a key, which is stored inline.
+func valueOf(key []byte) []byte {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, crc32.ChecksumIEEE(key))
+
+	return value
+}
+
+func TestBytesTreePutAndGet(t *testing.T) {
+	tree, _ := emptyBytesTree(t, PageSize*1_000)
+
+	keys := stringKeys(20_000)
+	for _, key := range keys {
+		err := tree.Put(key, valueOf(key))
+		if err != nil {
+			t.Fatalf("Error putting key %q: %v", key, err)
+		}
+	}
+
+	for _, key := range keys {
+		value, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting key %q: %v", key, err)
+		}
+		if !bytes.Equal(value, valueOf(key)) {
+			t.Errorf("Got value %q for key %q", value, key)
+		}
+	}
+
+	_, err := tree.Get([]byte("user:"))
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for missing key; got %v", err)
+	}
+
+	err = tree.Put(keys[0], []byte("other"))
+	if !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists when putting existing key; got %v", err)
+	}
+
+	err = tree.Put(make([]byte, MaxKeySize+1), nil)
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge for oversized key; got %v", err)
+	}
+}
+
+func TestBytesTreeUpsert(t *testing.T) {
+	tree, _ := emptyBytesTree(t, PageSize*100)
+
+	key := []byte("answer")
+	values := [][]byte{[]byte("41"), randomBytes(2*PageSize, 1), []byte("42")}
+	for _, value := range values {
+		err := tree.Upsert(key, value)
+		if err != nil {
+			t.Fatalf("Error upserting key: %v", err)
+		}
+
+		got, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting key: %v", err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("Got %dB value; expected %dB", len(got), len(value))
+		}
+	}
+}
+
+func TestBytesTreeLargeKeys(t *testing.T) {
+	tree, _ := emptyBytesTree(t, PageSize*100)
+
+	// Keys of maximum size only fit four to a page, and differ in their
+	// last byte only.
+	keys := make([][]byte, 200)
+	for i := range keys {
+		keys[i] = bytes.Repeat([]byte{'k'}, MaxKeySize)
+		keys[i][MaxKeySize-1] = byte(i)
+		if err := tree.Put(keys[i], []byte{byte(i)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", i, err)
+		}
+	}
+
+	for i, key := range keys {
+		value, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting key %d: %v", i, err)
+		}
+		if !bytes.Equal(value, []byte{byte(i)}) {
+			t.Errorf("Got value %v for key %d", value, i)
+		}
+	}
+
+	for i, key := range keys {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", i, err)
+		}
+	}
+	// All merges should have collapsed the tree into a single, empty leaf.
+	if pages := tree.bufferPool.pageTable.len(); pages != 1 {
+		t.Errorf("Expected a single page to remain; got %d", pages)
+	}
+}
+
+func TestBytesTreeScan(t *testing.T) {
+	tree, _ := emptyBytesTree(t, PageSize*1_000)
+
+	keys := stringKeys(5_000)
+	for _, key := range keys {
+		if err := tree.Put(key, valueOf(key)); err != nil {
+			t.Fatalf("Error putting key %q: %v", key, err)
+		}
+	}
+
+	sorted := append([][]byte(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	var scanned [][]byte
+	err := tree.Scan(nil, nil, func(key, value []byte) bool {
+		if !bytes.Equal(value, valueOf(key)) {
+			t.Errorf("Got value %q for key %q", value, key)
+		}
+		scanned = append(scanned, append([]byte(nil), key...))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Error scanning: %v", err)
+	}
+	if len(scanned) != len(sorted) {
+		t.Fatalf("Scanned %d keys; expected %d", len(scanned), len(sorted))
+	}
+	for i := range sorted {
+		if !bytes.Equal(scanned[i], sorted[i]) {
+			t.Fatalf("Scanned key %q at position %d; expected %q", scanned[i], i, sorted[i])
+		}
+	}
+
+	from, to := sorted[100], sorted[199]
+	count := 0
+	err = tree.Scan(from, to, func(key, value []byte) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Error scanning range: %v", err)
+	}
+	if count != 100 {
+		t.Errorf("Scanned %d keys in range; expected 100", count)
+	}
+}
+
+func TestBytesTreeDelete(t *testing.T) {
+	tree, _ := emptyBytesTree(t, PageSize*1_000)
+
+	keys := stringKeys(20_000)
+	for _, key := range keys {
+		if err := tree.Put(key, valueOf(key)); err != nil {
+			t.Fatalf("Error putting key %q: %v", key, err)
+		}
+	}
+	allocated := tree.bufferPool.pageTable.len()
+
+	kept := keys[:100]
+	for _, key := range keys[100:] {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %q: %v", key, err)
+		}
+	}
+
+	if err := tree.Delete(keys[100]); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound when deleting missing key; got %v", err)
+	}
+
+	for _, key := range kept {
+		if _, err := tree.Get(key); err != nil {
+			t.Errorf("Error getting remaining key %q: %v", key, err)
+		}
+	}
+	for _, key := range keys[100:200] {
+		if _, err := tree.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for deleted key %q; got %v", key, err)
+		}
+	}
+
+	remaining := tree.bufferPool.pageTable.len()
+	if remaining*10 > allocated {
+		t.Errorf("Expected merges to free most pages; %d of %d pages remain", remaining, allocated)
+	}
+
+	for _, key := range kept {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %q: %v", key, err)
+		}
+	}
+	err := tree.Scan(nil, nil, func(key, value []byte) bool {
+		t.Errorf("Found key %q in emptied tree", key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Error scanning: %v", err)
+	}
+}
+
+func TestBytesTreeSurvivesReopen(t *testing.T) {
+	tree, dir := emptyBytesTree(t, PageSize*16)
+
+	keys := stringKeys(5_000)
+	for _, key := range keys {
+		if err := tree.Put(key, valueOf(key)); err != nil {
+			t.Fatalf("Error putting key %q: %v", key, err)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Error closing tree: %v", err)
+	}
+
+	reopened := &BytesTree{}
+	err := reopened.Open(KvStoreConfig{
+		MemorySize:       PageSize * 16,
+		WorkingDirectory: dir,
+	})
+	if err != nil {
+		t.Fatalf("Error opening tree: %v", err)
+	}
+
+	for _, key := range keys {
+		value, err := reopened.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting key %q after reopening: %v", key, err)
+		}
+		if !bytes.Equal(value, valueOf(key)) {
+			t.Errorf("Got value %q for key %q after reopening", value, key)
+		}
+	}
+}
@@ -1,5 +1,23 @@
 package kv
 
+import (
+	"container/list"
+	"fmt"
+)
+
+/*
+CacheEviction elects the frames of a BufferPool whose pages get evicted.
+
+A frame is eligible for eviction between being added and being removed again.
+Frames get removed when their page gets pinned, so removing a frame which holds
+a page counts as reference to that page. Policies which track the history of
+pages rather than frames learn which page a frame holds through Load.
+
+Policies may keep frames which are not eligible in their queues, rather than
+dropping their history, as long as Victim skips them.
+
+Implementations must be safe for concurrent use.
+*/
 type CacheEviction interface {
 	// Victim elects a victim to evict.
 	Victim() *FrameID
@@ -7,4 +25,96 @@ type CacheEviction interface {
 	Remove(FrameID)
 	// Add a frame for eviction election.
 	Add(FrameID)
+	// Load tells that a page got loaded into a frame, which is pinned and
+	// thus not eligible for eviction yet.
+	Load(FrameID, PageID)
+}
+
+// EvictionPolicy selects the CacheEviction used by the buffer pool of a KV
+// store.
+type EvictionPolicy uint8
+
+const (
+	// EvictLRU evicts the least recently used page.
+	EvictLRU EvictionPolicy = iota
+	// EvictCLOCK approximates LRU by giving pages a second chance, using a
+	// single reference bit per frame.
+	EvictCLOCK
+	// EvictLRUK evicts the page whose second most recent reference is the
+	// oldest, such that pages referenced only once are evicted first.
+	EvictLRUK
+	// Evict2Q keeps pages referenced once in a FIFO queue, and only
+	// promotes them to an LRU queue if they are referenced again after
+	// having been evicted.
+	Evict2Q
+	// EvictARC adaptively balances between recency and frequency of
+	// references.
+	EvictARC
+)
+
+// String returns the name of the policy.
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "LRU"
+	case EvictCLOCK:
+		return "CLOCK"
+	case EvictLRUK:
+		return "LRU-K"
+	case Evict2Q:
+		return "2Q"
+	case EvictARC:
+		return "ARC"
+	}
+
+	return fmt.Sprintf("EvictionPolicy(%d)", uint8(p))
+}
+
+// NewCacheEviction creates the CacheEviction of the given policy for a buffer
+// pool with the given number of frames.
+func NewCacheEviction(policy EvictionPolicy, size uint) (CacheEviction, error) {
+	switch policy {
+	case EvictLRU:
+		c := NewLRUCache(size)
+		return &c, nil
+	case EvictCLOCK:
+		c := NewClockCache(size)
+		return &c, nil
+	case EvictLRUK:
+		c := NewLRUKCache(size)
+		return &c, nil
+	case Evict2Q:
+		c := NewTwoQueueCache(size)
+		return &c, nil
+	case EvictARC:
+		c := NewARCCache(size)
+		return &c, nil
+	}
+
+	return nil, fmt.Errorf("Unknown eviction policy %v", policy)
+}
+
+// queuedFrame is the state of a frame tracked in one of the queues of a
+// CacheEviction.
+type queuedFrame struct {
+	id FrameID
+	// Page loaded into the frame, if loaded is set.
+	page     PageID
+	loaded   bool
+	eligible bool
+	// Queue the frame is in, and its position therein.
+	queue   *list.List
+	element *list.Element
+}
+
+// oldestEligible returns the eligible frame closest to the back of a queue of
+// queuedFrames, or nil if none is eligible.
+func oldestEligible(queue *list.List) *queuedFrame {
+	for e := queue.Back(); e != nil; e = e.Prev() {
+		if f := e.Value.(*queuedFrame); f.eligible {
+			return f
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,284 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+pageCapture tracks the pages modified by an operation on a BufferPool.
+
+If holding, pages unpinned as dirty while capturing are held, meaning the
+buffer pool keeps them pinned until the capture is released. This ensures that
+no modification reaches the disk before the operation has been logged. Pages
+allocated while capturing are exempt, as no page on disk references them
+before then. They are copied whenever unpinned as dirty instead, such that they
+can be evicted, and values larger than the buffer pool can be logged.
+
+If undoing, a copy of each page is taken the first time it gets fetched while
+capturing, such that all modifications may be reverted with revertCapture.
+
+Deallocations are deferred until the capture gets released in either case, as
+deallocated pages could not be restored otherwise.
+*/
+type pageCapture struct {
+	holding bool
+	held    map[PageID]bool
+	order   []PageID
+	// Copies of pages allocated while holding, as of when they were last
+	// unpinned as dirty, or nil if they were not yet.
+	images map[PageID]*Page
+
+	// Copies of pages as of their first fetch while capturing. Pages
+	// allocated while capturing are recorded as nil.
+	undo map[PageID]*Page
+
+	allocated   []PageID
+	deallocated []PageID
+}
+
+// beginCapture starts capturing the pages modified by an operation. The
+// capture must be ended with endCapture and released with releaseCapture.
+//
+// If holding, all pre-existing pages modified by the operation must be held by
+// the buffer pool at the same time, so the buffer pool must be large enough to
+// fit them.
+func (b *BufferPool) beginCapture(holding bool, undo bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.capture = &pageCapture{
+		holding: holding,
+		held:    make(map[PageID]bool),
+		images:  make(map[PageID]*Page),
+	}
+	if undo {
+		b.capture.undo = make(map[PageID]*Page)
+	}
+	atomic.StoreInt32(&b.capturing, 1)
+}
+
+// hold holds a page which is being unpinned as dirty, if capturing. Returns
+// true if the page is newly held, in which case the pin of the caller is kept.
+// Pages allocated while capturing are copied instead of being held. The caller
+// must hold the mutex.
+func (b *BufferPool) hold(page *Page) bool {
+	if b.capture == nil || !b.capture.holding || b.capture.held[page.id] {
+		return false
+	}
+	if image, ok := b.capture.images[page.id]; ok {
+		if image == nil {
+			image = newPage(page.id)
+			b.capture.images[page.id] = image
+		}
+		*image.data = *page.data
+		return false
+	}
+
+	b.capture.held[page.id] = true
+	b.capture.order = append(b.capture.order, page.id)
+
+	return true
+}
+
+// noFrameError returns the error of failing to reserve a frame, which explains
+// the failure if the frames are taken by pages held by a capture.
+func (b *BufferPool) noFrameError() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.capture == nil || len(b.capture.held) == 0 {
+		return errors.New("unable to reserve buffer frame")
+	}
+
+	return fmt.Errorf("unable to reserve buffer frame, as %d of %d frames hold pages modified by the current operation, which must fit into the buffer pool until logged",
+		len(b.capture.held), len(b.pages))
+}
+
+// releaseHeld releases a held page ahead of its deletion. The caller must hold
+// the mutex.
+func (b *BufferPool) releaseHeld(page *Page) {
+	if b.capture == nil || !b.capture.held[page.id] {
+		return
+	}
+
+	delete(b.capture.held, page.id)
+	page.decrementPinCount()
+}
+
+// recordAllocation records a page allocated while capturing. The caller must
+// hold the mutex.
+func (b *BufferPool) recordAllocation(page *Page) {
+	if b.capture == nil {
+		return
+	}
+
+	b.capture.allocated = append(b.capture.allocated, page.id)
+	if b.capture.holding {
+		b.capture.images[page.id] = nil
+	}
+	if b.capture.undo != nil {
+		b.capture.undo[page.id] = nil
+	}
+}
+
+// recordUndo takes a copy of a page fetched while capturing, unless it has
+// been taken already or the page was allocated while capturing.
+func (b *BufferPool) recordUndo(page *Page) {
+	if !b.isCapturing() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.capture == nil || b.capture.undo == nil {
+		return
+	}
+	if _, ok := b.capture.undo[page.id]; ok {
+		return
+	}
+
+	image := newPage(page.id)
+	*image.data = *page.data
+	b.capture.undo[page.id] = image
+}
+
+// deallocate deallocates a page on disk, deferring it until the capture gets
+// released if capturing. The caller must hold the mutex.
+func (b *BufferPool) deallocate(pageID PageID) {
+	if b.capture != nil {
+		b.capture.deallocated = append(b.capture.deallocated, pageID)
+		return
+	}
+
+	b.disk.DeallocatePage(pageID)
+}
+
+// endCapture returns a record holding copies of all pages modified since the
+// capture began, taken from the copies of the capture for allocated pages
+// which are not cached anymore. The root of the record is left to the caller.
+func (b *BufferPool) endCapture() *walRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	record := &walRecord{
+		allocated:   b.capture.allocated,
+		deallocated: b.capture.deallocated,
+	}
+
+	deallocated := make(map[PageID]bool, len(b.capture.deallocated))
+	for _, id := range b.capture.deallocated {
+		deallocated[id] = true
+	}
+
+	seen := make(map[PageID]bool)
+	for _, ids := range [][]PageID{b.capture.order, b.capture.allocated} {
+		for _, id := range ids {
+			page, ok := b.pageTable.get(id)
+			if !ok {
+				page = b.capture.images[id]
+			}
+			if seen[id] || deallocated[id] || page == nil {
+				continue
+			}
+			seen[id] = true
+
+			image := newPage(id)
+			*image.data = *page.data
+			record.pages = append(record.pages, image)
+		}
+	}
+
+	return record
+}
+
+/*
+revertCapture restores all pages fetched while capturing to their state when
+first fetched, and drops all pages allocated while capturing. Deferred
+deallocations of pre-existing pages are cancelled.
+
+Afterwards the capture only records the allocation and deallocation of the
+dropped pages, such that the disk ends up in a consistent state once the
+capture gets released.
+
+Pages which are still pinned by the caller stay pinned. Pages held by the
+capture get released.
+
+Returns an error if a page which is not cached anymore could not be restored on
+disk.
+*/
+func (b *BufferPool) revertCapture() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	capture := b.capture
+
+	for _, id := range capture.order {
+		page, ok := b.pageTable.get(id)
+		if !ok || !capture.held[id] {
+			continue
+		}
+
+		b.unpin(page, false)
+	}
+	capture.held = make(map[PageID]bool)
+	capture.order = nil
+
+	for _, id := range capture.allocated {
+		if page, ok := b.pageTable.get(id); ok {
+			b.drop(page.frameID)
+		}
+	}
+
+	var errs []error
+	for id, image := range capture.undo {
+		if image == nil {
+			continue
+		}
+
+		if page, ok := b.pageTable.get(id); ok {
+			*page.data = *image.data
+			page.isDirty = true
+			continue
+		}
+
+		// The page got either evicted or deleted, in which case it is still
+		// allocated on disk, as deallocation got deferred.
+		if err := b.disk.WritePage(image); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	capture.deallocated = append([]PageID(nil), capture.allocated...)
+
+	if len(errs) != 0 {
+		return fmt.Errorf("Errors while restoring pages: %v", errs)
+	}
+
+	return nil
+}
+
+// releaseCapture unpins all pages held by the capture, and performs the
+// deferred deallocations.
+func (b *BufferPool) releaseCapture() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	capture := b.capture
+	b.capture = nil
+	atomic.StoreInt32(&b.capturing, 0)
+
+	for _, id := range capture.order {
+		if !capture.held[id] {
+			continue
+		}
+		if page, ok := b.pageTable.get(id); ok {
+			b.unpin(page, true)
+		}
+	}
+	for _, id := range capture.deallocated {
+		b.disk.DeallocatePage(id)
+	}
+}
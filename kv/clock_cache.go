@@ -0,0 +1,83 @@
+package kv
+
+import "sync"
+
+/*
+ClockCache is an approximation of LRU using the CLOCK algorithm.
+
+Each frame has a reference bit, which is set whenever the frame is added. To
+elect a victim, a clock hand sweeps over all frames. Eligible frames whose bit
+is set get a second chance, their bit is cleared and the hand moves on. The
+first eligible frame with a cleared bit is the victim.
+*/
+type ClockCache struct {
+	mu       sync.Mutex
+	eligible []bool
+	ref      []bool
+	hand     int
+	// Number of eligible frames, such that sweeping over no eligible
+	// frame at all is avoided.
+	numEligible int
+}
+
+// NewClockCache creates a new ClockCache for a buffer pool with the given
+// number of frames.
+func NewClockCache(size uint) ClockCache {
+	return ClockCache{
+		eligible: make([]bool, size),
+		ref:      make([]bool, size),
+	}
+}
+
+func (c *ClockCache) Victim() *FrameID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.numEligible == 0 {
+		return nil
+	}
+
+	// At most two rounds are required, as the first one clears all bits.
+	for {
+		id := c.hand
+		c.hand = (c.hand + 1) % len(c.eligible)
+
+		if !c.eligible[id] {
+			continue
+		}
+		if c.ref[id] {
+			c.ref[id] = false
+			continue
+		}
+
+		c.eligible[id] = false
+		c.numEligible--
+		frameID := FrameID(id)
+
+		return &frameID
+	}
+}
+
+func (c *ClockCache) Remove(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.eligible[frameID] {
+		c.eligible[frameID] = false
+		c.numEligible--
+	}
+}
+
+func (c *ClockCache) Add(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.eligible[frameID] {
+		c.eligible[frameID] = true
+		c.numEligible++
+	}
+	c.ref[frameID] = true
+}
+
+// Load is a no-op, as CLOCK only tracks frames.
+func (c *ClockCache) Load(FrameID, PageID) {}
@@ -0,0 +1,206 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// concurrentValue returns the value stored for a key by TestConcurrentAccess.
+func concurrentValue(key uint64) [10]byte {
+	return [10]byte{byte(key), byte(key >> 8), byte(key >> 16)}
+}
+
+// concurrentWriter puts, updates and deletes keys congruent to worker modulo
+// numWorkers, returning the keys it left in the tree.
+func concurrentWriter(tree *BTree, worker, numWorkers uint64, numKeys uint64) (map[uint64]bool, error) {
+	rng := rand.New(rand.NewSource(int64(worker)))
+	present := make(map[uint64]bool)
+	large := randomBytes(OverflowDataSize+1, int64(worker))
+
+	for i := 0; i < 3*int(numKeys); i++ {
+		key := uint64(rng.Int63n(int64(numKeys)))*numWorkers + worker
+		var err error
+		switch {
+		case !present[key] && key%7 == 0:
+			err = tree.PutBytes(key, large)
+		case !present[key]:
+			err = tree.Put(key, concurrentValue(key))
+		case rng.Intn(3) == 0 && key%7 != 0:
+			err = tree.Update(key, concurrentValue(key))
+		default:
+			err = tree.Delete(key)
+			present[key] = false
+			if err != nil {
+				return nil, fmt.Errorf("Error deleting key %d: %v", key, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error writing key %d: %v", key, err)
+		}
+		present[key] = true
+	}
+
+	return present, nil
+}
+
+// concurrentReader gets random keys and scans the tree, checking that all
+// items found have the expected values and are returned in order.
+func concurrentReader(tree *BTree, seed int64, maxKey uint64, stop <-chan struct{}) error {
+	rng := rand.New(rand.NewSource(seed))
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		key := uint64(rng.Int63n(int64(maxKey)))
+		if key%7 == 0 {
+			value, err := tree.GetBytes(key)
+			if err == nil && len(value) != OverflowDataSize+1 {
+				return fmt.Errorf("Got value of %dB for key %d", len(value), key)
+			}
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return fmt.Errorf("Error getting key %d: %v", key, err)
+			}
+		} else {
+			value, err := tree.Get(key)
+			if err == nil && value != concurrentValue(key) {
+				return fmt.Errorf("Got value %v for key %d", value, key)
+			}
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return fmt.Errorf("Error getting key %d: %v", key, err)
+			}
+		}
+
+		var scanned []uint64
+		err := tree.Scan(key, key+200, func(k uint64, value [10]byte) bool {
+			scanned = append(scanned, k)
+			return true
+		})
+		if err != nil {
+			return fmt.Errorf("Error scanning: %v", err)
+		}
+		for i, k := range scanned {
+			if k < key || k > key+200 || (i > 0 && k <= scanned[i-1]) {
+				return fmt.Errorf("Scan from %d returned key %d at position %d", key, k, i)
+			}
+		}
+	}
+}
+
+// prefillConcurrent bulk loads full nodes with keys above those of the
+// workers, such that the tree is three levels high from the start and the
+// workers' inserts split its internal nodes. Returns the number of keys
+// loaded.
+func prefillConcurrent(t *testing.T, tree *BTree, from uint64) int {
+	// More leaves than a single internal node can hold.
+	numKeys := 2 * (NumInternalKeys + 1) * NumLeafKeys
+	keys := make([]uint64, numKeys)
+	values := make([][]byte, numKeys)
+	for i := range keys {
+		keys[i] = from + uint64(i)
+		value := concurrentValue(keys[i])
+		values[i] = value[:]
+	}
+
+	if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+		t.Fatalf("Error bulk loading tree: %v", err)
+	}
+
+	return numKeys
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	const numWorkers, numReaders, numKeys = 4, 4, 2_000
+
+	for _, logged := range []bool{false, true} {
+		var tree *BTree
+		if logged {
+			tree, _ = helper.GetInstance(t, KvStoreConfig{MemorySize: 64 * PageSize, DisableWriteAheadLog: false})
+		} else {
+			// Few pages force evictions while latched pages are in use.
+			tree, _ = helper.GetInstance(t, KvStoreConfig{MemorySize: 32 * PageSize, DisableWriteAheadLog: true})
+		}
+		prefilled := prefillConcurrent(t, tree, numWorkers*numKeys)
+
+		stop := make(chan struct{})
+		errs := make(chan error, numWorkers+numReaders)
+		results := make([]map[uint64]bool, numWorkers)
+
+		var readers sync.WaitGroup
+		for r := 0; r < numReaders; r++ {
+			readers.Add(1)
+			go func(seed int64) {
+				defer readers.Done()
+				if err := concurrentReader(tree, seed, numWorkers*numKeys, stop); err != nil {
+					errs <- err
+				}
+			}(int64(r))
+		}
+
+		var writers sync.WaitGroup
+		for w := 0; w < numWorkers; w++ {
+			writers.Add(1)
+			go func(worker int) {
+				defer writers.Done()
+				present, err := concurrentWriter(tree, uint64(worker), numWorkers, numKeys)
+				if err != nil {
+					errs <- err
+				}
+				results[worker] = present
+			}(w)
+		}
+
+		writers.Wait()
+		close(stop)
+		readers.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		expected := 0
+		for _, present := range results {
+			for key, ok := range present {
+				if !ok {
+					continue
+				}
+				expected++
+
+				value, err := tree.GetBytes(key)
+				if err != nil {
+					t.Fatalf("Error getting key %d: %v", key, err)
+				}
+				expectedValue := concurrentValue(key)
+				if key%7 != 0 && !bytes.Equal(value, expectedValue[:]) {
+					t.Fatalf("Got value %v for key %d", value, key)
+				}
+			}
+		}
+
+		keys, _ := tree.TraverseAll()
+		if len(keys) != expected+prefilled {
+			t.Errorf("Expected %d keys in tree; found %d", expected+prefilled, len(keys))
+		}
+		for i := 1; i < len(keys); i++ {
+			if keys[i] <= keys[i-1] {
+				t.Fatalf("Keys out of order: %d after %d", keys[i], keys[i-1])
+			}
+		}
+
+		stats, err := tree.Stats()
+		if err != nil {
+			t.Fatalf("Error getting stats: %v", err)
+		}
+		if stats.Height <= 2 {
+			t.Errorf("Expected tree to grow beyond two levels; height is %d", stats.Height)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package kv
+
+import (
+	"math"
+
+	"github.com/tobiasfamos/KVStore/search"
+)
+
+/*
+Cursor iterates over the items of a BTree in key order.
+
+A Cursor keeps a copy of the items of the leaves it is currently positioned on,
+such that it neither pins nor latches any page in between calls. Positioning
+the cursor descends from the root to a leaf, and then follows the sibling links
+to the right, copying up to cursorReadAhead leaves. The right sibling is
+latched before the latch of the current leaf is released. Moving past the end
+of the copy descends again, to the leaf holding the keys right after those of
+the copy.
+
+Moving past the start of the copy always descends from the root, as leaves are
+not latched from right to left by readers. The walk to the right stops early if
+the sibling is latched exclusively, see latch.go.
+
+A freshly created Cursor is not positioned on any item. It must be positioned
+with Seek, First or Last before Key and Value may be called. Once a Cursor has
+moved past either end of the tree it has to be repositioned again.
+
+The tree may be modified while a Cursor is positioned. Each leaf is copied in a
+consistent state, but modifications of keys the cursor has already moved past,
+or which are part of its current copy, are not seen by it.
+
+Close should be called once done, for symmetry with other resources.
+*/
+type Cursor struct {
+	tree *BTree
+
+	// Copy of the items of the current leaves, and the range of keys the
+	// first of them may contain.
+	keys   []uint64
+	values []leafValue
+	bounds leafBounds
+	// The smallest key beyond the copy, if the tree may hold any.
+	next    uint64
+	hasNext bool
+
+	idx   int
+	valid bool
+
+	err error
+}
+
+// cursorReadAhead is the number of leaves a Cursor copies at once when moving
+// forward.
+const cursorReadAhead = 4
+
+// Cursor creates a new cursor on the tree. See Cursor for details.
+func (t *BTree) Cursor() *Cursor {
+	if !t.open {
+		panic("Cannot read from closed tree")
+	}
+
+	return &Cursor{tree: t}
+}
+
+// Scan calls fn for each item with a key in the inclusive range [from, to], in
+// ascending key order. Scanning stops early if fn returns false.
+//
+// An error is returned if a page could not be fetched.
+func (t *BTree) Scan(from, to uint64, fn func(key uint64, value [10]byte) bool) error {
+	c := t.Cursor()
+	defer c.Close()
+
+	for ok := c.Seek(from); ok && c.Key() <= to; ok = c.Next() {
+		if !fn(c.Key(), c.Value()) {
+			break
+		}
+	}
+
+	return c.Err()
+}
+
+// Seek positions the cursor on the first item with a key greater or equal to
+// the given key. It returns whether such an item exists.
+func (c *Cursor) Seek(key uint64) bool {
+	for c.loadForward(key) {
+		idx, _ := search.Binary(key, c.keys)
+		if int(idx) < len(c.keys) {
+			c.idx, c.valid = int(idx), true
+			return true
+		}
+
+		// All remaining keys are larger than those of the copy.
+		if !c.hasNext {
+			break
+		}
+		key = c.next
+	}
+
+	return false
+}
+
+// seekLast positions the cursor on the last item with a key less or equal to
+// the given key. It returns whether such an item exists.
+func (c *Cursor) seekLast(key uint64) bool {
+	for c.load(key) {
+		idx := len(c.keys)
+		if key < math.MaxUint64 {
+			next, _ := search.Binary(key+1, c.keys)
+			idx = int(next)
+		}
+		if idx > 0 {
+			c.idx, c.valid = idx-1, true
+			return true
+		}
+
+		// All remaining keys are smaller than those of the leaf.
+		if !c.bounds.hasLower {
+			break
+		}
+		key = c.bounds.lower
+	}
+
+	return false
+}
+
+// First positions the cursor on the item with the smallest key. It returns
+// whether the tree contains any item.
+func (c *Cursor) First() bool {
+	return c.Seek(0)
+}
+
+// Last positions the cursor on the item with the largest key. It returns
+// whether the tree contains any item.
+func (c *Cursor) Last() bool {
+	return c.seekLast(math.MaxUint64)
+}
+
+// Next moves the cursor to the next item. It returns false if there is no
+// next item, in which case the cursor is no longer positioned.
+func (c *Cursor) Next() bool {
+	if !c.Valid() {
+		return false
+	}
+
+	if c.idx+1 < len(c.keys) {
+		c.idx++
+		return true
+	}
+
+	c.valid = false
+	if !c.hasNext {
+		return false
+	}
+
+	return c.Seek(c.next)
+}
+
+// Prev moves the cursor to the previous item. It returns false if there is no
+// previous item, in which case the cursor is no longer positioned.
+//
+// Unlike Next, moving past the start of the copy descends from the root to
+// the previous leaf, rather than following the sibling link.
+func (c *Cursor) Prev() bool {
+	if !c.Valid() {
+		return false
+	}
+
+	if c.idx > 0 {
+		c.idx--
+		return true
+	}
+
+	c.valid = false
+	if !c.bounds.hasLower {
+		return false
+	}
+
+	return c.seekLast(c.bounds.lower)
+}
+
+// Valid returns whether the cursor is positioned on an item.
+func (c *Cursor) Valid() bool {
+	return c.valid
+}
+
+// Key returns the key of the current item.
+func (c *Cursor) Key() uint64 {
+	if !c.Valid() {
+		panic("Cannot read key from unpositioned cursor")
+	}
+
+	return c.keys[c.idx]
+}
+
+// Value returns the value of the current item as fixed-size array. Values
+// which do not fit into 10 bytes are returned as zero array, ValueBytes must
+// be used for those.
+func (c *Cursor) Value() [10]byte {
+	if !c.Valid() {
+		panic("Cannot read value from unpositioned cursor")
+	}
+
+	value, _ := fixedValue(c.values[c.idx])
+	return value
+}
+
+// ValueBytes returns the value of the current item, regardless of its size.
+//
+// Values stored in overflow pages are read from the tree again, as the pages
+// of the copied value may have been freed in the meantime. If the item got
+// deleted since, ErrKeyNotFound is returned.
+func (c *Cursor) ValueBytes() ([]byte, error) {
+	if !c.Valid() {
+		panic("Cannot read value from unpositioned cursor")
+	}
+
+	value := c.values[c.idx]
+	if value.isOverflow() {
+		return c.tree.GetBytes(c.keys[c.idx])
+	}
+
+	return c.tree.bufferPool.loadValue(value)
+}
+
+// Err returns the error which caused the cursor to stop, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the copy held by the cursor. The cursor must not be used
+// afterwards.
+func (c *Cursor) Close() {
+	c.keys, c.values = nil, nil
+	c.valid = false
+}
+
+// load copies the items of the leaf which may contain the given key, leaving
+// the cursor unpositioned.
+func (c *Cursor) load(key uint64) bool {
+	c.valid = false
+
+	c.tree.isolation.RLock()
+	defer c.tree.isolation.RUnlock()
+
+	leaf, bounds, err := c.tree.descendTo(key)
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	c.keys, c.values = c.keys[:0], c.values[:0]
+	c.copyLeaf(leaf)
+	c.bounds = bounds
+	c.next, c.hasNext = bounds.upper+1, bounds.hasUpper && bounds.upper < math.MaxUint64
+
+	c.tree.bufferPool.UnpinPage(*leaf.id, false)
+	leaf.latch.RUnlock()
+
+	return true
+}
+
+// loadForward copies the items of the leaf which may contain the given key,
+// and of the leaves to its right, leaving the cursor unpositioned. Leaves are
+// copied until at least cursorReadAhead leaves and a key greater or equal to
+// the given one were copied, the end of the tree is reached, or a sibling
+// could not be latched.
+func (c *Cursor) loadForward(key uint64) bool {
+	c.valid = false
+
+	c.tree.isolation.RLock()
+	defer c.tree.isolation.RUnlock()
+
+	leaf, bounds, err := c.tree.descendTo(key)
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	c.keys, c.values = c.keys[:0], c.values[:0]
+	c.bounds = bounds
+	// The first leaf holds all keys up to its upper bound, the ones to its
+	// right at least those up to their last key.
+	c.next, c.hasNext = bounds.upper+1, bounds.hasUpper && bounds.upper < math.MaxUint64
+
+	for leaves := 1; ; leaves++ {
+		c.copyLeaf(leaf)
+		if last := len(c.keys) - 1; last >= 0 && c.keys[last] >= c.next {
+			c.next, c.hasNext = c.keys[last]+1, c.keys[last] < math.MaxUint64
+		}
+
+		id := *leaf.rightSibling
+		done := id == NoSibling || (leaves >= cursorReadAhead && len(c.keys) > 0 && c.keys[len(c.keys)-1] >= key)
+		var sibling *LNodePage
+		if !done {
+			sibling, err = c.tree.tryLatchSibling(id)
+		}
+
+		c.tree.bufferPool.UnpinPage(*leaf.id, false)
+		leaf.latch.RUnlock()
+
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if sibling == nil {
+			if id == NoSibling {
+				c.hasNext = false
+			}
+			return true
+		}
+		leaf = sibling
+	}
+}
+
+// copyLeaf appends the items of a leaf to the copy.
+func (c *Cursor) copyLeaf(leaf *LNodePage) {
+	numKeys := *leaf.numKeys
+	c.keys = append(c.keys, leaf.keys[:numKeys]...)
+	c.values = append(c.values, leaf.values[:numKeys]...)
+	c.idx = 0
+}
@@ -0,0 +1,231 @@
+package kv
+
+import (
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// filledTree returns a tree containing the given keys, each key's value
+// being its first byte.
+func filledTree(t *testing.T, keys []uint64) *BTree {
+	kv, _ := helper.GetEmptyInstance()
+
+	for _, key := range keys {
+		err := kv.Put(key, [10]byte{byte(key)})
+		if err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+
+	return kv.(*BTree)
+}
+
+func TestCursorForward(t *testing.T) {
+	// Every second key, spanning several leaves
+	keys := make([]uint64, 4*NumLeafKeys)
+	for i := range keys {
+		keys[i] = uint64(2 * i)
+	}
+	shuffled := append([]uint64{}, keys...)
+	util.Shuffle(shuffled)
+	tree := filledTree(t, shuffled)
+
+	c := tree.Cursor()
+	defer c.Close()
+
+	i := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		if c.Key() != keys[i] {
+			t.Fatalf("Got key %d at position %d; expected %d", c.Key(), i, keys[i])
+		}
+		if c.Value() != [10]byte{byte(keys[i])} {
+			t.Errorf("Got unexpected value %v for key %d", c.Value(), c.Key())
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Errorf("Iterated over %d keys; expected %d", i, len(keys))
+	}
+	if c.Err() != nil {
+		t.Errorf("Got unexpected cursor error: %v", c.Err())
+	}
+}
+
+func TestCursorBackward(t *testing.T) {
+	keys := make([]uint64, 4*NumLeafKeys)
+	util.FillAsc(keys, 1)
+	tree := filledTree(t, keys)
+
+	c := tree.Cursor()
+	defer c.Close()
+
+	i := len(keys) - 1
+	for ok := c.Last(); ok; ok = c.Prev() {
+		if c.Key() != keys[i] {
+			t.Fatalf("Got key %d at position %d; expected %d", c.Key(), i, keys[i])
+		}
+		i--
+	}
+	if i != -1 {
+		t.Errorf("Stopped backward iteration at position %d; expected -1", i)
+	}
+}
+
+func TestCursorSeek(t *testing.T) {
+	keys := make([]uint64, 2*NumLeafKeys)
+	for i := range keys {
+		keys[i] = uint64(10 * (i + 1))
+	}
+	tree := filledTree(t, keys)
+
+	c := tree.Cursor()
+	defer c.Close()
+
+	tests := []struct {
+		seek     uint64
+		valid    bool
+		expected uint64
+	}{
+		{0, true, 10},
+		{10, true, 10},
+		{11, true, 20},
+		{keys[NumLeafKeys], true, keys[NumLeafKeys]},
+		{keys[len(keys)-1], true, keys[len(keys)-1]},
+		{keys[len(keys)-1] + 1, false, 0},
+	}
+
+	for _, test := range tests {
+		valid := c.Seek(test.seek)
+		if valid != test.valid {
+			t.Errorf("Seek(%d) returned %t; expected %t", test.seek, valid, test.valid)
+			continue
+		}
+		if valid && c.Key() != test.expected {
+			t.Errorf("Seek(%d) positioned on %d; expected %d", test.seek, c.Key(), test.expected)
+		}
+	}
+
+	// Moving back and forth must return the same items
+	c.Seek(keys[NumLeafKeys])
+	c.Prev()
+	if c.Key() != keys[NumLeafKeys-1] {
+		t.Errorf("Prev() after Seek() positioned on %d; expected %d", c.Key(), keys[NumLeafKeys-1])
+	}
+	c.Next()
+	if c.Key() != keys[NumLeafKeys] {
+		t.Errorf("Next() after Prev() positioned on %d; expected %d", c.Key(), keys[NumLeafKeys])
+	}
+}
+
+func TestCursorEmptyTree(t *testing.T) {
+	tree := filledTree(t, nil)
+
+	c := tree.Cursor()
+	defer c.Close()
+
+	if c.First() {
+		t.Errorf("Expected First() on empty tree to fail")
+	}
+	if c.Last() {
+		t.Errorf("Expected Last() on empty tree to fail")
+	}
+	if c.Valid() {
+		t.Errorf("Expected cursor on empty tree not to be valid")
+	}
+}
+
+func TestCursorPinsOnlyCurrentLeaf(t *testing.T) {
+	keys := make([]uint64, 4*NumLeafKeys)
+	util.FillAsc(keys, 1)
+	tree := filledTree(t, keys)
+
+	c := tree.Cursor()
+	for ok := c.First(); ok; ok = c.Next() {
+	}
+	c.Close()
+
+	for _, page := range tree.bufferPool.pageTable.all() {
+		if page.id != tree.rootPage.id && page.pins() != 0 {
+			t.Errorf("Expected page %d to be unpinned after iterating; pin count is %d", page.id, page.pins())
+		}
+	}
+}
+
+func TestCursorStopsAtLatchedSibling(t *testing.T) {
+	keys := make([]uint64, 4*NumLeafKeys)
+	util.FillAsc(keys, 1)
+	tree := filledTree(t, keys)
+
+	first, _, err := tree.descendTo(0)
+	if err != nil {
+		t.Fatalf("Error descending to first leaf: %v", err)
+	}
+	numKeys, siblingID := int(*first.numKeys), *first.rightSibling
+	tree.bufferPool.UnpinPage(*first.id, false)
+	first.latch.RUnlock()
+
+	sibling, err := tree.fetchLatched(siblingID)
+	if err != nil {
+		t.Fatalf("Error latching sibling: %v", err)
+	}
+
+	c := tree.Cursor()
+	defer c.Close()
+	if !c.First() {
+		t.Fatalf("Expected cursor to be positioned; got error %v", c.Err())
+	}
+	if len(c.keys) != numKeys {
+		t.Errorf("Expected only the first leaf with %d keys to be copied; got %d keys", numKeys, len(c.keys))
+	}
+
+	tree.releaseLeaf(RawLNodeFrom(sibling), false)
+
+	i := 0
+	for ok := true; ok; ok = c.Next() {
+		if c.Key() != keys[i] {
+			t.Fatalf("Got key %d at position %d; expected %d", c.Key(), i, keys[i])
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Errorf("Iterated over %d keys; expected %d", i, len(keys))
+	}
+}
+
+func TestScan(t *testing.T) {
+	keys := make([]uint64, 3*NumLeafKeys)
+	util.FillAsc(keys, 0)
+	tree := filledTree(t, keys)
+
+	var scanned []uint64
+	err := tree.Scan(100, 2*NumLeafKeys, func(key uint64, value [10]byte) bool {
+		scanned = append(scanned, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Error scanning: %v", err)
+	}
+
+	if len(scanned) != 2*NumLeafKeys-100+1 {
+		t.Fatalf("Scanned %d keys; expected %d", len(scanned), 2*NumLeafKeys-100+1)
+	}
+	for i, key := range scanned {
+		if key != uint64(100+i) {
+			t.Fatalf("Got key %d at position %d; expected %d", key, i, 100+i)
+		}
+	}
+
+	// Stopping early
+	count := 0
+	err = tree.Scan(0, 1000, func(key uint64, value [10]byte) bool {
+		count++
+		return count < 5
+	})
+	if err != nil {
+		t.Fatalf("Error scanning: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("Expected scan to stop after 5 keys; got %d", count)
+	}
+}
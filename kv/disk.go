@@ -1,5 +1,7 @@
 package kv
 
+import "fmt"
+
 type Disk interface {
 	/*
 		AllocatePage allocates a new page and returns the associated ID.
@@ -20,3 +22,76 @@ type Disk interface {
 	// After a close, the disk must not be used anymore.
 	Close() error
 }
+
+// States of pages on disk, stored in the last byte of each page, which is not
+// used by the page's data.
+const (
+	// pageUnused is the state of pages which were never allocated.
+	pageUnused byte = iota
+	pageAllocated
+	// pageFree is the state of deallocated pages, including the ones holding
+	// a free list.
+	pageFree
+)
+
+// StorageEngine selects the Disk used by a KV store.
+type StorageEngine uint8
+
+const (
+	// StoragePageFiles stores pages in multiple page files, with separate
+	// files for the meta data of the disk and the tree.
+	StoragePageFiles StorageEngine = iota
+	// StorageSingleFile stores all pages and meta data in a single file.
+	StorageSingleFile
+	// StorageMmap maps page files into memory, such that pages are read
+	// without copying them. It is only supported on Linux and macOS.
+	StorageMmap
+)
+
+// String returns the name of the storage engine.
+func (e StorageEngine) String() string {
+	switch e {
+	case StoragePageFiles:
+		return "page files"
+	case StorageSingleFile:
+		return "single file"
+	case StorageMmap:
+		return "mmap"
+	}
+
+	return fmt.Sprintf("StorageEngine(%d)", uint8(e))
+}
+
+// NewDisk creates the disk of the given storage engine in a directory, or
+// opens it if the directory already contains one.
+func NewDisk(engine StorageEngine, directory string) (Disk, error) {
+	switch engine {
+	case StoragePageFiles:
+		return NewPersistentDisk(directory)
+	case StorageSingleFile:
+		return NewSingleFileDisk(directory)
+	case StorageMmap:
+		return NewMmapDisk(directory)
+	}
+
+	return nil, fmt.Errorf("Unknown storage engine %v", engine)
+}
+
+// rootStore is implemented by disks which store the ID of the root page of
+// the tree themselves, such that the tree needs no meta data file of its own.
+type rootStore interface {
+	// root returns the ID of the root page. An error is returned if none
+	// was stored yet.
+	root() (PageID, error)
+	// setRoot persists the ID of the root page.
+	setRoot(PageID) error
+}
+
+// fileDisk is implemented by disks which store pages in files, and track free
+// pages in a free list.
+type fileDisk interface {
+	// pageFiles returns the paths of all files holding pages.
+	pageFiles() []string
+	// freePages returns the number of free pages.
+	freePages() uint
+}
@@ -1,90 +1,140 @@
 package kv
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
 
 const diskSize = 8
 
-func emptyDisks() []Disk {
-	return []Disk{
-		NewRAMDisk(diskSize, diskSize),
+// diskFactories create an empty disk of each kind, such that all disks can be
+// tested with the same suite. Disks with sequentialIDs hand out the IDs 0, 1,
+// 2, ... and reuse the lowest deallocated ID first.
+var diskFactories = []struct {
+	name          string
+	new           func(t TestOrBenchmark) Disk
+	sequentialIDs bool
+}{
+	{"RAMDisk", func(TestOrBenchmark) Disk { return NewRAMDisk(diskSize, diskSize) }, true},
+	{"PersistentDisk", func(t TestOrBenchmark) Disk { return emptyDisk(t, StoragePageFiles) }, true},
+	// Page 0 holds the superblock of single file disks.
+	{"SingleFileDisk", func(t TestOrBenchmark) Disk { return emptyDisk(t, StorageSingleFile) }, false},
+	{"MmapDisk", func(t TestOrBenchmark) Disk { return emptyDisk(t, StorageMmap) }, true},
+}
+
+func emptyDisk(t TestOrBenchmark, engine StorageEngine) Disk {
+	disk, err := NewDisk(engine, helper.GetTempDir(t, "disk_"))
+	if err != nil {
+		t.Fatalf("Error creating %v disk: %v", engine, err)
 	}
+
+	return disk
+}
+
+// testedPages returns the number of pages to test a disk with, which is
+// diskSize unless the disk is smaller.
+func testedPages(disk Disk) uint {
+	return util.Min(disk.Capacity(), diskSize)
 }
 
 func TestDisk_AllocatePage(t *testing.T) {
-	disks := emptyDisks()
+	for _, factory := range diskFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			disk := factory.new(t)
+			defer disk.Close()
 
-	for _, disk := range disks {
-		for i := uint(0); i < disk.Capacity(); i++ {
-			page, err := disk.AllocatePage()
+			ids := make(map[PageID]bool)
+			for i := uint(0); i < testedPages(disk); i++ {
+				page, err := disk.AllocatePage()
 
-			if err != nil {
-				t.Errorf("Actual error = %s, Expected == nil", err)
-			}
-			if page.id != PageID(i) {
-				t.Errorf("Actual PageID = %d, Expected == %d", page.id, i)
-			}
-			if disk.Occupied() != i+1 {
-				t.Errorf("Actual occupied = %d, Expected == %d", disk.Occupied(), i)
+				if err != nil {
+					t.Errorf("Actual error = %s, Expected == nil", err)
+				}
+				if factory.sequentialIDs && page.id != PageID(i) {
+					t.Errorf("Actual PageID = %d, Expected == %d", page.id, i)
+				}
+				if ids[page.id] {
+					t.Errorf("Actual PageID = %d, Expected a PageID not allocated yet", page.id)
+				}
+				ids[page.id] = true
+				if disk.Occupied() != i+1 {
+					t.Errorf("Actual occupied = %d, Expected == %d", disk.Occupied(), i)
+				}
 			}
-		}
 
-		for i := 0; i < 4; i++ {
-			_, err := disk.AllocatePage()
-
-			if err == nil {
-				t.Errorf("Actual error = nil, Expected == \"unable to allocate page on RAM disk\"")
+			if disk.Capacity() != testedPages(disk) {
+				return
 			}
-			if disk.Occupied() != disk.Capacity() {
-				t.Errorf("Actual occupied = %d, Expected == %d", disk.Occupied(), i)
+			for i := 0; i < 4; i++ {
+				_, err := disk.AllocatePage()
+
+				if err == nil {
+					t.Errorf("Actual error = nil, Expected == \"unable to allocate page on RAM disk\"")
+				}
+				if disk.Occupied() != disk.Capacity() {
+					t.Errorf("Actual occupied = %d, Expected == %d", disk.Occupied(), i)
+				}
 			}
-		}
+		})
 	}
 }
 
 func TestDisk_DeallocatePage(t *testing.T) {
-	disks := emptyDisks()
-
-	for _, disk := range disks {
-		for i := uint(0); i < disk.Capacity(); i++ {
-			for j := i; j < disk.Capacity(); j++ {
-				page, _ := disk.AllocatePage()
-				if page.id != PageID(i) {
-					t.Errorf("Actual page = %d, Expected == %d", page.id, i)
-				}
-				disk.DeallocatePage(page.id)
-				if disk.Occupied() != i {
-					t.Errorf("Actual occupied = %d, Expected == %d", disk.Occupied(), i)
+	for _, factory := range diskFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			disk := factory.new(t)
+			defer disk.Close()
+
+			for i := uint(0); i < testedPages(disk); i++ {
+				var id PageID
+				for j := i; j < testedPages(disk); j++ {
+					page, _ := disk.AllocatePage()
+					if factory.sequentialIDs && page.id != PageID(i) {
+						t.Errorf("Actual page = %d, Expected == %d", page.id, i)
+					}
+					if j > i && page.id != id {
+						t.Errorf("Actual page = %d, Expected == %d", page.id, id)
+					}
+					id = page.id
+					disk.DeallocatePage(page.id)
+					if disk.Occupied() != i {
+						t.Errorf("Actual occupied = %d, Expected == %d", disk.Occupied(), i)
+					}
 				}
+				_, _ = disk.AllocatePage()
 			}
-			_, _ = disk.AllocatePage()
-		}
+		})
 	}
 }
 
 func TestDisk_ReadPage(t *testing.T) {
-	disks := emptyDisks()
-
-	for _, disk := range disks {
-		for i := uint(0); i < disk.Capacity(); i++ {
-			newPage, _ := disk.AllocatePage()
-			page, err := disk.ReadPage(newPage.id)
-			if err != nil {
-				t.Errorf("Actual error = %s, Expected == nil", err)
-			}
+	for _, factory := range diskFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			disk := factory.new(t)
+			defer disk.Close()
+
+			for i := uint(0); i < testedPages(disk); i++ {
+				newPage, _ := disk.AllocatePage()
+				page, err := disk.ReadPage(newPage.id)
+				if err != nil {
+					t.Errorf("Actual error = %s, Expected == nil", err)
+				}
 
-			if newPage != page {
-				t.Errorf("Actual retrieved page = %x, Expected == %x", &page, &newPage)
+				if page.id != newPage.id || *page.data != *newPage.data {
+					t.Errorf("Actual retrieved page = %x, Expected == %x", &page, &newPage)
+				}
 			}
-		}
+		})
 	}
 }
 
 func FuzzDisk_WritePage(f *testing.F) {
 	f.Add([]byte{42, 69})
 	f.Fuzz(func(t *testing.T, in []byte) {
-		disks := emptyDisks()
+		for _, factory := range diskFactories {
+			disk := factory.new(t)
 
-		for _, disk := range disks {
 			newPage, _ := disk.AllocatePage()
 			copy(newPage.data[:], in)
 
@@ -93,9 +143,36 @@ func FuzzDisk_WritePage(f *testing.F) {
 			}
 
 			page, _ := disk.ReadPage(newPage.id)
-			if page.data != newPage.data {
+			if *page.data != *newPage.data {
 				t.Errorf("Actual data = %x, Expected == %x", page.data, newPage.data)
 			}
+
+			disk.Close()
 		}
 	})
 }
+
+func BenchmarkDisk_ReadPage(b *testing.B) {
+	for _, factory := range diskFactories {
+		b.Run(factory.name, func(b *testing.B) {
+			disk := factory.new(b)
+			defer disk.Close()
+
+			ids := make([]PageID, testedPages(disk))
+			for i := range ids {
+				page, err := disk.AllocatePage()
+				if err != nil {
+					b.Fatalf("Error allocating page: %v", err)
+				}
+				ids[i] = page.id
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := disk.ReadPage(ids[i%len(ids)]); err != nil {
+					b.Fatalf("Error reading page: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultGroupCommitInterval is the interval of group commits if the config
+// does not specify one.
+const defaultGroupCommitInterval = 10 * time.Millisecond
+
+// Durability selects when a KV store syncs its page and meta data files to
+// stable storage, and thus when modifications survive a crash of the operating
+// system.
+//
+// A write-ahead log is synced on every modification regardless, unless
+// DurabilityGroupCommit is selected, which syncs it in groups as well.
+type Durability uint8
+
+const (
+	// DurabilityNone never syncs, leaving it to the operating system to
+	// write modifications back eventually. Checkpoints of a write-ahead
+	// log are synced nonetheless, as the log gets truncated afterwards.
+	DurabilityNone Durability = iota
+	// DurabilityOnClose syncs all files when the store is closed.
+	DurabilityOnClose
+	// DurabilityPerWrite syncs all files before each modification returns.
+	// Without a write-ahead log, this requires writing all modified pages
+	// and the meta data on every modification.
+	DurabilityPerWrite
+	// DurabilityGroupCommit syncs all files in intervals of
+	// KvStoreConfig.GroupCommitInterval. Modifications return once the
+	// group they are part of was synced, such that concurrent
+	// modifications share a single sync.
+	DurabilityGroupCommit
+)
+
+// String returns the name of the durability.
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityOnClose:
+		return "on close"
+	case DurabilityPerWrite:
+		return "per write"
+	case DurabilityGroupCommit:
+		return "group commit"
+	}
+
+	return fmt.Sprintf("Durability(%d)", uint8(d))
+}
+
+/*
+groupCommit syncs groups of modifications in intervals. Modifications wait for
+the group they are part of to be synced, such that all modifications of an
+interval share a single sync.
+
+Intervals in which no modification waits are skipped.
+*/
+type groupCommit struct {
+	persist func() error
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Number of the group modifications currently join, and whether any
+	// modification joined it.
+	group   uint64
+	pending bool
+	// Number of the group synced last, and the error syncing it.
+	synced uint64
+	err    error
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// startGroupCommit starts syncing groups of modifications in the given
+// interval, using persist to sync.
+func startGroupCommit(interval time.Duration, persist func() error) *groupCommit {
+	if interval == 0 {
+		interval = defaultGroupCommitInterval
+	}
+
+	g := &groupCommit{
+		persist: persist,
+		group:   1,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	g.cond = sync.NewCond(&g.mu)
+
+	go g.run(interval)
+
+	return g
+}
+
+func (g *groupCommit) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(g.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+			g.commit()
+		case <-g.stop:
+			g.commit()
+			return
+		}
+	}
+}
+
+// commit syncs the current group, if any modification joined it.
+func (g *groupCommit) commit() {
+	g.mu.Lock()
+	if !g.pending {
+		g.mu.Unlock()
+		return
+	}
+	group := g.group
+	g.group++
+	g.pending = false
+	g.mu.Unlock()
+
+	err := g.persist()
+
+	g.mu.Lock()
+	g.synced = group
+	g.err = err
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// wait joins the current group and waits for it to be synced.
+//
+// An error is returned if syncing failed. As each sync covers all groups
+// before it, the error of the latest sync is returned.
+func (g *groupCommit) wait() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	group := g.group
+	g.pending = true
+	for g.synced < group {
+		g.cond.Wait()
+	}
+
+	return g.err
+}
+
+// close syncs the current group, and stops syncing. Modifications must not
+// wait for a group anymore afterwards.
+func (g *groupCommit) close() error {
+	close(g.stop)
+	<-g.stopped
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.err
+}
+
+// storeRoot persists the ID of the root page of a tree stored on a disk, in
+// the meta data file at the given path unless the disk stores it itself. If
+// durable is set, it is synced to stable storage.
+func storeRoot(disk Disk, metaFilePath string, rootPageID PageID, durable bool) error {
+	if store, ok := disk.(rootStore); ok {
+		if err := store.setRoot(rootPageID); err != nil {
+			return err
+		}
+		if recoverable, ok := disk.(recoverableDisk); ok && durable {
+			return recoverable.sync()
+		}
+		return nil
+	}
+
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data[0:4], uint32(rootPageID))
+
+	// The meta data file is replaced atomically, such that it never
+	// references a root which is only partially written.
+	if err := writeFileAtomically(metaFilePath, data, durable); err != nil {
+		return fmt.Errorf("IO error while writing tree meta data: %v", err)
+	}
+	if durable {
+		// Syncing the directory persists the renames of the meta data
+		// files of both the tree and the disk.
+		return syncDirectory(filepath.Dir(metaFilePath))
+	}
+
+	return nil
+}
+
+// syncDirectory flushes a directory to stable storage, such that files
+// created or renamed within it persist.
+func syncDirectory(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("IO error while opening %s: %v", path, err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("IO error while syncing %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// writeFileAtomically replaces the file at the given path with the given
+// data, such that it holds either its previous or its new content even if the
+// process crashes in between.
+//
+// The data is written to a temporary file first, which is then renamed to the
+// path. If durable is set, the temporary file is synced before, such that the
+// file holds either content even if the operating system crashes.
+func writeFileAtomically(path string, data []byte, durable bool) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return fmt.Errorf("IO error while opening %s: %v", tmpPath, err)
+	}
+
+	_, err = file.Write(data)
+	if err == nil && durable {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("IO error while writing %s: %v", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("IO error while replacing %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// startDurability starts syncing modifications as required by the durability
+// of the config. It must be called once the tree is loaded.
+func (t *BTree) startDurability(config KvStoreConfig) {
+	t.durability = config.Durability
+	if t.durability != DurabilityGroupCommit {
+		return
+	}
+
+	persist := t.persist
+	if t.wal != nil {
+		// Logged modifications are durable once the log is synced.
+		t.wal.deferSync = true
+		persist = t.wal.sync
+	}
+	t.group = startGroupCommit(config.GroupCommitInterval, persist)
+}
+
+// commit makes a modification durable as required by the durability of the
+// tree. It must not be called while holding the isolation lock.
+func (t *BTree) commit() error {
+	switch t.durability {
+	case DurabilityPerWrite:
+		if t.wal != nil {
+			// The modification was synced when logging it.
+			return nil
+		}
+		return t.persist()
+	case DurabilityGroupCommit:
+		return t.group.wait()
+	}
+
+	return nil
+}
+
+// persist persists all pages as well as the meta data of the tree and its
+// disk to stable storage, while no modification is running.
+func (t *BTree) persist() error {
+	t.isolation.Lock()
+	defer t.isolation.Unlock()
+
+	return t.flush()
+}
+
+// flush persists all pages as well as the meta data of the tree and its disk
+// to stable storage. Modifications must not run concurrently.
+//
+// The pages are synced before the meta data referencing them is written, and
+// the meta data of the disk before the one of the tree, such that a crash in
+// between at most leaks pages.
+func (t *BTree) flush() error {
+	if errs := t.bufferPool.FlushAllPages(); len(errs) != 0 {
+		return fmt.Errorf("Errors while flushing pages to disk: %v", errs)
+	}
+	if err := t.bufferPool.disk.(recoverableDisk).storeMetaData(true); err != nil {
+		return err
+	}
+
+	return t.writeMetaData(t.rootPage.id, true)
+}
+
+// startDurability starts syncing modifications as required by the durability
+// of the config. It must be called once the tree is loaded.
+//
+// As a BytesTree is not safe for concurrent use, groups consist of a single
+// modification each.
+func (t *BytesTree) startDurability(config KvStoreConfig) {
+	t.durability = config.Durability
+	if t.durability == DurabilityGroupCommit {
+		t.group = startGroupCommit(config.GroupCommitInterval, t.flush)
+	}
+}
+
+// commit makes a modification durable as required by the durability of the
+// tree.
+func (t *BytesTree) commit() error {
+	switch t.durability {
+	case DurabilityPerWrite:
+		return t.flush()
+	case DurabilityGroupCommit:
+		return t.group.wait()
+	}
+
+	return nil
+}
+
+// flush persists all pages as well as the meta data of the tree and its disk
+// to stable storage, in the same order as BTree.flush.
+func (t *BytesTree) flush() error {
+	if errs := t.bufferPool.FlushAllPages(); len(errs) != 0 {
+		return fmt.Errorf("Errors while flushing pages to disk: %v", errs)
+	}
+	if err := t.bufferPool.disk.(recoverableDisk).storeMetaData(true); err != nil {
+		return err
+	}
+
+	return t.writeMetaData(true)
+}
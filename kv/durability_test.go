@@ -0,0 +1,160 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// durableConfig returns the config of a tree with the given durability, with
+// or without write-ahead log.
+func durableConfig(durability Durability, wal bool) KvStoreConfig {
+	return KvStoreConfig{
+		MemorySize:           16 * PageSize,
+		DisableWriteAheadLog: !wal,
+		Durability:           durability,
+		GroupCommitInterval:  time.Millisecond,
+	}
+}
+
+// crashWithoutLog abandons a tree without a write-ahead log, and opens the
+// state it left on disk.
+func crashWithoutLog(t *testing.T, config KvStoreConfig) *BTree {
+	recovered := &BTree{}
+	if err := recovered.Open(config); err != nil {
+		t.Fatalf("Error opening crashed tree: %v", err)
+	}
+
+	return recovered
+}
+
+func TestDurability_SurvivesReopen(t *testing.T) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityOnClose, DurabilityPerWrite, DurabilityGroupCommit} {
+		for _, wal := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v/WAL=%v", durability, wal), func(t *testing.T) {
+				tree, config := helper.GetInstance(t, durableConfig(durability, wal))
+
+				keys := make([]uint64, 500)
+				util.FillAsc(keys, 1)
+				util.Shuffle(keys)
+				for _, key := range keys {
+					if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+						t.Fatalf("Error putting key %d: %v", key, err)
+					}
+				}
+				if err := tree.Close(); err != nil {
+					t.Fatalf("Error closing tree: %v", err)
+				}
+
+				tree = &BTree{}
+				if err := tree.Open(config); err != nil {
+					t.Fatalf("Error opening tree: %v", err)
+				}
+				defer tree.Close()
+
+				for _, key := range keys {
+					if value, err := tree.Get(key); err != nil || value != [10]byte{byte(key)} {
+						t.Fatalf("Expected value %d for key %d; got %v, %v", byte(key), key, value, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDurability_PerWriteWithoutLog(t *testing.T) {
+	tree, config := helper.GetInstance(t, durableConfig(DurabilityPerWrite, false))
+
+	keys := make([]uint64, 500)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	for _, key := range keys[:250] {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+
+	// Every modification is on disk once it returns, without the tree
+	// being closed.
+	recovered := crashWithoutLog(t, config)
+
+	for i, key := range keys {
+		value, err := recovered.Get(key)
+		if i < 250 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected deleted key %d not to be found; got %v", key, err)
+			}
+			continue
+		}
+		if err != nil || value != [10]byte{byte(key)} {
+			t.Fatalf("Expected value %d for key %d; got %v, %v", byte(key), key, value, err)
+		}
+	}
+}
+
+func TestDurability_GroupCommit(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		tree, config := helper.GetInstance(t, durableConfig(DurabilityGroupCommit, wal))
+
+		var wg sync.WaitGroup
+		for w := uint64(0); w < 8; w++ {
+			wg.Add(1)
+			go func(w uint64) {
+				defer wg.Done()
+				for key := w * 100; key < (w+1)*100; key++ {
+					if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+						t.Errorf("Error putting key %d: %v", key, err)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		var recovered *BTree
+		if wal {
+			recovered = crashAndRecover(t, tree, config)
+		} else {
+			recovered = crashWithoutLog(t, config)
+		}
+
+		for key := uint64(0); key < 800; key++ {
+			if value, err := recovered.Get(key); err != nil || value != [10]byte{byte(key)} {
+				t.Fatalf("Expected value %d for key %d; got %v, %v", byte(key), key, value, err)
+			}
+		}
+		tree.group.close()
+		recovered.Close()
+	}
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+	path := filepath.Join(helper.GetTempDir(t, "atomic"), "file")
+
+	for i, data := range [][]byte{{1, 2, 3, 4}, {5, 6}} {
+		if err := writeFileAtomically(path, data, i%2 == 0); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+
+		read, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Error reading file: %v", err)
+		}
+		if string(read) != string(data) {
+			t.Errorf("Expected file to hold %v; got %v", data, read)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("Expected no temporary file to remain; got %v", err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package kv
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+var evictionPolicies = []EvictionPolicy{EvictLRU, EvictCLOCK, EvictLRUK, Evict2Q, EvictARC}
+
+func newEviction(t TestOrBenchmark, policy EvictionPolicy, size uint) CacheEviction {
+	eviction, err := NewCacheEviction(policy, size)
+	if err != nil {
+		t.Fatalf("Error creating %v eviction: %v", policy, err)
+	}
+
+	return eviction
+}
+
+func TestCacheEviction_OnlyElectsEligibleFrames(t *testing.T) {
+	const size = 16
+	pinned := map[FrameID]bool{3: true, 7: true}
+
+	for _, policy := range evictionPolicies {
+		t.Run(policy.String(), func(t *testing.T) {
+			eviction := newEviction(t, policy, size)
+			for frame := FrameID(0); frame < size; frame++ {
+				eviction.Load(frame, PageID(frame))
+				if !pinned[frame] {
+					eviction.Add(frame)
+				}
+			}
+
+			elected := make(map[FrameID]bool)
+			for i := 0; i < size-len(pinned); i++ {
+				victim := eviction.Victim()
+				if victim == nil {
+					t.Fatalf("Expected victim after %d victims, got none", i)
+				}
+				if pinned[*victim] {
+					t.Fatalf("Expected unpinned victim, got pinned frame %d", *victim)
+				}
+				if elected[*victim] {
+					t.Fatalf("Expected frame %d to be elected once only", *victim)
+				}
+				elected[*victim] = true
+			}
+
+			if victim := eviction.Victim(); victim != nil {
+				t.Fatalf("Expected no victim, got frame %d", *victim)
+			}
+
+			eviction.Add(3)
+			if victim := eviction.Victim(); victim == nil || *victim != 3 {
+				t.Fatalf("Expected frame 3 as victim, got %v", victim)
+			}
+		})
+	}
+}
+
+func TestCacheEviction_RemovedFramesAreNotElected(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		t.Run(policy.String(), func(t *testing.T) {
+			eviction := newEviction(t, policy, 4)
+			for frame := FrameID(0); frame < 4; frame++ {
+				eviction.Load(frame, PageID(frame))
+				eviction.Add(frame)
+			}
+			eviction.Remove(0)
+			eviction.Remove(2)
+
+			for i := 0; i < 2; i++ {
+				victim := eviction.Victim()
+				if victim == nil || *victim == 0 || *victim == 2 {
+					t.Fatalf("Expected frame 1 or 3 as victim, got %v", victim)
+				}
+			}
+			if victim := eviction.Victim(); victim != nil {
+				t.Fatalf("Expected no victim, got frame %d", *victim)
+			}
+		})
+	}
+}
+
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	eviction := NewLRUCache(3)
+	eviction.Add(0)
+	eviction.Add(1)
+	eviction.Add(2)
+	eviction.Remove(0)
+	eviction.Add(0)
+
+	for _, expected := range []FrameID{1, 2, 0} {
+		if victim := eviction.Victim(); victim == nil || *victim != expected {
+			t.Fatalf("Expected frame %d as victim, got %v", expected, victim)
+		}
+	}
+}
+
+func TestClockCache_GivesSecondChance(t *testing.T) {
+	eviction := NewClockCache(3)
+	eviction.Add(0)
+	eviction.Add(1)
+	eviction.Add(2)
+
+	// The first sweep clears all bits, such that frame 0 is elected.
+	if victim := eviction.Victim(); victim == nil || *victim != 0 {
+		t.Fatalf("Expected frame 0 as victim, got %v", victim)
+	}
+
+	// Referencing frame 1 again gives it a second chance.
+	eviction.Remove(1)
+	eviction.Add(1)
+	if victim := eviction.Victim(); victim == nil || *victim != 2 {
+		t.Fatalf("Expected frame 2 as victim, got %v", victim)
+	}
+}
+
+func TestCacheEviction_ScanResistance(t *testing.T) {
+	const size = 64
+	trace := scanHeavyTrace(50_000, size)
+	lru := simulateEviction(t, EvictLRU, size, trace)
+
+	for _, policy := range []EvictionPolicy{EvictLRUK, Evict2Q, EvictARC} {
+		hitRate := simulateEviction(t, policy, size, trace)
+		if hitRate <= lru {
+			t.Errorf(
+				"Expected %v to have a higher hit rate than LRU on a scan-heavy workload, got %.3f vs %.3f",
+				policy,
+				hitRate,
+				lru,
+			)
+		}
+	}
+}
+
+func TestCacheEviction_BTree(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		t.Run(policy.String(), func(t *testing.T) {
+			tree := BTree{}
+			err := tree.Create(KvStoreConfig{
+				MemorySize:       16 * PageSize,
+				WorkingDirectory: helper.GetTempDir(t, "eviction_"),
+				Eviction:         policy,
+			})
+			if err != nil {
+				t.Fatalf("Error creating tree: %v", err)
+			}
+			defer tree.Close()
+
+			keys := make([]uint64, 5_000)
+			util.FillAsc(keys, 1)
+			util.Shuffle(keys)
+			for _, key := range keys {
+				if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+					t.Fatalf("Error putting key %d: %v", key, err)
+				}
+			}
+
+			util.Shuffle(keys)
+			for _, key := range keys {
+				value, err := tree.Get(key)
+				if err != nil {
+					t.Fatalf("Error getting key %d: %v", key, err)
+				}
+				if value != [10]byte{byte(key)} {
+					t.Fatalf("Expected value %d for key %d, got %v", byte(key), key, value)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCacheEviction_HitRate(b *testing.B) {
+	const size = 256
+	workloads := []struct {
+		name  string
+		trace []PageID
+	}{
+		{"Skewed", skewedTrace(100_000, 16*size)},
+		{"ScanHeavy", scanHeavyTrace(100_000, size)},
+	}
+
+	for _, workload := range workloads {
+		for _, policy := range evictionPolicies {
+			b.Run(fmt.Sprintf("%s/%v", workload.name, policy), func(b *testing.B) {
+				sim := newEvictionSimulation(b, policy, size)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					sim.access(b, workload.trace[i%len(workload.trace)])
+				}
+				b.StopTimer()
+
+				b.ReportMetric(100*sim.hitRate(), "hit%")
+			})
+		}
+	}
+}
+
+// evictionSimulation simulates the references of a buffer pool to its
+// CacheEviction for a trace of page accesses.
+type evictionSimulation struct {
+	eviction   CacheEviction
+	frames     map[PageID]FrameID
+	pages      []PageID
+	freeFrames []FrameID
+	hits       int
+	misses     int
+}
+
+func newEvictionSimulation(t TestOrBenchmark, policy EvictionPolicy, size uint) *evictionSimulation {
+	sim := &evictionSimulation{
+		eviction:   newEviction(t, policy, size),
+		frames:     make(map[PageID]FrameID, size),
+		pages:      make([]PageID, size),
+		freeFrames: make([]FrameID, size),
+	}
+	for i := range sim.freeFrames {
+		sim.freeFrames[i] = FrameID(i)
+	}
+
+	return sim
+}
+
+// access pins and unpins a page, loading it into a frame if necessary.
+func (sim *evictionSimulation) access(t TestOrBenchmark, page PageID) {
+	if frame, ok := sim.frames[page]; ok {
+		sim.hits++
+		sim.eviction.Remove(frame)
+		sim.eviction.Add(frame)
+		return
+	}
+
+	sim.misses++
+	var frame FrameID
+	if len(sim.freeFrames) > 0 {
+		frame = sim.freeFrames[len(sim.freeFrames)-1]
+		sim.freeFrames = sim.freeFrames[:len(sim.freeFrames)-1]
+	} else {
+		victim := sim.eviction.Victim()
+		if victim == nil {
+			t.Fatalf("Expected victim with all frames unpinned, got none")
+		}
+		frame = *victim
+		delete(sim.frames, sim.pages[frame])
+	}
+
+	sim.frames[page] = frame
+	sim.pages[frame] = page
+	sim.eviction.Load(frame, page)
+	sim.eviction.Add(frame)
+}
+
+func (sim *evictionSimulation) hitRate() float64 {
+	return float64(sim.hits) / float64(sim.hits+sim.misses)
+}
+
+// simulateEviction returns the hit rate of a policy for a trace.
+func simulateEviction(t TestOrBenchmark, policy EvictionPolicy, size uint, trace []PageID) float64 {
+	sim := newEvictionSimulation(t, policy, size)
+	for _, page := range trace {
+		sim.access(t, page)
+	}
+
+	return sim.hitRate()
+}
+
+// skewedTrace returns a trace of accesses to the given number of pages,
+// following a Zipf distribution.
+func skewedTrace(length int, numPages uint64) []PageID {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, numPages-1)
+
+	trace := make([]PageID, length)
+	for i := range trace {
+		trace[i] = PageID(zipf.Uint64())
+	}
+
+	return trace
+}
+
+// scanHeavyTrace returns a trace of random accesses to a hot set of three
+// quarters of the cache size, interleaved with a sequential scan over pages
+// which are never accessed again.
+func scanHeavyTrace(length int, cacheSize uint) []PageID {
+	random := rand.New(rand.NewSource(1))
+	hotPages := int(3 * cacheSize / 4)
+
+	trace := make([]PageID, length)
+	next := PageID(hotPages)
+	for i := range trace {
+		if random.Intn(2) == 0 {
+			trace[i] = PageID(random.Intn(hotPages))
+		} else {
+			trace[i] = next
+			next++
+		}
+	}
+
+	return trace
+}
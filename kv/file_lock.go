@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock on the file, which is released
+// once the file is closed. An error is returned if another process, or
+// another open file of this process, holds a lock on it already.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return fmt.Errorf("Store file %s is in use by another process", file.Name())
+	}
+	if err != nil {
+		return fmt.Errorf("IO error while locking store file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin)
+
+package kv
+
+import "os"
+
+// lockFile does nothing on this platform, files are not locked.
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package kv
+
+import "testing"
+
+func TestSingleFileDisk_LocksFile(t *testing.T) {
+	dir := helper.GetTempDir(t, "single_file_lock")
+	disk := newSingleFileDisk(t, dir)
+
+	if _, err := NewSingleFileDisk(dir); err == nil {
+		t.Fatalf("Expected error opening store which is in use; got none")
+	}
+
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+	disk = newSingleFileDisk(t, dir)
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+}
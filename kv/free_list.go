@@ -0,0 +1,247 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// freeListTrunkCapacity is the number of page IDs a single trunk page of a
+// free list holds. A trunk page consists of the ID of the next trunk page and
+// the number of IDs it holds, followed by the IDs.
+const freeListTrunkCapacity = (PageDataSize - 8) / 4
+
+// freeListStorage provides access to the pages a free list is stored in.
+type freeListStorage interface {
+	// readFreeListPage reads the data of a free page.
+	readFreeListPage(PageID) (*[PageDataSize]byte, error)
+	// writeFreeListPage writes the data of a free page.
+	writeFreeListPage(PageID, *[PageDataSize]byte) error
+	// extend allocates a page beyond all existing pages, to be used by the
+	// free list.
+	extend() (PageID, error)
+}
+
+/*
+freeList tracks the free pages of a disk in a chain of trunk pages, which are
+free pages themselves. Only the trunk which pages are currently taken from is
+held in memory, along with the pages freed since the free list was last stored.
+
+The chain on disk is never modified in place, such that it stays valid until
+store() writes a new chain and the disk persists its head. Hence pages freed in
+between are not reused immediately, but kept in memory until the free list is
+stored, and trunk pages are only reused after having been replaced.
+*/
+type freeList struct {
+	// Head of the chain on disk.
+	head PageID
+	// Trunk pages are currently taken from, and its remaining IDs.
+	trunk   PageID
+	entries []PageID
+	// Trunk following the current one.
+	next PageID
+	// Trunk pages which all pages were taken from. They must not be reused
+	// until the free list has been stored.
+	retired []PageID
+	// Pages freed since the free list was last stored.
+	freed []PageID
+
+	// Number of free pages, including the trunks.
+	pages uint32
+	// Whether the free list changed since it was last stored.
+	dirty bool
+}
+
+// newFreeList returns the free list whose chain starts at the given trunk,
+// and which holds the given number of pages. Trunks are only read once pages
+// are taken from them.
+func newFreeList(head PageID, pages uint32) *freeList {
+	return &freeList{head: head, trunk: noPage, next: head, pages: pages}
+}
+
+// peek returns the page pop() would return, without taking it. The boolean
+// is false if no page is available.
+//
+// An error is returned if a trunk page cannot be read.
+func (l *freeList) peek(storage freeListStorage) (PageID, bool, error) {
+	if len(l.freed) > 0 {
+		return l.freed[len(l.freed)-1], true, nil
+	}
+
+	for len(l.entries) == 0 {
+		if l.next == noPage {
+			return 0, false, nil
+		}
+		if err := l.advance(storage); err != nil {
+			return 0, false, err
+		}
+	}
+
+	return l.entries[len(l.entries)-1], true, nil
+}
+
+// pop takes a free page. The boolean is false if no page is available.
+//
+// An error is returned if a trunk page cannot be read.
+func (l *freeList) pop(storage freeListStorage) (PageID, bool, error) {
+	id, ok, err := l.peek(storage)
+	if !ok || err != nil {
+		return id, ok, err
+	}
+
+	if len(l.freed) > 0 {
+		l.freed = l.freed[:len(l.freed)-1]
+	} else {
+		l.entries = l.entries[:len(l.entries)-1]
+	}
+	l.pages--
+	l.dirty = true
+
+	return id, true, nil
+}
+
+// push adds a free page.
+func (l *freeList) push(id PageID) {
+	l.freed = append(l.freed, id)
+	l.pages++
+	l.dirty = true
+}
+
+// contains returns whether the given page is free. Trunks which pages were
+// not taken from yet are read, but not loaded.
+//
+// An error is returned if a trunk page cannot be read.
+func (l *freeList) contains(storage freeListStorage, id PageID) (bool, error) {
+	if id == l.trunk || containsPage(l.freed, id) || containsPage(l.entries, id) || containsPage(l.retired, id) {
+		return true, nil
+	}
+
+	for trunk := l.next; trunk != noPage; {
+		if trunk == id {
+			return true, nil
+		}
+
+		next, entries, err := readTrunk(storage, trunk)
+		if err != nil {
+			return false, err
+		}
+		if containsPage(entries, id) {
+			return true, nil
+		}
+		trunk = next
+	}
+
+	return false, nil
+}
+
+// advance retires the current trunk, and loads the next one.
+func (l *freeList) advance(storage freeListStorage) error {
+	next, entries, err := readTrunk(storage, l.next)
+	if err != nil {
+		return err
+	}
+
+	if l.trunk != noPage {
+		l.retired = append(l.retired, l.trunk)
+	}
+	l.trunk = l.next
+	l.entries = entries
+	l.next = next
+
+	return nil
+}
+
+// readTrunk reads a trunk page, and returns the ID of the next trunk page
+// along with the IDs it holds.
+func readTrunk(storage freeListStorage, id PageID) (PageID, []PageID, error) {
+	data, err := storage.readFreeListPage(id)
+	if err != nil {
+		return noPage, nil, fmt.Errorf("Unable to read free list trunk page %d: %v", id, err)
+	}
+
+	count := binary.BigEndian.Uint32(data[4:8])
+	if count > freeListTrunkCapacity {
+		return noPage, nil, fmt.Errorf("Free list trunk page %d holds %d IDs, exceeding its capacity", id, count)
+	}
+
+	entries := make([]PageID, count)
+	for i := range entries {
+		entries[i] = PageID(binary.BigEndian.Uint32(data[8+i*4 : 12+i*4]))
+	}
+
+	return PageID(binary.BigEndian.Uint32(data[0:4])), entries, nil
+}
+
+// containsPage returns whether the given IDs contain the given page.
+func containsPage(ids []PageID, id PageID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// store writes a new chain holding all free pages, and returns its head. The
+// caller must persist the head, which the chain previously stored remains
+// valid until.
+//
+// An error is returned if a trunk page cannot be written.
+func (l *freeList) store(storage freeListStorage) (PageID, error) {
+	if !l.dirty {
+		return l.head, nil
+	}
+
+	// Free pages which are not part of the chain on disk come first, as
+	// they can be overwritten with new trunks.
+	ids := make([]PageID, 0, len(l.freed)+len(l.entries)+len(l.retired)+1)
+	ids = append(ids, l.freed...)
+	ids = append(ids, l.entries...)
+	overwritable := len(ids)
+	ids = append(ids, l.retired...)
+	if l.trunk != noPage {
+		ids = append(ids, l.trunk)
+	}
+
+	// The chain is built back to front, ending in the trunks which were
+	// not taken from yet.
+	head := l.next
+	for len(ids) > 0 {
+		var trunk PageID
+		if overwritable > 0 {
+			trunk = ids[0]
+			ids = ids[1:]
+			overwritable--
+		} else {
+			var err error
+			if trunk, err = storage.extend(); err != nil {
+				return l.head, err
+			}
+			l.pages++
+		}
+
+		count := util.Min(len(ids), freeListTrunkCapacity)
+		entries := ids[len(ids)-count:]
+		ids = ids[:len(ids)-count]
+		overwritable = util.Min(overwritable, len(ids))
+
+		var data [PageDataSize]byte
+		binary.BigEndian.PutUint32(data[0:4], uint32(head))
+		binary.BigEndian.PutUint32(data[4:8], uint32(count))
+		for i, id := range entries {
+			binary.BigEndian.PutUint32(data[8+i*4:12+i*4], uint32(id))
+		}
+		if err := storage.writeFreeListPage(trunk, &data); err != nil {
+			return l.head, fmt.Errorf("Unable to write free list trunk page %d: %v", trunk, err)
+		}
+
+		head = trunk
+	}
+
+	pages := l.pages
+	*l = *newFreeList(head, pages)
+
+	return head, nil
+}
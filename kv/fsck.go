@@ -0,0 +1,527 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pageCorrupt marks a page which is stored in a page file, but could not be
+// read while checking a store.
+const pageCorrupt = math.MaxUint8
+
+// CheckReport is the result of checking a store with Check.
+type CheckReport struct {
+	// Number of pages which were ever allocated, and how many of them are
+	// allocated, on the free list, and reachable from the root.
+	Pages     uint
+	Allocated uint
+	Free      uint
+	Reachable uint
+	// Number of items stored in the tree.
+	Items uint
+
+	// Inconsistencies found, each described by a message.
+	Problems []string
+	// Pages which are allocated, but not reachable from the root.
+	Leaked []PageID
+	// Pages which are neither allocated nor on the free list.
+	Orphaned []PageID
+	// Whether leaked and orphaned pages were added to the free list.
+	Reclaimed bool
+}
+
+// OK returns whether the store is consistent, and no page is lost.
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0 && len(r.Leaked) == 0 && len(r.Orphaned) == 0
+}
+
+// String summarises the report, listing all problems found.
+func (r *CheckReport) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d pages: %d allocated, %d free, %d reachable from the root\n", r.Pages, r.Allocated, r.Free, r.Reachable)
+	fmt.Fprintf(&b, "%d items\n", r.Items)
+	for _, problem := range r.Problems {
+		fmt.Fprintf(&b, "Problem: %s\n", problem)
+	}
+	if len(r.Leaked) > 0 {
+		fmt.Fprintf(&b, "%d leaked pages: %v\n", len(r.Leaked), r.Leaked)
+	}
+	if len(r.Orphaned) > 0 {
+		fmt.Fprintf(&b, "%d orphaned pages: %v\n", len(r.Orphaned), r.Orphaned)
+	}
+	if r.Reclaimed {
+		fmt.Fprintf(&b, "Reclaimed %d pages\n", len(r.Leaked)+len(r.Orphaned))
+	}
+	if r.OK() {
+		b.WriteString("No problems found\n")
+	}
+
+	return b.String()
+}
+
+func (r *CheckReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+/*
+Check verifies the integrity of the store in the working directory of the
+config, without opening it as a tree. The store must not be open while being
+checked.
+
+All page files are read, verifying the checksum of each page. The free list is
+followed from the meta data of the disk, and the tree from the root stored in
+its meta data, verifying that:
+  - keys within each node are strictly ascending, and lie within the bounds
+    given by the separators of its parents,
+  - all leaves are at the same depth and linked to their siblings in key order,
+  - all pages referenced by the tree, including overflow pages, are allocated
+    and referenced only once,
+  - all pages on the free list are free in their page files.
+
+Pages which are allocated but not reachable from the root are reported as
+leaked, pages which are neither allocated nor on the free list as orphaned. If
+reclaim is set and no problem was found, both are added to the free list.
+
+Only stores using page files can be checked. An error is returned if the store
+cannot be checked at all, e.g. as its meta data cannot be read. Inconsistencies
+are reported in the returned report instead.
+*/
+func Check(config KvStoreConfig, reclaim bool) (*CheckReport, error) {
+	if config.Storage != StoragePageFiles {
+		return nil, fmt.Errorf("Checking %v storage is not supported", config.Storage)
+	}
+
+	c := &checker{
+		directory: config.WorkingDirectory,
+		report:    &CheckReport{},
+		states:    make(map[PageID]byte),
+		free:      make(map[PageID]bool),
+		reached:   make(map[PageID]bool),
+		files:     make(map[PageID]*PageFile),
+		leafDepth: -1,
+	}
+	defer c.close()
+
+	disk := &PersistentDisk{Directory: c.directory}
+	if err := disk.loadMetaData(); err != nil {
+		return nil, err
+	}
+	c.next = disk.nextPageID
+	c.report.Pages = uint(c.next)
+
+	root, err := c.loadRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	c.checkLog()
+	c.scanPageFiles()
+	c.checkFreeList(disk.free)
+	c.checkTree(root)
+	c.findLostPages()
+
+	if reclaim && len(c.report.Problems) == 0 && !c.report.OK() {
+		// Pages are only read by the checker, so they must be released
+		// before the disk writes to them.
+		c.close()
+		if err := c.reclaim(); err != nil {
+			return c.report, err
+		}
+		c.report.Reclaimed = true
+	}
+
+	return c.report, nil
+}
+
+// checker holds the state of a check of a store of page files.
+type checker struct {
+	directory string
+	report    *CheckReport
+	next      PageID
+
+	// States of all pages stored in page files.
+	states map[PageID]byte
+	// Pages on the free list, including its trunks.
+	free map[PageID]bool
+	// Pages reachable from the root.
+	reached map[PageID]bool
+
+	// Page files opened for reading, by file ID. Missing page files are
+	// recorded as nil.
+	files map[PageID]*PageFile
+
+	// Depth of all leaves, or -1 until the first leaf was reached.
+	leafDepth int
+	// Last leaf reached, and its right sibling.
+	lastLeaf      PageID
+	expectedRight PageID
+}
+
+// loadRoot reads the ID of the root page from the meta data of the tree.
+func (c *checker) loadRoot() (PageID, error) {
+	data, err := os.ReadFile(filepath.Join(c.directory, treeMetaDataFile))
+	if err != nil {
+		return 0, fmt.Errorf("IO error while reading tree meta data file: %v", err)
+	}
+	if len(data) != 4 {
+		return 0, fmt.Errorf("Tree meta data file has invalid size of %dB", len(data))
+	}
+
+	return PageID(binary.BigEndian.Uint32(data)), nil
+}
+
+// checkLog reports a write-ahead log holding records, as the store is only
+// consistent once they are redone by opening it.
+func (c *checker) checkLog() {
+	info, err := os.Stat(filepath.Join(c.directory, walFile))
+	if err == nil && info.Size() > 0 {
+		c.report.problem("Write-ahead log holds %dB not yet checkpointed; open the store to recover them", info.Size())
+	}
+}
+
+// scanPageFiles reads all pages stored in page files, recording their states
+// and verifying their checksums.
+func (c *checker) scanPageFiles() {
+	for fileID := PageID(0); fileID*pagesPerFile < c.next; fileID++ {
+		pf := c.pageFile(fileID * pagesPerFile)
+		if pf == nil {
+			continue
+		}
+
+		for id := range pf.PageLocations {
+			if id/pagesPerFile != fileID || id >= c.next {
+				c.report.problem("Page %d is stored in %s, but was never allocated", id, pf.Path)
+				continue
+			}
+
+			_, state, err := pf.readPage(id)
+			if err != nil {
+				c.report.problem("Unable to read page %d: %v", id, err)
+				state = pageCorrupt
+			}
+			if state == pageUnused {
+				// Page files written before states were
+				// introduced only hold allocated pages.
+				state = pageAllocated
+			}
+			c.states[id] = state
+			if state == pageAllocated {
+				c.report.Allocated++
+			}
+		}
+	}
+}
+
+// checkFreeList follows the chain of trunk pages of the free list, and
+// verifies that all pages on it are free.
+func (c *checker) checkFreeList(list *freeList) {
+	add := func(id PageID) {
+		switch {
+		case id >= c.next:
+			c.report.problem("Page %d is on the free list, but was never allocated", id)
+		case c.free[id]:
+			c.report.problem("Page %d is on the free list more than once", id)
+		case c.states[id] == pageAllocated:
+			c.report.problem("Page %d is on the free list, but allocated", id)
+		}
+		c.free[id] = true
+	}
+
+	for trunk := list.head; trunk != noPage; {
+		if c.free[trunk] {
+			c.report.problem("Free list trunk page %d is referenced more than once", trunk)
+			break
+		}
+		add(trunk)
+
+		pf := c.pageFile(trunk)
+		if pf == nil {
+			c.report.problem("Free list trunk page %d is not stored in any page file", trunk)
+			break
+		}
+		page, state, err := pf.readPage(trunk)
+		if err != nil {
+			c.report.problem("Unable to read free list trunk page %d: %v", trunk, err)
+			break
+		}
+		if state != pageFree {
+			c.report.problem("Free list trunk page %d is not marked as free", trunk)
+			break
+		}
+
+		count := binary.BigEndian.Uint32(page.data[4:8])
+		if count > freeListTrunkCapacity {
+			c.report.problem("Free list trunk page %d holds %d IDs, exceeding its capacity", trunk, count)
+			break
+		}
+		for i := uint32(0); i < count; i++ {
+			add(PageID(binary.BigEndian.Uint32(page.data[8+i*4 : 12+i*4])))
+		}
+		trunk = PageID(binary.BigEndian.Uint32(page.data[0:4]))
+	}
+
+	// Meta data in the legacy format holds the free pages themselves.
+	for _, id := range list.freed {
+		add(id)
+	}
+
+	c.report.Free = uint(len(c.free))
+	if uint32(len(c.free)) != list.pages {
+		c.report.problem("Free list holds %d pages, but the disk's meta data counts %d", len(c.free), list.pages)
+	}
+}
+
+// checkTree follows the tree from its root, verifying the invariants of all
+// nodes reached.
+func (c *checker) checkTree(root PageID) {
+	c.lastLeaf, c.expectedRight = NoSibling, NoSibling
+
+	page := c.reach(root, "root")
+	if page == nil {
+		return
+	}
+	if page.data[IsLeafIndex] != 0 {
+		c.report.problem("Root page %d is no internal node", root)
+		return
+	}
+	c.checkInternal(page, leafBounds{}, 0)
+
+	if c.expectedRight != NoSibling {
+		c.report.problem("Rightmost leaf %d has right sibling %d", c.lastLeaf, c.expectedRight)
+	}
+	c.report.Reachable = uint(len(c.reached))
+}
+
+// reach marks a page referenced by the tree as reached, and reads it. Returns
+// nil if the page is not allocated, or was reached before.
+func (c *checker) reach(id PageID, referrer string) *Page {
+	if c.reached[id] {
+		c.report.problem("Page %d referenced by %s is referenced more than once", id, referrer)
+		return nil
+	}
+	c.reached[id] = true
+
+	if c.states[id] != pageAllocated {
+		if c.states[id] != pageCorrupt {
+			c.report.problem("Page %d referenced by %s is not allocated", id, referrer)
+		}
+		return nil
+	}
+
+	page, _, err := c.pageFile(id).readPage(id)
+	if err != nil {
+		c.report.problem("Unable to read page %d: %v", id, err)
+		return nil
+	}
+
+	return page
+}
+
+// checkInternal verifies an internal node and all nodes below it.
+func (c *checker) checkInternal(page *Page, bounds leafBounds, depth int) {
+	node := RawINodeFrom(page)
+	numKeys := *node.numKeys
+	if numKeys == 0 || numKeys > NumInternalKeys {
+		c.report.problem("Internal node %d holds %d keys", page.id, numKeys)
+		return
+	}
+	c.checkKeys(page.id, node.keys[:numKeys], bounds)
+
+	referrer := fmt.Sprintf("internal node %d", page.id)
+	for i, id := range node.pages[:numKeys+1] {
+		childBounds := bounds
+		if i > 0 {
+			childBounds.lower, childBounds.hasLower = node.keys[i-1], true
+		}
+		if i < int(numKeys) {
+			childBounds.upper, childBounds.hasUpper = node.keys[i], true
+		}
+
+		child := c.reach(id, referrer)
+		if child == nil {
+			continue
+		}
+		switch child.data[IsLeafIndex] {
+		case 0:
+			c.checkInternal(child, childBounds, depth+1)
+		case 1:
+			c.checkLeaf(child, childBounds, depth+1)
+		default:
+			c.report.problem("Child %d of internal node %d is no node", id, page.id)
+		}
+	}
+}
+
+// checkLeaf verifies a leaf, its links to its siblings and its overflow
+// values.
+func (c *checker) checkLeaf(page *Page, bounds leafBounds, depth int) {
+	if c.leafDepth == -1 {
+		c.leafDepth = depth
+	} else if depth != c.leafDepth {
+		c.report.problem("Leaf %d is at depth %d, other leaves at depth %d", page.id, depth, c.leafDepth)
+	}
+
+	leaf := RawLNodeFrom(page)
+	numKeys := *leaf.numKeys
+	if numKeys > NumLeafKeys {
+		c.report.problem("Leaf %d holds %d keys", page.id, numKeys)
+		return
+	}
+	c.checkKeys(page.id, leaf.keys[:numKeys], bounds)
+	c.report.Items += uint(numKeys)
+
+	if *leaf.leftSibling != c.lastLeaf {
+		c.report.problem("Leaf %d has left sibling %d, expected %d", page.id, *leaf.leftSibling, c.lastLeaf)
+	}
+	if c.lastLeaf != NoSibling && c.expectedRight != page.id {
+		c.report.problem("Leaf %d has right sibling %d, expected %d", c.lastLeaf, c.expectedRight, page.id)
+	}
+	c.lastLeaf, c.expectedRight = page.id, *leaf.rightSibling
+
+	for i, value := range leaf.values[:numKeys] {
+		if value.isOverflow() {
+			c.checkOverflow(leaf.keys[i], value)
+		} else if value.size > MaxInlineValueSize {
+			c.report.problem("Value of key %d in leaf %d has invalid size %d", leaf.keys[i], page.id, value.size)
+		}
+	}
+}
+
+// checkKeys verifies that the keys of a node are strictly ascending, and lie
+// within its bounds.
+func (c *checker) checkKeys(id PageID, keys []uint64, bounds leafBounds) {
+	for i, key := range keys {
+		if i > 0 && key <= keys[i-1] {
+			c.report.problem("Keys of node %d are out of order: %d after %d", id, key, keys[i-1])
+		}
+		if !bounds.contains(key) {
+			c.report.problem("Key %d of node %d lies outside of the bounds given by its parents", key, id)
+		}
+	}
+}
+
+// checkOverflow verifies the chain of overflow pages of a value.
+func (c *checker) checkOverflow(key uint64, value leafValue) {
+	first, length := value.overflow()
+	referrer := fmt.Sprintf("value of key %d", key)
+
+	pages := (int(length) + OverflowDataSize - 1) / OverflowDataSize
+	id := first
+	for i := 0; i < pages; i++ {
+		if id == NoSibling {
+			c.report.problem("Overflow chain of key %d ends after %d of %d pages", key, i, pages)
+			return
+		}
+
+		page := c.reach(id, referrer)
+		if page == nil {
+			return
+		}
+		if !isOverflowPage(page) {
+			c.report.problem("Page %d in overflow chain of key %d is no overflow page", id, key)
+			return
+		}
+		id = *RawOverflowFrom(page).next
+	}
+
+	if id != NoSibling {
+		c.report.problem("Overflow chain of key %d continues beyond its %d pages", key, pages)
+	}
+}
+
+// findLostPages reports all pages which are allocated but not reachable, or
+// neither allocated nor free.
+func (c *checker) findLostPages() {
+	for id := PageID(0); id < c.next; id++ {
+		state, stored := c.states[id]
+		switch {
+		case stored && state == pageAllocated:
+			if !c.reached[id] {
+				c.report.Leaked = append(c.report.Leaked, id)
+			}
+		case state == pageCorrupt:
+			// Already reported as problem.
+		case !c.free[id]:
+			c.report.Orphaned = append(c.report.Orphaned, id)
+		}
+	}
+}
+
+// reclaim adds all leaked and orphaned pages to the free list of the disk.
+func (c *checker) reclaim() error {
+	disk, err := NewPersistentDisk(c.directory)
+	if err != nil {
+		return err
+	}
+	d := disk.(*PersistentDisk)
+
+	lost := append(append([]PageID{}, c.report.Leaked...), c.report.Orphaned...)
+	sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+	for _, id := range lost {
+		// Other than DeallocatePage, this frees pages not stored in
+		// their page file, or marked as free in it, as well.
+		if err := d.redoDeallocate(id); err != nil {
+			d.Close()
+			return err
+		}
+	}
+	if err := d.storeMetaData(true); err != nil {
+		d.Close()
+		return err
+	}
+
+	return d.Close()
+}
+
+// pageFile returns the page file containing the given page, opened for
+// reading only. Returns nil if the page file does not exist, or its meta data
+// cannot be read, which gets reported.
+func (c *checker) pageFile(id PageID) *PageFile {
+	fileID := id / pagesPerFile
+	if pf, ok := c.files[fileID]; ok {
+		return pf
+	}
+
+	path := (&PersistentDisk{Directory: c.directory}).pageFilePath(id)
+	pf, err := openPageFileReadOnly(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.report.problem("Unable to read page file %s: %v", path, err)
+	}
+	c.files[fileID] = pf
+
+	return pf
+}
+
+// close closes all page files opened for reading.
+func (c *checker) close() {
+	for fileID, pf := range c.files {
+		if pf != nil {
+			pf.Close()
+		}
+		delete(c.files, fileID)
+	}
+}
+
+// openPageFileReadOnly opens an existing page file for reading only. Its meta
+// data is loaded, but never stored.
+func openPageFileReadOnly(path string) (*PageFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pf := &PageFile{Path: path, Capacity: pagesPerFile, file: file}
+	if err := pf.loadMetaData(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return pf, nil
+}
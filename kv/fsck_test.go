@@ -0,0 +1,201 @@
+package kv
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkedStore creates a store of page files holding some keys, with values
+// stored inline as well as in overflow pages, and closes it again.
+func checkedStore(t *testing.T) KvStoreConfig {
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize})
+
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 20_000; i++ {
+		key := uint64(rng.Intn(10_000))
+		switch {
+		case i%3 == 2:
+			tree.Delete(key)
+		case i%100 == 0:
+			tree.PutBytes(key, randomBytes(2*OverflowDataSize, int64(i)))
+		default:
+			tree.Put(key, [10]byte{byte(key)})
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Error closing tree: %v", err)
+	}
+
+	return config
+}
+
+func checkStore(t *testing.T, config KvStoreConfig, reclaim bool) *CheckReport {
+	report, err := Check(config, reclaim)
+	if err != nil {
+		t.Fatalf("Error checking store: %v", err)
+	}
+
+	return report
+}
+
+// firstLeaf returns the ID of the leftmost leaf of a closed store.
+func firstLeaf(t *testing.T, disk *PersistentDisk, config KvStoreConfig) PageID {
+	data, err := os.ReadFile(filepath.Join(config.WorkingDirectory, treeMetaDataFile))
+	if err != nil {
+		t.Fatalf("Error reading tree meta data: %v", err)
+	}
+
+	id := PageID(binary.BigEndian.Uint32(data))
+	for {
+		page, err := disk.ReadPage(id)
+		if err != nil {
+			t.Fatalf("Error reading page %d: %v", id, err)
+		}
+		leaf, node := RawNodeFrom(page)
+		if leaf != nil {
+			return id
+		}
+		id = node.pages[0]
+	}
+}
+
+func TestCheckConsistentStore(t *testing.T) {
+	config := checkedStore(t)
+
+	report := checkStore(t, config, false)
+	if !report.OK() {
+		t.Fatalf("Expected consistent store; got report:\n%s", report)
+	}
+	if report.Reachable != report.Allocated || report.Allocated+report.Free != report.Pages {
+		t.Errorf("Expected all pages to be reachable or free; got report:\n%s", report)
+	}
+	if report.Items == 0 {
+		t.Errorf("Expected items to be counted; got none")
+	}
+}
+
+func TestCheckDetectsCorruptPage(t *testing.T) {
+	config := checkedStore(t)
+
+	disk := existingDisk(t, config.WorkingDirectory)
+	id := firstLeaf(t, disk, config)
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+
+	path := (&PersistentDisk{Directory: config.WorkingDirectory}).pageFilePath(id)
+	pf, err := openPageFileReadOnly(path)
+	if err != nil {
+		t.Fatalf("Error opening page file: %v", err)
+	}
+	offset := pf.PageLocations[id]
+	pf.Close()
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening page file: %v", err)
+	}
+	if _, err := file.WriteAt([]byte{0xFF, 0xFF}, int64(offset)+100); err != nil {
+		t.Fatalf("Error corrupting page: %v", err)
+	}
+	file.Close()
+
+	report := checkStore(t, config, true)
+	if report.OK() || !strings.Contains(report.String(), "Unable to read page") {
+		t.Errorf("Expected corrupt page to be reported; got report:\n%s", report)
+	}
+	if report.Reclaimed {
+		t.Errorf("Expected no pages to be reclaimed from corrupt store")
+	}
+}
+
+func TestCheckDetectsUnorderedKeys(t *testing.T) {
+	config := checkedStore(t)
+
+	disk := existingDisk(t, config.WorkingDirectory)
+	id := firstLeaf(t, disk, config)
+	page, err := disk.ReadPage(id)
+	if err != nil {
+		t.Fatalf("Error reading page: %v", err)
+	}
+	leaf := RawLNodeFrom(page)
+	leaf.keys[0], leaf.keys[1] = leaf.keys[1], leaf.keys[0]
+	if err := disk.WritePage(page); err != nil {
+		t.Fatalf("Error writing page: %v", err)
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+
+	report := checkStore(t, config, false)
+	if report.OK() || !strings.Contains(report.String(), "out of order") {
+		t.Errorf("Expected unordered keys to be reported; got report:\n%s", report)
+	}
+}
+
+func TestCheckReclaimsLostPages(t *testing.T) {
+	config := checkedStore(t)
+
+	disk := existingDisk(t, config.WorkingDirectory)
+	// Allocated, but never referenced by the tree.
+	leaked, err := disk.AllocatePage()
+	if err != nil {
+		t.Fatalf("Error allocating page: %v", err)
+	}
+	if err := disk.WritePage(leaked); err != nil {
+		t.Fatalf("Error writing page: %v", err)
+	}
+	// Removed from its page file, without being added to the free list.
+	orphaned, err := disk.AllocatePage()
+	if err != nil {
+		t.Fatalf("Error allocating page: %v", err)
+	}
+	pf, err := disk.pageFile(orphaned.id)
+	if err != nil {
+		t.Fatalf("Error opening page file: %v", err)
+	}
+	if err := pf.DeallocatePage(orphaned.id); err != nil {
+		t.Fatalf("Error removing page: %v", err)
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+
+	report := checkStore(t, config, false)
+	if len(report.Problems) != 0 {
+		t.Fatalf("Expected no problems; got report:\n%s", report)
+	}
+	if len(report.Leaked) != 1 || report.Leaked[0] != leaked.id {
+		t.Errorf("Expected page %d to be leaked; got %v", leaked.id, report.Leaked)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0] != orphaned.id {
+		t.Errorf("Expected page %d to be orphaned; got %v", orphaned.id, report.Orphaned)
+	}
+
+	if report := checkStore(t, config, true); !report.Reclaimed {
+		t.Fatalf("Expected lost pages to be reclaimed; got report:\n%s", report)
+	}
+	after := checkStore(t, config, false)
+	if !after.OK() {
+		t.Errorf("Expected consistent store after reclaiming; got report:\n%s", after)
+	}
+	if after.Free != report.Free+2 {
+		t.Errorf("Expected %d free pages after reclaiming; got %d", report.Free+2, after.Free)
+	}
+}
+
+func TestCheckRejectsOtherStorage(t *testing.T) {
+	config := KvStoreConfig{
+		WorkingDirectory: helper.GetTempDir(t, "fsck"),
+		Storage:          StorageSingleFile,
+	}
+
+	if _, err := Check(config, false); err == nil {
+		t.Errorf("Expected error checking single file storage; got none")
+	}
+}
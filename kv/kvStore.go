@@ -3,21 +3,68 @@ package kv
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 const MaxMem = 1 << (10 * 3) // Do not allow KV stores to use more than 1GB of memory
 const DefaultPath = "."      // Default to current working directory to persist KV store
 
+var (
+	// ErrKeyNotFound is returned if an operation requires an item with a
+	// key which does not exist in the KV store.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrKeyExists is returned if an operation requires that no item with
+	// the given key exists in the KV store yet.
+	ErrKeyExists = errors.New("key already exists")
+
+	// ErrValueTooLarge is returned if a value is requested as fixed-size
+	// array, but does not fit into one.
+	ErrValueTooLarge = errors.New("value does not fit into 10 bytes")
+
+	// ErrKeyTooLarge is returned if a key of a BytesTree exceeds
+	// MaxKeySize.
+	ErrKeyTooLarge = errors.New("key exceeds maximum key size")
+
+	// ErrTxDone is returned if a transaction is used after it has been
+	// committed or rolled back.
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+)
+
 // KeyValueStore defines the interface to be implemented by the KV store.
 type KeyValueStore interface {
 	// Put stores a new item with given key and value in the KV store. If
-	// an item with the requested key already exists, an error is returned.
+	// an item with the requested key already exists, ErrKeyExists is
+	// returned.
 	Put(key uint64, value [10]byte) error
 
+	// Upsert stores an item with given key and value in the KV store. If
+	// an item with the requested key already exists, its value is
+	// replaced.
+	Upsert(key uint64, value [10]byte) error
+
+	// Update replaces the value of the item with given key in the KV
+	// store. If no item with the requested key exists, ErrKeyNotFound is
+	// returned.
+	Update(key uint64, value [10]byte) error
+
 	// Get retrieves an item with given key rom the KV store. If no item
-	// with the requested key exists, an error is returned.
+	// with the requested key exists, ErrKeyNotFound is returned. If the
+	// value of the item does not fit into 10 bytes, ErrValueTooLarge is
+	// returned.
 	Get(key uint64) ([10]byte, error)
 
+	// PutBytes, UpsertBytes, UpdateBytes and GetBytes are equivalent to
+	// their fixed-size counterparts, but support values of arbitrary size.
+	PutBytes(key uint64, value []byte) error
+	UpsertBytes(key uint64, value []byte) error
+	UpdateBytes(key uint64, value []byte) error
+	GetBytes(key uint64) ([]byte, error)
+
+	// Delete removes the item with given key from the KV store. If no item
+	// with the requested key exists, ErrKeyNotFound is returned.
+	Delete(key uint64) error
+
 	// Create initializes a new instance of the KV store with the supplied
 	// parameters. If creation fails, an error is returned.
 	Create(config KvStoreConfig) error
@@ -26,9 +73,9 @@ type KeyValueStore interface {
 	// error is returned.
 	Open(config KvStoreConfig) error
 
-	// Delete deletes the currently opened KV store. If deletion fails, an
+	// Destroy deletes the currently opened KV store. If deletion fails, an
 	// error is returned.
-	Delete() error
+	Destroy() error
 
 	// Close persists the active KV store to disk and unloads it. If it
 	// fails, an error is returned.
@@ -42,8 +89,15 @@ type KeyValueStore interface {
 
 // KVStoreConfig provides parameters used to initialize a new KV store.
 type KvStoreConfig struct {
-	MemorySize       uint   // Maximum amount of memory to be used by KV store
-	WorkingDirectory string // Directory on disk in which KV store will be persisted
+	MemorySize           uint           // Maximum amount of memory to be used by KV store
+	WorkingDirectory     string         // Directory on disk in which KV store will be persisted
+	DisableWriteAheadLog bool           // Whether modifications are applied without being logged and synced to disk first
+	Eviction             EvictionPolicy // Policy used to evict pages from memory, LRU by default
+	Storage              StorageEngine  // Layout of the KV store on disk, page files by default
+
+	Durability          Durability    // When page and meta data files are synced to stable storage, never by default
+	GroupCommitInterval time.Duration // Interval of group commits, 10ms by default
+	BulkLoadFillFactor  float64       // Fraction of each node filled by BulkLoad, between 0.5 and 1 (default)
 }
 
 func NewKvStoreInstance(size int, path string) (KeyValueStore, error) {
@@ -65,6 +119,14 @@ func (KvStoreStub) Put(key uint64, value [10]byte) error {
 	return nil
 }
 
+func (KvStoreStub) Upsert(key uint64, value [10]byte) error {
+	return nil
+}
+
+func (KvStoreStub) Update(key uint64, value [10]byte) error {
+	return nil
+}
+
 func (*KvStoreStub) Get(a1 uint64) ([10]byte, error) {
 	return [10]byte{10, 10, 1}, nil
 }
@@ -77,7 +139,27 @@ func (*KvStoreStub) Create(config KvStoreConfig) error {
 	return nil
 }
 
-func (*KvStoreStub) Delete() error {
+func (KvStoreStub) PutBytes(key uint64, value []byte) error {
+	return nil
+}
+
+func (KvStoreStub) UpsertBytes(key uint64, value []byte) error {
+	return nil
+}
+
+func (KvStoreStub) UpdateBytes(key uint64, value []byte) error {
+	return nil
+}
+
+func (*KvStoreStub) GetBytes(a1 uint64) ([]byte, error) {
+	return []byte{10, 10, 1}, nil
+}
+
+func (*KvStoreStub) Delete(key uint64) error {
+	return nil
+}
+
+func (*KvStoreStub) Destroy() error {
 	return nil
 
 }
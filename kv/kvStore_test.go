@@ -332,8 +332,99 @@ func TestPutExistingElement(t *testing.T) {
 	}
 
 	err = kv.Put(1, [10]byte{})
-	if err == nil {
-		t.Errorf("Expected error when putting existing element; got none")
+	if !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists when putting existing element; got %v", err)
+	}
+}
+
+func TestPutExistingElementInFullLeaf(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+
+	for i := uint64(0); i < NumLeafKeys; i++ {
+		err := kv.Put(i, [10]byte{byte(i)})
+		if err != nil {
+			t.Fatalf("Error putting element %d: %v", i, err)
+		}
+	}
+
+	// The leaf is full now, so this must not cause a split
+	err := kv.Put(0, [10]byte{42})
+	if !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists when putting existing element; got %v", err)
+	}
+
+	val, err := kv.Get(0)
+	if err != nil {
+		t.Fatalf("Error getting element: %v", err)
+	}
+	if val != [10]byte{0} {
+		t.Errorf("Expected existing value to be unchanged; got %v", val)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+
+	// Insert more than a leaf can hold, to upsert across splits.
+	for i := uint64(0); i < 2*NumLeafKeys; i++ {
+		err := kv.Upsert(i, [10]byte{1})
+		if err != nil {
+			t.Fatalf("Error upserting new element %d: %v", i, err)
+		}
+	}
+
+	for i := uint64(0); i < 2*NumLeafKeys; i++ {
+		err := kv.Upsert(i, [10]byte{2, byte(i)})
+		if err != nil {
+			t.Fatalf("Error upserting existing element %d: %v", i, err)
+		}
+	}
+
+	for i := uint64(0); i < 2*NumLeafKeys; i++ {
+		val, err := kv.Get(i)
+		if err != nil {
+			t.Fatalf("Error getting element %d: %v", i, err)
+		}
+		if val != [10]byte{2, byte(i)} {
+			t.Errorf("Got unexpected value %v for key %d; expected %v", val, i, [10]byte{2, byte(i)})
+		}
+	}
+
+	keys, _ := kv.TraverseAll()
+	if len(keys) != 2*NumLeafKeys {
+		t.Errorf("Expected %d keys after upserting; got %d", 2*NumLeafKeys, len(keys))
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+
+	err := kv.Update(1, [10]byte{1})
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound when updating nonexistant element; got %v", err)
+	}
+
+	_, err = kv.Get(1)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected update of nonexistant element not to insert it; got %v", err)
+	}
+
+	err = kv.Put(1, [10]byte{1})
+	if err != nil {
+		t.Fatalf("Error putting element: %v", err)
+	}
+
+	err = kv.Update(1, [10]byte{2})
+	if err != nil {
+		t.Fatalf("Error updating element: %v", err)
+	}
+
+	val, err := kv.Get(1)
+	if err != nil {
+		t.Fatalf("Error getting element: %v", err)
+	}
+	if val != [10]byte{2} {
+		t.Errorf("Got unexpected value %v after update; expected %v", val, [10]byte{2})
 	}
 }
 
@@ -341,8 +432,217 @@ func TestGetNonexistantElement(t *testing.T) {
 	kv, _ := helper.GetEmptyInstance()
 
 	_, err := kv.Get(1)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound when getting nonexistant element; got %v", err)
+	}
+}
+
+func TestDeleteElement(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+
+	for i := uint64(1); i <= 3; i++ {
+		err := kv.Put(i, [10]byte{byte(i)})
+		if err != nil {
+			t.Fatalf("Error putting element %d: %v", i, err)
+		}
+	}
+
+	err := kv.Delete(2)
+	if err != nil {
+		t.Fatalf("Error deleting element: %v", err)
+	}
+
+	_, err = kv.Get(2)
 	if err == nil {
-		t.Errorf("Expected error when getting nonexistant element; got none")
+		t.Errorf("Expected error when getting deleted element; got none")
+	}
+
+	for _, key := range []uint64{1, 3} {
+		val, err := kv.Get(key)
+		if err != nil {
+			t.Errorf("Error getting element %d: %v", key, err)
+		}
+		if val != [10]byte{byte(key)} {
+			t.Errorf("Got unexpected value %v for key %d; expected %v", val, key, [10]byte{byte(key)})
+		}
+	}
+
+	// Deleted keys must be insertable again
+	err = kv.Put(2, [10]byte{42})
+	if err != nil {
+		t.Errorf("Error re-inserting deleted element: %v", err)
+	}
+}
+
+func TestDeleteNonexistantElement(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+
+	err := kv.Delete(1)
+	if err == nil {
+		t.Errorf("Expected error when deleting nonexistant element; got none")
+	}
+
+	err = kv.Put(1, [10]byte{})
+	if err != nil {
+		t.Fatalf("Error putting element: %v", err)
+	}
+	err = kv.Delete(1)
+	if err != nil {
+		t.Fatalf("Error deleting element: %v", err)
+	}
+
+	err = kv.Delete(1)
+	if err == nil {
+		t.Errorf("Expected error when deleting element twice; got none")
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	// Enough keys for the tree to grow to three levels, such that
+	// deleting them forces merges of internal nodes and a collapse of the
+	// root.
+	const numberOfKeys = 100_000
+	const numberOfKeysToKeep = 100
+
+	kv, _ := helper.GetEmptyInstance()
+	tree := kv.(*BTree)
+
+	keys := make([]uint64, numberOfKeys)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+
+	for _, key := range keys {
+		a := [10]byte{}
+		binary.LittleEndian.PutUint64(a[:], key)
+		err := kv.Put(key, a)
+		if err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+
+	occupiedBefore := tree.bufferPool.disk.Occupied()
+
+	toDelete := keys[numberOfKeysToKeep:]
+	for _, key := range toDelete {
+		err := kv.Delete(key)
+		if err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+
+	for _, key := range toDelete[:1000] {
+		_, err := kv.Get(key)
+		if err == nil {
+			t.Fatalf("Expected error when getting deleted key %d; got none", key)
+		}
+	}
+
+	for _, key := range keys[:numberOfKeysToKeep] {
+		val, err := kv.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting key %d: %v", key, err)
+		}
+		if binary.LittleEndian.Uint64(val[:]) != key {
+			t.Errorf("Got unexpected value %v for key %d", val, key)
+		}
+	}
+
+	traversedKeys, _ := kv.TraverseAll()
+	if len(traversedKeys) != numberOfKeysToKeep {
+		t.Errorf("Expected %d keys to remain; got %d", numberOfKeysToKeep, len(traversedKeys))
+	}
+	for i := 1; i < len(traversedKeys); i++ {
+		if traversedKeys[i-1] >= traversedKeys[i] {
+			t.Fatalf("Keys not in order after deletion: %d >= %d", traversedKeys[i-1], traversedKeys[i])
+		}
+	}
+
+	// The root must have collapsed down to pointing at leaves directly.
+	child, err := tree.bufferPool.FetchPage(tree.root.pages[0])
+	if err != nil {
+		t.Fatalf("Error fetching child of root: %v", err)
+	}
+	if leaf, _ := RawNodeFrom(child); leaf == nil {
+		t.Errorf("Expected root to point to leaves after deleting most keys")
+	}
+	tree.bufferPool.UnpinPage(child.id, false)
+
+	occupiedAfter := tree.bufferPool.disk.Occupied()
+	if occupiedAfter >= occupiedBefore/10 {
+		t.Errorf("Expected merged pages to be freed; %d pages occupied before, %d after", occupiedBefore, occupiedAfter)
+	}
+}
+
+func TestLeafSiblingLinks(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+	tree := kv.(*BTree)
+
+	keys := make([]uint64, 20*NumLeafKeys)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+
+	for _, key := range keys {
+		if err := kv.Put(key, [10]byte{}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	// Deleting a large part of the keys forces merges of leaves.
+	for _, key := range keys[:15*NumLeafKeys] {
+		if err := kv.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+
+	// Walk all leaves from left to right, and back again.
+	leftmost, _, err := tree.descendTo(0)
+	if err != nil {
+		t.Fatalf("Error finding leftmost leaf: %v", err)
+	}
+	if *leftmost.leftSibling != NoSibling {
+		t.Errorf("Expected leftmost leaf to have no left sibling; got %d", *leftmost.leftSibling)
+	}
+
+	var forward []PageID
+	var lastKey uint64
+	numKeys := 0
+	for id := *leftmost.id; id != NoSibling; {
+		page, err := tree.bufferPool.FetchPage(id)
+		if err != nil {
+			t.Fatalf("Error fetching leaf %d: %v", id, err)
+		}
+		leaf := RawLNodeFrom(page)
+		for _, key := range leaf.keys[:*leaf.numKeys] {
+			if key <= lastKey {
+				t.Fatalf("Keys out of order across leaves: %d after %d", key, lastKey)
+			}
+			lastKey = key
+			numKeys++
+		}
+		forward = append(forward, id)
+		id = *leaf.rightSibling
+		tree.bufferPool.UnpinPage(page.id, false)
+	}
+	tree.bufferPool.UnpinPage(*leftmost.id, false)
+	leftmost.latch.RUnlock()
+
+	if numKeys != 5*NumLeafKeys {
+		t.Errorf("Found %d keys walking the leaves; expected %d", numKeys, 5*NumLeafKeys)
+	}
+
+	id := forward[len(forward)-1]
+	for i := len(forward) - 1; i >= 0; i-- {
+		if id != forward[i] {
+			t.Fatalf("Backward walk reached leaf %d at position %d; expected %d", id, i, forward[i])
+		}
+		page, err := tree.bufferPool.FetchPage(id)
+		if err != nil {
+			t.Fatalf("Error fetching leaf %d: %v", id, err)
+		}
+		id = *RawLNodeFrom(page).leftSibling
+		tree.bufferPool.UnpinPage(page.id, false)
+	}
+	if id != NoSibling {
+		t.Errorf("Expected backward walk to end at NoSibling; got %d", id)
 	}
 }
 
@@ -445,10 +745,10 @@ func TestOpenAndClose(t *testing.T) {
 	}
 }
 
-func TestDelete(t *testing.T) {
+func TestDestroy(t *testing.T) {
 	kv, dir := helper.GetEmptyInstance()
 
-	err := kv.Delete()
+	err := kv.Destroy()
 	if err != nil {
 		t.Fatalf("Error deleting KV store: %v", err)
 	}
@@ -460,6 +760,27 @@ func TestDelete(t *testing.T) {
 
 }
 
+func TestDestroy_ClosesDisk(t *testing.T) {
+	config := KvStoreConfig{
+		MemorySize:       16 * PageSize,
+		WorkingDirectory: helper.GetTempDir(t, "destroy"),
+		Storage:          StorageSingleFile,
+	}
+
+	tree := &BTree{}
+	if err := tree.Create(config); err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+	file := tree.bufferPool.disk.(*SingleFileDisk).file
+
+	if err := tree.Destroy(); err != nil {
+		t.Fatalf("Error deleting KV store: %v", err)
+	}
+	if _, err := file.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected store file to be closed; got %v", err)
+	}
+}
+
 // TODO: Future tests which might be required, depending on functionality of open/delete/...
 // - Get/Put without having opened KV store should error sanely
 // - Open should probably error if one already opened. Alternatively should close existing one.
@@ -0,0 +1,297 @@
+package kv
+
+/*
+Concurrent access to a BTree is coordinated by latches on its pages, following
+the latch coupling ("crabbing") protocol:
+
+  - Nodes are only ever latched top-down, or from left to right among the
+    leaves, such that no two operations can wait for each other. The one
+    exception are writers rebalancing a leaf, see below.
+  - While descending, the latch of a child is taken before the latch of its
+    parent is released.
+  - Readers take shared latches, and hold only a single node latched once they
+    reached the child.
+  - Writers take exclusive latches. They keep all nodes above the current one
+    latched, unless the current node is safe, meaning that modifying one of
+    its children can't propagate up to it. Once a safe node is reached, all
+    latches above it are released. A writer thus only holds the part of the
+    path it might have to split or merge.
+
+A writer rebalancing an underflowing leaf latches its left sibling while holding
+the leaf itself, which is right to left. Among writers this is safe, as the
+writer also holds the parent of both leaves exclusively: any other writer
+holding the left sibling released the parent only because the sibling was
+safe, and so never waits for a neighbouring leaf. Readers walking the leaves
+from left to right, such as a Cursor, may however hold the left sibling while
+waiting for the leaf. They thus only try to latch the right sibling, and stop
+walking if it is latched exclusively, see tryLatchSibling.
+
+The root is not latched by the latch of its page, but by the rootLatch of the
+tree, as it may be replaced by a split or collapse of the root while another
+operation is waiting for it.
+
+Pages are always unpinned before their latch is released. As each page is
+pinned only by operations holding the latch of the page itself, of its parent
+or, for leaves, of their left sibling, a writer holding the parent and both a
+leaf and its left sibling thus knows the leaf to be pinned only by itself,
+allowing it to delete the leaf. Internal nodes are deleted the same way.
+*/
+
+// latchMode is the kind of modification a writer descends the tree for,
+// determining which nodes are safe.
+type latchMode uint8
+
+const (
+	// latchUpdate modifies a value in place, so all nodes are safe.
+	latchUpdate latchMode = iota
+	// latchInsert inserts a key, so nodes are safe unless they are full.
+	latchInsert
+	// latchDelete deletes a key, so nodes are safe unless deleting a key
+	// would make them underflow.
+	latchDelete
+)
+
+// internalSafe returns whether an internal node is safe for a modification.
+func (m latchMode) internalSafe(node *INodePage) bool {
+	switch m {
+	case latchInsert:
+		return !node.isFull()
+	case latchDelete:
+		return *node.numKeys > MinInternalKeys
+	}
+
+	return true
+}
+
+// leafSafe returns whether a leaf is safe for a modification.
+func (m latchMode) leafSafe(leaf *LNodePage) bool {
+	switch m {
+	case latchInsert:
+		return !leaf.isFull()
+	case latchDelete:
+		return *leaf.numKeys > MinLeafKeys
+	}
+
+	return true
+}
+
+// trace is the path of internal nodes held latched exclusively by a writer,
+// from top to bottom.
+type trace struct {
+	nodes []*INodePage
+	// Whether the first node is the root, in which case the rootLatch is
+	// held rather than the latch of its page.
+	fromRoot bool
+}
+
+// last returns the bottommost node of the trace.
+func (tr trace) last() *INodePage {
+	return tr.nodes[len(tr.nodes)-1]
+}
+
+// parents returns the trace without its bottommost node.
+func (tr trace) parents() trace {
+	return trace{tr.nodes[:len(tr.nodes)-1], tr.fromRoot}
+}
+
+// isRoot returns whether the node at the given index is the root.
+func (tr trace) isRoot(idx int) bool {
+	return idx == 0 && tr.fromRoot
+}
+
+// release releases all nodes of a trace, unpinning all but the root, which
+// stays pinned for the lifetime of the tree.
+func (t *BTree) release(tr trace, isDirty bool) {
+	for i, node := range tr.nodes {
+		t.releaseInternal(node, tr.isRoot(i), isDirty)
+	}
+}
+
+// releaseInternal unpins an internal node latched exclusively, unless it is
+// the root, and releases its latch.
+func (t *BTree) releaseInternal(node *INodePage, isRoot bool, isDirty bool) {
+	if isRoot {
+		t.rootLatch.Unlock()
+		return
+	}
+
+	t.bufferPool.UnpinPage(*node.id, isDirty)
+	node.latch.Unlock()
+}
+
+// releaseLeaf unpins a leaf latched exclusively, and releases its latch.
+func (t *BTree) releaseLeaf(leaf *LNodePage, isDirty bool) {
+	t.bufferPool.UnpinPage(*leaf.id, isDirty)
+	leaf.latch.Unlock()
+}
+
+// fetchLatched fetches a page and latches it exclusively.
+func (t *BTree) fetchLatched(id PageID) (*Page, error) {
+	page, err := t.bufferPool.FetchPage(id)
+	if err != nil {
+		return nil, err
+	}
+	page.latch.Lock()
+
+	return page, nil
+}
+
+// newLatched allocates a new page and latches it exclusively. Though nobody
+// else can reach the page yet, it will be reachable once its parent is
+// released.
+func (t *BTree) newLatched() (*Page, error) {
+	page, err := t.bufferPool.NewPage()
+	if err != nil {
+		return nil, err
+	}
+	page.latch.Lock()
+
+	return page, nil
+}
+
+// traceTo descends to the leaf which may contain the given key, latching all
+// nodes exclusively and releasing them once a safe node is reached. Returns
+// the nodes still latched above the leaf, as well as the leaf itself.
+func (t *BTree) traceTo(key uint64, mode latchMode) (trace, *LNodePage, error) {
+	tr, leaf, _, err := t.traceWithBounds(key, mode)
+	return tr, leaf, err
+}
+
+// traceWithBounds is like traceTo, but additionally returns the bounds of the
+// leaf, which remain valid as long as the leaf stays latched.
+func (t *BTree) traceWithBounds(key uint64, mode latchMode) (trace, *LNodePage, leafBounds, error) {
+	var bounds leafBounds
+
+	t.rootLatch.Lock()
+	tr := trace{nodes: []*INodePage{t.root}, fromRoot: true}
+
+	for {
+		idx := bounds.narrow(tr.last(), key)
+		page, err := t.fetchLatched(tr.last().pages[idx])
+		if err != nil {
+			t.release(tr, false)
+			return trace{}, nil, bounds, err
+		}
+
+		l, i := RawNodeFrom(page)
+		if l != nil {
+			if mode.leafSafe(l) {
+				t.release(tr, false)
+				tr = trace{}
+			}
+			return tr, l, bounds, nil
+		}
+
+		if mode.internalSafe(i) {
+			t.release(tr, false)
+			tr = trace{}
+		}
+		tr.nodes = append(tr.nodes, i)
+	}
+}
+
+// leafBounds is the range of keys (lower, upper] a leaf may contain, as given
+// by the separators above it. Leaves at either end of the tree are unbounded
+// on that side.
+type leafBounds struct {
+	lower, upper       uint64
+	hasLower, hasUpper bool
+}
+
+// narrow narrows the bounds to those of the child of an internal node which
+// may contain the given key, and returns the index of that child.
+func (b *leafBounds) narrow(node *INodePage, key uint64) uint16 {
+	idx := node.childIndex(key)
+	if idx > 0 {
+		b.lower, b.hasLower = node.keys[idx-1], true
+	}
+	if idx < *node.numKeys {
+		b.upper, b.hasUpper = node.keys[idx], true
+	}
+
+	return idx
+}
+
+// contains returns whether a key lies within the bounds.
+func (b leafBounds) contains(key uint64) bool {
+	return (!b.hasLower || key > b.lower) && (!b.hasUpper || key <= b.upper)
+}
+
+// descendTo finds the leaf which may contain the given key, latching nodes
+// shared on the way down.
+//
+// Only the returned leaf stays pinned and latched, and must be released by
+// the caller.
+func (t *BTree) descendTo(key uint64) (*LNodePage, leafBounds, error) {
+	var bounds leafBounds
+
+	t.rootLatch.RLock()
+	node, isRoot := t.root, true
+
+	for {
+		idx := bounds.narrow(node, key)
+		page, err := t.bufferPool.FetchPage(node.pages[idx])
+		if err == nil {
+			page.latch.RLock()
+		}
+		if isRoot {
+			t.rootLatch.RUnlock()
+		} else {
+			t.bufferPool.UnpinPage(*node.id, false)
+			node.latch.RUnlock()
+		}
+		if err != nil {
+			return nil, bounds, err
+		}
+
+		l, i := RawNodeFrom(page)
+		if l != nil {
+			return l, bounds, nil
+		}
+		node, isRoot = i, false
+	}
+}
+
+// tryLatchSibling fetches the right sibling of a leaf latched shared, and
+// tries to latch it shared as well. If the sibling is latched exclusively, it
+// is unpinned again and nil is returned, as its writer may be waiting for the
+// leaf.
+//
+// The sibling can't be deleted before it is latched, as that requires the
+// latch of its left sibling, the leaf held by the caller.
+func (t *BTree) tryLatchSibling(id PageID) (*LNodePage, error) {
+	page, err := t.bufferPool.FetchPage(id)
+	if err != nil {
+		return nil, err
+	}
+	if !page.latch.TryRLock() {
+		t.bufferPool.UnpinPage(id, false)
+		return nil, nil
+	}
+
+	return RawLNodeFrom(page), nil
+}
+
+// lookup finds the value of the item with given key, and calls fn with it
+// while its leaf is still latched. If no item with the requested key exists,
+// ErrKeyNotFound is returned.
+func (t *BTree) lookup(key uint64, fn func(leafValue) error) error {
+	leaf, _, err := t.descendTo(key)
+	if err != nil {
+		return err
+	}
+
+	value, found := leaf.get(key)
+	if found && fn != nil {
+		err = fn(value)
+	}
+
+	t.bufferPool.UnpinPage(*leaf.id, false)
+	leaf.latch.RUnlock()
+
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	return err
+}
@@ -1,44 +1,65 @@
 package kv
 
-import "time"
+import (
+	"container/list"
+	"sync"
+)
 
 /*
-LRUCache is a Least Recently Used cache algorithm.
+LRUCache is a Least Recently Used cache algorithm. It is safe for concurrent use.
+
+Eligible frames are kept in a list ordered by the time they were added, such
+that all operations run in constant time.
 */
 type LRUCache struct {
-	items map[FrameID]time.Time
+	mu sync.Mutex
+	// Eligible frames, most recently added in front.
+	order *list.List
+	items map[FrameID]*list.Element
 }
 
 func NewLRUCache(size uint) LRUCache {
 	return LRUCache{
-		items: make(map[FrameID]time.Time, size),
+		order: list.New(),
+		items: make(map[FrameID]*list.Element, size),
 	}
 }
 
 func (c *LRUCache) Victim() *FrameID {
-	if len(c.items) == 0 {
-		return nil
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	oldestTime := time.Now()
-	var oldestID FrameID
-
-	for id, idTime := range c.items {
-		if idTime.Before(oldestTime) {
-			oldestTime = idTime
-			oldestID = id
-		}
+	oldest := c.order.Back()
+	if oldest == nil {
+		return nil
 	}
 
-	delete(c.items, oldestID)
+	id := c.order.Remove(oldest).(FrameID)
+	delete(c.items, id)
 
-	return &oldestID
+	return &id
 }
 
 func (c *LRUCache) Remove(frameID FrameID) {
-	delete(c.items, frameID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[frameID]; ok {
+		c.order.Remove(e)
+		delete(c.items, frameID)
+	}
 }
 
 func (c *LRUCache) Add(frameID FrameID) {
-	c.items[frameID] = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[frameID]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[frameID] = c.order.PushFront(frameID)
 }
+
+// Load is a no-op, as LRU only tracks the order of frames.
+func (c *LRUCache) Load(FrameID, PageID) {}
@@ -0,0 +1,212 @@
+package kv
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+)
+
+// LRUKDepth is the number of most recent references LRUKCache tracks per
+// page, which is the K of LRU-K.
+const LRUKDepth = 2
+
+/*
+LRUKCache implements the LRU-K algorithm.
+
+For each page, the times of its LRUKDepth most recent references are tracked.
+The victim is the eligible page whose LRUKDepth-th most recent reference is the
+oldest. Pages with fewer references are considered to have been referenced
+infinitely long ago, and are evicted first, least recently referenced first.
+Thus pages which are only referenced once, e.g. by a scan, can't push out
+pages which are referenced repeatedly.
+
+References of evicted pages are retained for as many pages as there are
+frames, such that pages which get loaded again soon keep their history.
+*/
+type LRUKCache struct {
+	mu    sync.Mutex
+	clock uint64
+
+	frames map[FrameID]*lrukFrame
+	// Eligible frames with fewer than LRUKDepth references, most recently
+	// referenced in front.
+	young *list.List
+	// Eligible frames with LRUKDepth references.
+	old lrukHeap
+
+	// History of evicted pages as lrukRetained, oldest in front.
+	retained      map[PageID]*list.Element
+	retainedOrder *list.List
+	retainedSize  int
+}
+
+// lrukRetained is the retained history of an evicted page.
+type lrukRetained struct {
+	page    PageID
+	history [LRUKDepth]uint64
+}
+
+// lrukFrame is the state of a frame tracked by LRUKCache.
+type lrukFrame struct {
+	id   FrameID
+	page PageID
+	// Times of the most recent references, most recent first. Zero if
+	// there were fewer references.
+	history [LRUKDepth]uint64
+
+	eligible bool
+	// Position in either the young list or the old heap, if eligible.
+	element   *list.Element
+	heapIndex int
+}
+
+// NewLRUKCache creates a new LRUKCache for a buffer pool with the given
+// number of frames.
+func NewLRUKCache(size uint) LRUKCache {
+	return LRUKCache{
+		frames:        make(map[FrameID]*lrukFrame, size),
+		young:         list.New(),
+		retained:      make(map[PageID]*list.Element, size),
+		retainedOrder: list.New(),
+		retainedSize:  int(size),
+	}
+}
+
+func (c *LRUKCache) Victim() *FrameID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var f *lrukFrame
+	if back := c.young.Back(); back != nil {
+		f = back.Value.(*lrukFrame)
+	} else if len(c.old) > 0 {
+		f = c.old[0]
+	} else {
+		return nil
+	}
+
+	c.unlink(f)
+	delete(c.frames, f.id)
+	c.retain(f.page, f.history)
+
+	id := f.id
+	return &id
+}
+
+func (c *LRUKCache) Remove(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.frames[frameID]; ok {
+		c.unlink(f)
+		c.reference(f)
+	}
+}
+
+func (c *LRUKCache) Add(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.frames[frameID]
+	if !ok {
+		// The frame was added without a page having been loaded,
+		// treat it as a fresh page.
+		f = &lrukFrame{id: frameID}
+		c.frames[frameID] = f
+		c.reference(f)
+	}
+	if f.eligible {
+		return
+	}
+
+	f.eligible = true
+	if f.history[LRUKDepth-1] == 0 {
+		f.element = c.young.PushFront(f)
+	} else {
+		heap.Push(&c.old, f)
+	}
+}
+
+func (c *LRUKCache) Load(frameID FrameID, pageID PageID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.frames[frameID]; ok {
+		c.unlink(f)
+	}
+
+	f := &lrukFrame{id: frameID, page: pageID}
+	if e, ok := c.retained[pageID]; ok {
+		f.history = c.retainedOrder.Remove(e).(lrukRetained).history
+		delete(c.retained, pageID)
+	}
+	c.frames[frameID] = f
+	c.reference(f)
+}
+
+// reference records a reference of the page of a frame.
+func (c *LRUKCache) reference(f *lrukFrame) {
+	c.clock++
+	copy(f.history[1:], f.history[:LRUKDepth-1])
+	f.history[0] = c.clock
+}
+
+// unlink makes a frame ineligible.
+func (c *LRUKCache) unlink(f *lrukFrame) {
+	if !f.eligible {
+		return
+	}
+
+	f.eligible = false
+	if f.element != nil {
+		c.young.Remove(f.element)
+		f.element = nil
+	} else {
+		heap.Remove(&c.old, f.heapIndex)
+	}
+}
+
+// retain retains the history of an evicted page, forgetting the oldest
+// retained history if there are too many.
+func (c *LRUKCache) retain(page PageID, history [LRUKDepth]uint64) {
+	if e, ok := c.retained[page]; ok {
+		c.retainedOrder.Remove(e)
+	}
+	c.retained[page] = c.retainedOrder.PushBack(lrukRetained{page, history})
+
+	for c.retainedOrder.Len() > c.retainedSize {
+		oldest := c.retainedOrder.Remove(c.retainedOrder.Front()).(lrukRetained)
+		delete(c.retained, oldest.page)
+	}
+}
+
+// lrukHeap is a min-heap of frames by their LRUKDepth-th most recent
+// reference.
+type lrukHeap []*lrukFrame
+
+func (h lrukHeap) Len() int { return len(h) }
+
+func (h lrukHeap) Less(i, j int) bool {
+	return h[i].history[LRUKDepth-1] < h[j].history[LRUKDepth-1]
+}
+
+func (h lrukHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *lrukHeap) Push(x any) {
+	f := x.(*lrukFrame)
+	f.heapIndex = len(*h)
+	*h = append(*h, f)
+}
+
+func (h *lrukHeap) Pop() any {
+	old := *h
+	f := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return f
+}
@@ -0,0 +1,699 @@
+//go:build linux || darwin
+
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// mmapMetaDataFile specifies the name of the file used by the mmap disk to
+// store its meta data.
+const mmapMetaDataFile = "mmap.meta"
+
+// mmapPageFilePattern specifies the (printf-compatible) pattern which is used
+// to determine the name of the page files of the mmap disk.
+const mmapPageFilePattern = "mmap.pages.%d"
+
+// mmapPagesPerFile is the number of pages stored in a single page file of the
+// mmap disk. Each page file is mapped as a whole, such that the mapping never
+// has to move while the file grows.
+const mmapPagesPerFile = 1 << 12
+
+// mmapGrowPages is the minimum number of pages a page file of the mmap disk
+// grows by.
+const mmapGrowPages = 64
+
+// mmapMetaDataMagic identifies the meta data file of an mmap disk.
+const mmapMetaDataMagic = "KVMMAP\x00\x00"
+
+// mmapFormatVersion is the version of the format of the mmap disk. It must be
+// incremented whenever the format changes incompatibly.
+const mmapFormatVersion = 3
+
+// mmapMetaDataSize is the size of the encoded meta data:
+// - 8 bytes magic
+// - 4 bytes format version
+// - 4 bytes page size
+// - 4 bytes next page ID
+// - 4 bytes free list head
+// - 4 bytes number of free pages
+// - 8 bytes checkpoint LSN
+// - 4 bytes checksum
+const mmapMetaDataSize = 8 + 5*4 + 8 + 4
+
+// MmapDisk implements a disk which maps its page files into memory.
+//
+// Each page occupies PageSize bytes of a page file, holding its data followed
+// by its state in the last byte. The data of pages returned by ReadPage and
+// AllocatePage points directly into a private mapping of the page files, such
+// that reading a page neither copies its data nor allocates memory for it,
+// which suits read-mostly workloads. The pages themselves are allocated anew
+// for each call and owned by the buffer pool.
+//
+// As the private mapping is copy-on-write, pages modified through it are never
+// written back by the operating system. WritePage copies a page into a second,
+// shared mapping of the page files instead, and schedules it to be written
+// back via msync. Page files thus only change once pages get written, like
+// those of PersistentDisk, such that the disk can be used with a write-ahead
+// log and any durability. Syncing and closing the disk waits for all written
+// pages to be on stable storage.
+//
+// Each page file is mapped at its full size up front, and only grown on disk
+// as pages get allocated, such that pages handed out never move. Deallocated
+// pages are tracked in a free list, see freeList.
+//
+// This type requires initialization, and as such should only be created via
+// the NewMmapDisk() function. Once all page operations are done, Close() must
+// be called to make the disk persist its meta data. Pages handed out by the
+// disk must not be accessed after it was closed.
+//
+// MmapDisk is safe for concurrent use, but serializes all operations.
+type MmapDisk struct {
+	Directory  string
+	nextPageID PageID
+	free       *freeList
+	files      []*mmapFile
+	// LSN of the last write-ahead log record which is part of the meta
+	// data.
+	lsn uint64
+
+	// mu guards the meta data and the page files. The data of pages
+	// handed out is guarded by the buffer pool.
+	mu sync.Mutex
+}
+
+// mmapFile is a page file of an mmap disk.
+type mmapFile struct {
+	file *os.File
+	// Private and shared mapping of the whole page file, of which the
+	// first size pages exist on disk. The private mapping holds the
+	// current state of all pages, which is copied into the shared one
+	// when written.
+	private []byte
+	shared  []byte
+	size    int
+}
+
+// NewMmapDisk initializes a new mmap disk.
+//
+// If the supplied directory already contains an mmap disk, the disk is
+// initialized from it. Otherwise a new disk is created in this directory.
+//
+// An error is returned if initialization fails.
+func NewMmapDisk(directory string) (Disk, error) {
+	d := &MmapDisk{
+		Directory: directory,
+		free:      newFreeList(noPage, 0),
+	}
+
+	err := d.initialize()
+	if err != nil {
+		d.unmap()
+	}
+
+	return d, err
+}
+
+func (d *MmapDisk) initialize() error {
+	data, err := os.ReadFile(d.metaFilePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Initializing new disk in this directory.
+			return d.writeMetaData(false)
+		}
+		return fmt.Errorf("IO error while trying to read meta data: %v", err)
+	}
+
+	if err := d.decodeMetaData(data); err != nil {
+		return err
+	}
+
+	for first := PageID(0); first < d.nextPageID; first += mmapPagesPerFile {
+		f, err := d.mapFile(len(d.files))
+		if err != nil {
+			return err
+		}
+
+		used := int(util.Min(d.nextPageID-first, mmapPagesPerFile))
+		if f.size < used {
+			return fmt.Errorf("Page file %s holds %d pages, but %d are in use", f.file.Name(), f.size, used)
+		}
+	}
+
+	return nil
+}
+
+// AllocatePage allocates a new unused page.
+//
+// Free pages are reused before the page files are extended.
+//
+// An error is returned if page allocation fails.
+func (d *MmapDisk) AllocatePage() (*Page, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id, ok, err := d.free.pop(d)
+	if err != nil {
+		return &Page{}, err
+	}
+	if !ok {
+		if id, err = d.extend(); err != nil {
+			return &Page{}, err
+		}
+	}
+
+	return d.allocate(id), nil
+}
+
+// DeallocatePage deallocates a page, zeroing its content.
+//
+// Trying to deallocate an unallocated page will be a no-op, not having any effect.
+func (d *MmapDisk) DeallocatePage(id PageID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if id >= d.nextPageID || *d.state(id) != pageAllocated {
+		return
+	}
+
+	d.deallocate(id)
+	d.free.push(id)
+}
+
+// ReadPage returns the page with the specified ID, whose data points into the
+// private mapping.
+//
+// If no page with this ID is allocated, an error is returned.
+func (d *MmapDisk) ReadPage(id PageID) (*Page, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if id >= d.nextPageID || *d.state(id) != pageAllocated {
+		return &Page{}, fmt.Errorf("No page with ID %d on disk", id)
+	}
+
+	return &Page{id: id, data: d.data(id)}, nil
+}
+
+// WritePage writes the given page back to its page file, and schedules it to
+// be written to stable storage.
+//
+// Pages whose data does not point into the private mapping are copied into it
+// first. The page must have previously been allocated via AllocatePage. Trying
+// to write a page beyond all allocated pages will return an error.
+//
+// An error is returned if an IO error is encountered.
+func (d *MmapDisk) WritePage(page *Page) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if page.id >= d.nextPageID {
+		return fmt.Errorf("Unable to write page %d, as it was never allocated", page.id)
+	}
+
+	if data := d.data(page.id); data != page.data {
+		*data = *page.data
+	}
+	*d.state(page.id) = pageAllocated
+
+	f, offset := d.writeBack(page.id)
+
+	return f.sync(offset, PageSize, syscall.MS_ASYNC)
+}
+
+// Occupied returns the number of currently allocated pages.
+func (d *MmapDisk) Occupied() uint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return uint(d.nextPageID) - uint(d.free.pages)
+}
+
+// Capacity returns the maximum number of supported pages.
+func (d *MmapDisk) Capacity() uint {
+	// noPage is not available.
+	return math.MaxUint32
+}
+
+// Close persists the meta data, and unmaps and closes all page files. After
+// having called Close() neither the disk nor any page it handed out must be
+// used anymore.
+//
+// An error is returned if an IO error is encountered.
+func (d *MmapDisk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// All pages written are synced on close, as their write back was
+	// only scheduled.
+	err := d.writeMetaData(true)
+	if unmapErr := d.unmap(); err == nil {
+		err = unmapErr
+	}
+
+	return err
+}
+
+// redoAllocate repeats the allocation of the page with the given ID while
+// recovering from a write-ahead log. Pages which are allocated already are
+// left as they are.
+//
+// An error is returned if AllocatePage would have allocated a different page.
+func (d *MmapDisk) redoAllocate(id PageID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expected, ok, err := d.free.peek(d)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		expected = d.nextPageID
+	}
+	if id != expected {
+		if id < d.nextPageID {
+			free, err := d.free.contains(d, id)
+			if err != nil {
+				return err
+			}
+			if !free {
+				return nil
+			}
+		}
+		return fmt.Errorf("Unable to redo allocation of page %d, as page %d would have been allocated", id, expected)
+	}
+
+	if ok {
+		_, _, err = d.free.pop(d)
+	} else {
+		_, err = d.extend()
+	}
+	if err != nil {
+		return err
+	}
+
+	d.allocate(id)
+
+	return nil
+}
+
+// redoDeallocate repeats the deallocation of the page with the given ID while
+// recovering from a write-ahead log. Pages which are on the free list already
+// are left as they are.
+//
+// Other than DeallocatePage, the page is freed even if it is not allocated, as
+// it might already have been deallocated before the crash.
+//
+// An error is returned if the free list cannot be read.
+func (d *MmapDisk) redoDeallocate(id PageID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if free, err := d.free.contains(d, id); err != nil || free {
+		return err
+	}
+
+	if id < d.nextPageID {
+		d.deallocate(id)
+	}
+	d.free.push(id)
+
+	return nil
+}
+
+// checkpointLSN returns the LSN of the last write-ahead log record which is
+// part of the meta data.
+func (d *MmapDisk) checkpointLSN() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.lsn
+}
+
+// setCheckpointLSN sets the LSN which is stored along with the meta data the
+// next time it is stored.
+func (d *MmapDisk) setCheckpointLSN(lsn uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lsn = lsn
+}
+
+// storeMetaData persists the free list and the meta data. If durable is set,
+// the page files are synced before, and the meta data file after being
+// written.
+func (d *MmapDisk) storeMetaData(durable bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.writeMetaData(durable)
+}
+
+// sync flushes all page files to stable storage.
+//
+// An error is returned if an IO error is encountered.
+func (d *MmapDisk) sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.syncFiles()
+}
+
+// allocate zeroes the page with the given ID, marks it as allocated and hands
+// it out as new page. The caller must hold the mutex.
+func (d *MmapDisk) allocate(id PageID) *Page {
+	data := d.data(id)
+	*data = [PageDataSize]byte{}
+	*d.state(id) = pageAllocated
+	d.writeBack(id)
+
+	return &Page{id: id, data: data}
+}
+
+// deallocate zeroes the page with the given ID, and marks it as free. The
+// caller must hold the mutex.
+func (d *MmapDisk) deallocate(id PageID) {
+	*d.data(id) = [PageDataSize]byte{}
+	*d.state(id) = pageFree
+	d.writeBack(id)
+}
+
+// writeMetaData stores the free list, and then the meta data referencing it,
+// syncing both if durable is set. The caller must hold the mutex, unless the
+// disk is still being initialized.
+func (d *MmapDisk) writeMetaData(durable bool) error {
+	if _, err := d.free.store(d); err != nil {
+		return err
+	}
+
+	// The free list must be on disk before the meta data references it.
+	if durable {
+		if err := d.syncFiles(); err != nil {
+			return err
+		}
+	}
+
+	err := writeFileAtomically(d.metaFilePath(), d.encodeMetaData(), durable)
+	if err != nil {
+		return fmt.Errorf("IO error while trying to write meta data: %v", err)
+	}
+
+	return nil
+}
+
+// syncFiles flushes all page files to stable storage. The caller must hold
+// the mutex.
+func (d *MmapDisk) syncFiles() error {
+	for _, f := range d.files {
+		if err := f.sync(0, f.size*PageSize, syscall.MS_SYNC); err != nil {
+			return err
+		}
+		if err := f.file.Sync(); err != nil {
+			return fmt.Errorf("IO error while syncing %s: %v", f.file.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// unmap unmaps and closes all page files. The caller must hold the mutex.
+func (d *MmapDisk) unmap() error {
+	var err error
+	for _, f := range d.files {
+		for _, data := range [][]byte{f.private, f.shared} {
+			if unmapErr := syscall.Munmap(data); unmapErr != nil && err == nil {
+				err = fmt.Errorf("Error unmapping %s: %v", f.file.Name(), unmapErr)
+			}
+		}
+		if closeErr := f.file.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("IO error while closing %s: %v", f.file.Name(), closeErr)
+		}
+	}
+	d.files = nil
+
+	return err
+}
+
+// extend allocates the page following all existing pages, growing or adding
+// a page file if required. The caller must hold the mutex.
+func (d *MmapDisk) extend() (PageID, error) {
+	if d.nextPageID == noPage {
+		return 0, fmt.Errorf("Unable to allocate page, as all %d pages are in use", d.Capacity())
+	}
+
+	id := d.nextPageID
+	index := int(id / mmapPagesPerFile)
+	if index == len(d.files) {
+		if _, err := d.mapFile(index); err != nil {
+			return 0, err
+		}
+	}
+
+	f, slot := d.locate(id)
+	if err := f.grow(slot + 1); err != nil {
+		return 0, err
+	}
+	d.nextPageID++
+
+	return id, nil
+}
+
+// mapFile opens and maps the page file with the given index, creating it if
+// it does not exist yet. The caller must hold the mutex.
+func (d *MmapDisk) mapFile(index int) (*mmapFile, error) {
+	path := filepath.Join(d.Directory, fmt.Sprintf(mmapPageFilePattern, index))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("IO error while opening page file: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("IO error while reading size of %s: %v", path, err)
+	}
+	if info.Size()%PageSize != 0 {
+		file.Close()
+		return nil, fmt.Errorf("Page file %s of %dB does not consist of whole pages", path, info.Size())
+	}
+
+	f := &mmapFile{
+		file: file,
+		size: int(info.Size() / PageSize),
+	}
+	for _, mapping := range []struct {
+		data  *[]byte
+		flags int
+	}{{&f.private, syscall.MAP_PRIVATE}, {&f.shared, syscall.MAP_SHARED}} {
+		*mapping.data, err = syscall.Mmap(
+			int(file.Fd()),
+			0,
+			mmapPagesPerFile*PageSize,
+			syscall.PROT_READ|syscall.PROT_WRITE,
+			mapping.flags,
+		)
+		if err != nil {
+			if f.private != nil {
+				syscall.Munmap(f.private)
+			}
+			file.Close()
+			return nil, fmt.Errorf("Error mapping %s: %v", path, err)
+		}
+	}
+	d.files = append(d.files, f)
+
+	return f, nil
+}
+
+// locate returns the page file and slot of the page with the given ID. The
+// caller must hold the mutex.
+func (d *MmapDisk) locate(id PageID) (*mmapFile, int) {
+	return d.files[id/mmapPagesPerFile], int(id % mmapPagesPerFile)
+}
+
+// data returns the data of the page with the given ID within the private
+// mapping. The caller must hold the mutex.
+func (d *MmapDisk) data(id PageID) *[PageDataSize]byte {
+	f, slot := d.locate(id)
+
+	return (*[PageDataSize]byte)(f.private[slot*PageSize : slot*PageSize+PageDataSize])
+}
+
+// state returns the state of the page with the given ID within the private
+// mapping. The caller must hold the mutex.
+func (d *MmapDisk) state(id PageID) *byte {
+	f, slot := d.locate(id)
+
+	return &f.private[slot*PageSize+PageSize-1]
+}
+
+// writeBack copies the page with the given ID from the private into the shared
+// mapping, which writes it back to its page file. Returns the page file and
+// the offset of the page within it. The caller must hold the mutex.
+func (d *MmapDisk) writeBack(id PageID) (*mmapFile, int) {
+	f, slot := d.locate(id)
+	offset := slot * PageSize
+	copy(f.shared[offset:offset+PageSize], f.private[offset:offset+PageSize])
+
+	// The private copy of the page now equals the page file, so it is
+	// dropped to free its memory, unless it shares a page of the operating
+	// system with other pages, which might not have been written yet.
+	if os.Getpagesize() <= PageSize {
+		syscall.Madvise(f.private[offset:offset+PageSize], syscall.MADV_DONTNEED)
+	}
+
+	return f, offset
+}
+
+// readFreeListPage reads a page of the free list. The caller must hold the
+// mutex.
+func (d *MmapDisk) readFreeListPage(id PageID) (*[PageDataSize]byte, error) {
+	if id >= d.nextPageID || *d.state(id) != pageFree {
+		return nil, fmt.Errorf("Page %d is not free", id)
+	}
+
+	data := *d.data(id)
+
+	return &data, nil
+}
+
+// writeFreeListPage writes a page of the free list. The caller must hold the
+// mutex.
+func (d *MmapDisk) writeFreeListPage(id PageID, data *[PageDataSize]byte) error {
+	*d.data(id) = *data
+	*d.state(id) = pageFree
+	d.writeBack(id)
+
+	return nil
+}
+
+// pageFiles returns the paths of all page files.
+func (d *MmapDisk) pageFiles() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	paths := make([]string, len(d.files))
+	for i, f := range d.files {
+		paths[i] = f.file.Name()
+	}
+
+	return paths
+}
+
+// freePages returns the number of pages on the free list.
+func (d *MmapDisk) freePages() uint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return uint(d.free.pages)
+}
+
+// metaFilePath returns the file path of the file containing the meta data.
+func (d *MmapDisk) metaFilePath() string {
+	return filepath.Join(d.Directory, mmapMetaDataFile)
+}
+
+// encodeMetaData encodes the disk's meta data into a byte slice. It must only
+// be called once the free list has been stored.
+func (d *MmapDisk) encodeMetaData() []byte {
+	data := make([]byte, mmapMetaDataSize)
+
+	copy(data[0:8], mmapMetaDataMagic)
+	binary.BigEndian.PutUint32(data[8:12], mmapFormatVersion)
+	binary.BigEndian.PutUint32(data[12:16], PageSize)
+	binary.BigEndian.PutUint32(data[16:20], uint32(d.nextPageID))
+	binary.BigEndian.PutUint32(data[20:24], uint32(d.free.head))
+	binary.BigEndian.PutUint32(data[24:28], d.free.pages)
+	binary.BigEndian.PutUint64(data[28:36], d.lsn)
+
+	checksum := crc32.ChecksumIEEE(data[:mmapMetaDataSize-4])
+	binary.BigEndian.PutUint32(data[mmapMetaDataSize-4:], checksum)
+
+	return data
+}
+
+// decodeMetaData decodes meta data and sets the disk's meta data to it.
+//
+// If the provided binary data is not a valid encoding, or the page files were
+// written with a different page size, an error is returned. The disk's
+// meta data is not affected if this is the case.
+func (d *MmapDisk) decodeMetaData(data []byte) error {
+	if len(data) != mmapMetaDataSize || !bytes.Equal(data[0:8], []byte(mmapMetaDataMagic)) {
+		return fmt.Errorf("File %s is no mmap disk meta data", d.metaFilePath())
+	}
+
+	checksum := binary.BigEndian.Uint32(data[mmapMetaDataSize-4:])
+	newChecksum := crc32.ChecksumIEEE(data[:mmapMetaDataSize-4])
+	if newChecksum != checksum {
+		return fmt.Errorf("Checksum in file different from checksum calculated from data: %x != %x", checksum, newChecksum)
+	}
+
+	version := binary.BigEndian.Uint32(data[8:12])
+	if version != mmapFormatVersion {
+		return fmt.Errorf("Disk has format version %d, but only version %d is supported", version, mmapFormatVersion)
+	}
+	if pageSize := binary.BigEndian.Uint32(data[12:16]); pageSize != PageSize {
+		return fmt.Errorf("Disk stores pages of %dB, but this build requires %dB", pageSize, PageSize)
+	}
+
+	d.nextPageID = PageID(binary.BigEndian.Uint32(data[16:20]))
+	d.free = newFreeList(
+		PageID(binary.BigEndian.Uint32(data[20:24])),
+		binary.BigEndian.Uint32(data[24:28]),
+	)
+	d.lsn = binary.BigEndian.Uint64(data[28:36])
+
+	return nil
+}
+
+// sync commits the given range of the shared mapping to the page file, using
+// the given msync flags. With MS_SYNC it waits for the range to be on stable
+// storage, with MS_ASYNC it merely schedules it to be written.
+func (f *mmapFile) sync(offset int, length int, flags int) error {
+	if length == 0 {
+		return nil
+	}
+
+	// The start of the range must be aligned to the page size of the
+	// operating system.
+	start := offset &^ (os.Getpagesize() - 1)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&f.shared[start])),
+		uintptr(offset+length-start),
+		uintptr(flags),
+	)
+	if errno != 0 {
+		return fmt.Errorf("IO error while syncing %s: %v", f.file.Name(), errno)
+	}
+
+	return nil
+}
+
+// grow grows the page file on disk to hold at least the given number of
+// pages.
+func (f *mmapFile) grow(pages int) error {
+	if pages <= f.size {
+		return nil
+	}
+
+	size := util.Min(util.Max(pages, f.size+mmapGrowPages), mmapPagesPerFile)
+	if err := f.file.Truncate(int64(size * PageSize)); err != nil {
+		return fmt.Errorf("IO error while growing %s: %v", f.file.Name(), err)
+	}
+	f.size = size
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin)
+
+package kv
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// NewMmapDisk is not supported on this platform, and always returns an error.
+func NewMmapDisk(directory string) (Disk, error) {
+	return nil, fmt.Errorf("Memory-mapped disks are not supported on %s", runtime.GOOS)
+}
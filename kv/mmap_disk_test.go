@@ -0,0 +1,200 @@
+//go:build linux || darwin
+
+package kv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+func newMmapDisk(t *testing.T, dir string) *MmapDisk {
+	disk, err := NewMmapDisk(dir)
+	if err != nil {
+		t.Fatalf("Error creating mmap disk: %v", err)
+	}
+
+	return disk.(*MmapDisk)
+}
+
+func TestMmapDisk_PagesPointIntoMapping(t *testing.T) {
+	disk := newMmapDisk(t, helper.GetTempDir(t, "mmap_disk"))
+	defer disk.Close()
+
+	page, err := disk.AllocatePage()
+	if err != nil {
+		t.Fatalf("Error allocating page: %v", err)
+	}
+	page.data[0] = 42
+
+	read, err := disk.ReadPage(page.id)
+	if err != nil {
+		t.Fatalf("Error reading page: %v", err)
+	}
+	if read.data != page.data {
+		t.Errorf("Expected the page read to share its data with the page allocated")
+	}
+	if read.data[0] != 42 {
+		t.Errorf("Expected page to start with 42; got %d", read.data[0])
+	}
+}
+
+func TestMmapDisk_GrowsAcrossPageFiles(t *testing.T) {
+	dir := helper.GetTempDir(t, "mmap_disk")
+	disk := newMmapDisk(t, dir)
+
+	numPages := mmapPagesPerFile + mmapGrowPages + 1
+	pages := make([]*Page, numPages)
+	for i := range pages {
+		page, err := disk.AllocatePage()
+		if err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+		page.data[0] = byte(i)
+		page.data[PageDataSize-1] = byte(i >> 8)
+		pages[i] = page
+	}
+
+	// Pages handed out must not move while the page files grow.
+	for i, page := range pages {
+		if page.data[0] != byte(i) {
+			t.Fatalf("Expected page %d to start with %d; got %d", page.id, byte(i), page.data[0])
+		}
+		if err := disk.WritePage(page); err != nil {
+			t.Fatalf("Error writing page: %v", err)
+		}
+	}
+
+	for _, page := range pages[:100] {
+		disk.DeallocatePage(page.id)
+	}
+
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+	disk = newMmapDisk(t, dir)
+	defer disk.Close()
+
+	if disk.Occupied() != uint(numPages-100) {
+		t.Errorf("Expected %d occupied pages after reopening; got %d", numPages-100, disk.Occupied())
+	}
+	for i := 100; i < numPages; i++ {
+		page, err := disk.ReadPage(PageID(i))
+		if err != nil {
+			t.Fatalf("Error reading page %d: %v", i, err)
+		}
+		if page.data[0] != byte(i) || page.data[PageDataSize-1] != byte(i>>8) {
+			t.Fatalf("Expected page %d to hold %d; got %d", i, i, page.data[0])
+		}
+	}
+	if _, err := disk.ReadPage(0); err == nil {
+		t.Errorf("Expected error reading deallocated page; got none")
+	}
+
+	// Deallocated pages are reused before the page files grow, except the
+	// one holding the free list.
+	for i := 0; i < 99; i++ {
+		page, err := disk.AllocatePage()
+		if err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+		if page.id >= 100 {
+			t.Fatalf("Expected deallocated page to be reused; got page %d", page.id)
+		}
+	}
+}
+
+func TestMmapDisk_KeepsUnwrittenModificationsOffDisk(t *testing.T) {
+	dir := helper.GetTempDir(t, "mmap_disk")
+	disk := newMmapDisk(t, dir)
+
+	page, err := disk.AllocatePage()
+	if err != nil {
+		t.Fatalf("Error allocating page: %v", err)
+	}
+	page.data[0] = 1
+	if err := disk.WritePage(page); err != nil {
+		t.Fatalf("Error writing page: %v", err)
+	}
+	page.data[0] = 2
+
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+	disk = newMmapDisk(t, dir)
+	defer disk.Close()
+
+	read, err := disk.ReadPage(page.id)
+	if err != nil {
+		t.Fatalf("Error reading page: %v", err)
+	}
+	if read.data[0] != 1 {
+		t.Errorf("Expected page to start with the 1 written; got %d", read.data[0])
+	}
+}
+
+func TestMmapDisk_BTree(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("WAL=%v", wal), func(t *testing.T) {
+			testMmapDiskBTree(t, wal)
+		})
+	}
+}
+
+func testMmapDiskBTree(t *testing.T, wal bool) {
+	config := KvStoreConfig{
+		MemorySize:           16 * PageSize,
+		WorkingDirectory:     helper.GetTempDir(t, "mmap_tree"),
+		DisableWriteAheadLog: !wal,
+		Durability:           DurabilityOnClose,
+		Storage:              StorageMmap,
+	}
+
+	tree := &BTree{}
+	if err := tree.Create(config); err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+
+	keys := make([]uint64, 5_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	for _, key := range keys[:2_500] {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+	if wal {
+		tree = crashAndRecover(t, tree, config)
+	} else {
+		if err := tree.Close(); err != nil {
+			t.Fatalf("Error closing tree: %v", err)
+		}
+		tree = &BTree{}
+		if err := tree.Open(config); err != nil {
+			t.Fatalf("Error opening tree: %v", err)
+		}
+	}
+	defer tree.Close()
+
+	for i, key := range keys {
+		value, err := tree.Get(key)
+		if i < 2_500 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected deleted key %d not to be found; got %v", key, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error getting key %d: %v", key, err)
+		}
+		if value != [10]byte{byte(key)} {
+			t.Fatalf("Expected value %d for key %d; got %v", byte(key), key, value)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package kv
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+const (
+	// OverflowMarker is the value at IsLeafIndex which marks a page as an OverflowPage.
+	OverflowMarker = 2
+
+	// OverflowNextIndex is the starting index for the PageID of the next page in an overflow chain.
+	OverflowNextIndex = 1
+
+	// OverflowDataStartIndex is the starting index for the value bytes stored in an OverflowPage.
+	OverflowDataStartIndex = OverflowNextIndex + 4
+
+	// OverflowDataSize is the number of value bytes an OverflowPage may hold.
+	OverflowDataSize = PageDataSize - OverflowDataStartIndex
+)
+
+/*
+OverflowPage is a page holding a part of a value which is too large to be stored within a leaf node.
+
+Overflow pages form a singly linked chain, the last page pointing to NoSibling.
+The total length of the value is stored within the leaf, such that only the
+last page of a chain may be partially filled.
+
+An OverflowPage is a transmutation of a Page.
+Any mutation on an OverflowPage therefore writes directly to a Page and should update the isDirty flag accordingly.
+*/
+type OverflowPage struct {
+	id      *PageID
+	isDirty *bool
+	next    *PageID
+	data    []byte
+}
+
+// isOverflowPage returns whether a page holds an OverflowPage.
+func isOverflowPage(page *Page) bool {
+	return page.data[IsLeafIndex] == OverflowMarker
+}
+
+// RawOverflowFrom explicitly transmutes a Page into an OverflowPage.
+// If IsLeafIndex has the wrong value it gets corrected and the page gets marked as isDirty.
+func RawOverflowFrom(page *Page) *OverflowPage {
+	if page.data[IsLeafIndex] != OverflowMarker {
+		page.data[IsLeafIndex] = OverflowMarker
+		page.isDirty = true
+	}
+	next := (*PageID)(unsafe.Pointer(&page.data[OverflowNextIndex]))
+	data := page.data[OverflowDataStartIndex:]
+
+	return &OverflowPage{&page.id, &page.isDirty, next, data}
+}
+
+// storeValue prepares a value of arbitrary size for storage within a leaf.
+// Values larger than MaxInlineValueSize get written to a new overflow chain.
+func (b *BufferPool) storeValue(value []byte) (leafValue, error) {
+	if len(value) <= MaxInlineValueSize {
+		v := leafValue{size: uint8(len(value))}
+		copy(v.data[:], value)
+		return v, nil
+	}
+
+	if uint64(len(value)) > math.MaxUint32 {
+		return leafValue{}, fmt.Errorf("value of %dB exceeds maximum size of %dB", len(value), uint32(math.MaxUint32))
+	}
+
+	first, err := b.writeOverflow(value)
+	if err != nil {
+		return leafValue{}, err
+	}
+
+	return overflowValue(first, uint32(len(value))), nil
+}
+
+// loadValue returns the full value of a leaf value slot, reading its
+// overflow chain if required.
+func (b *BufferPool) loadValue(v leafValue) ([]byte, error) {
+	if v.isOverflow() {
+		return b.readOverflow(v.overflow())
+	}
+
+	value := make([]byte, v.size)
+	copy(value, v.data[:v.size])
+
+	return value, nil
+}
+
+// freeValue releases the overflow chain of a leaf value slot, if any.
+func (b *BufferPool) freeValue(v leafValue) error {
+	if !v.isOverflow() {
+		return nil
+	}
+
+	first, _ := v.overflow()
+	return b.freeOverflow(first)
+}
+
+// fixedValue returns the value of a leaf value slot as a fixed-size array.
+// Inline values shorter than 10 bytes are zero-padded.
+// If the value is stored in overflow pages, ErrValueTooLarge is returned.
+func fixedValue(v leafValue) ([10]byte, error) {
+	if v.isOverflow() {
+		return [10]byte{}, ErrValueTooLarge
+	}
+
+	value := [10]byte{}
+	copy(value[:], v.data[:v.size])
+
+	return value, nil
+}
+
+// writeOverflow writes a value to a new chain of overflow pages, returning
+// the PageID of the first page of the chain.
+//
+// If writing fails, all pages allocated so far get freed again.
+func (b *BufferPool) writeOverflow(value []byte) (PageID, error) {
+	first := NoSibling
+	var previous *OverflowPage
+
+	for offset := 0; offset < len(value); offset += OverflowDataSize {
+		page, err := b.NewPage()
+		if err != nil {
+			if previous != nil {
+				b.UnpinPage(*previous.id, true)
+			}
+			if first != NoSibling {
+				if freeErr := b.freeOverflow(first); freeErr != nil {
+					err = fmt.Errorf("%v; additionally unable to free partial overflow chain: %v", err, freeErr)
+				}
+			}
+			return NoSibling, err
+		}
+
+		current := RawOverflowFrom(page)
+		*current.next = NoSibling
+		copy(current.data, value[offset:])
+		*current.isDirty = true
+
+		if previous == nil {
+			first = *current.id
+		} else {
+			*previous.next = *current.id
+			b.UnpinPage(*previous.id, true)
+		}
+		previous = current
+	}
+
+	b.UnpinPage(*previous.id, true)
+
+	return first, nil
+}
+
+// readOverflow reads a value of the given length from a chain of overflow
+// pages.
+func (b *BufferPool) readOverflow(first PageID, length uint32) ([]byte, error) {
+	value := make([]byte, length)
+
+	id := first
+	for offset := 0; offset < len(value); offset += OverflowDataSize {
+		if id == NoSibling {
+			return nil, fmt.Errorf("overflow chain starting at page %d ends prematurely", first)
+		}
+
+		page, err := b.FetchPage(id)
+		if err != nil {
+			return nil, err
+		}
+		if !isOverflowPage(page) {
+			b.UnpinPage(id, false)
+			return nil, fmt.Errorf("page %d in overflow chain starting at page %d is no overflow page", id, first)
+		}
+
+		current := RawOverflowFrom(page)
+		copy(value[offset:], current.data)
+		id = *current.next
+
+		b.UnpinPage(page.id, false)
+	}
+
+	return value, nil
+}
+
+// freeOverflow deletes all pages of an overflow chain.
+//
+// A page which is no overflow page ends the chain with an error, without being
+// deleted, as it is likely in use otherwise.
+func (b *BufferPool) freeOverflow(first PageID) error {
+	for id := first; id != NoSibling; {
+		page, err := b.FetchPage(id)
+		if err != nil {
+			return err
+		}
+		if !isOverflowPage(page) {
+			b.UnpinPage(id, false)
+			return fmt.Errorf("page %d in overflow chain starting at page %d is no overflow page", id, first)
+		}
+
+		next := *RawOverflowFrom(page).next
+		if err := b.UnpinAndDeletePage(id); err != nil {
+			return err
+		}
+
+		id = next
+	}
+
+	return nil
+}
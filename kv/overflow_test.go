@@ -0,0 +1,212 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// randomBytes returns a deterministic pseudo-random byte slice of given length.
+func randomBytes(length int, seed int64) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+
+	return data
+}
+
+func TestPutAndGetBytes(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+
+	tests := []struct {
+		key   uint64
+		value []byte
+	}{
+		{1, []byte{}},
+		{2, []byte{1, 2, 3}},
+		{3, randomBytes(MaxInlineValueSize, 3)},
+		{4, randomBytes(MaxInlineValueSize+1, 4)},
+		{5, randomBytes(OverflowDataSize, 5)},
+		{6, randomBytes(3*OverflowDataSize+17, 6)},
+	}
+
+	for _, test := range tests {
+		err := kv.PutBytes(test.key, test.value)
+		if err != nil {
+			t.Fatalf("Error putting %dB value for key %d: %v", len(test.value), test.key, err)
+		}
+	}
+
+	for _, test := range tests {
+		val, err := kv.GetBytes(test.key)
+		if err != nil {
+			t.Fatalf("Error getting key %d: %v", test.key, err)
+		}
+		if !bytes.Equal(val, test.value) {
+			t.Errorf("Got unexpected %dB value for key %d; expected %dB value", len(val), test.key, len(test.value))
+		}
+	}
+
+	// Fixed-size values are zero-padded, or too large
+	val, err := kv.Get(2)
+	if err != nil || val != [10]byte{1, 2, 3} {
+		t.Errorf("Got %v, %v for short value; expected %v", val, err, [10]byte{1, 2, 3})
+	}
+	_, err = kv.Get(4)
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge when getting large value as fixed-size array; got %v", err)
+	}
+
+	// Fixed-size values are readable as byte slice
+	err = kv.Put(7, [10]byte{7})
+	if err != nil {
+		t.Fatalf("Error putting fixed-size value: %v", err)
+	}
+	bytesVal, err := kv.GetBytes(7)
+	if err != nil || !bytes.Equal(bytesVal, []byte{7, 0, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Got %v, %v for fixed-size value; expected it zero-padded to 10 bytes", bytesVal, err)
+	}
+}
+
+func TestOverflowPagesAreReclaimed(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+	tree := kv.(*BTree)
+
+	occupied := tree.bufferPool.disk.Occupied()
+
+	err := kv.PutBytes(1, randomBytes(5*OverflowDataSize, 1))
+	if err != nil {
+		t.Fatalf("Error putting large value: %v", err)
+	}
+	if tree.bufferPool.disk.Occupied() != occupied+5 {
+		t.Errorf("Expected value to occupy 5 overflow pages; occupies %d", tree.bufferPool.disk.Occupied()-occupied)
+	}
+
+	// Failing to insert must not leak pages
+	err = kv.PutBytes(1, randomBytes(2*OverflowDataSize, 2))
+	if !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists when putting existing key; got %v", err)
+	}
+	if tree.bufferPool.disk.Occupied() != occupied+5 {
+		t.Errorf("Expected failed put not to leak pages; %d pages occupied by value", tree.bufferPool.disk.Occupied()-occupied)
+	}
+
+	expected := randomBytes(2*OverflowDataSize, 3)
+	err = kv.UpsertBytes(1, expected)
+	if err != nil {
+		t.Fatalf("Error upserting large value: %v", err)
+	}
+	if tree.bufferPool.disk.Occupied() != occupied+2 {
+		t.Errorf("Expected replaced value to be reclaimed; %d pages occupied by value", tree.bufferPool.disk.Occupied()-occupied)
+	}
+	val, err := kv.GetBytes(1)
+	if err != nil || !bytes.Equal(val, expected) {
+		t.Errorf("Got unexpected value after upsert: %v", err)
+	}
+
+	err = kv.UpdateBytes(1, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatalf("Error updating to small value: %v", err)
+	}
+	if tree.bufferPool.disk.Occupied() != occupied {
+		t.Errorf("Expected value replaced by inline value to be reclaimed; %d pages occupied by value", tree.bufferPool.disk.Occupied()-occupied)
+	}
+
+	err = kv.UpdateBytes(1, randomBytes(OverflowDataSize+1, 4))
+	if err != nil {
+		t.Fatalf("Error updating to large value: %v", err)
+	}
+	err = kv.Delete(1)
+	if err != nil {
+		t.Fatalf("Error deleting large value: %v", err)
+	}
+	if tree.bufferPool.disk.Occupied() != occupied {
+		t.Errorf("Expected deleted value to be reclaimed; %d pages occupied by value", tree.bufferPool.disk.Occupied()-occupied)
+	}
+}
+
+func TestOverflowValuesSurviveReopen(t *testing.T) {
+	kv, dir := helper.GetEmptyInstanceWithMemoryLimit(16 * PageSize)
+
+	values := make(map[uint64][]byte)
+	for i := uint64(0); i < 50; i++ {
+		values[i] = randomBytes(int(i)*PageSize/4, int64(i))
+		err := kv.PutBytes(i, values[i])
+		if err != nil {
+			t.Fatalf("Error putting key %d: %v", i, err)
+		}
+	}
+
+	err := kv.Close()
+	if err != nil {
+		t.Fatalf("Error closing KV store: %v", err)
+	}
+
+	newKV := BTree{}
+	err = newKV.Open(KvStoreConfig{
+		MemorySize:       16 * PageSize,
+		WorkingDirectory: dir,
+	})
+	if err != nil {
+		t.Fatalf("Error opening KV store: %v", err)
+	}
+
+	c := newKV.Cursor()
+	defer c.Close()
+	count := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		val, err := c.ValueBytes()
+		if err != nil {
+			t.Fatalf("Error reading value of key %d: %v", c.Key(), err)
+		}
+		if !bytes.Equal(val, values[c.Key()]) {
+			t.Errorf("Got unexpected value for key %d after reopening", c.Key())
+		}
+		count++
+	}
+	if count != len(values) {
+		t.Errorf("Found %d keys after reopening; expected %d", count, len(values))
+	}
+}
+
+func TestOverflowChainRejectsOtherPages(t *testing.T) {
+	kv, _ := helper.GetEmptyInstance()
+	b := &kv.(*BTree).bufferPool
+
+	value := randomBytes(3*OverflowDataSize, 1)
+	first, err := b.writeOverflow(value)
+	if err != nil {
+		t.Fatalf("Error writing overflow chain: %v", err)
+	}
+
+	// Turn the second page of the chain into a leaf
+	page, err := b.FetchPage(first)
+	if err != nil {
+		t.Fatalf("Error fetching first page of chain: %v", err)
+	}
+	second := *RawOverflowFrom(page).next
+	b.UnpinPage(first, false)
+	page, err = b.FetchPage(second)
+	if err != nil {
+		t.Fatalf("Error fetching second page of chain: %v", err)
+	}
+	page.data[IsLeafIndex] = 1
+	b.UnpinPage(second, true)
+
+	if _, err := b.readOverflow(first, uint32(len(value))); err == nil {
+		t.Errorf("Expected error reading chain containing leaf %d", second)
+	}
+
+	occupied := b.disk.Occupied()
+	if err := b.freeOverflow(first); err == nil {
+		t.Errorf("Expected error freeing chain containing leaf %d", second)
+	}
+	if b.disk.Occupied() != occupied-1 {
+		t.Errorf("Expected only the first page of the chain to be freed; %d freed", occupied-b.disk.Occupied())
+	}
+	if page, err := b.FetchPage(second); err != nil || isOverflowPage(page) {
+		t.Errorf("Expected leaf %d to remain; got %v", second, err)
+	} else {
+		b.UnpinPage(second, false)
+	}
+}
@@ -1,6 +1,10 @@
 package kv
 
-import "bytes"
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
 
 // PageSize is the default page size of a whole page.
 const PageSize = 4096
@@ -21,18 +25,52 @@ Page is a fixed-length block of PageSize that contains some bytes of metadata an
 type Page struct {
 	// id of the page.
 	id PageID
-	// pinCount tracks the number of concurrent accesses.
-	pinCount uint16
+	// pinCount tracks the number of concurrent accesses. It must only be
+	// accessed atomically.
+	pinCount int32
+	// frameID is the frame of the buffer pool the page is cached in.
+	frameID FrameID
 	// isDirty indicates the page was modified after being read.
 	isDirty bool
-	// data stores the raw node data.
-	data [PageDataSize]byte
+	// latch guards the data of the page against concurrent access. It must
+	// only be taken while the page is pinned.
+	latch sync.RWMutex
+	// data stores the raw node data. It usually belongs to the page alone,
+	// but might point into memory managed by the disk, see MmapDisk.
+	data *[PageDataSize]byte
 }
 
-// decrementPinCount decrements the pin count unless it was 0 already.
-func (p *Page) decrementPinCount() {
-	if p.pinCount > 0 {
-		p.pinCount--
+// newPage returns a page with the given ID, holding zeroed data of its own.
+func newPage(id PageID) *Page {
+	return &Page{id: id, data: new([PageDataSize]byte)}
+}
+
+// pin increments the pin count, returning the new pin count.
+func (p *Page) pin() int32 {
+	return atomic.AddInt32(&p.pinCount, 1)
+}
+
+// pins returns the current pin count.
+func (p *Page) pins() int32 {
+	return atomic.LoadInt32(&p.pinCount)
+}
+
+// setPins sets the pin count of a page nobody else can access yet.
+func (p *Page) setPins(pins int32) {
+	atomic.StoreInt32(&p.pinCount, pins)
+}
+
+// decrementPinCount decrements the pin count unless it was 0 already,
+// returning the new pin count.
+func (p *Page) decrementPinCount() int32 {
+	for {
+		pins := atomic.LoadInt32(&p.pinCount)
+		if pins == 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt32(&p.pinCount, pins, pins-1) {
+			return pins - 1
+		}
 	}
 }
 
@@ -45,7 +83,7 @@ func (p *Page) Equal(other *Page) bool {
 		return false
 	}
 
-	if p.pinCount != other.pinCount {
+	if p.pins() != other.pins() {
 		return false
 	}
 
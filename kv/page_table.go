@@ -0,0 +1,165 @@
+package kv
+
+import "sync"
+
+// pageTableShards is the number of shards of a pageTable.
+const pageTableShards = 64
+
+/*
+pageTable maps the IDs of all pages cached by a BufferPool to their pages.
+
+The table is split into shards, each guarded by its own lock, such that
+lookups of different pages rarely contend. Pages are assigned to shards by
+their ID.
+
+Pages are only ever pinned while the lock of their shard is held, and only
+evicted while holding it exclusively. This ensures that a page which is pinned
+by anyone is never evicted.
+*/
+type pageTable struct {
+	shards [pageTableShards]pageTableShard
+}
+
+// pageTableShard is a single shard of a pageTable.
+type pageTableShard struct {
+	sync.RWMutex
+	pages map[PageID]*Page
+}
+
+// newPageTable creates a new page table for a buffer pool of the given size.
+func newPageTable(size uint) *pageTable {
+	t := &pageTable{}
+	for i := range t.shards {
+		t.shards[i].pages = make(map[PageID]*Page, size/pageTableShards+1)
+	}
+
+	return t
+}
+
+// shard returns the shard a page is assigned to.
+func (t *pageTable) shard(id PageID) *pageTableShard {
+	return &t.shards[uint(id)%pageTableShards]
+}
+
+// get returns the cached page with the given ID, if any.
+func (t *pageTable) get(id PageID) (*Page, bool) {
+	s := t.shard(id)
+	s.RLock()
+	defer s.RUnlock()
+
+	page, ok := s.pages[id]
+	return page, ok
+}
+
+// pin pins the cached page with the given ID, if any. Returns the page and
+// whether it was unpinned before.
+func (t *pageTable) pin(id PageID) (page *Page, first bool, ok bool) {
+	s := t.shard(id)
+	s.RLock()
+	defer s.RUnlock()
+
+	page, ok = s.pages[id]
+	if !ok {
+		return nil, false, false
+	}
+
+	return page, page.pin() == 1, true
+}
+
+// insert caches a page loaded into the given frame, pinning it once. If the
+// page got cached concurrently by someone else, the cached page is pinned
+// instead and returned along with false.
+func (t *pageTable) insert(page *Page, frameID FrameID) (*Page, bool) {
+	s := t.shard(page.id)
+	s.Lock()
+	defer s.Unlock()
+
+	if cached, ok := s.pages[page.id]; ok {
+		cached.pin()
+		return cached, false
+	}
+
+	page.frameID = frameID
+	page.setPins(1)
+	s.pages[page.id] = page
+
+	return page, true
+}
+
+// remove removes a page from the table, unless it is pinned or not cached in
+// the given frame anymore. Returns whether the page got removed.
+//
+// If given, flush is called before removing the page, while it can't be
+// pinned by anyone. The page is kept if flush fails.
+func (t *pageTable) remove(page *Page, frameID FrameID, flush func(*Page) error) (bool, error) {
+	s := t.shard(page.id)
+	s.Lock()
+	defer s.Unlock()
+
+	// The frame ID may only be read once the page is known to be cached,
+	// as it is written while caching the page.
+	if s.pages[page.id] != page || page.frameID != frameID || page.pins() > 0 {
+		return false, nil
+	}
+
+	if flush != nil {
+		if err := flush(page); err != nil {
+			return false, err
+		}
+	}
+	delete(s.pages, page.id)
+
+	return true, nil
+}
+
+// locked calls fn with a page while it can't be removed from the table,
+// unless it isn't cached anymore. As removing a page flushes it, this keeps a
+// page from being flushed twice at once.
+func (t *pageTable) locked(page *Page, fn func(*Page) error) error {
+	s := t.shard(page.id)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pages[page.id] != page {
+		return nil
+	}
+
+	return fn(page)
+}
+
+// drop removes a page from the table, regardless of whether it is pinned.
+func (t *pageTable) drop(id PageID) {
+	s := t.shard(id)
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.pages, id)
+}
+
+// len returns the number of cached pages.
+func (t *pageTable) len() int {
+	n := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.RLock()
+		n += len(s.pages)
+		s.RUnlock()
+	}
+
+	return n
+}
+
+// all returns all cached pages.
+func (t *pageTable) all() []*Page {
+	var pages []*Page
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.RLock()
+		for _, page := range s.pages {
+			pages = append(pages, page)
+		}
+		s.RUnlock()
+	}
+
+	return pages
+}
@@ -17,6 +17,12 @@ import (
 // there is no need to manually close or flush the file. As such a value of
 // type PageFile can be discarded at any time with no cleanup required.
 //
+// Alternatively, a page file can be opened via the Open() method. An opened
+// page file keeps its OS file open and its meta data in memory, only storing
+// the meta data on Flush() and Close(). This saves opening the file as well as
+// rewriting the meta data on every access, but requires Close() to be called
+// once done.
+//
 // Known limitations:
 // - The metadata structure of a page file, which governs where in the file a
 //   page is persisted, is rather naive. This will likely cause scalability
@@ -30,6 +36,18 @@ type PageFile struct {
 	PageCount uint32
 	// PageLocations is the offset in bytes where the page with the given ID starts in the file.
 	PageLocations map[PageID]uint32
+
+	// file is the OS file of an opened page file, nil otherwise.
+	file *os.File
+	// metaDataDirty is set if the meta data of an opened page file changed
+	// since it was last stored.
+	metaDataDirty bool
+	// occupied tracks which slots of the file hold a page, with slot i
+	// starting at offset (i+1) * PageSize. It is built from PageLocations
+	// when first needed.
+	occupied []bool
+	// firstFree is a lower bound of the first unoccupied slot.
+	firstFree int
 }
 
 // DeallocatePage deallocates the page with the passed ID.
@@ -46,13 +64,22 @@ func (pf *PageFile) DeallocatePage(id PageID) error {
 		return fmt.Errorf("No page with ID %d in this page file", id)
 	}
 
-	// Zero page
-	file, err := os.OpenFile(pf.Path, os.O_WRONLY, 0666)
+	file, done, err := pf.osFile(os.O_RDWR)
 	if err != nil {
 		return fmt.Errorf("IO error while trying to open page file: %v", err)
 	}
-	defer file.Close()
+	defer done()
+
+	state := make([]byte, 1)
+	_, err = file.ReadAt(state, int64(offset)+PageSize-1)
+	if err != nil {
+		return fmt.Errorf("IO error while trying to read from page file: %v", err)
+	}
+	if state[0] == pageFree {
+		return fmt.Errorf("No page with ID %d in this page file", id)
+	}
 
+	// Zero page
 	emptyPage := make([]byte, PageDataSize)
 	_, err = file.WriteAt(emptyPage, int64(offset))
 	if err != nil {
@@ -61,8 +88,9 @@ func (pf *PageFile) DeallocatePage(id PageID) error {
 
 	delete(pf.PageLocations, id)
 	pf.PageCount--
+	pf.release(offset)
 	// Persist meta data as we changed the lookup map
-	err = pf.storeMetaData()
+	err = pf.metaDataChanged()
 	if err != nil {
 		return err
 	}
@@ -74,13 +102,22 @@ func (pf *PageFile) DeallocatePage(id PageID) error {
 //
 // If an IO error is encountered or the file is full, an error is returned.
 func (pf *PageFile) WritePage(page *Page) error {
+	return pf.writePage(page.id, page.data, pageAllocated)
+}
+
+// writePage writes the data of the page with the given ID to the file, along
+// with its state. Pages in state pageFree hold a free list, and can neither be
+// read nor deallocated as regular pages.
+//
+// If an IO error is encountered or the file is full, an error is returned.
+func (pf *PageFile) writePage(id PageID, pageData *[PageDataSize]byte, state byte) error {
 	var offset uint32
 	metaDataDirty := false // Whether we must flush the PageFile's meta data
 
-	_, exist := pf.PageLocations[page.id]
+	_, exist := pf.PageLocations[id]
 	if exist {
 		// Page ID already present in file, we'll overwrite
-		offset = pf.PageLocations[page.id]
+		offset = pf.PageLocations[id]
 	} else {
 		var err error
 		offset, err = pf.findEmptyOffset()
@@ -91,8 +128,9 @@ func (pf *PageFile) WritePage(page *Page) error {
 
 		// Page ID new to this file, we'll add to the lookup map and mark our meta data as dirty
 		metaDataDirty = true
-		pf.PageLocations[page.id] = offset
+		pf.PageLocations[id] = offset
 		pf.PageCount++
+		pf.occupy(offset)
 	}
 
 	data := make([]byte, PageSize)
@@ -104,17 +142,22 @@ func (pf *PageFile) WritePage(page *Page) error {
 	// and then will with the actual page data.
 
 	// Four bytes of checksum
-	checksum := crc32.ChecksumIEEE(page.data[:])
+	checksum := crc32.ChecksumIEEE(pageData[:])
 	binary.BigEndian.PutUint32(data[0:4], checksum)
 
 	// Then the PageDataSize bytes of page data
-	copy(data[4:PageDataSize+4], page.data[:])
+	copy(data[4:PageDataSize+4], pageData[:])
+
+	// And the page's state in the last byte. Page files written before
+	// states were introduced hold pageUnused, which we treat like
+	// pageAllocated.
+	data[PageSize-1] = state
 
-	file, err := os.OpenFile(pf.Path, os.O_WRONLY, 0666)
+	file, done, err := pf.osFile(os.O_WRONLY)
 	if err != nil {
 		return fmt.Errorf("IO error while trying to open page file: %v", err)
 	}
-	defer file.Close()
+	defer done()
 
 	_, err = file.WriteAt(data, int64(offset))
 	if err != nil {
@@ -122,7 +165,7 @@ func (pf *PageFile) WritePage(page *Page) error {
 	}
 
 	if metaDataDirty {
-		err = pf.storeMetaData()
+		err = pf.metaDataChanged()
 		if err != nil {
 			return err
 		}
@@ -141,23 +184,20 @@ func (pf *PageFile) findEmptyOffset() (uint32, error) {
 		return offset, fmt.Errorf("No space left in this page file")
 	}
 
-	// This is a very brute-force approach, but given:
-	// - The lower number of pages per page file
-	// - The frequency at which a new page will be written
-	// This seems ok as an MVP.
-	occupied := make(map[uint32]bool)
-	for _, v := range pf.PageLocations {
-		occupied[v] = true
+	if pf.occupied == nil {
+		pf.occupied = make([]bool, pf.Capacity)
+		for _, v := range pf.PageLocations {
+			pf.occupied[v/PageSize-1] = true
+		}
+		pf.firstFree = 0
 	}
 
 	// First page is for meta data, so the lowest allowed byte offset for
-	// an actual page is PageSize
-	// <= Because we want to support pf.Capacity *pages*, not counting the
-	// one used for meta data.
-	for i := uint32(PageSize); i <= pf.Capacity*PageSize; i += PageSize {
-		_, exist := occupied[i]
-		if !exist {
-			return i, nil
+	// an actual page is PageSize, which is slot 0.
+	for i := pf.firstFree; i < len(pf.occupied); i++ {
+		if !pf.occupied[i] {
+			pf.firstFree = i
+			return uint32(i+1) * PageSize, nil
 		}
 	}
 
@@ -169,43 +209,77 @@ func (pf *PageFile) findEmptyOffset() (uint32, error) {
 	))
 }
 
+// occupy marks the slot at the given offset as occupied.
+func (pf *PageFile) occupy(offset uint32) {
+	if pf.occupied != nil {
+		pf.occupied[offset/PageSize-1] = true
+	}
+}
+
+// release marks the slot at the given offset as unoccupied.
+func (pf *PageFile) release(offset uint32) {
+	if pf.occupied != nil {
+		slot := int(offset/PageSize - 1)
+		pf.occupied[slot] = false
+		if slot < pf.firstFree {
+			pf.firstFree = slot
+		}
+	}
+}
+
 // ReadPage read the page with the given ID from the file.
 //
 // If an IO error is encountered or no such page exists, an error is returned.
 func (pf *PageFile) ReadPage(id PageID) (*Page, error) {
+	page, state, err := pf.readPage(id)
+	if err != nil {
+		return page, err
+	}
+	if state == pageFree {
+		return &Page{}, fmt.Errorf("No page with ID %d in this page file", id)
+	}
+
+	return page, nil
+}
+
+// readPage reads the page with the given ID from the file, along with its
+// state.
+//
+// If an IO error is encountered or no such page exists, an error is returned.
+func (pf *PageFile) readPage(id PageID) (*Page, byte, error) {
 	offset, exist := pf.PageLocations[id]
 	if !exist {
-		return &Page{}, fmt.Errorf("No page with ID %d in this page file", id)
+		return &Page{}, pageUnused, fmt.Errorf("No page with ID %d in this page file", id)
 	}
 
-	file, err := os.Open(pf.Path)
+	file, done, err := pf.osFile(os.O_RDONLY)
 	if err != nil {
-		return &Page{}, fmt.Errorf("Error reading page file: %v", err)
+		return &Page{}, pageUnused, fmt.Errorf("Error reading page file: %v", err)
 	}
-	defer file.Close()
+	defer done()
 
 	page := make([]byte, PageSize)
 	_, err = file.ReadAt(page, int64(offset))
 	if err != nil {
-		return &Page{}, fmt.Errorf("Error reading from page file: %v", err)
+		return &Page{}, pageUnused, fmt.Errorf("Error reading from page file: %v", err)
 	}
 
 	// First four bytes are checksum
 	checksum := binary.BigEndian.Uint32(page[0:4])
 	// Then PageDataSize of page data
-	var pageData [PageDataSize]byte
+	pageData := new([PageDataSize]byte)
 	copy(pageData[:], page[4:4+PageDataSize])
 
 	// Verify the checksum
 	newChecksum := crc32.ChecksumIEEE(pageData[:])
 	if newChecksum != checksum {
-		return &Page{}, fmt.Errorf("Checksum in file different from checksum calculated from data: %x != %x", checksum, newChecksum)
+		return &Page{}, pageUnused, fmt.Errorf("Checksum in file different from checksum calculated from data: %x != %x", checksum, newChecksum)
 	}
 
 	return &Page{
 		id:   id,
 		data: pageData,
-	}, nil
+	}, page[PageSize-1], nil
 }
 
 // Initialize initializes a new page file.
@@ -215,6 +289,103 @@ func (pf *PageFile) ReadPage(id PageID) (*Page, error) {
 //
 // If an IO error is encountered an error is returned.
 func (pf *PageFile) Initialize() error {
+	exists, err := pf.exists()
+	if err != nil {
+		return err
+	}
+
+	return pf.initialize(exists)
+}
+
+// Open initializes the page file like Initialize(), and keeps it open until
+// Close() is called.
+//
+// If an IO error is encountered an error is returned.
+func (pf *PageFile) Open() error {
+	exists, err := pf.exists()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(pf.Path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("IO error while trying to open page file: %v", err)
+	}
+	pf.file = file
+
+	err = pf.initialize(exists)
+	if err != nil {
+		file.Close()
+		pf.file = nil
+	}
+
+	return err
+}
+
+// Flush stores the meta data of an opened page file, if it changed since it
+// was last stored.
+//
+// If an IO error is encountered an error is returned.
+func (pf *PageFile) Flush() error {
+	if !pf.metaDataDirty {
+		return nil
+	}
+
+	err := pf.storeMetaData()
+	if err != nil {
+		return err
+	}
+	pf.metaDataDirty = false
+
+	return nil
+}
+
+// Sync flushes an opened page file, and then commits it to stable storage.
+//
+// If an IO error is encountered an error is returned.
+func (pf *PageFile) Sync() error {
+	if pf.file == nil {
+		return syncFile(pf.Path)
+	}
+
+	err := pf.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = pf.file.Sync()
+	if err != nil {
+		return fmt.Errorf("IO error while syncing %s: %v", pf.Path, err)
+	}
+
+	return nil
+}
+
+// Close flushes and closes an opened page file. It is a no-op for page files
+// which were not opened.
+//
+// If an IO error is encountered an error is returned.
+func (pf *PageFile) Close() error {
+	if pf.file == nil {
+		return nil
+	}
+
+	err := pf.Flush()
+	closeErr := pf.file.Close()
+	pf.file = nil
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return fmt.Errorf("IO error while closing page file: %v", closeErr)
+	}
+
+	return nil
+}
+
+// initialize initializes the page file, either from its meta data on disk if
+// it exists, or by storing new meta data.
+func (pf *PageFile) initialize(exists bool) error {
 	// We require that all our meta data fits in one page.
 	size := pf.metaDataSize()
 	if size > PageSize {
@@ -225,16 +396,13 @@ func (pf *PageFile) Initialize() error {
 		)
 	}
 
-	exists, err := pf.exists()
-	if err != nil {
-		return err
-	}
 	if exists {
 		// Load from disk
 		return pf.loadMetaData()
 	} else {
 		// Initialize and flush to disk
 		pf.PageLocations = make(map[PageID]uint32)
+		pf.occupied = nil
 		return pf.storeMetaData()
 	}
 }
@@ -296,11 +464,11 @@ func (pf *PageFile) encodeMetaData() []byte {
 //
 // This will overwrite any currently loaded meta data.
 func (pf *PageFile) loadMetaData() error {
-	file, err := os.Open(pf.Path)
+	file, done, err := pf.osFile(os.O_RDONLY)
 	if err != nil {
 		return fmt.Errorf("IO error while trying to open page file: %v", err)
 	}
-	defer file.Close()
+	defer done()
 
 	// First page's worth of data is meta data
 	data := make([]byte, PageSize)
@@ -314,11 +482,11 @@ func (pf *PageFile) loadMetaData() error {
 
 // storeMetaData stores the PageFile's meta data to file.
 func (pf *PageFile) storeMetaData() error {
-	file, err := os.OpenFile(pf.Path, os.O_CREATE|os.O_WRONLY, 0666)
+	file, done, err := pf.osFile(os.O_CREATE | os.O_WRONLY)
 	if err != nil {
 		return fmt.Errorf("IO error while trying to open page file: %v", err)
 	}
-	defer file.Close()
+	defer done()
 
 	metaData := pf.encodeMetaData()
 	_, err = file.WriteAt(metaData, 0)
@@ -329,6 +497,33 @@ func (pf *PageFile) storeMetaData() error {
 	return nil
 }
 
+// metaDataChanged stores the meta data after it was changed. For opened page
+// files, it is only marked as dirty, to be stored on Flush() or Close().
+func (pf *PageFile) metaDataChanged() error {
+	if pf.file != nil {
+		pf.metaDataDirty = true
+		return nil
+	}
+
+	return pf.storeMetaData()
+}
+
+// osFile returns the OS file of an opened page file, or opens it with the
+// given flags otherwise. The returned function must be called once done with
+// the file, closing it unless the page file was opened.
+func (pf *PageFile) osFile(flag int) (*os.File, func(), error) {
+	if pf.file != nil {
+		return pf.file, func() {}, nil
+	}
+
+	file, err := os.OpenFile(pf.Path, flag, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, func() { file.Close() }, nil
+}
+
 // decodeMetaData decodes meta data and sets the page file's meta data to it.
 //
 // If the provided binary data is not a valid encoding, an error is returned.
@@ -364,6 +559,7 @@ func (pf *PageFile) decodeMetaData(data []byte) error {
 	pf.Capacity = capacity
 	pf.PageCount = pageCount
 	pf.PageLocations = pageLocations
+	pf.occupied = nil
 
 	return nil
 }
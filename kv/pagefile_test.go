@@ -27,12 +27,12 @@ func TestDeallocatePage(t *testing.T) {
 
 	page1 := &Page{
 		id:   0,
-		data: [PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
+		data: &[PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
 	}
 
 	page2 := &Page{
 		id:   42,
-		data: [PageDataSize]byte{0x00, 0x2},
+		data: &[PageDataSize]byte{0x00, 0x2},
 	}
 
 	err := pf.WritePage(page1)
@@ -96,7 +96,7 @@ func TestDeallocatePagePersistsChanges(t *testing.T) {
 
 	page1 := &Page{
 		id:   0,
-		data: [PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
+		data: &[PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
 	}
 	err := pf.WritePage(page1)
 	if err != nil {
@@ -117,12 +117,12 @@ func TestReadAndWritePage(t *testing.T) {
 
 	page1 := &Page{
 		id:   0,
-		data: [PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
+		data: &[PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
 	}
 
 	page2 := &Page{
 		id:   42,
-		data: [PageDataSize]byte{0x00, 0x2},
+		data: &[PageDataSize]byte{0x00, 0x2},
 	}
 
 	err := pf.WritePage(page1)
@@ -175,12 +175,12 @@ func TestWriteNewPagePersistsMetadata(t *testing.T) {
 
 	page1 := &Page{
 		id:   0,
-		data: [PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
+		data: &[PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
 	}
 
 	page2 := &Page{
 		id:   42,
-		data: [PageDataSize]byte{0x00, 0x2},
+		data: &[PageDataSize]byte{0x00, 0x2},
 	}
 
 	err := pf.WritePage(page1)
@@ -228,12 +228,54 @@ func TestWriteNewPagePersistsMetadata(t *testing.T) {
 	}
 }
 
+func TestOpenDefersMetaDataUntilFlush(t *testing.T) {
+	path := helper.GetTempFile(t, "pagefile")
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Unable to remove temporary file: %v", err)
+	}
+
+	pf := PageFile{Path: path, Capacity: 10}
+	if err := pf.Open(); err != nil {
+		t.Fatalf("Error opening page file: %v", err)
+	}
+	defer pf.Close()
+
+	page := &Page{id: 42, data: &[PageDataSize]byte{0x42}}
+	if err := pf.WritePage(page); err != nil {
+		t.Fatalf("Error writing page: %v", err)
+	}
+
+	// The page is not yet known to a page file reading the meta data from
+	// disk.
+	other := PageFile{Path: path, Capacity: 10}
+	if err := other.Initialize(); err != nil {
+		t.Fatalf("Error initializing page file: %v", err)
+	}
+	if _, err := other.ReadPage(page.id); err == nil {
+		t.Errorf("Expected error reading page whose meta data was not flushed; got none")
+	}
+
+	if err := pf.Flush(); err != nil {
+		t.Fatalf("Error flushing page file: %v", err)
+	}
+	if err := other.Initialize(); err != nil {
+		t.Fatalf("Error initializing page file: %v", err)
+	}
+	read, err := other.ReadPage(page.id)
+	if err != nil {
+		t.Fatalf("Error reading page after flush: %v", err)
+	}
+	if !page.Equal(read) {
+		t.Errorf("Got unexpected page %+v; expected %+v", read, page)
+	}
+}
+
 func TestWritePageAfterDeallocating(t *testing.T) {
 	pf, _ := newPageFile(t)
 
 	page1 := &Page{
 		id:   0,
-		data: [PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
+		data: &[PageDataSize]byte{0x21, 0x30, 0xA0, 0xFB},
 	}
 
 	err := pf.WritePage(page1)
@@ -275,7 +317,7 @@ func TestReadAndWriteFull(t *testing.T) {
 	for i := uint32(0); i < pf.Capacity; i++ {
 		pages[i] = &Page{
 			id:   PageID(i),
-			data: [PageDataSize]byte{},
+			data: &[PageDataSize]byte{},
 		}
 		binary.BigEndian.PutUint32(pages[i].data[:], i)
 	}
@@ -1,6 +1,8 @@
 package kv
 
 import (
+	"bytes"
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,6 +10,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 // diskMetaDataFile specifies the name of the file used by the persistent disk type
@@ -27,6 +30,32 @@ const diskPageFilePattern = "disk.pages.%d"
 // low, as its meta data structure is rather naive.
 const pagesPerFile = (PageSize - 12) / 8
 
+// diskMetaDataMagic identifies the format of the meta data file. Meta data files
+// written before free list pages were introduced lack it, and instead start with
+// the next page ID.
+const diskMetaDataMagic = "KVDISK\x00\x00"
+
+// diskMetaDataVersion is the version of the format of the meta data file.
+// Version 1 lacks the checkpoint LSN.
+const diskMetaDataVersion = 2
+
+// diskMetaDataSize is the size of the encoded meta data:
+// - 8 bytes magic
+// - 4 bytes format version
+// - 4 bytes next page ID
+// - 4 bytes free list head
+// - 4 bytes number of free pages
+// - 8 bytes checkpoint LSN
+// - 4 bytes checksum
+const diskMetaDataSize = 8 + 4*4 + 8 + 4
+
+// diskMetaDataV1Size is the size of meta data in format version 1.
+const diskMetaDataV1Size = 8 + 4*4 + 4
+
+// maxOpenPageFiles is the number of page files a persistent disk keeps open at
+// most. Once exceeded, the least recently used page file is closed.
+const maxOpenPageFiles = 64
+
 // PersistentDisk implements a disk which persists arbitrary pages to disk.
 //
 // Once instantiated it can be queried for pages, told to store pages, asked
@@ -38,6 +67,15 @@ const pagesPerFile = (PageSize - 12) / 8
 // Once all page operations are done, Close() must be called to make the disk
 // persist its meta data.
 //
+// Deallocated pages are tracked in a free list, see freeList, whose trunk pages
+// are stored in the page files like any other page, but marked as free.
+//
+// Recently used page files are kept open, with their meta data in memory,
+// such that accessing a page neither requires opening its page file nor
+// reading or rewriting the page file's meta data. Their meta data is only
+// stored once they are closed, either when too many page files are open, or
+// when the disk is synced or closed.
+//
 // Pages are stored in separate files on disk, with each such page file
 // containing pagesPerFile pages grouped together. Assignment of pages to page
 // files happens based on pages' IDs.
@@ -50,18 +88,36 @@ const pagesPerFile = (PageSize - 12) / 8
 // - A page's ID determining the file it is stored in means that, once page IDs
 //   are reused, sequential pages in terms of the user might not be sequential
 //   in terms of the disk.
-// - Deallocated pages are currently kept fully in memory in a slice. This
-//   could lead to significant memory usage if a lot of pages are deallocated
-//   without new ones being allocated.
 // - While PersistentDisk does know about which pages are allocated, these
-//   checks are delegated to the underlying PageFile. This does imply that each
-//   read of a page, even if the page does not exist, will cause at least one
-//   read from disk. As this is something which should not happen anyway, this
+//   checks are delegated to the underlying PageFile. This does imply that a
+//   read of a page, even if the page does not exist, might cause its page file
+//   to be opened. As this is something which should not happen anyway, this
 //   seems fine.
+// - PersistentDisk is safe for concurrent use, but serializes all operations,
+//   as page files are not safe for concurrent use.
 type PersistentDisk struct {
-	Directory          string
-	nextPageID         PageID
-	deallocatedPageIDs []PageID
+	Directory  string
+	nextPageID PageID
+	free       *freeList
+	// LSN of the last write-ahead log record which is part of the meta
+	// data.
+	lsn uint64
+
+	// Open page files by their file ID, as elements of openFileOrder,
+	// which holds the most recently used openPageFile in front.
+	openFiles     map[PageID]*list.Element
+	openFileOrder *list.List
+	// IDs of the page files modified since they were last synced.
+	dirtyFiles map[PageID]bool
+
+	// mu guards both the meta data and the page files.
+	mu sync.Mutex
+}
+
+// openPageFile is a page file kept open by a persistent disk.
+type openPageFile struct {
+	fileID   PageID
+	pageFile *PageFile
 }
 
 // NewPersistentDisk initializes a new persistent disk.
@@ -75,10 +131,9 @@ type PersistentDisk struct {
 func NewPersistentDisk(directory string) (Disk, error) {
 	d := &PersistentDisk{
 		Directory: directory,
+		free:      newFreeList(noPage, 0),
 	}
 
-	d.deallocatedPageIDs = make([]PageID, 0)
-
 	err := d.initialize()
 
 	return d, err
@@ -90,7 +145,7 @@ func (d *PersistentDisk) initialize() error {
 		if errors.Is(err, os.ErrNotExist) {
 			// Initializing new store in this directory.
 			// Currently this only involves us dumping our current meta data to disk.
-			return d.storeMetaData()
+			return d.writeMetaData(false)
 
 		} else {
 			return fmt.Errorf("Unexpected IO error while checking existence of meta data file: %v", err)
@@ -105,32 +160,34 @@ func (d *PersistentDisk) initialize() error {
 
 // AllocatePage allocates a new unused page.
 //
-// The new page will be assigned the lowest unused page ID.
+// The most recently deallocated page is reused, if there is any. Otherwise the
+// new page will be assigned the lowest page ID which was never used.
 //
 // An error is returned if page allocation fails.
 func (d *PersistentDisk) AllocatePage() (*Page, error) {
-	var id PageID
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if len(d.deallocatedPageIDs) == 0 {
-		id = d.nextPageID
-		d.nextPageID++
-	} else {
-		id = d.deallocatedPageIDs[0]
-		d.deallocatedPageIDs = d.deallocatedPageIDs[1:]
+	id, ok, err := d.free.pop(d)
+	if err != nil {
+		return &Page{}, err
 	}
-
-	p := Page{
-		id: id,
+	if !ok {
+		id, _ = d.extend()
 	}
 
+	p := newPage(id)
+
 	// We'll write freshly allocated pages to disk. This is required, as:
 	// - They might end up in a new file which does not exist yet
 	// - They might end up in a new part of a file which wasn't allocated yet
-	// While it would not be required for recycled pages, as those will
-	// have been zeroed, quickly writing them doesn't hurt us a lot.
-	err := d.WritePage(&p)
+	// While it would not be required for most recycled pages, as those
+	// will have been zeroed, quickly writing them doesn't hurt us a lot.
+	// Pages which held the free list must be written though, to be marked
+	// as allocated again.
+	err = d.writePage(p)
 
-	return &p, err
+	return p, err
 }
 
 // DeallocatePage deallocates a page.
@@ -140,7 +197,10 @@ func (d *PersistentDisk) AllocatePage() (*Page, error) {
 //
 // Trying to deallocate an unallocated page will be a no-op, not having any effect.
 func (d *PersistentDisk) DeallocatePage(id PageID) {
-	pageFile, err := d.pageFile(id)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pageFile, err := d.modifiedPageFile(id)
 	if err != nil {
 		// Unable to read page file, ID might be out of valid range. So
 		// we won't deallocate the ID.
@@ -156,8 +216,146 @@ func (d *PersistentDisk) DeallocatePage(id PageID) {
 	}
 
 	// If we got to here we actually deallocated a page on disk, so we can
-	// add it to our slice of IDs to be recycled.
-	d.deallocatedPageIDs = append(d.deallocatedPageIDs, id)
+	// add it to the free list to be recycled.
+	d.free.push(id)
+}
+
+// redoAllocate repeats the allocation of the page with the given ID while
+// recovering from a write-ahead log. Pages which are allocated already are
+// left as they are.
+//
+// An error is returned if AllocatePage would have allocated a different page.
+func (d *PersistentDisk) redoAllocate(id PageID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expected, ok, err := d.free.peek(d)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		expected = d.nextPageID
+	}
+	if id != expected {
+		if id < d.nextPageID {
+			free, err := d.free.contains(d, id)
+			if err != nil {
+				return err
+			}
+			if !free {
+				return nil
+			}
+		}
+		return fmt.Errorf("Unable to redo allocation of page %d, as page %d would have been allocated", id, expected)
+	}
+
+	if ok {
+		_, _, err = d.free.pop(d)
+	} else {
+		_, err = d.extend()
+	}
+	if err != nil {
+		return err
+	}
+
+	// The log holds the page's content, but it might have held the free
+	// list, in which case it must be marked as allocated again.
+	return d.writePage(newPage(id))
+}
+
+// redoDeallocate repeats the deallocation of the page with the given ID while
+// recovering from a write-ahead log. Pages which are on the free list already
+// are left as they are.
+//
+// Other than DeallocatePage, the ID is recycled even if the page is not
+// present in its page file, as it might already have been deallocated before
+// the crash.
+//
+// An error is returned if the free list cannot be read.
+func (d *PersistentDisk) redoDeallocate(id PageID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if free, err := d.free.contains(d, id); err != nil || free {
+		return err
+	}
+
+	if pageFile, err := d.modifiedPageFile(id); err == nil {
+		// The page file does not know the page if it had already been
+		// deallocated, so errors are expected.
+		_ = pageFile.DeallocatePage(id)
+	}
+
+	d.free.push(id)
+
+	return nil
+}
+
+// checkpointLSN returns the LSN of the last write-ahead log record which is
+// part of the meta data.
+func (d *PersistentDisk) checkpointLSN() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.lsn
+}
+
+// setCheckpointLSN sets the LSN which is stored along with the meta data the
+// next time it is stored.
+func (d *PersistentDisk) setCheckpointLSN(lsn uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lsn = lsn
+}
+
+// sync flushes the page files modified since they were last synced to stable
+// storage.
+//
+// An error is returned if an IO error is encountered.
+func (d *PersistentDisk) sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.syncPageFiles()
+}
+
+// syncPageFiles flushes the page files modified since they were last synced
+// to stable storage. The caller must hold the mutex.
+func (d *PersistentDisk) syncPageFiles() error {
+	for fileID := range d.dirtyFiles {
+		var err error
+		if e, ok := d.openFiles[fileID]; ok {
+			err = e.Value.(openPageFile).pageFile.Sync()
+		} else {
+			err = syncFile(d.pageFilePath(fileID * pagesPerFile))
+		}
+		if err != nil {
+			return err
+		}
+		delete(d.dirtyFiles, fileID)
+	}
+
+	return nil
+}
+
+// syncFile flushes the file at the given path to stable storage. Files which
+// do not exist are ignored.
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("IO error while opening %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("IO error while syncing %s: %v", path, err)
+	}
+
+	return nil
 }
 
 // ReadPage reads the page with the specified ID from disk.
@@ -165,12 +363,15 @@ func (d *PersistentDisk) DeallocatePage(id PageID) {
 // If no page with this ID exists, or an IO error is encountered while reading
 // the page, an error is returned.
 func (d *PersistentDisk) ReadPage(id PageID) (*Page, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	// Rather than checking whether the ID is valid by:
 	// - Checking it is < nextPageID
-	// - Checking it is not in our (unsorted) slice of deallocated IDs
+	// - Checking it is not in the free list
 	// We will simply try to read from the appropriate page file. That will
 	// trigger that one to read its metadata, and then return an error if
-	// the page does not exist.
+	// the page does not exist, or holds the free list.
 
 	pageFile, err := d.pageFile(id)
 	if err != nil {
@@ -192,7 +393,15 @@ func (d *PersistentDisk) ReadPage(id PageID) (*Page, error) {
 //
 // An error is returned if an IO error is encountered.
 func (d *PersistentDisk) WritePage(page *Page) error {
-	pageFile, err := d.pageFile(page.id)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.writePage(page)
+}
+
+// writePage writes the given page to disk. The caller must hold the mutex.
+func (d *PersistentDisk) writePage(page *Page) error {
+	pageFile, err := d.modifiedPageFile(page.id)
 	if err != nil {
 		return err
 	}
@@ -207,7 +416,10 @@ func (d *PersistentDisk) WritePage(page *Page) error {
 
 // Occupied returns the number of currently allocated pages.
 func (d *PersistentDisk) Occupied() uint {
-	return uint(d.nextPageID) - uint(len(d.deallocatedPageIDs))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return uint(d.nextPageID) - uint(d.free.pages)
 }
 
 // Capacit returns the maximum number of supported pages.
@@ -216,15 +428,32 @@ func (d *PersistentDisk) Capacity() uint {
 	return math.MaxUint32 + 1
 }
 
-// Close flushes meta data to disk. After having called Close() it is save to
-// discard the PersistentDisk value, as long as no further page operations are
-// issued.
+// Close flushes meta data to disk, and closes all open page files. After
+// having called Close() it is save to discard the PersistentDisk value, as
+// long as no further page operations are issued.
 //
 // An error is returned if an IO error is encountered.
 func (d *PersistentDisk) Close() error {
-	err := d.storeMetaData()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	return err
+	err := d.writeMetaData(false)
+
+	var closeErr error
+	for fileID, e := range d.openFiles {
+		if err := e.Value.(openPageFile).pageFile.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+		delete(d.openFiles, fileID)
+	}
+	d.openFileOrder = nil
+	d.openFiles = nil
+
+	if err != nil {
+		return err
+	}
+
+	return closeErr
 }
 
 // loadMetaData loads the disk's meta data to file.
@@ -237,11 +466,45 @@ func (d *PersistentDisk) loadMetaData() error {
 	return d.decodeMetaData(data)
 }
 
-// storeMetaData stores the disk's meta data to file.
-func (d *PersistentDisk) storeMetaData() error {
+// storeMetaData stores the disk's meta data to file. If durable is set, the
+// modified page files are synced before, and the meta data file after being
+// written.
+func (d *PersistentDisk) storeMetaData(durable bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.writeMetaData(durable)
+}
+
+// writeMetaData stores the free list, and then the disk's meta data
+// referencing it to file, syncing both if durable is set. The caller must
+// hold the mutex, unless the disk is still being initialized.
+func (d *PersistentDisk) writeMetaData(durable bool) error {
+	if _, err := d.free.store(d); err != nil {
+		return err
+	}
+
+	// The page files holding the free list must know about its pages
+	// before the meta data references them.
+	if d.openFileOrder != nil {
+		for e := d.openFileOrder.Front(); e != nil; e = e.Next() {
+			if err := e.Value.(openPageFile).pageFile.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The pages, including the free list, must reach stable storage
+	// before the meta data referencing them.
+	if durable {
+		if err := d.syncPageFiles(); err != nil {
+			return err
+		}
+	}
+
 	metaData := d.encodeMetaData()
 
-	err := os.WriteFile(d.metaFilePath(), metaData, 0660)
+	err := writeFileAtomically(d.metaFilePath(), metaData, durable)
 	if err != nil {
 		return fmt.Errorf("IO error while trying to write meta data: %v", err)
 	}
@@ -249,34 +512,39 @@ func (d *PersistentDisk) storeMetaData() error {
 	return nil
 }
 
-// encodeMetaData encodes the disk's meta data into a byte slice.
+// encodeMetaData encodes the disk's meta data into a byte slice. It must only
+// be called once the free list has been stored.
 func (d *PersistentDisk) encodeMetaData() []byte {
-	// 4 bytes for nextPageID
-	// 8 bytes for length of deallocatedPageIDs
-	// 4 bytes for each entry in deallocatedPageIDs
-	// 4 bytes checksum
-	dataLength := 4 + 8 + len(d.deallocatedPageIDs)*4 + 4
-	data := make([]byte, dataLength)
+	data := make([]byte, diskMetaDataSize)
 
-	binary.BigEndian.PutUint32(data[0:4], uint32(d.nextPageID))
-	binary.BigEndian.PutUint64(data[4:12], uint64(len(d.deallocatedPageIDs)))
-	for i, id := range d.deallocatedPageIDs {
-		binary.BigEndian.PutUint32(data[12+i*4:12+(i+1)*4], uint32(id))
-	}
+	copy(data[0:8], diskMetaDataMagic)
+	binary.BigEndian.PutUint32(data[8:12], diskMetaDataVersion)
+	binary.BigEndian.PutUint32(data[12:16], uint32(d.nextPageID))
+	binary.BigEndian.PutUint32(data[16:20], uint32(d.free.head))
+	binary.BigEndian.PutUint32(data[20:24], d.free.pages)
+	binary.BigEndian.PutUint64(data[24:32], d.lsn)
 
 	// Take care not to include the 4 0x00 bytes where the checksum will be
 	// placed *in* the checksum.
-	checksum := crc32.ChecksumIEEE(data[:dataLength-4])
-	binary.BigEndian.PutUint32(data[dataLength-4:], checksum)
+	checksum := crc32.ChecksumIEEE(data[:diskMetaDataSize-4])
+	binary.BigEndian.PutUint32(data[diskMetaDataSize-4:], checksum)
 
 	return data
 }
 
 // decodeMetaData decodes meta data and sets the disks's meta data to it.
 //
+// Meta data in the legacy format, which holds all deallocated page IDs, is
+// migrated into a new free list, which is stored along with the meta data the
+// next time.
+//
 // If the provided binary data is not a valid encoding, an error is returned.
 // The disk's meta data is not affected if this is the case.
 func (d *PersistentDisk) decodeMetaData(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("Meta data of %dB is too short", len(data))
+	}
+
 	checksum := binary.BigEndian.Uint32(data[len(data)-4:])
 	data = data[:len(data)-4]
 
@@ -285,18 +553,61 @@ func (d *PersistentDisk) decodeMetaData(data []byte) error {
 		return fmt.Errorf("Checksum in file different from checksum calculated from data: %x != %x", checksum, newChecksum)
 	}
 
+	if !bytes.HasPrefix(data, []byte(diskMetaDataMagic)) {
+		return d.decodeLegacyMetaData(data)
+	}
+	if len(data) < 12 {
+		return fmt.Errorf("Meta data of %dB is too short", len(data)+4)
+	}
+
+	var lsn uint64
+	version := binary.BigEndian.Uint32(data[8:12])
+	switch {
+	case version == 1 && len(data) == diskMetaDataV1Size-4:
+	case version == diskMetaDataVersion && len(data) == diskMetaDataSize-4:
+		lsn = binary.BigEndian.Uint64(data[24:32])
+	case version == 1 || version == diskMetaDataVersion:
+		return fmt.Errorf("Meta data of %dB has unexpected size", len(data)+4)
+	default:
+		return fmt.Errorf("Meta data has format version %d, but only versions up to %d are supported", version, diskMetaDataVersion)
+	}
+
+	// Now we were able to load it all, so we can overwrite it
+	d.nextPageID = PageID(binary.BigEndian.Uint32(data[12:16]))
+	d.free = newFreeList(
+		PageID(binary.BigEndian.Uint32(data[16:20])),
+		binary.BigEndian.Uint32(data[20:24]),
+	)
+	d.lsn = lsn
+
+	return nil
+}
+
+// decodeLegacyMetaData decodes meta data in the legacy format, without its
+// checksum, and sets the disk's meta data to it.
+func (d *PersistentDisk) decodeLegacyMetaData(data []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("Meta data of %dB is too short", len(data)+4)
+	}
+
 	nextPageID := PageID(binary.BigEndian.Uint32(data[0:4]))
 	deallocatedPageCount := binary.BigEndian.Uint64(data[4:12])
-	deallocatedPageIDs := make([]PageID, deallocatedPageCount)
-	for i := 0; i < int(deallocatedPageCount); i++ {
-		deallocatedPageIDs[i] = PageID(binary.BigEndian.Uint32(
+	if uint64(len(data)-12) != deallocatedPageCount*4 {
+		return fmt.Errorf("Meta data of %dB does not fit %d deallocated pages", len(data)+4, deallocatedPageCount)
+	}
+
+	// Deallocated pages used to be reused in order, so they are pushed in
+	// reverse to keep that order.
+	free := newFreeList(noPage, 0)
+	for i := int(deallocatedPageCount) - 1; i >= 0; i-- {
+		free.push(PageID(binary.BigEndian.Uint32(
 			data[12+i*4 : 12+(i+1)*4],
-		))
+		)))
 	}
 
 	// Now we were able to load it all, so we can overwrite it
 	d.nextPageID = nextPageID
-	d.deallocatedPageIDs = deallocatedPageIDs
+	d.free = free
 
 	return nil
 }
@@ -306,17 +617,135 @@ func (d *PersistentDisk) metaFilePath() string {
 	return filepath.Join(d.Directory, diskMetaDataFile)
 }
 
-// pageFile returns a PageFile containing the requested page.
+// pageFile returns the opened PageFile containing the requested page. The
+// caller must hold the mutex.
 func (d *PersistentDisk) pageFile(id PageID) (*PageFile, error) {
-	path := d.pageFilePath(id)
+	if d.openFiles == nil {
+		d.openFiles = make(map[PageID]*list.Element, maxOpenPageFiles)
+		d.openFileOrder = list.New()
+	}
+
+	fileID := id / pagesPerFile
+	if e, ok := d.openFiles[fileID]; ok {
+		d.openFileOrder.MoveToFront(e)
+		return e.Value.(openPageFile).pageFile, nil
+	}
+
+	if d.openFileOrder.Len() >= maxOpenPageFiles {
+		if err := d.closeOldestPageFile(); err != nil {
+			return &PageFile{}, err
+		}
+	}
 
 	pageFile := PageFile{
-		Path:     path,
+		Path:     d.pageFilePath(id),
 		Capacity: pagesPerFile,
 	}
-	err := pageFile.Initialize()
+	err := pageFile.Open()
+	if err != nil {
+		return &pageFile, err
+	}
+	d.openFiles[fileID] = d.openFileOrder.PushFront(openPageFile{fileID, &pageFile})
+
+	return &pageFile, nil
+}
+
+// modifiedPageFile returns the page file holding the page with the given ID
+// like pageFile, and marks it to be synced. The caller must hold the mutex.
+func (d *PersistentDisk) modifiedPageFile(id PageID) (*PageFile, error) {
+	pageFile, err := d.pageFile(id)
+	if err != nil {
+		return pageFile, err
+	}
+
+	if d.dirtyFiles == nil {
+		d.dirtyFiles = make(map[PageID]bool)
+	}
+	d.dirtyFiles[id/pagesPerFile] = true
+
+	return pageFile, nil
+}
+
+// extend allocates the page following all pages which were ever allocated.
+// The caller must hold the mutex.
+func (d *PersistentDisk) extend() (PageID, error) {
+	id := d.nextPageID
+	d.nextPageID++
+
+	return id, nil
+}
+
+// readFreeListPage reads a page of the free list. The caller must hold the
+// mutex.
+func (d *PersistentDisk) readFreeListPage(id PageID) (*[PageDataSize]byte, error) {
+	pageFile, err := d.pageFile(id)
+	if err != nil {
+		return nil, err
+	}
+
+	page, state, err := pageFile.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	if state != pageFree {
+		return nil, fmt.Errorf("Page %d is not free", id)
+	}
+
+	return page.data, nil
+}
+
+// writeFreeListPage writes a page of the free list. The caller must hold the
+// mutex.
+func (d *PersistentDisk) writeFreeListPage(id PageID, data *[PageDataSize]byte) error {
+	pageFile, err := d.modifiedPageFile(id)
+	if err != nil {
+		return err
+	}
+
+	return pageFile.writePage(id, data, pageFree)
+}
+
+// closeOldestPageFile closes the least recently used open page file. The
+// caller must hold the mutex.
+//
+// If its meta data cannot be stored, the page file is kept open, such that
+// its meta data is not lost, and an error is returned.
+func (d *PersistentDisk) closeOldestPageFile() error {
+	oldest := d.openFileOrder.Back()
+	open := oldest.Value.(openPageFile)
+	if err := open.pageFile.Flush(); err != nil {
+		return err
+	}
+
+	d.openFileOrder.Remove(oldest)
+	delete(d.openFiles, open.fileID)
+
+	return open.pageFile.Close()
+}
+
+// pageFiles returns the paths of all page files which were written to.
+func (d *PersistentDisk) pageFiles() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var paths []string
+	for id := PageID(0); id < d.nextPageID; id += pagesPerFile {
+		// Page files are only created once a page is written to them.
+		path := d.pageFilePath(id)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// freePages returns the number of pages on the free list.
+func (d *PersistentDisk) freePages() uint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	return &pageFile, err
+	return uint(d.free.pages)
 }
 
 // pageFilePath returns the file path of the file containing the given page.
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -213,7 +214,7 @@ func TestAllocatePage(t *testing.T) {
 			t.Errorf("Expected page %d data to be of size %d; was %d", i, PageDataSize, len(page.data))
 		}
 
-		if page.data != [PageDataSize]byte{} {
+		if *page.data != [PageDataSize]byte{} {
 			t.Errorf("Expected page data to be %d-length zero-byte array, but was %x", PageDataSize, page.data)
 		}
 	}
@@ -244,13 +245,13 @@ func TestAllocatePageReusesIDs(t *testing.T) {
 		}
 	}
 
-	deallocatedIDs := []PageID{0, 3, 9}
-	for _, id := range deallocatedIDs {
+	for _, id := range []PageID{0, 3, 9} {
 		disk.DeallocatePage(PageID(id))
 	}
 
-	// Ensure IDs reused in sequence before new ones assigned
-	for _, id := range deallocatedIDs {
+	// Ensure IDs reused, most recently deallocated first, before new ones
+	// assigned
+	for _, id := range []PageID{9, 3, 0} {
 		page, err := disk.AllocatePage()
 		if err != nil {
 			t.Fatalf("Got error while allocating page: %v", err)
@@ -262,15 +263,16 @@ func TestAllocatePageReusesIDs(t *testing.T) {
 	}
 
 	// Ensure we reuse IDs after a reload still
-	deallocatedIDs = []PageID{2, 8, 4}
-	for _, id := range deallocatedIDs {
+	for _, id := range []PageID{2, 8, 4} {
 		disk.DeallocatePage(PageID(id))
 	}
 
 	disk.Close()
 	disk = existingDisk(t, dir)
 
-	for _, id := range deallocatedIDs {
+	// Page 2 now holds the free list, so it is only reused once the free
+	// list has been stored again.
+	for _, id := range []PageID{4, 8, 10} {
 		page, err := disk.AllocatePage()
 		if err != nil {
 			t.Fatalf("Got error while allocating page: %v", err)
@@ -280,6 +282,70 @@ func TestAllocatePageReusesIDs(t *testing.T) {
 			t.Errorf("Expected reused page to have ID %d; got %d", id, page.id)
 		}
 	}
+
+	if err := disk.storeMetaData(false); err != nil {
+		t.Fatalf("Error storing meta data: %v", err)
+	}
+
+	page, err := disk.AllocatePage()
+	if err != nil {
+		t.Fatalf("Got error while allocating page: %v", err)
+	}
+	if page.id != 2 {
+		t.Errorf("Expected reused page to have ID %d; got %d", 2, page.id)
+	}
+}
+
+func TestDeallocateLotsOfPages(t *testing.T) {
+	disk, dir := newDisk(t)
+
+	// Enough pages to require multiple free list pages.
+	numPages := 3 * freeListTrunkCapacity
+	for i := 0; i < numPages; i++ {
+		if _, err := disk.AllocatePage(); err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+	}
+	for id := 0; id < numPages-10; id++ {
+		disk.DeallocatePage(PageID(id))
+	}
+
+	disk.Close()
+
+	// The meta data no longer grows with the number of deallocated pages.
+	metaData, err := os.ReadFile(filepath.Join(dir, diskMetaDataFile))
+	if err != nil {
+		t.Fatalf("Error reading meta data: %v", err)
+	}
+	if len(metaData) != diskMetaDataSize {
+		t.Errorf("Expected meta data of %dB; got %dB", diskMetaDataSize, len(metaData))
+	}
+
+	disk = existingDisk(t, dir)
+	defer disk.Close()
+
+	if disk.Occupied() != 10 {
+		t.Errorf("Expected disk to have 10 occupied pages; got %d", disk.Occupied())
+	}
+
+	// Free list pages can neither be read nor deallocated.
+	if _, err := disk.ReadPage(disk.free.head); err == nil {
+		t.Errorf("Expected error reading free list page %d; got none", disk.free.head)
+	}
+	disk.DeallocatePage(disk.free.head)
+	if disk.Occupied() != 10 {
+		t.Errorf("Expected deallocating free list page to have no effect; got %d occupied pages", disk.Occupied())
+	}
+
+	for i := 0; i < numPages-20; i++ {
+		page, err := disk.AllocatePage()
+		if err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+		if int(page.id) >= numPages {
+			t.Fatalf("Expected deallocated page to be reused; got new page %d", page.id)
+		}
+	}
 }
 
 func TestAllocatePageWritesToDisk(t *testing.T) {
@@ -308,6 +374,97 @@ func TestAllocatePageWritesToDisk(t *testing.T) {
 
 }
 
+func TestPersistentDiskBoundsOpenPageFiles(t *testing.T) {
+	disk, dir := newDisk(t)
+
+	// Write the first page of more page files than are kept open.
+	numFiles := 2 * maxOpenPageFiles
+	for i := 0; i < numFiles; i++ {
+		page := newPage(PageID(i * pagesPerFile))
+		page.data[0] = byte(i)
+		if err := disk.WritePage(page); err != nil {
+			t.Fatalf("Error writing page: %v", err)
+		}
+		if len(disk.openFiles) > maxOpenPageFiles {
+			t.Fatalf("Expected at most %d open page files; got %d", maxOpenPageFiles, len(disk.openFiles))
+		}
+	}
+
+	// Syncing stores the meta data of open page files, such that all pages
+	// are found without closing the disk.
+	if err := disk.sync(); err != nil {
+		t.Fatalf("Error syncing disk: %v", err)
+	}
+	reopened := existingDisk(t, dir)
+
+	for i := 0; i < numFiles; i++ {
+		id := PageID(i * pagesPerFile)
+		page, err := reopened.ReadPage(id)
+		if err != nil {
+			t.Fatalf("Error reading page %d: %v", id, err)
+		}
+		if page.data[0] != byte(i) {
+			t.Errorf("Expected page %d to start with %d; got %d", id, byte(i), page.data[0])
+		}
+	}
+}
+
+func TestPersistentDiskSyncsDirtyPageFiles(t *testing.T) {
+	disk, _ := newDisk(t)
+
+	for i := 0; i < 3; i++ {
+		if err := disk.WritePage(newPage(PageID(i * pagesPerFile))); err != nil {
+			t.Fatalf("Error writing page: %v", err)
+		}
+	}
+	if len(disk.dirtyFiles) != 3 {
+		t.Errorf("Expected 3 dirty page files; got %v", disk.dirtyFiles)
+	}
+
+	if err := disk.sync(); err != nil {
+		t.Fatalf("Error syncing disk: %v", err)
+	}
+	if len(disk.dirtyFiles) != 0 {
+		t.Errorf("Expected no dirty page files after syncing; got %v", disk.dirtyFiles)
+	}
+
+	if _, err := disk.ReadPage(pagesPerFile); err != nil {
+		t.Fatalf("Error reading page: %v", err)
+	}
+	if err := disk.WritePage(newPage(2*pagesPerFile + 1)); err != nil {
+		t.Fatalf("Error writing page: %v", err)
+	}
+	if len(disk.dirtyFiles) != 1 || !disk.dirtyFiles[2] {
+		t.Errorf("Expected only page file 2 to be dirty; got %v", disk.dirtyFiles)
+	}
+}
+
+func TestPersistentDiskSyncsPagesBeforeMetaData(t *testing.T) {
+	disk, _ := newDisk(t)
+
+	page, err := disk.AllocatePage()
+	if err != nil {
+		t.Fatalf("Error allocating page: %v", err)
+	}
+	if err := disk.WritePage(page); err != nil {
+		t.Fatalf("Error writing page: %v", err)
+	}
+
+	if err := disk.storeMetaData(false); err != nil {
+		t.Fatalf("Error storing meta data: %v", err)
+	}
+	if len(disk.dirtyFiles) != 1 {
+		t.Errorf("Expected page file to remain dirty without durability; got %v", disk.dirtyFiles)
+	}
+
+	if err := disk.storeMetaData(true); err != nil {
+		t.Fatalf("Error storing meta data durably: %v", err)
+	}
+	if len(disk.dirtyFiles) != 0 {
+		t.Errorf("Expected page file to be synced along with the meta data; got %v", disk.dirtyFiles)
+	}
+}
+
 func TestCapacity(t *testing.T) {
 	disk, _ := newDisk(t)
 
@@ -354,24 +511,20 @@ func TestOccupied(t *testing.T) {
 func TestEncodeMetaData(t *testing.T) {
 	disk := PersistentDisk{
 		nextPageID: 1074701930,
-		deallocatedPageIDs: []PageID{
-			0, 1, 42, 257, 3120, 22222, 1073470479,
-		},
+		free:       newFreeList(3120, 22222),
+		lsn:        0x0102030405060708,
 	}
 
 	metaData := []byte{
-		0x40, 0x0e, 0xa6, 0x6a, // nextPageID
+		0x4b, 0x56, 0x44, 0x49, 0x53, 0x4b, 0x00, 0x00, // Magic
+		0x00, 0x00, 0x00, 0x02, // Version
 
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, // len(deallocatedPageIDs)
-		0x00, 0x00, 0x00, 0x00, // 0
-		0x00, 0x00, 0x00, 0x01, // 1
-		0x00, 0x00, 0x00, 0x2a, // 42
-		0x00, 0x00, 0x01, 0x01, // 257
-		0x00, 0x00, 0x0c, 0x30, // 3120
-		0x00, 0x00, 0x56, 0xce, // 22222,
-		0x3f, 0xfb, 0xdc, 0x0f, // 1073470479
+		0x40, 0x0e, 0xa6, 0x6a, // nextPageID
+		0x00, 0x00, 0x0c, 0x30, // Free list head
+		0x00, 0x00, 0x56, 0xce, // Free pages
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // Checkpoint LSN
 
-		0xdb, 0x7b, 0x57, 0xf8, // Checksum
+		0x3e, 0x83, 0x54, 0xe0, // Checksum
 	}
 
 	actual := disk.encodeMetaData()
@@ -381,6 +534,60 @@ func TestEncodeMetaData(t *testing.T) {
 }
 
 func TestDecodeMetaData(t *testing.T) {
+	tests := []struct {
+		name     string
+		metaData []byte
+		lsn      uint64
+	}{
+		{"Version1", []byte{
+			0x4b, 0x56, 0x44, 0x49, 0x53, 0x4b, 0x00, 0x00, // Magic
+			0x00, 0x00, 0x00, 0x01, // Version
+
+			0x40, 0x0e, 0xa6, 0x6a, // nextPageID
+			0x00, 0x00, 0x0c, 0x30, // Free list head
+			0x00, 0x00, 0x56, 0xce, // Free pages
+
+			0x37, 0x64, 0x57, 0x61, // Checksum
+		}, 0},
+		{"Version2", []byte{
+			0x4b, 0x56, 0x44, 0x49, 0x53, 0x4b, 0x00, 0x00, // Magic
+			0x00, 0x00, 0x00, 0x02, // Version
+
+			0x40, 0x0e, 0xa6, 0x6a, // nextPageID
+			0x00, 0x00, 0x0c, 0x30, // Free list head
+			0x00, 0x00, 0x56, 0xce, // Free pages
+			0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // Checkpoint LSN
+
+			0x3e, 0x83, 0x54, 0xe0, // Checksum
+		}, 0x0102030405060708},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disk := PersistentDisk{}
+
+			err := disk.decodeMetaData(test.metaData)
+			if err != nil {
+				t.Fatalf("Error decoding meta data: %v", err)
+			}
+
+			if disk.nextPageID != 1074701930 {
+				t.Errorf("Got next page ID %d; expected %d", disk.nextPageID, 1074701930)
+			}
+			if disk.free.head != 3120 {
+				t.Errorf("Got free list head %d; expected %d", disk.free.head, 3120)
+			}
+			if disk.free.pages != 22222 {
+				t.Errorf("Got %d free pages; expected %d", disk.free.pages, 22222)
+			}
+			if disk.lsn != test.lsn {
+				t.Errorf("Got checkpoint LSN %d; expected %d", disk.lsn, test.lsn)
+			}
+		})
+	}
+}
+
+func TestDecodeLegacyMetaData(t *testing.T) {
 	disk := PersistentDisk{}
 
 	metaData := []byte{
@@ -407,16 +614,23 @@ func TestDecodeMetaData(t *testing.T) {
 		t.Errorf("Got next page ID %d; expected %d", disk.nextPageID, 1074701930)
 	}
 
+	// The deallocated page IDs are reused in the same order as before.
 	ids := []PageID{0, 1, 42, 257, 3120, 22222, 1073470479}
-	if len(ids) != len(disk.deallocatedPageIDs) {
-		t.Fatalf("Got unexpected number of deallocated page IDs %d; expected %d", len(disk.deallocatedPageIDs), len(ids))
+	if int(disk.free.pages) != len(ids) {
+		t.Fatalf("Got unexpected number of deallocated page IDs %d; expected %d", disk.free.pages, len(ids))
 	}
 	for i, id := range ids {
-		if id != disk.deallocatedPageIDs[i] {
+		// The free list does not need to read any pages, as the IDs
+		// are held in memory until it is stored.
+		actual, _, err := disk.free.pop(nil)
+		if err != nil {
+			t.Fatalf("Error taking deallocated page ID: %v", err)
+		}
+		if id != actual {
 			t.Errorf(
 				"Got unexpected deallocatd page ID at index %d: %d; expected %d",
 				i,
-				disk.deallocatedPageIDs[i],
+				actual,
 				id,
 			)
 		}
@@ -424,13 +638,11 @@ func TestDecodeMetaData(t *testing.T) {
 }
 
 func TestDecodeMetaDataWithInvalidData(t *testing.T) {
-	pageIDs := []PageID{
-		1, 2, 20, 30, 42, 202,
-	}
+	free := newFreeList(42, 202)
 	disk := PersistentDisk{
-		Directory:          "foo/bar",
-		nextPageID:         123,
-		deallocatedPageIDs: pageIDs,
+		Directory:  "foo/bar",
+		nextPageID: 123,
+		free:       free,
 	}
 
 	err := disk.decodeMetaData([]byte{0x00, 0x00, 0x02, 0x04, 0x08, 0x10})
@@ -452,16 +664,12 @@ func TestDecodeMetaDataWithInvalidData(t *testing.T) {
 		)
 	}
 
-	for i := 0; i < len(pageIDs); i++ {
-		if pageIDs[i] != disk.deallocatedPageIDs[i] {
-			t.Errorf(
-				"Expected disk's deallocated page IDs to not be affected, but ID %d is now %d",
-				i,
-				disk.deallocatedPageIDs[i],
-			)
-		}
+	if disk.free != free || disk.free.head != 42 || disk.free.pages != 202 {
+		t.Errorf(
+			"Expected disk's free list not to be affected; but is now %+v",
+			disk.free,
+		)
 	}
-
 }
 
 func TestPageFilePath(t *testing.T) {
@@ -3,12 +3,15 @@ package kv
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
 /*
-RAMDisk is a memory mock of a disk.
+RAMDisk is a memory mock of a disk. It is safe for concurrent use.
 */
 type RAMDisk struct {
+	mu sync.Mutex
+
 	maxPagesOnDisk uint
 	nextPageID     PageID
 	deallocated    []PageID
@@ -25,7 +28,10 @@ func NewRAMDisk(initialSize uint, maxPagesOnDisk uint) Disk {
 }
 
 func (r *RAMDisk) AllocatePage() (*Page, error) {
-	page := &Page{}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	page := &Page{data: new([PageDataSize]byte)}
 	// re-allocate deallocated pages
 	if len(r.deallocated) > 0 {
 		page.id = r.deallocated[0]
@@ -42,6 +48,9 @@ func (r *RAMDisk) AllocatePage() (*Page, error) {
 }
 
 func (r *RAMDisk) DeallocatePage(id PageID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	delete(r.pages, id)
 	if id < r.nextPageID {
 		r.deallocated = append(r.deallocated, id)
@@ -49,6 +58,9 @@ func (r *RAMDisk) DeallocatePage(id PageID) {
 }
 
 func (r *RAMDisk) ReadPage(id PageID) (*Page, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if page, ok := r.pages[id]; ok {
 		return page, nil
 	}
@@ -57,12 +69,18 @@ func (r *RAMDisk) ReadPage(id PageID) (*Page, error) {
 }
 
 func (r *RAMDisk) WritePage(page *Page) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.pages[page.id] = page
 
 	return nil
 }
 
 func (r *RAMDisk) Occupied() uint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	return uint(len(r.pages))
 }
 
@@ -1,7 +1,11 @@
 package kv
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/tobiasfamos/KVStore/search"
@@ -15,7 +19,7 @@ const (
 	// NumKeysIndex is the starting index for the number of keys for both InternalNode and LeafNode.
 	NumKeysIndex = 1
 
-	// KeyStartIndex is the starting index for keys for both InternalNode and LeafNode.
+	// KeyStartIndex is the starting index for keys for InternalNode, and of the sibling PageIDs for LeafNode.
 	KeyStartIndex = 3
 
 	// NumInternalKeys is the number of keys an InternalNode may hold at any given time.
@@ -27,22 +31,91 @@ const (
 	// InternalNodeSize is the size in bytes that an InternalNode uses.
 	InternalNodeSize = KeyStartIndex + 4 + 12*NumInternalKeys
 
+	// LeftSiblingIndex is the starting index for the PageID of the left sibling of a LeafNode.
+	LeftSiblingIndex = KeyStartIndex
+
+	// RightSiblingIndex is the starting index for the PageID of the right sibling of a LeafNode.
+	RightSiblingIndex = LeftSiblingIndex + 4
+
+	// LeafKeyStartIndex is the starting index for keys in LeafNode.
+	LeafKeyStartIndex = RightSiblingIndex + 4
+
 	// NumLeafKeys is the number of keys a LeafNode may hold at any given time.
-	NumLeafKeys = (PageDataSize - KeyStartIndex) / 18
+	NumLeafKeys = (PageDataSize - LeafKeyStartIndex) / (8 + LeafValueSize)
 
 	// NumLeafValues is the number of values a LeafNode may hold at any given time.
 	NumLeafValues = NumLeafKeys
 
 	// LeafNodeSize is the size in bytes that a LeafNode uses.
-	LeafNodeSize = KeyStartIndex + 18*NumLeafKeys
+	LeafNodeSize = LeafKeyStartIndex + (8+LeafValueSize)*NumLeafKeys
 
 	// PagesStartIndex is the starting index for the page IDs in InternalNode.
 	PagesStartIndex = KeyStartIndex + NumInternalKeys*8
 
 	// ValuesStartIndex is the starting index for the values in LeafNode.
-	ValuesStartIndex = KeyStartIndex + NumLeafKeys*8
+	ValuesStartIndex = LeafKeyStartIndex + NumLeafKeys*8
+
+	// LeafValueSize is the size in bytes of a single value slot in LeafNode, holding the value and its size.
+	LeafValueSize = MaxInlineValueSize + 1
+
+	// MaxInlineValueSize is the largest size of a value which is stored within a LeafNode.
+	// Larger values are stored in overflow pages.
+	MaxInlineValueSize = 10
+
+	// MinInternalKeys is the number of keys a non-root InternalNode must hold after a deletion.
+	// If it falls below, it either borrows from or gets merged with a sibling.
+	MinInternalKeys = NumInternalKeys / 2
+
+	// MinLeafKeys is the number of keys a LeafNode must hold after a deletion.
+	// If it falls below, it either borrows from or gets merged with a sibling.
+	MinLeafKeys = NumLeafKeys / 2
 )
 
+// NoSibling is the sibling PageID of leaves at either end of the tree.
+// It is not a valid PageID, meaning PageID(math.MaxUint32) must never be allocated.
+const NoSibling = PageID(math.MaxUint32)
+
+// overflowValueSize is the size of a leafValue which refers to overflow pages.
+const overflowValueSize = math.MaxUint8
+
+/*
+leafValue is a value slot of a LeafNode.
+
+Values of at most MaxInlineValueSize bytes are stored inline, with size being
+their length. Larger values are stored in a chain of overflow pages, in which
+case size is overflowValueSize and data holds the first PageID of the chain
+as well as the total length of the value.
+*/
+type leafValue struct {
+	data [MaxInlineValueSize]byte
+	size uint8
+}
+
+// inlineValue returns a leafValue storing a fixed-size value inline.
+func inlineValue(value [10]byte) leafValue {
+	return leafValue{value, MaxInlineValueSize}
+}
+
+// overflowValue returns a leafValue referring to a chain of overflow pages.
+func overflowValue(first PageID, length uint32) leafValue {
+	v := leafValue{size: overflowValueSize}
+	binary.BigEndian.PutUint32(v.data[0:4], uint32(first))
+	binary.BigEndian.PutUint32(v.data[4:8], length)
+
+	return v
+}
+
+// isOverflow returns whether the value is stored in overflow pages.
+func (v leafValue) isOverflow() bool {
+	return v.size == overflowValueSize
+}
+
+// overflow returns the first PageID of the overflow chain and the length of the value.
+// It must only be called on values for which isOverflow is true.
+func (v leafValue) overflow() (PageID, uint32) {
+	return PageID(binary.BigEndian.Uint32(v.data[0:4])), binary.BigEndian.Uint32(v.data[4:8])
+}
+
 type KeyRange struct {
 	min uint64
 	max uint64
@@ -59,8 +132,9 @@ Any mutation on an INodePage therefore writes directly to a Page and should upda
 */
 type INodePage struct {
 	id       *PageID
-	pinCount *uint16
+	pinCount *int32
 	isDirty  *bool
+	latch    *sync.RWMutex
 	numKeys  *uint16
 	keys     []uint64
 	pages    []PageID
@@ -76,7 +150,7 @@ func (n *INodePage) GetDebugInfo() string {
 			"\n\tkeys:     %d"+
 			"\n\tpages:    %d"+
 			"\n}",
-		*n.id, *n.pinCount, *n.isDirty, *n.numKeys, n.keys, n.pages,
+		*n.id, atomic.LoadInt32(n.pinCount), *n.isDirty, *n.numKeys, n.keys, n.pages,
 	)
 }
 
@@ -85,28 +159,36 @@ LNodePage is a leaf node page that points NumLeafKeys keys to NumLeafKeys values
 
 For <n = numKeys> used keys, there are also <n> values.
 
+All leaves are doubly linked to their left and right siblings, in key order.
+The leftmost and rightmost leaves point to NoSibling.
+
 An LNodePage is a transmutation of a Page.
 Any mutation on an LNodePage therefore writes directly to a Page and should update the isDirty flag accordingly.
 */
 type LNodePage struct {
-	id       *PageID
-	pinCount *uint16
-	isDirty  *bool
-	numKeys  *uint16
-	keys     []uint64
-	values   [][10]byte
+	id           *PageID
+	pinCount     *int32
+	isDirty      *bool
+	latch        *sync.RWMutex
+	numKeys      *uint16
+	leftSibling  *PageID
+	rightSibling *PageID
+	keys         []uint64
+	values       []leafValue
 }
 
 func (n *LNodePage) GetDebugInfo() string {
 	return fmt.Sprintf("LNode {"+
-		"\n\tid:       %d"+
-		"\n\tpinCount: %d"+
-		"\n\tisDirty:  %t"+
-		"\n\tnumKeys:  %d"+
-		"\n\tkeys:     %d"+
-		"\n\tvalues:   %d"+
+		"\n\tid:           %d"+
+		"\n\tpinCount:     %d"+
+		"\n\tisDirty:      %t"+
+		"\n\tnumKeys:      %d"+
+		"\n\tleftSibling:  %d"+
+		"\n\trightSibling: %d"+
+		"\n\tkeys:         %d"+
+		"\n\tvalues:       %d"+
 		"\n}",
-		*n.id, *n.pinCount, *n.isDirty, *n.numKeys, n.keys, n.values,
+		*n.id, atomic.LoadInt32(n.pinCount), *n.isDirty, *n.numKeys, *n.leftSibling, *n.rightSibling, n.keys, n.values,
 	)
 }
 
@@ -131,7 +213,7 @@ func RawINodeFrom(page *Page) *INodePage {
 	keys := unsafe.Slice((*uint64)(unsafe.Pointer(&page.data[KeyStartIndex])), NumInternalKeys)
 	pages := unsafe.Slice((*PageID)(unsafe.Pointer(&page.data[PagesStartIndex])), NumInternalPages)
 
-	return &INodePage{&page.id, &page.pinCount, &page.isDirty, numKeys, keys, pages}
+	return &INodePage{&page.id, &page.pinCount, &page.isDirty, &page.latch, numKeys, keys, pages}
 }
 
 // keyRange returns the (min, max) key range of an INodePage. If the page was empty, it returns (0, 0).
@@ -156,23 +238,53 @@ func (n *INodePage) contains(s uint64) bool {
 
 // get returns the PageID associated with a given key.
 func (n *INodePage) get(key uint64) PageID {
+	return n.pages[n.childIndex(key)]
+}
+
+// childIndex returns the index of the page associated with a given key.
+func (n *INodePage) childIndex(key uint64) uint16 {
 	if *n.numKeys == 0 {
 		panic("invalid state: INodePage should not be empty")
 	}
 
 	if key <= n.keys[0] {
-		return n.pages[0]
+		return 0
 	}
 
 	for i := uint16(1); i < *n.numKeys; i++ {
 		if key <= n.keys[i] {
-			return n.pages[i]
+			return i
 		}
 	}
-	return n.pages[*n.numKeys]
+	return *n.numKeys
 
 	//idx, _ := search.Binary(key, n.keys[:*n.numKeys])
-	//return n.pages[idx]
+	//return uint16(idx)
+}
+
+// indexOf returns the index of the child with the given PageID.
+// The second return value is false if the page is no child of this INodePage.
+func (n *INodePage) indexOf(id PageID) (uint16, bool) {
+	for i := uint16(0); i <= *n.numKeys; i++ {
+		if n.pages[i] == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// isUnderflowing returns whether the INodePage holds less than MinInternalKeys keys.
+func (n *INodePage) isUnderflowing() bool {
+	return *n.numKeys < MinInternalKeys
+}
+
+// remove removes the separator at idx together with its RIGHT target node.
+// This is the inverse operation of rightInsert.
+func (n *INodePage) remove(idx uint16) {
+	util.ShiftLeft(n.keys, idx+1, *n.numKeys, 0)
+	util.ShiftLeft(n.pages, idx+2, *n.numKeys+1, PageID(0))
+	*n.numKeys--
+	*n.isDirty = true
 }
 
 // rightInsert inserts a new separator into an INodePage, preserving the order of keys.
@@ -226,19 +338,40 @@ func (n *INodePage) splitRight(pageForRightNode *Page) (uint64, *INodePage) {
 	return parentSeparator, right
 }
 
+// mergeFrom appends the separator and all keys and pages of the right sibling to the INodePage.
+// The separator must be the parent separator between both nodes.
+//
+// SAFETY: The caller must ensure that the combined keys fit into a single node.
+func (n *INodePage) mergeFrom(separator uint64, right *INodePage) {
+	offset := *n.numKeys + 1
+	n.keys[*n.numKeys] = separator
+	util.MoveSlice(n.keys[offset:offset+*right.numKeys], right.keys[:*right.numKeys], 0)
+	util.MoveSlice(n.pages[offset:offset+*right.numKeys+1], right.pages[:*right.numKeys+1], PageID(0))
+
+	*n.numKeys += *right.numKeys + 1
+	*n.isDirty = true
+	*right.numKeys = 0
+	*right.isDirty = true
+}
+
 // RawLNodeFrom explicitly transmutes a Page into an LNodePage.
-// If IsLeafIndex has the wrong value it gets corrected and the page gets marked as isDirty.
+// If IsLeafIndex has the wrong value it gets corrected, the siblings get reset to NoSibling and the page gets marked as isDirty.
 func RawLNodeFrom(page *Page) *LNodePage {
+	numKeys := (*uint16)(unsafe.Pointer(&page.data[NumKeysIndex]))
+	leftSibling := (*PageID)(unsafe.Pointer(&page.data[LeftSiblingIndex]))
+	rightSibling := (*PageID)(unsafe.Pointer(&page.data[RightSiblingIndex]))
+	keys := unsafe.Slice((*uint64)(unsafe.Pointer(&page.data[LeafKeyStartIndex])), NumLeafKeys)
+	values := unsafe.Slice((*leafValue)(unsafe.Pointer(&page.data[ValuesStartIndex])), NumLeafValues)
+
 	if page.data[IsLeafIndex] == 0 {
 		//log.Println("Interpreting non-LNode data as LNode")
 		page.isDirty = true
 		page.data[IsLeafIndex] = 1
+		*leftSibling = NoSibling
+		*rightSibling = NoSibling
 	}
-	numKeys := (*uint16)(unsafe.Pointer(&page.data[NumKeysIndex]))
-	keys := unsafe.Slice((*uint64)(unsafe.Pointer(&page.data[KeyStartIndex])), NumLeafKeys)
-	values := unsafe.Slice((*[10]byte)(unsafe.Pointer(&page.data[ValuesStartIndex])), NumLeafValues)
 
-	return &LNodePage{&page.id, &page.pinCount, &page.isDirty, numKeys, keys, values}
+	return &LNodePage{&page.id, &page.pinCount, &page.isDirty, &page.latch, numKeys, leftSibling, rightSibling, keys, values}
 }
 
 // keyRange returns the (min, max) key range of an INodePage. If the page was empty, it returns (0, 0).
@@ -261,14 +394,14 @@ func (n *LNodePage) contains(key uint64) bool {
 	return found
 }
 
-// get returns the PageID associated with a given key.
+// get returns the value associated with a given key.
 // If no association was found, the second return value is false.
-func (n *LNodePage) get(key uint64) ([10]byte, bool) {
+func (n *LNodePage) get(key uint64) (leafValue, bool) {
 	idx, found := search.Binary(key, n.keys[:*n.numKeys])
 	if found {
 		return n.values[idx], true
 	} else {
-		return [10]byte{}, false
+		return leafValue{}, false
 	}
 }
 
@@ -279,7 +412,7 @@ nothing will be done and the method returns false.
 Otherwise, the key-value pair will be inserted, preserving the order inside the LNodePage,
 and the method returns true.
 */
-func (n *LNodePage) insert(key uint64, value [10]byte) bool {
+func (n *LNodePage) insert(key uint64, value leafValue) bool {
 	if n.isFull() {
 		return false
 	}
@@ -298,9 +431,69 @@ func (n *LNodePage) insert(key uint64, value [10]byte) bool {
 	return true
 }
 
+// update replaces the value associated with an existing key in an LNodePage, returning the replaced value.
+// If the key was not found, nothing will be done and the method returns false.
+func (n *LNodePage) update(key uint64, value leafValue) (leafValue, bool) {
+	idx, found := search.Binary(key, n.keys[:*n.numKeys])
+	if !found {
+		return leafValue{}, false
+	}
+
+	old := util.Replace(&n.values[idx], value)
+
+	*n.isDirty = true
+	return old, true
+}
+
+// remove removes a key and its value from an LNodePage, preserving the order inside the LNodePage.
+// The removed value is returned.
+// If the key was not found, nothing will be done and the method returns false.
+func (n *LNodePage) remove(key uint64) (leafValue, bool) {
+	idx, found := search.Binary(key, n.keys[:*n.numKeys])
+	if !found {
+		return leafValue{}, false
+	}
+
+	value := n.values[idx]
+	util.ShiftLeft(n.keys, idx+1, uint(*n.numKeys), 0)
+	util.ShiftLeft(n.values, idx+1, uint(*n.numKeys), leafValue{})
+
+	*n.numKeys--
+
+	*n.isDirty = true
+	return value, true
+}
+
+// isUnderflowing returns whether the LNodePage holds less than MinLeafKeys keys.
+func (n *LNodePage) isUnderflowing() bool {
+	return *n.numKeys < MinLeafKeys
+}
+
+// mergeFrom appends all key-value pairs of the right sibling to the LNodePage.
+// The LNodePage takes over the right sibling of the merged node.
+//
+// SAFETY: The caller must ensure that the combined keys fit into a single node,
+// and must update the left sibling of the new right sibling.
+func (n *LNodePage) mergeFrom(right *LNodePage) {
+	*n.rightSibling = *right.rightSibling
+
+	offset := *n.numKeys
+	util.MoveSlice(n.keys[offset:offset+*right.numKeys], right.keys[:*right.numKeys], 0)
+	util.MoveSlice(n.values[offset:offset+*right.numKeys], right.values[:*right.numKeys], leafValue{})
+
+	*n.numKeys += *right.numKeys
+	*n.isDirty = true
+	*right.numKeys = 0
+	*right.isDirty = true
+}
+
 // splitRight splits an LNodePage in the middle into a left (itself) and a right node.
 // The right node lives in the provided page.
 //
+// The right node gets linked in between the left node and its former right sibling.
+//
+// SAFETY: The caller must update the left sibling of the former right sibling.
+//
 // Returns the last key of the left node as a separator for the parent node (left-biased) and the right node.
 func (n *LNodePage) splitRight(pageForRightNode *Page) (uint64, *LNodePage) {
 	totalKeys := *n.numKeys
@@ -308,9 +501,12 @@ func (n *LNodePage) splitRight(pageForRightNode *Page) (uint64, *LNodePage) {
 
 	right := RawLNodeFrom(pageForRightNode)
 	*right.isDirty = true
+	*right.leftSibling = *n.id
+	*right.rightSibling = *n.rightSibling
+	*n.rightSibling = *right.id
 	*right.numKeys = totalKeys - middle
 	util.MoveSlice(right.keys[0:*right.numKeys], n.keys[middle:totalKeys], 0)
-	util.MoveSlice(right.values[0:*right.numKeys], n.values[middle:totalKeys], [10]byte{})
+	util.MoveSlice(right.values[0:*right.numKeys], n.values[middle:totalKeys], leafValue{})
 
 	left := n
 	*left.isDirty = true
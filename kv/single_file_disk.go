@@ -0,0 +1,621 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// singleFileName specifies the name of the file used by the single file disk
+// to store all pages and meta data.
+const singleFileName = "store.kv"
+
+// superblockMagic identifies a file as single file store.
+const superblockMagic = "KVSTORE\x00"
+
+// singleFileFormatVersion is the version of the format of single file stores.
+// It must be incremented whenever the format changes incompatibly. Stores of
+// version 1, whose superblock lacks the checkpoint LSN, are upgraded once
+// their superblock is written.
+const singleFileFormatVersion = 2
+
+// superblockSize is the size of the encoded superblock, which is stored at
+// the start of page 0:
+// - 8 bytes magic
+// - 4 bytes format version
+// - 4 bytes page size
+// - 4 bytes root page ID
+// - 4 bytes free list head
+// - 4 bytes next page ID
+// - 4 bytes number of free pages
+// - 8 bytes checkpoint LSN
+// - 4 bytes checksum
+const superblockSize = 8 + 6*4 + 8 + 4
+
+// superblockV1Size is the size of superblocks of format version 1.
+const superblockV1Size = 8 + 6*4 + 4
+
+// noPage marks the absence of a page where a page ID is expected. Like
+// NoSibling, it is never allocated.
+const noPage = PageID(math.MaxUint32)
+
+// superblock holds the meta data of a single file store.
+type superblock struct {
+	version      uint32
+	pageSize     uint32
+	root         PageID
+	freeListHead PageID
+	nextPageID   PageID
+	freePages    uint32
+	// LSN of the last write-ahead log record which is part of the
+	// superblock.
+	lsn uint64
+}
+
+// SingleFileDisk implements a disk which persists all pages, along with its
+// meta data and the root of the tree, in a single file.
+//
+// The first page of the file holds the superblock, the page with ID n is
+// stored at offset n * PageSize. Each page on disk consists of a CRC32
+// checksum, the page's data, and its state in the last byte. Free pages are
+// tracked in a chain of free list pages, see freeList.
+//
+// This type requires initialization, and as such should only be created via
+// the NewSingleFileDisk() function. Once all page operations are done,
+// Close() must be called to make the disk persist its meta data.
+//
+// SingleFileDisk is safe for concurrent use, but serializes all operations.
+type SingleFileDisk struct {
+	Path string
+
+	file *os.File
+	// Superblock as it was last persisted.
+	superblock superblock
+	nextPageID PageID
+	free       *freeList
+	// LSN to store with the superblock the next time it is written.
+	lsn uint64
+
+	// mu guards the meta data and the file.
+	mu sync.Mutex
+}
+
+// NewSingleFileDisk initializes a new single file disk.
+//
+// If the supplied directory already contains a single file store, the disk is
+// initialized from it. Otherwise a new store is created in this directory.
+// The file is locked exclusively until the disk is closed.
+//
+// An error is returned if initialization fails, or if the file is locked by
+// another process.
+func NewSingleFileDisk(directory string) (Disk, error) {
+	d := &SingleFileDisk{
+		Path: filepath.Join(directory, singleFileName),
+	}
+
+	file, err := os.OpenFile(d.Path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return d, fmt.Errorf("IO error while opening store file: %v", err)
+	}
+	d.file = file
+
+	err = lockFile(file)
+	if err == nil {
+		err = d.initialize()
+	}
+	if err != nil {
+		file.Close()
+	}
+
+	return d, err
+}
+
+func (d *SingleFileDisk) initialize() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return fmt.Errorf("IO error while reading size of store file: %v", err)
+	}
+
+	if info.Size() == 0 {
+		// Initializing a new store, page 0 being the superblock.
+		d.superblock = superblock{
+			version:      singleFileFormatVersion,
+			pageSize:     PageSize,
+			root:         noPage,
+			freeListHead: noPage,
+			nextPageID:   1,
+		}
+		if err := d.writeSuperblock(); err != nil {
+			return err
+		}
+	} else {
+		data := make([]byte, superblockSize)
+		if _, err := d.file.ReadAt(data, 0); err != nil {
+			return fmt.Errorf("IO error while reading superblock: %v", err)
+		}
+		if d.superblock, err = decodeSuperblock(data); err != nil {
+			return err
+		}
+	}
+
+	d.nextPageID = d.superblock.nextPageID
+	d.free = newFreeList(d.superblock.freeListHead, d.superblock.freePages)
+	d.lsn = d.superblock.lsn
+
+	return nil
+}
+
+// AllocatePage allocates a new unused page.
+//
+// Free pages are reused before the file is extended.
+//
+// An error is returned if page allocation fails.
+func (d *SingleFileDisk) AllocatePage() (*Page, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id, ok, err := d.free.pop(d)
+	if err != nil {
+		return &Page{}, err
+	}
+	if !ok {
+		if id, err = d.extend(); err != nil {
+			return &Page{}, err
+		}
+	}
+
+	p := newPage(id)
+	err = d.writePage(id, p.data, pageAllocated)
+
+	return p, err
+}
+
+// DeallocatePage deallocates a page, zeroing its content on disk.
+//
+// Trying to deallocate an unallocated page will be a no-op, not having any effect.
+func (d *SingleFileDisk) DeallocatePage(id PageID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.exists(id) {
+		return
+	}
+	state, err := d.pageState(id)
+	if err != nil || state != pageAllocated {
+		return
+	}
+
+	if err := d.writePage(id, &[PageDataSize]byte{}, pageFree); err != nil {
+		// Unable to mark the page as free, so we won't deallocate it.
+		return
+	}
+	d.free.push(id)
+}
+
+// ReadPage reads the page with the specified ID from disk.
+//
+// If no page with this ID is allocated, or an IO error is encountered while
+// reading the page, an error is returned.
+func (d *SingleFileDisk) ReadPage(id PageID) (*Page, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.exists(id) {
+		return &Page{}, fmt.Errorf("No page with ID %d on disk", id)
+	}
+
+	data, state, err := d.readPage(id)
+	if err != nil {
+		return &Page{}, err
+	}
+	if state != pageAllocated {
+		return &Page{}, fmt.Errorf("No page with ID %d on disk", id)
+	}
+
+	return &Page{
+		id:   id,
+		data: data,
+	}, nil
+}
+
+// WritePage writes the given page to disk.
+//
+// The page must have previously been allocated via AllocatePage. Trying to
+// write a page beyond all allocated pages will return an error.
+//
+// An error is returned if an IO error is encountered.
+func (d *SingleFileDisk) WritePage(page *Page) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.exists(page.id) {
+		return fmt.Errorf("Unable to write page %d, as it was never allocated", page.id)
+	}
+
+	return d.writePage(page.id, page.data, pageAllocated)
+}
+
+// Occupied returns the number of currently allocated pages.
+func (d *SingleFileDisk) Occupied() uint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Page 0 holds the superblock.
+	return uint(d.nextPageID) - 1 - uint(d.free.pages)
+}
+
+// Capacity returns the maximum number of supported pages.
+func (d *SingleFileDisk) Capacity() uint {
+	// Neither the superblock nor noPage are available.
+	return math.MaxUint32 - 1
+}
+
+// Close persists the meta data and closes the file. After having called
+// Close() the disk must not be used anymore.
+//
+// An error is returned if an IO error is encountered.
+func (d *SingleFileDisk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.writeMetaData(false)
+	if closeErr := d.file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("IO error while closing store file: %v", closeErr)
+	}
+
+	return err
+}
+
+// redoAllocate repeats the allocation of the page with the given ID while
+// recovering from a write-ahead log. Pages which are allocated already are
+// left as they are.
+//
+// An error is returned if AllocatePage would have allocated a different page.
+func (d *SingleFileDisk) redoAllocate(id PageID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expected, ok, err := d.free.peek(d)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		expected = d.nextPageID
+	}
+	if id != expected {
+		if d.exists(id) {
+			free, err := d.free.contains(d, id)
+			if err != nil {
+				return err
+			}
+			if !free {
+				return nil
+			}
+		}
+		return fmt.Errorf("Unable to redo allocation of page %d, as page %d would have been allocated", id, expected)
+	}
+
+	if ok {
+		_, _, err = d.free.pop(d)
+	} else {
+		_, err = d.extend()
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.writePage(id, &[PageDataSize]byte{}, pageAllocated)
+}
+
+// redoDeallocate repeats the deallocation of the page with the given ID while
+// recovering from a write-ahead log. Pages which are on the free list already
+// are left as they are.
+//
+// Other than DeallocatePage, the page is freed even if it is not allocated
+// on disk, as it might already have been deallocated before the crash.
+//
+// An error is returned if the free list cannot be read.
+func (d *SingleFileDisk) redoDeallocate(id PageID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if free, err := d.free.contains(d, id); err != nil || free {
+		return err
+	}
+
+	// The free list does not depend on the state of the page, so errors
+	// are no reason not to free it.
+	_ = d.writePage(id, &[PageDataSize]byte{}, pageFree)
+	d.free.push(id)
+
+	return nil
+}
+
+// checkpointLSN returns the LSN of the last write-ahead log record which is
+// part of the superblock.
+func (d *SingleFileDisk) checkpointLSN() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.superblock.lsn
+}
+
+// setCheckpointLSN sets the LSN which is stored along with the superblock the
+// next time the meta data is stored.
+func (d *SingleFileDisk) setCheckpointLSN(lsn uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lsn = lsn
+}
+
+// storeMetaData persists the free list and the superblock. If durable is set,
+// the file is synced both before and after writing the superblock.
+func (d *SingleFileDisk) storeMetaData(durable bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.writeMetaData(durable)
+}
+
+// sync flushes the file, including the superblock, to stable storage.
+func (d *SingleFileDisk) sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.syncFile()
+}
+
+// syncFile flushes the file to stable storage. The caller must hold the
+// mutex.
+func (d *SingleFileDisk) syncFile() error {
+	if err := d.file.Sync(); err != nil {
+		return fmt.Errorf("IO error while syncing %s: %v", d.Path, err)
+	}
+
+	return nil
+}
+
+// root returns the ID of the root page of the tree stored on the disk.
+//
+// An error is returned if no root has been stored yet.
+func (d *SingleFileDisk) root() (PageID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.superblock.root == noPage {
+		return 0, fmt.Errorf("No root page stored in %s", d.Path)
+	}
+
+	return d.superblock.root, nil
+}
+
+// setRoot persists the ID of the root page of the tree stored on the disk.
+func (d *SingleFileDisk) setRoot(id PageID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.superblock.root = id
+
+	return d.writeSuperblock()
+}
+
+// writeMetaData stores the free list, and then the superblock referencing
+// it, syncing both if durable is set. The caller must hold the mutex.
+func (d *SingleFileDisk) writeMetaData(durable bool) error {
+	head, err := d.free.store(d)
+	if err != nil {
+		return err
+	}
+
+	// The pages, including the free list, must reach stable storage
+	// before the superblock referencing them.
+	if durable {
+		if err := d.syncFile(); err != nil {
+			return err
+		}
+	}
+
+	d.superblock.freeListHead = head
+	d.superblock.freePages = d.free.pages
+	d.superblock.nextPageID = d.nextPageID
+	d.superblock.lsn = d.lsn
+
+	if err := d.writeSuperblock(); err != nil {
+		return err
+	}
+	if durable {
+		return d.syncFile()
+	}
+
+	return nil
+}
+
+// writeSuperblock writes the superblock to the start of the file. The caller
+// must hold the mutex.
+func (d *SingleFileDisk) writeSuperblock() error {
+	d.superblock.version = singleFileFormatVersion
+	_, err := d.file.WriteAt(d.superblock.encode(), 0)
+	if err != nil {
+		return fmt.Errorf("IO error while writing superblock: %v", err)
+	}
+
+	return nil
+}
+
+// pageFiles returns the path of the single file, which holds all pages.
+func (d *SingleFileDisk) pageFiles() []string {
+	return []string{d.Path}
+}
+
+// freePages returns the number of pages on the free list.
+func (d *SingleFileDisk) freePages() uint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return uint(d.free.pages)
+}
+
+// exists returns whether the page with the given ID was ever allocated. The
+// caller must hold the mutex.
+func (d *SingleFileDisk) exists(id PageID) bool {
+	return id != 0 && id < d.nextPageID
+}
+
+// extend allocates the page following all existing pages. The caller must
+// hold the mutex.
+func (d *SingleFileDisk) extend() (PageID, error) {
+	if d.nextPageID == noPage {
+		return 0, fmt.Errorf("Unable to allocate page, as all %d pages are in use", d.Capacity())
+	}
+
+	id := d.nextPageID
+	d.nextPageID++
+
+	return id, nil
+}
+
+// readPage reads the data and state of a page. The caller must hold the
+// mutex.
+func (d *SingleFileDisk) readPage(id PageID) (*[PageDataSize]byte, byte, error) {
+	page := make([]byte, PageSize)
+	_, err := d.file.ReadAt(page, int64(id)*PageSize)
+	if errors.Is(err, io.EOF) {
+		// The page was allocated, but never written.
+		return &[PageDataSize]byte{}, pageUnused, nil
+	}
+	if err != nil {
+		return nil, pageUnused, fmt.Errorf("Error reading page %d from store file: %v", id, err)
+	}
+
+	var data [PageDataSize]byte
+	copy(data[:], page[4:4+PageDataSize])
+
+	checksum := binary.BigEndian.Uint32(page[0:4])
+	newChecksum := crc32.ChecksumIEEE(data[:])
+	if newChecksum != checksum {
+		return nil, pageUnused, fmt.Errorf("Checksum of page %d different from checksum calculated from data: %x != %x", id, checksum, newChecksum)
+	}
+
+	return &data, page[PageSize-1], nil
+}
+
+// pageState reads the state of a page. The caller must hold the mutex.
+func (d *SingleFileDisk) pageState(id PageID) (byte, error) {
+	state := make([]byte, 1)
+	_, err := d.file.ReadAt(state, int64(id)*PageSize+PageSize-1)
+	if errors.Is(err, io.EOF) {
+		return pageUnused, nil
+	}
+	if err != nil {
+		return pageUnused, fmt.Errorf("Error reading state of page %d from store file: %v", id, err)
+	}
+
+	return state[0], nil
+}
+
+// writePage writes the data and state of a page. The caller must hold the
+// mutex.
+func (d *SingleFileDisk) writePage(id PageID, data *[PageDataSize]byte, state byte) error {
+	page := make([]byte, PageSize)
+	binary.BigEndian.PutUint32(page[0:4], crc32.ChecksumIEEE(data[:]))
+	copy(page[4:4+PageDataSize], data[:])
+	page[PageSize-1] = state
+
+	_, err := d.file.WriteAt(page, int64(id)*PageSize)
+	if err != nil {
+		return fmt.Errorf("IO error while writing page %d to store file: %v", id, err)
+	}
+
+	return nil
+}
+
+// readFreeListPage reads a page of the free list. The caller must hold the
+// mutex.
+func (d *SingleFileDisk) readFreeListPage(id PageID) (*[PageDataSize]byte, error) {
+	data, state, err := d.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	if state != pageFree {
+		return nil, fmt.Errorf("Page %d is not free", id)
+	}
+
+	return data, nil
+}
+
+// writeFreeListPage writes a page of the free list. The caller must hold the
+// mutex.
+func (d *SingleFileDisk) writeFreeListPage(id PageID, data *[PageDataSize]byte) error {
+	return d.writePage(id, data, pageFree)
+}
+
+// encode encodes the superblock into a byte slice.
+func (s *superblock) encode() []byte {
+	data := make([]byte, superblockSize)
+
+	copy(data[0:8], superblockMagic)
+	binary.BigEndian.PutUint32(data[8:12], s.version)
+	binary.BigEndian.PutUint32(data[12:16], s.pageSize)
+	binary.BigEndian.PutUint32(data[16:20], uint32(s.root))
+	binary.BigEndian.PutUint32(data[20:24], uint32(s.freeListHead))
+	binary.BigEndian.PutUint32(data[24:28], uint32(s.nextPageID))
+	binary.BigEndian.PutUint32(data[28:32], s.freePages)
+	binary.BigEndian.PutUint64(data[32:40], s.lsn)
+
+	checksum := crc32.ChecksumIEEE(data[:superblockSize-4])
+	binary.BigEndian.PutUint32(data[superblockSize-4:], checksum)
+
+	return data
+}
+
+// decodeSuperblock decodes a superblock.
+//
+// An error is returned if the data is no valid superblock, or if the store it
+// belongs to has a different format version or page size.
+func decodeSuperblock(data []byte) (superblock, error) {
+	if len(data) < superblockV1Size || !bytes.Equal(data[0:8], []byte(superblockMagic)) {
+		return superblock{}, fmt.Errorf("File is not a single file store")
+	}
+
+	size := superblockSize
+	if binary.BigEndian.Uint32(data[8:12]) == 1 {
+		size = superblockV1Size
+	}
+	if len(data) < size {
+		return superblock{}, fmt.Errorf("File is not a single file store")
+	}
+
+	checksum := binary.BigEndian.Uint32(data[size-4 : size])
+	newChecksum := crc32.ChecksumIEEE(data[:size-4])
+	if newChecksum != checksum {
+		return superblock{}, fmt.Errorf("Checksum of superblock different from checksum calculated from data: %x != %x", checksum, newChecksum)
+	}
+
+	s := superblock{
+		version:      binary.BigEndian.Uint32(data[8:12]),
+		pageSize:     binary.BigEndian.Uint32(data[12:16]),
+		root:         PageID(binary.BigEndian.Uint32(data[16:20])),
+		freeListHead: PageID(binary.BigEndian.Uint32(data[20:24])),
+		nextPageID:   PageID(binary.BigEndian.Uint32(data[24:28])),
+		freePages:    binary.BigEndian.Uint32(data[28:32]),
+	}
+	if s.version > singleFileFormatVersion {
+		return superblock{}, fmt.Errorf("Store has format version %d, but only versions up to %d are supported", s.version, singleFileFormatVersion)
+	}
+	if s.version > 1 {
+		s.lsn = binary.BigEndian.Uint64(data[32:40])
+	}
+	if s.pageSize != PageSize {
+		return superblock{}, fmt.Errorf("Store has page size %dB, but the page size is %dB", s.pageSize, PageSize)
+	}
+
+	return s, nil
+}
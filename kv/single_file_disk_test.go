@@ -0,0 +1,353 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+func newSingleFileDisk(t *testing.T, dir string) *SingleFileDisk {
+	disk, err := NewSingleFileDisk(dir)
+	if err != nil {
+		t.Fatalf("Error creating single file disk: %v", err)
+	}
+
+	return disk.(*SingleFileDisk)
+}
+
+func TestSingleFileDisk_ReadWritePage(t *testing.T) {
+	dir := helper.GetTempDir(t, "single_file_disk")
+	disk := newSingleFileDisk(t, dir)
+
+	for i := 1; i <= 10; i++ {
+		page, err := disk.AllocatePage()
+		if err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+		// Page 0 is the superblock.
+		if page.id != PageID(i) {
+			t.Errorf("Expected page to have ID %d; got %d", i, page.id)
+		}
+
+		page.data[0] = byte(i)
+		if err := disk.WritePage(page); err != nil {
+			t.Fatalf("Error writing page: %v", err)
+		}
+	}
+
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+	disk = newSingleFileDisk(t, dir)
+	defer disk.Close()
+
+	for i := 1; i <= 10; i++ {
+		page, err := disk.ReadPage(PageID(i))
+		if err != nil {
+			t.Fatalf("Error reading page %d: %v", i, err)
+		}
+		if page.data[0] != byte(i) {
+			t.Errorf("Expected page %d to start with %d; got %d", i, i, page.data[0])
+		}
+	}
+
+	if _, err := disk.ReadPage(0); err == nil {
+		t.Errorf("Expected error reading the superblock as page; got none")
+	}
+	if _, err := disk.ReadPage(11); err == nil {
+		t.Errorf("Expected error reading unallocated page; got none")
+	}
+	if err := disk.WritePage(newPage(11)); err == nil {
+		t.Errorf("Expected error writing unallocated page; got none")
+	}
+
+	disk.DeallocatePage(5)
+	if _, err := disk.ReadPage(5); err == nil {
+		t.Errorf("Expected error reading deallocated page; got none")
+	}
+}
+
+func TestSingleFileDisk_ReusesFreePages(t *testing.T) {
+	dir := helper.GetTempDir(t, "single_file_disk")
+	disk := newSingleFileDisk(t, dir)
+
+	// Enough pages to require multiple free list trunks.
+	numPages := 3 * freeListTrunkCapacity
+	for i := 0; i < numPages; i++ {
+		if _, err := disk.AllocatePage(); err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+	}
+
+	deallocated := make(map[PageID]bool)
+	ids := make([]uint64, numPages)
+	util.FillAsc(ids, 1)
+	util.Shuffle(ids)
+	for _, id := range ids[:numPages-100] {
+		disk.DeallocatePage(PageID(id))
+		deallocated[PageID(id)] = true
+	}
+	// Deallocating twice has no effect.
+	disk.DeallocatePage(PageID(ids[0]))
+
+	if disk.Occupied() != 100 {
+		t.Errorf("Expected 100 occupied pages; got %d", disk.Occupied())
+	}
+
+	if err := disk.Close(); err != nil {
+		t.Fatalf("Error closing disk: %v", err)
+	}
+	disk = newSingleFileDisk(t, dir)
+	defer disk.Close()
+
+	if disk.Occupied() != 100 {
+		t.Errorf("Expected 100 occupied pages after reopening; got %d", disk.Occupied())
+	}
+
+	// All free pages are reused before the file grows, except the ones
+	// holding the free list, which become free once it is stored again.
+	free := numPages - int(disk.Occupied())
+	grown := 0
+	for i := 0; i < free; i++ {
+		page, err := disk.AllocatePage()
+		if err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+		if int(page.id) > numPages {
+			grown++
+		}
+		delete(deallocated, page.id)
+	}
+	if grown > 3 {
+		t.Errorf("Expected only free list pages not to be reused; got %d new pages", grown)
+	}
+
+	if err := disk.storeMetaData(false); err != nil {
+		t.Fatalf("Error storing meta data: %v", err)
+	}
+	for i := 0; i < grown; i++ {
+		page, err := disk.AllocatePage()
+		if err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+		delete(deallocated, page.id)
+	}
+
+	if len(deallocated) != 0 {
+		t.Errorf("Expected all deallocated pages to be reused; %d were not", len(deallocated))
+	}
+}
+
+func TestSingleFileDisk_StoredFreeListMatchesLoaded(t *testing.T) {
+	dir := helper.GetTempDir(t, "single_file_disk")
+	disk := newSingleFileDisk(t, dir)
+	defer disk.Close()
+
+	numPages := 2 * freeListTrunkCapacity
+	for i := 0; i < numPages; i++ {
+		if _, err := disk.AllocatePage(); err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+	}
+	for id := 1; id <= numPages; id += 2 {
+		disk.DeallocatePage(PageID(id))
+	}
+	if err := disk.storeMetaData(false); err != nil {
+		t.Fatalf("Error storing meta data: %v", err)
+	}
+
+	// Take pages from both the first and the second trunk, free some more,
+	// and store the free list again.
+	for i := 0; i < freeListTrunkCapacity/2+10; i++ {
+		if _, err := disk.AllocatePage(); err != nil {
+			t.Fatalf("Error allocating page: %v", err)
+		}
+	}
+	for id := 2; id <= 200; id += 2 {
+		disk.DeallocatePage(PageID(id))
+	}
+	if err := disk.storeMetaData(false); err != nil {
+		t.Fatalf("Error storing meta data: %v", err)
+	}
+
+	// Pages must be taken in the same order from the free list in memory
+	// and the one loaded from disk, as recovery relies on it. The store is
+	// loaded from a copy, as the open disk keeps its file locked.
+	data, err := os.ReadFile(disk.Path)
+	if err != nil {
+		t.Fatalf("Error reading store file: %v", err)
+	}
+	copyDir := helper.GetTempDir(t, "single_file_disk_copy")
+	if err := os.WriteFile(filepath.Join(copyDir, singleFileName), data, 0660); err != nil {
+		t.Fatalf("Error copying store file: %v", err)
+	}
+	loaded := newSingleFileDisk(t, copyDir)
+	defer loaded.file.Close()
+
+	if loaded.free.pages != disk.free.pages {
+		t.Fatalf("Expected %d free pages after loading; got %d", disk.free.pages, loaded.free.pages)
+	}
+	for {
+		expected, ok, err := disk.free.pop(disk)
+		if err != nil {
+			t.Fatalf("Error taking free page: %v", err)
+		}
+		actual, loadedOk, err := loaded.free.pop(loaded)
+		if err != nil {
+			t.Fatalf("Error taking free page of loaded free list: %v", err)
+		}
+
+		if ok != loadedOk || expected != actual {
+			t.Fatalf("Expected free page %d (%v); got %d (%v)", expected, ok, actual, loadedOk)
+		}
+		if !ok {
+			break
+		}
+	}
+}
+
+func TestSingleFileDisk_RejectsInvalidSuperblock(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64
+		data   []byte
+	}{
+		{"magic", 0, []byte("NOTAKV")},
+		{"version", 8, []byte{0, 0, 0, 3}},
+		{"checksum", 24, []byte{0xff}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := helper.GetTempDir(t, "single_file_disk")
+			disk := newSingleFileDisk(t, dir)
+			if err := disk.Close(); err != nil {
+				t.Fatalf("Error closing disk: %v", err)
+			}
+
+			file, err := os.OpenFile(filepath.Join(dir, singleFileName), os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatalf("Error opening store file: %v", err)
+			}
+			_, err = file.WriteAt(test.data, test.offset)
+			file.Close()
+			if err != nil {
+				t.Fatalf("Error corrupting store file: %v", err)
+			}
+
+			if _, err := NewSingleFileDisk(dir); err == nil {
+				t.Errorf("Expected error opening store with invalid %s; got none", test.name)
+			}
+		})
+	}
+}
+
+func TestSingleFileDisk_BTree(t *testing.T) {
+	config := KvStoreConfig{
+		MemorySize:           16 * PageSize,
+		WorkingDirectory:     helper.GetTempDir(t, "single_file_tree"),
+		DisableWriteAheadLog: true,
+		Storage:              StorageSingleFile,
+	}
+
+	tree := &BTree{}
+	if err := tree.Create(config); err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+
+	keys := make([]uint64, 5_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	for _, key := range keys[:2_500] {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Error closing tree: %v", err)
+	}
+
+	files, err := os.ReadDir(config.WorkingDirectory)
+	if err != nil {
+		t.Fatalf("Error listing directory: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != singleFileName {
+		t.Errorf("Expected directory to only contain %s; got %v", singleFileName, files)
+	}
+
+	tree = &BTree{}
+	if err := tree.Open(config); err != nil {
+		t.Fatalf("Error opening tree: %v", err)
+	}
+	defer tree.Close()
+
+	for i, key := range keys {
+		value, err := tree.Get(key)
+		if i < 2_500 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected deleted key %d not to be found; got %v", key, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error getting key %d: %v", key, err)
+		}
+		if value != [10]byte{byte(key)} {
+			t.Fatalf("Expected value %d for key %d; got %v", byte(key), key, value)
+		}
+	}
+}
+
+func TestSingleFileDisk_WALRecovery(t *testing.T) {
+	config := KvStoreConfig{
+		MemorySize:       16 * PageSize,
+		WorkingDirectory: helper.GetTempDir(t, "single_file_wal"),
+		Storage:          StorageSingleFile,
+	}
+
+	tree := &BTree{}
+	if err := tree.Create(config); err != nil {
+		t.Fatalf("Error creating tree: %v", err)
+	}
+
+	keys := make([]uint64, 5_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	for _, key := range keys[:2_500] {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+
+	tree.bufferPool.disk.(*SingleFileDisk).file.Close()
+	tree = crashAndRecover(t, tree, config)
+	defer tree.Close()
+
+	for i, key := range keys {
+		value, err := tree.Get(key)
+		if i < 2_500 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected deleted key %d not to be found; got %v", key, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error getting key %d: %v", key, err)
+		}
+		if value != [10]byte{byte(key)} {
+			t.Fatalf("Expected value %d for key %d; got %v", byte(key), key, value)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// SlottedLeafMarker is the value at IsLeafIndex which marks a page as a leaf SlottedPage.
+	SlottedLeafMarker = 3
+
+	// SlottedInternalMarker is the value at IsLeafIndex which marks a page as an internal SlottedPage.
+	SlottedInternalMarker = 4
+
+	// NumSlotsIndex is the starting index for the number of slots of a SlottedPage.
+	NumSlotsIndex = 1
+
+	// FreeEndIndex is the starting index for the offset at which the cell area of a SlottedPage starts.
+	FreeEndIndex = NumSlotsIndex + 2
+
+	// SlottedLinkIndex is the starting index for the PageID of the right sibling of a leaf SlottedPage,
+	// and of the rightmost child of an internal SlottedPage.
+	SlottedLinkIndex = FreeEndIndex + 2
+
+	// SlottedLeftSiblingIndex is the starting index for the PageID of the left sibling of a leaf SlottedPage.
+	SlottedLeftSiblingIndex = SlottedLinkIndex + 4
+
+	// SlotsStartIndex is the starting index for the slot array of a SlottedPage.
+	SlotsStartIndex = SlottedLeftSiblingIndex + 4
+
+	// SlottedCapacity is the number of bytes available for slots and cells in a SlottedPage.
+	SlottedCapacity = PageDataSize - SlotsStartIndex
+
+	// MaxSlots is the largest number of slots a SlottedPage may hold.
+	MaxSlots = SlottedCapacity / 2
+
+	// MaxKeySize is the largest size of a key stored in a BytesTree.
+	// It is chosen such that any page holds at least four cells, which keeps splits balanced.
+	MaxKeySize = SlottedCapacity/4 - slotSize - cellHeaderSize - LeafValueSize
+
+	// slotSize is the size of a single entry in the slot array.
+	slotSize = 2
+
+	// cellHeaderSize is the size of the key length prefix of every cell.
+	cellHeaderSize = 2
+
+	// childSize is the size of the child PageID stored in cells of internal pages.
+	childSize = 4
+)
+
+/*
+SlottedPage is a node page of a BytesTree, holding keys of variable length.
+
+The page starts with a fixed header, followed by the slot array growing towards
+the end of the page. Cells are stored at the end of the page, growing towards
+the start. Each slot holds the offset of a cell, slots being ordered by key.
+Free space is thus kept in the middle of the page, such that inserting only
+has to shift slots rather than cells.
+
+Each cell starts with the length of its key and the key itself. Leaf cells are
+followed by a leafValue, internal cells by the PageID of the child holding keys
+less or equal to the key of the cell. The child holding keys greater than the
+last key of an internal page is stored in the header as link.
+
+Removing a cell leaves a gap in the cell area, which gets reclaimed by
+compacting the page once a cell no longer fits.
+
+A SlottedPage is a transmutation of a Page.
+Any mutation on a SlottedPage therefore writes directly to a Page and should update the isDirty flag accordingly.
+*/
+type SlottedPage struct {
+	id       *PageID
+	pinCount *int32
+	isDirty  *bool
+	data     *[PageDataSize]byte
+	numSlots *uint16
+	freeEnd  *uint16
+	// link is the right sibling of a leaf, or the rightmost child of an internal page.
+	link        *PageID
+	leftSibling *PageID
+	slots       []uint16
+}
+
+// RawSlottedFrom explicitly transmutes a Page into a SlottedPage.
+// If IsLeafIndex does not match the requested kind of page, the page gets
+// initialized as an empty SlottedPage and marked as isDirty.
+func RawSlottedFrom(page *Page, isLeaf bool) *SlottedPage {
+	marker := byte(SlottedInternalMarker)
+	if isLeaf {
+		marker = SlottedLeafMarker
+	}
+
+	n := rawSlottedFrom(page)
+	if page.data[IsLeafIndex] != marker {
+		page.data[IsLeafIndex] = marker
+		n.reset()
+		*n.link = NoSibling
+		*n.leftSibling = NoSibling
+	}
+
+	return n
+}
+
+// RawSlottedNodeFrom transmutes a Page holding either kind of SlottedPage.
+// An error is returned if the page does not hold a SlottedPage.
+func RawSlottedNodeFrom(page *Page) (*SlottedPage, error) {
+	if !isSlottedPage(page) {
+		return nil, fmt.Errorf("page %d does not hold a slotted node", page.id)
+	}
+
+	return rawSlottedFrom(page), nil
+}
+
+// isSlottedPage returns whether a page holds a SlottedPage.
+func isSlottedPage(page *Page) bool {
+	return page.data[IsLeafIndex] == SlottedLeafMarker || page.data[IsLeafIndex] == SlottedInternalMarker
+}
+
+func rawSlottedFrom(page *Page) *SlottedPage {
+	numSlots := (*uint16)(unsafe.Pointer(&page.data[NumSlotsIndex]))
+	freeEnd := (*uint16)(unsafe.Pointer(&page.data[FreeEndIndex]))
+	link := (*PageID)(unsafe.Pointer(&page.data[SlottedLinkIndex]))
+	leftSibling := (*PageID)(unsafe.Pointer(&page.data[SlottedLeftSiblingIndex]))
+	slots := unsafe.Slice((*uint16)(unsafe.Pointer(&page.data[SlotsStartIndex])), MaxSlots)
+
+	return &SlottedPage{&page.id, &page.pinCount, &page.isDirty, page.data, numSlots, freeEnd, link, leftSibling, slots}
+}
+
+func (n *SlottedPage) GetDebugInfo() string {
+	keys := make([]string, *n.numSlots)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%q", n.key(uint16(i)))
+	}
+
+	return fmt.Sprintf("%T {"+
+		"\n\tid:        %d"+
+		"\n\tpinCount:  %d"+
+		"\n\tisDirty:   %t"+
+		"\n\tisLeaf:    %t"+
+		"\n\tnumSlots:  %d"+
+		"\n\tfreeSpace: %d"+
+		"\n\tlink:      %d"+
+		"\n\tkeys:      %v"+
+		"\n}",
+		n, *n.id, atomic.LoadInt32(n.pinCount), *n.isDirty, n.isLeaf(), *n.numSlots, n.freeSpace(), *n.link, keys,
+	)
+}
+
+// isLeaf returns whether the page is a leaf.
+func (n *SlottedPage) isLeaf() bool {
+	return n.data[IsLeafIndex] == SlottedLeafMarker
+}
+
+// reset removes all cells from the page, keeping its links.
+func (n *SlottedPage) reset() {
+	*n.numSlots = 0
+	*n.freeEnd = PageDataSize
+	*n.isDirty = true
+}
+
+// payloadSize returns the size of the data following the key of each cell.
+func (n *SlottedPage) payloadSize() int {
+	if n.isLeaf() {
+		return LeafValueSize
+	}
+
+	return childSize
+}
+
+// cell returns the cell referenced by the slot at the given index.
+func (n *SlottedPage) cell(idx uint16) []byte {
+	offset := int(n.slots[idx])
+	keyLength := int(binary.BigEndian.Uint16(n.data[offset:]))
+	size := cellHeaderSize + keyLength + n.payloadSize()
+
+	return n.data[offset : offset+size]
+}
+
+// key returns the key of the cell at the given index.
+// The returned slice points into the page and must not be retained.
+func (n *SlottedPage) key(idx uint16) []byte {
+	cell := n.cell(idx)
+	return cell[cellHeaderSize : len(cell)-n.payloadSize()]
+}
+
+// value returns the value of the leaf cell at the given index.
+func (n *SlottedPage) value(idx uint16) leafValue {
+	cell := n.cell(idx)
+	v := leafValue{size: cell[len(cell)-1]}
+	copy(v.data[:], cell[len(cell)-LeafValueSize:])
+
+	return v
+}
+
+// setValue replaces the value of the leaf cell at the given index.
+func (n *SlottedPage) setValue(idx uint16, v leafValue) {
+	cell := n.cell(idx)
+	copy(cell[len(cell)-LeafValueSize:], v.data[:])
+	cell[len(cell)-1] = v.size
+	*n.isDirty = true
+}
+
+// child returns the PageID of the child at the given index of an internal
+// page. The index numSlots refers to the rightmost child.
+func (n *SlottedPage) child(idx uint16) PageID {
+	if idx == *n.numSlots {
+		return *n.link
+	}
+
+	cell := n.cell(idx)
+	return PageID(binary.BigEndian.Uint32(cell[len(cell)-childSize:]))
+}
+
+// search returns the index of the first cell with a key greater or equal to
+// the given key, and whether the key at that index equals the given key.
+func (n *SlottedPage) search(key []byte) (uint16, bool) {
+	idx := sort.Search(int(*n.numSlots), func(i int) bool {
+		return bytes.Compare(n.key(uint16(i)), key) >= 0
+	})
+	found := idx < int(*n.numSlots) && bytes.Equal(n.key(uint16(idx)), key)
+
+	return uint16(idx), found
+}
+
+// childIndex returns the index of the child which may hold the given key.
+func (n *SlottedPage) childIndex(key []byte) uint16 {
+	idx, _ := n.search(key)
+	return idx
+}
+
+// indexOf returns the index of the child with the given PageID.
+func (n *SlottedPage) indexOf(id PageID) (uint16, bool) {
+	for i := uint16(0); i <= *n.numSlots; i++ {
+		if n.child(i) == id {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// freeSpace returns the number of contiguous bytes between the slot array and the cell area.
+func (n *SlottedPage) freeSpace() int {
+	return int(*n.freeEnd) - SlotsStartIndex - slotSize*int(*n.numSlots)
+}
+
+// usedSpace returns the number of bytes used by slots and cells, excluding gaps left by removed cells.
+func (n *SlottedPage) usedSpace() int {
+	used := 0
+	for i := uint16(0); i < *n.numSlots; i++ {
+		used += slotSize + len(n.cell(i))
+	}
+
+	return used
+}
+
+// isUnderflowing returns whether the page uses less than a quarter of its capacity.
+func (n *SlottedPage) isUnderflowing() bool {
+	return n.usedSpace() < SlottedCapacity/4
+}
+
+// insertCell inserts a cell at the given slot index, compacting the page if
+// required. It returns false if the cell does not fit into the page.
+func (n *SlottedPage) insertCell(idx uint16, cell []byte) bool {
+	if n.freeSpace() < slotSize+len(cell) {
+		if n.usedSpace()+slotSize+len(cell) > SlottedCapacity {
+			return false
+		}
+		n.compact()
+	}
+
+	*n.freeEnd -= uint16(len(cell))
+	copy(n.data[*n.freeEnd:], cell)
+
+	copy(n.slots[idx+1:*n.numSlots+1], n.slots[idx:*n.numSlots])
+	n.slots[idx] = *n.freeEnd
+	*n.numSlots++
+	*n.isDirty = true
+
+	return true
+}
+
+// appendCells appends cells in order. The cells must fit into the page.
+func (n *SlottedPage) appendCells(cells [][]byte) {
+	for _, cell := range cells {
+		if !n.insertCell(*n.numSlots, cell) {
+			panic("cells do not fit into slotted page")
+		}
+	}
+}
+
+// removeCell removes the cell at the given slot index.
+// The space of the cell is only reclaimed once the page gets compacted.
+func (n *SlottedPage) removeCell(idx uint16) {
+	copy(n.slots[idx:*n.numSlots-1], n.slots[idx+1:*n.numSlots])
+	*n.numSlots--
+	*n.isDirty = true
+}
+
+// cells returns copies of all cells in order.
+func (n *SlottedPage) cells() [][]byte {
+	cells := make([][]byte, *n.numSlots)
+	for i := range cells {
+		cells[i] = append([]byte(nil), n.cell(uint16(i))...)
+	}
+
+	return cells
+}
+
+// compact rewrites all cells to the end of the page, removing gaps left by removed cells.
+func (n *SlottedPage) compact() {
+	cells := n.cells()
+	n.reset()
+	n.appendCells(cells)
+}
+
+// leafCell encodes a key and its value as a cell of a leaf.
+func leafCell(key []byte, v leafValue) []byte {
+	cell := make([]byte, cellHeaderSize+len(key)+LeafValueSize)
+	binary.BigEndian.PutUint16(cell, uint16(len(key)))
+	copy(cell[cellHeaderSize:], key)
+	copy(cell[cellHeaderSize+len(key):], v.data[:])
+	cell[len(cell)-1] = v.size
+
+	return cell
+}
+
+// internalCell encodes a separator key and the child holding keys less or
+// equal to it as a cell of an internal page.
+func internalCell(key []byte, child PageID) []byte {
+	cell := make([]byte, cellHeaderSize+len(key)+childSize)
+	binary.BigEndian.PutUint16(cell, uint16(len(key)))
+	copy(cell[cellHeaderSize:], key)
+	binary.BigEndian.PutUint32(cell[cellHeaderSize+len(key):], uint32(child))
+
+	return cell
+}
+
+// cellKey returns the key of an encoded cell.
+func cellKey(cell []byte) []byte {
+	keyLength := int(binary.BigEndian.Uint16(cell))
+	return cell[cellHeaderSize : cellHeaderSize+keyLength]
+}
+
+// cellChild returns the child PageID of an encoded internal cell.
+func cellChild(cell []byte) PageID {
+	return PageID(binary.BigEndian.Uint32(cell[len(cell)-childSize:]))
+}
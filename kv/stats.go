@@ -0,0 +1,200 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// TreeStats describes the shape of a BTree and the state of its storage, as
+// returned by Stats.
+type TreeStats struct {
+	// Number of levels, from the root down to the leaves.
+	Height int
+	// Number of pages holding nodes, and values stored in overflow pages.
+	InternalPages uint
+	LeafPages     uint
+	OverflowPages uint
+	// Average fraction of the keys a node can hold which are in use, over
+	// all nodes.
+	FillFactor float64
+	// Statistics of each level, starting with the root.
+	Levels []LevelStats
+
+	// Number of items, and the smallest and greatest key among them. The
+	// keys are only valid if there is at least one item.
+	Keys   uint
+	MinKey uint64
+	MaxKey uint64
+
+	// Total size of all files of the tree, including meta data and the
+	// write-ahead log, and the number of files holding pages. Both are 0 if
+	// the tree is not stored on disk.
+	BytesOnDisk int64
+	PageFiles   int
+	// Number of pages on the disk's free list.
+	FreePages uint
+
+	BufferPool BufferPoolStats
+}
+
+// LevelStats describes a single level of a BTree.
+type LevelStats struct {
+	Pages uint
+	Keys  uint
+	// Fraction of the keys the nodes of the level can hold which are in use.
+	FillFactor float64
+}
+
+/*
+Stats returns statistics of the shape of the tree, its storage and its buffer
+pool.
+
+All nodes of the tree are read, so other operations on the tree block until
+Stats returns. The pages read are counted by the buffer pool as any other,
+though only by the statistics returned by later calls. Summary returns the
+statistics which don't require reading any node.
+*/
+func (t *BTree) Stats() (TreeStats, error) {
+	if !t.open {
+		panic("Cannot read from closed tree")
+	}
+
+	t.isolation.Lock()
+	defer t.isolation.Unlock()
+
+	stats := TreeStats{BufferPool: t.bufferPool.Stats()}
+	if err := t.walkLevels(&stats); err != nil {
+		return TreeStats{}, err
+	}
+	if err := t.storageStats(&stats); err != nil {
+		return TreeStats{}, err
+	}
+
+	return stats, nil
+}
+
+/*
+Summary returns the statistics of the tree's storage and buffer pool, leaving
+all statistics of the shape of the tree and its items zero.
+
+Other than Stats, no node is read, so Summary neither blocks other operations
+nor takes longer as the tree grows. It thus suits being called frequently, for
+example to monitor a server.
+*/
+func (t *BTree) Summary() (TreeStats, error) {
+	if !t.open {
+		panic("Cannot read from closed tree")
+	}
+
+	stats := TreeStats{BufferPool: t.bufferPool.Stats()}
+	if err := t.storageStats(&stats); err != nil {
+		return TreeStats{}, err
+	}
+
+	return stats, nil
+}
+
+// walkLevels adds the statistics of all nodes to stats, visiting them level
+// by level.
+func (t *BTree) walkLevels(stats *TreeStats) error {
+	var fills float64
+
+	addLevel := func(pages, keys, capacity uint) {
+		fill := float64(keys) / float64(pages*capacity)
+		stats.Levels = append(stats.Levels, LevelStats{pages, keys, fill})
+		fills += fill * float64(pages)
+	}
+
+	rootKeys := uint(*t.root.numKeys)
+	stats.InternalPages++
+	addLevel(1, rootKeys, NumInternalKeys)
+	level := append([]PageID{}, t.root.pages[:rootKeys+1]...)
+
+	for len(level) > 0 {
+		var next []PageID
+		var keys uint
+		isLeafLevel := false
+
+		for _, id := range level {
+			page, err := t.bufferPool.FetchPage(id)
+			if err != nil {
+				return err
+			}
+
+			leaf, node := RawNodeFrom(page)
+			if leaf != nil {
+				isLeafLevel = true
+				keys += stats.addLeaf(leaf)
+			} else {
+				keys += uint(*node.numKeys)
+				next = append(next, node.pages[:*node.numKeys+1]...)
+			}
+			t.bufferPool.UnpinPage(id, false)
+		}
+
+		if isLeafLevel {
+			stats.LeafPages += uint(len(level))
+			addLevel(uint(len(level)), keys, NumLeafKeys)
+		} else {
+			stats.InternalPages += uint(len(level))
+			addLevel(uint(len(level)), keys, NumInternalKeys)
+		}
+		level = next
+	}
+
+	stats.Height = len(stats.Levels)
+	stats.FillFactor = fills / float64(stats.InternalPages+stats.LeafPages)
+
+	return nil
+}
+
+// addLeaf adds the items of a leaf to the statistics, and returns their
+// number. Leaves must be added in key order.
+func (stats *TreeStats) addLeaf(leaf *LNodePage) uint {
+	numKeys := uint(*leaf.numKeys)
+	if numKeys == 0 {
+		return 0
+	}
+
+	if stats.Keys == 0 {
+		stats.MinKey = leaf.keys[0]
+	}
+	stats.MaxKey = leaf.keys[numKeys-1]
+	stats.Keys += numKeys
+
+	for _, value := range leaf.values[:numKeys] {
+		if value.isOverflow() {
+			_, length := value.overflow()
+			stats.OverflowPages += uint((int(length) + OverflowDataSize - 1) / OverflowDataSize)
+		}
+	}
+
+	return numKeys
+}
+
+// storageStats adds the statistics of the files of the tree to stats.
+func (t *BTree) storageStats(stats *TreeStats) error {
+	if disk, ok := t.bufferPool.disk.(fileDisk); ok {
+		stats.PageFiles = len(disk.pageFiles())
+		stats.FreePages = disk.freePages()
+	}
+
+	if t.directory == "" {
+		return nil
+	}
+
+	return filepath.Walk(t.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Temporary files might be gone by the time they are
+			// visited, as Summary doesn't wait for writes.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			stats.BytesOnDisk += info.Size()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,183 @@
+package kv
+
+import (
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+func TestStatsOfEmptyTree(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	stats, err := tree.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+
+	// The root and its two leaves.
+	if stats.Height != 2 || stats.InternalPages != 1 || stats.LeafPages != 2 {
+		t.Errorf("Expected root with two leaves; got %+v", stats)
+	}
+	if stats.Keys != 0 {
+		t.Errorf("Expected no keys; got %d", stats.Keys)
+	}
+	if stats.PageFiles != 1 || stats.BytesOnDisk == 0 {
+		t.Errorf("Expected a single page file; got %d files of %dB", stats.PageFiles, stats.BytesOnDisk)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	keys := make([]uint64, 20_000)
+	util.FillAsc(keys, 10)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	if err := tree.PutBytes(1, randomBytes(2*OverflowDataSize, 1)); err != nil {
+		t.Fatalf("Error putting large value: %v", err)
+	}
+	for _, key := range keys[:5_000] {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+
+	stats, err := tree.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+
+	if stats.Keys != 15_001 || stats.MinKey != 1 {
+		t.Errorf("Expected 15001 keys starting at 1; got %d starting at %d", stats.Keys, stats.MinKey)
+	}
+	if stats.OverflowPages != 2 {
+		t.Errorf("Expected 2 overflow pages; got %d", stats.OverflowPages)
+	}
+	// All leaves still fit below the root.
+	if stats.Height != 2 || len(stats.Levels) != 2 {
+		t.Errorf("Expected 2 levels; got height %d with %d levels", stats.Height, len(stats.Levels))
+	}
+
+	leaves := stats.Levels[len(stats.Levels)-1]
+	if leaves.Pages != stats.LeafPages || leaves.Keys != stats.Keys {
+		t.Errorf("Expected leaf level to hold all leaves and keys; got %+v", leaves)
+	}
+	// Each level but the leaves references all nodes of the level below.
+	for i, level := range stats.Levels[:len(stats.Levels)-1] {
+		if below := stats.Levels[i+1].Pages; level.Keys+level.Pages != below {
+			t.Errorf("Expected %d keys on level %d; got %d", below-level.Pages, i, level.Keys)
+		}
+	}
+	if stats.FillFactor < 0.25 || stats.FillFactor > 1 {
+		t.Errorf("Expected fill factor between 0.25 and 1; got %v", stats.FillFactor)
+	}
+
+	// All pages in use are part of the tree.
+	pages := stats.InternalPages + stats.LeafPages + stats.OverflowPages
+	if occupied := tree.bufferPool.disk.Occupied(); pages != occupied {
+		t.Errorf("Expected %d pages in tree; got %d", occupied, pages)
+	}
+	if stats.FreePages == 0 {
+		t.Errorf("Expected free pages after deleting keys; got none")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	for key := uint64(1); key <= 5_000; key++ {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+
+	stats, err := tree.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+
+	// Summary must not wait for operations holding the tree exclusively.
+	tree.isolation.Lock()
+	summary, err := tree.Summary()
+	tree.isolation.Unlock()
+	if err != nil {
+		t.Fatalf("Error getting summary: %v", err)
+	}
+
+	if summary.Keys != 0 || summary.Height != 0 || summary.LeafPages != 0 || summary.Levels != nil {
+		t.Errorf("Expected summary without statistics of the shape of the tree; got %+v", summary)
+	}
+	if summary.PageFiles != stats.PageFiles || summary.FreePages != stats.FreePages || summary.BytesOnDisk != stats.BytesOnDisk {
+		t.Errorf("Expected storage statistics %+v; got %+v", stats, summary)
+	}
+	if summary.BufferPool.Frames != 16 || summary.BufferPool.Misses < stats.BufferPool.Misses {
+		t.Errorf("Expected statistics of the buffer pool; got %+v", summary.BufferPool)
+	}
+}
+
+func TestBufferPoolStats(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	defer tree.Close()
+
+	keys := make([]uint64, 5_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+
+	before := tree.bufferPool.Stats()
+	if before.Frames != 16 || before.CachedPages == 0 {
+		t.Errorf("Expected 16 frames holding pages; got %+v", before)
+	}
+	if before.Misses == 0 || before.Evictions == 0 || before.DirtyFlushes == 0 {
+		t.Errorf("Expected pages to be evicted and flushed; got %+v", before)
+	}
+
+	// Looking up the same key twice hits the cached leaf.
+	tree.Get(keys[0])
+	tree.Get(keys[0])
+	after := tree.bufferPool.Stats()
+	if after.Hits <= before.Hits {
+		t.Errorf("Expected hits to increase from %d; got %d", before.Hits, after.Hits)
+	}
+	if ratio := after.HitRatio(); ratio <= 0 || ratio >= 1 {
+		t.Errorf("Expected hit ratio between 0 and 1; got %v", ratio)
+	}
+}
+
+func TestStatsOfBulkLoadedTree(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, BulkLoadFillFactor: 1})
+	defer tree.Close()
+
+	// More leaves than fit below the root.
+	n := (NumInternalPages + 1) * NumLeafKeys
+	keys, values := bulkItems(n)
+	if err := tree.BulkLoad(newSliceIterator(keys, values)); err != nil {
+		t.Fatalf("Error bulk loading: %v", err)
+	}
+
+	stats, err := tree.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+
+	if stats.Height != 3 || stats.Levels[1].Pages != 2 {
+		t.Errorf("Expected 3 levels with 2 internal nodes below the root; got %+v", stats.Levels)
+	}
+	if stats.Keys != uint(n) || stats.MinKey != 1 || stats.MaxKey != uint64(n) {
+		t.Errorf("Expected keys 1 through %d; got %d from %d to %d", n, stats.Keys, stats.MinKey, stats.MaxKey)
+	}
+	if leaves := stats.Levels[2]; leaves.Pages != uint(NumInternalPages+1) || leaves.FillFactor != 1 {
+		t.Errorf("Expected %d full leaves; got %+v", NumInternalPages+1, leaves)
+	}
+}
@@ -57,6 +57,9 @@ func (helper *TestHelper) GetEmptyInstance() (KeyValueStore, string) {
 
 // GetEmptyInstanceWithMemoryLimit provides a new ready-to-use KV store with a
 // custom memory limit. It also returns the working directory of the KV store.
+//
+// The store has no write-ahead log, as syncing it on every modification slows
+// tests down considerably.
 func (helper *TestHelper) GetEmptyInstanceWithMemoryLimit(memoryLimit uint) (KeyValueStore, string) {
 	kv := BTree{}
 
@@ -67,8 +70,9 @@ func (helper *TestHelper) GetEmptyInstanceWithMemoryLimit(memoryLimit uint) (Key
 
 	err = kv.Create(
 		KvStoreConfig{
-			MemorySize:       memoryLimit,
-			WorkingDirectory: dir,
+			MemorySize:           memoryLimit,
+			WorkingDirectory:     dir,
+			DisableWriteAheadLog: true,
 		},
 	)
 	if err != nil {
@@ -78,6 +82,24 @@ func (helper *TestHelper) GetEmptyInstanceWithMemoryLimit(memoryLimit uint) (Key
 	return &kv, dir
 }
 
+// GetInstance provides a new ready-to-use tree created with the given config,
+// which is returned along with it. Unless the config specifies a working
+// directory, one is created within TestHelper's base directory.
+//
+// If creation of the tree fails, the test aborts with a fatal error.
+func (helper *TestHelper) GetInstance(t TestOrBenchmark, config KvStoreConfig) (*BTree, KvStoreConfig) {
+	if config.WorkingDirectory == "" {
+		config.WorkingDirectory = helper.GetTempDir(t, "kv_store_")
+	}
+
+	tree := &BTree{}
+	if err := tree.Create(config); err != nil {
+		t.Fatalf("Test helper: Unable to create KV store: %v", err)
+	}
+
+	return tree, config
+}
+
 // GetTempDir creates a generic temporary directory within TestHelper's base directory.
 //
 // The supplied ID should be chosen to meaningfully identify the purpose of the directory.
@@ -0,0 +1,150 @@
+package kv
+
+import (
+	"container/list"
+	"sync"
+)
+
+/*
+TwoQueueCache implements the full version of the 2Q algorithm.
+
+Pages loaded for the first time enter the FIFO queue A1in. Once evicted from
+there, their ID is remembered in the ghost queue A1out. Only pages which get
+loaded again while remembered in A1out enter the LRU queue Am, which thus holds
+the pages referenced repeatedly over a longer period of time. References to
+pages in A1in are considered correlated, e.g. multiple accesses to the same
+page within a single operation, and don't promote them.
+
+Victims are taken from A1in as long as it exceeds a quarter of the frames,
+from Am otherwise. A1out remembers as many pages as half the frames.
+*/
+type TwoQueueCache struct {
+	mu sync.Mutex
+
+	// Resident frames by queue, as queuedFrame. New pages are pushed to
+	// the front.
+	a1in *list.List
+	am   *list.List
+	// Remembered IDs of pages evicted from a1in, most recent in front.
+	a1out     *list.List
+	a1outByID map[PageID]*list.Element
+
+	frames map[FrameID]*queuedFrame
+
+	maxA1in  int
+	maxA1out int
+}
+
+// NewTwoQueueCache creates a new TwoQueueCache for a buffer pool with the
+// given number of frames.
+func NewTwoQueueCache(size uint) TwoQueueCache {
+	return TwoQueueCache{
+		a1in:      list.New(),
+		am:        list.New(),
+		a1out:     list.New(),
+		a1outByID: make(map[PageID]*list.Element, size/2),
+		frames:    make(map[FrameID]*queuedFrame, size),
+		maxA1in:   int(size / 4),
+		maxA1out:  int(size / 2),
+	}
+}
+
+func (c *TwoQueueCache) Victim() *FrameID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	queues := []*list.List{c.am, c.a1in}
+	if c.a1in.Len() > c.maxA1in {
+		queues = []*list.List{c.a1in, c.am}
+	}
+
+	for _, queue := range queues {
+		f := oldestEligible(queue)
+		if f == nil {
+			continue
+		}
+
+		c.forget(f)
+		if queue == c.a1in && f.loaded {
+			c.remember(f.page)
+		}
+
+		id := f.id
+		return &id
+	}
+
+	return nil
+}
+
+func (c *TwoQueueCache) Remove(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.frames[frameID]
+	if !ok {
+		return
+	}
+
+	f.eligible = false
+	if f.queue == c.am {
+		c.am.MoveToFront(f.element)
+	}
+}
+
+func (c *TwoQueueCache) Add(frameID FrameID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.frames[frameID]
+	if !ok {
+		// The frame was added without a page having been loaded,
+		// treat it as a fresh page.
+		f = c.enqueue(frameID, c.a1in)
+	}
+	f.eligible = true
+}
+
+func (c *TwoQueueCache) Load(frameID FrameID, pageID PageID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.frames[frameID]; ok {
+		c.forget(f)
+	}
+
+	queue := c.a1in
+	if e, ok := c.a1outByID[pageID]; ok {
+		c.a1out.Remove(e)
+		delete(c.a1outByID, pageID)
+		queue = c.am
+	}
+
+	f := c.enqueue(frameID, queue)
+	f.page, f.loaded = pageID, true
+}
+
+// enqueue starts tracking a frame in the given queue.
+func (c *TwoQueueCache) enqueue(frameID FrameID, queue *list.List) *queuedFrame {
+	f := &queuedFrame{id: frameID, queue: queue}
+	f.element = queue.PushFront(f)
+	c.frames[frameID] = f
+
+	return f
+}
+
+// forget stops tracking a frame.
+func (c *TwoQueueCache) forget(f *queuedFrame) {
+	f.queue.Remove(f.element)
+	delete(c.frames, f.id)
+}
+
+// remember remembers the ID of a page evicted from a1in, forgetting the
+// oldest one if a1out is full.
+func (c *TwoQueueCache) remember(page PageID) {
+	c.a1outByID[page] = c.a1out.PushFront(page)
+
+	if c.a1out.Len() > c.maxA1out {
+		oldest := c.a1out.Remove(c.a1out.Back()).(PageID)
+		delete(c.a1outByID, oldest)
+	}
+}
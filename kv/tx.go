@@ -0,0 +1,303 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// txOp is the kind of modification buffered by a transaction for a key.
+type txOp uint8
+
+const (
+	// txInsert inserts an item which does not exist in the tree.
+	txInsert txOp = iota
+	// txReplace replaces the value of an item which was deleted earlier
+	// in the same transaction.
+	txReplace
+	// txDelete deletes an item which exists in the tree.
+	txDelete
+)
+
+// txWrite is a modification buffered by a transaction.
+type txWrite struct {
+	op    txOp
+	value []byte
+}
+
+/*
+Tx is a transaction on a BTree, started with Begin.
+
+Modifications are buffered within the transaction until it gets committed, so
+they are visible to the transaction itself, but not to anyone else reading the
+tree in the meantime. Commit applies all of them at once, such that either all
+or none of them end up in the tree.
+
+Put and Delete check their preconditions against the tree and the transaction
+itself right away. As the tree may be modified by others before the transaction
+is committed, the preconditions are checked again when committing, in which
+case the whole transaction fails.
+
+Once committed or rolled back, all methods of a transaction return ErrTxDone.
+*/
+type Tx struct {
+	tree   *BTree
+	writes map[uint64]txWrite
+	done   bool
+}
+
+// Begin starts a new transaction on the tree.
+func (t *BTree) Begin() *Tx {
+	if !t.open {
+		panic("Cannot begin transaction on closed tree")
+	}
+
+	return &Tx{
+		tree:   t,
+		writes: make(map[uint64]txWrite),
+	}
+}
+
+// Get retrieves the value of the item with given key, as seen by the
+// transaction. If no item with the requested key exists, ErrKeyNotFound is
+// returned. If the value does not fit into 10 bytes, ErrValueTooLarge is
+// returned.
+func (tx *Tx) Get(key uint64) ([10]byte, error) {
+	value, err := tx.GetBytes(key)
+	if err != nil {
+		return [10]byte{}, err
+	}
+	if len(value) > MaxInlineValueSize {
+		return [10]byte{}, ErrValueTooLarge
+	}
+
+	fixed := [10]byte{}
+	copy(fixed[:], value)
+
+	return fixed, nil
+}
+
+// GetBytes retrieves the value of the item with given key as seen by the
+// transaction, regardless of its size. If no item with the requested key
+// exists, ErrKeyNotFound is returned.
+func (tx *Tx) GetBytes(key uint64) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	if write, ok := tx.writes[key]; ok {
+		if write.op == txDelete {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte(nil), write.value...), nil
+	}
+
+	return tx.tree.GetBytes(key)
+}
+
+// Put stores a new item with given key and value within the transaction. If
+// an item with the requested key already exists, ErrKeyExists is returned.
+func (tx *Tx) Put(key uint64, value [10]byte) error {
+	return tx.PutBytes(key, value[:])
+}
+
+// PutBytes stores a new item with given key and a value of arbitrary size
+// within the transaction. If an item with the requested key already exists,
+// ErrKeyExists is returned.
+func (tx *Tx) PutBytes(key uint64, value []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	value = append([]byte(nil), value...)
+
+	if write, ok := tx.writes[key]; ok {
+		if write.op != txDelete {
+			return ErrKeyExists
+		}
+		tx.writes[key] = txWrite{op: txReplace, value: value}
+		return nil
+	}
+
+	exists, err := tx.existsInTree(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrKeyExists
+	}
+	tx.writes[key] = txWrite{op: txInsert, value: value}
+
+	return nil
+}
+
+// Delete removes the item with given key within the transaction. If no item
+// with the requested key exists, ErrKeyNotFound is returned.
+func (tx *Tx) Delete(key uint64) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	if write, ok := tx.writes[key]; ok {
+		switch write.op {
+		case txInsert:
+			delete(tx.writes, key)
+		case txReplace:
+			tx.writes[key] = txWrite{op: txDelete}
+		case txDelete:
+			return ErrKeyNotFound
+		}
+		return nil
+	}
+
+	exists, err := tx.existsInTree(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+	tx.writes[key] = txWrite{op: txDelete}
+
+	return nil
+}
+
+// existsInTree returns whether an item with given key exists in the tree,
+// disregarding the transaction.
+func (tx *Tx) existsInTree(key uint64) (bool, error) {
+	if !tx.tree.open {
+		panic("Cannot read from closed tree")
+	}
+
+	tx.tree.isolation.RLock()
+	defer tx.tree.isolation.RUnlock()
+
+	err := tx.tree.lookup(key, nil)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Commit applies all modifications of the transaction to the tree, in key
+// order. If any of them fails, none of them are applied and the error is
+// returned. Either way the transaction is done afterwards.
+//
+// If the tree has a write-ahead log, all pages the transaction modifies which
+// existed before must fit into the buffer pool at once, otherwise an error is
+// returned.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	t := tx.tree
+	if !t.open {
+		panic("Cannot write to closed tree")
+	}
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	keys := make([]uint64, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	// Nobody may observe the tree while the commit is applied, as it
+	// might still get reverted.
+	t.isolation.Lock()
+	err := t.atomically(func() error {
+		for _, key := range keys {
+			var err error
+			switch write := tx.writes[key]; write.op {
+			case txInsert:
+				err = t.storeAndInsert(key, write.value, false)
+			case txReplace:
+				err = t.storeAndUpdate(key, write.value)
+			case txDelete:
+				err = t.delete(key)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	t.isolation.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return t.commit()
+}
+
+// Rollback discards all modifications of the transaction. As the tree is only
+// modified when committing, it is left untouched.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.writes = nil
+
+	return nil
+}
+
+/*
+atomically runs an operation modifying the tree, such that either all or none
+of its modifications are applied. If the operation fails, all pages it modified
+are restored from copies taken when first fetched, and all pages it allocated
+are dropped again.
+
+If the tree has a write-ahead log, the operation gets logged like any other,
+in which case the buffer pool must be large enough to hold all pre-existing
+pages modified by it at once.
+*/
+func (t *BTree) atomically(op func() error) error {
+	rootID, root := t.rootPage.id, *t.rootPage.data
+
+	t.bufferPool.beginCapture(t.wal != nil, true)
+	err := op()
+	if err != nil {
+		if revertErr := t.revert(rootID, root); revertErr != nil {
+			err = fmt.Errorf("%v; additionally unable to roll back: %v", err, revertErr)
+		}
+	}
+
+	if t.wal == nil {
+		t.bufferPool.releaseCapture()
+		return err
+	}
+
+	return t.logCapture(err)
+}
+
+// revert reverts all modifications captured since atomically began, including
+// those of the root, whose state back then is given by rootID and root.
+func (t *BTree) revert(rootID PageID, root [PageDataSize]byte) error {
+	if t.rootPage.id != rootID {
+		// The new root might be a pre-existing page, which would
+		// otherwise stay pinned forever.
+		t.bufferPool.UnpinPage(t.rootPage.id, false)
+	}
+
+	err := t.bufferPool.revertCapture()
+
+	if t.rootPage.id != rootID {
+		page, fetchErr := t.bufferPool.FetchPage(rootID)
+		if fetchErr != nil {
+			return fmt.Errorf("Unable to restore root: %v", fetchErr)
+		}
+		t.rootPage = page
+		t.root = RawINodeFrom(page)
+	}
+	*t.rootPage.data = root
+	t.rootPage.isDirty = true
+
+	return err
+}
@@ -0,0 +1,179 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// assertTreeKeys checks that the tree holds exactly the given keys, each with
+// the value written by putting it in the tests below.
+func assertTreeKeys(t *testing.T, tree *BTree, keys []uint64) {
+	t.Helper()
+
+	found, values := tree.TraverseAll()
+	if len(found) != len(keys) {
+		t.Fatalf("Expected %d keys in tree; found %d", len(keys), len(found))
+	}
+	for i, key := range keys {
+		if found[i] != key {
+			t.Fatalf("Expected key %d at index %d; found %d", key, i, found[i])
+		}
+		if values[i] != [10]byte{byte(key)} {
+			t.Fatalf("Got value %v for key %d", values[i], key)
+		}
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	for key := uint64(1); key <= 10; key++ {
+		tree.Put(key, [10]byte{byte(key)})
+	}
+
+	tx := tree.Begin()
+	for key := uint64(11); key <= 3_000; key++ {
+		if err := tx.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	for key := uint64(1); key <= 5; key++ {
+		if err := tx.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+
+	// Modifications are visible within the transaction.
+	last := uint64(3_000)
+	if value, err := tx.Get(last); err != nil || value != [10]byte{byte(last)} {
+		t.Errorf("Expected to get own write; got %v, %v", value, err)
+	}
+	if _, err := tx.Get(1); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for own delete; got %v", err)
+	}
+	if err := tx.Put(11, [10]byte{}); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists for own put; got %v", err)
+	}
+
+	// But not to anyone else.
+	if _, err := tree.Get(3_000); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected uncommitted put not to be visible; got %v", err)
+	}
+	if _, err := tree.Get(1); err != nil {
+		t.Errorf("Expected uncommitted delete not to be visible; got %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Error committing: %v", err)
+	}
+
+	keys := make([]uint64, 3_000-5)
+	util.FillAsc(keys, 6)
+	assertTreeKeys(t, tree, keys)
+
+	if err := tx.Put(1, [10]byte{}); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone after commit; got %v", err)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	tree.Put(1, [10]byte{1})
+
+	tx := tree.Begin()
+	tx.Put(2, [10]byte{2})
+	tx.Delete(1)
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Error rolling back: %v", err)
+	}
+
+	assertTreeKeys(t, tree, []uint64{1})
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone after rollback; got %v", err)
+	}
+}
+
+func TestTxReplaceAndLargeValues(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+	tree.Put(1, [10]byte{1})
+
+	large := randomBytes(2*OverflowDataSize, 1)
+	tx := tree.Begin()
+	if err := tx.Delete(1); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+	if err := tx.PutBytes(1, large); err != nil {
+		t.Fatalf("Error putting deleted key again: %v", err)
+	}
+	if _, err := tx.Get(1); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge; got %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Error committing: %v", err)
+	}
+
+	value, err := tree.GetBytes(1)
+	if err != nil {
+		t.Fatalf("Error getting key: %v", err)
+	}
+	if !bytes.Equal(value, large) {
+		t.Errorf("Got unexpected value after commit")
+	}
+}
+
+func TestTxFailingCommitIsRolledBack(t *testing.T) {
+	for _, logged := range []bool{false, true} {
+		var tree *BTree
+		var config KvStoreConfig
+		if logged {
+			tree, config = helper.GetInstance(t, KvStoreConfig{MemorySize: 256 * PageSize, DisableWriteAheadLog: false})
+		} else {
+			tree, _ = helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: true})
+		}
+
+		keys := make([]uint64, 2_000)
+		util.FillAsc(keys, 1)
+		for _, key := range keys {
+			tree.Put(key, [10]byte{byte(key)})
+		}
+
+		// Splits and merges nodes before failing, reshaping the whole
+		// tree including its root.
+		tx := tree.Begin()
+		for key := uint64(1); key <= 1_900; key++ {
+			tx.Delete(key)
+		}
+		for key := uint64(10_000); key < 20_000; key++ {
+			tx.Put(key, [10]byte{byte(key)})
+		}
+		conflicting := uint64(1_000_000)
+		tx.PutBytes(conflicting, randomBytes(2*OverflowDataSize, 1))
+
+		// Conflicting modification outside of the transaction.
+		tree.Put(conflicting, [10]byte{byte(conflicting)})
+		keys = append(keys, conflicting)
+
+		if err := tx.Commit(); !errors.Is(err, ErrKeyExists) {
+			t.Fatalf("Expected conflicting commit to fail with ErrKeyExists; got %v", err)
+		}
+		assertTreeKeys(t, tree, keys)
+
+		// The tree remains usable.
+		tx = tree.Begin()
+		for key := uint64(1); key <= 1_000; key++ {
+			tx.Delete(key)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Error committing: %v", err)
+		}
+		keys = keys[1_000:]
+		assertTreeKeys(t, tree, keys)
+
+		if logged {
+			tree = crashAndRecover(t, tree, config)
+			assertTreeKeys(t, tree, keys)
+		}
+	}
+}
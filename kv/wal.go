@@ -0,0 +1,469 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// walFile specifies the name of the file used by the tree as write-ahead log.
+const walFile = "wal.log"
+
+// walCheckpointSize is the size in bytes above which the write-ahead log gets
+// truncated by checkpointing the tree.
+const walCheckpointSize = 64 << 20
+
+// walHeaderSize is the size of the header of each record in the write-ahead
+// log, holding the length of the payload and its checksum.
+const walHeaderSize = 8
+
+/*
+WAL is a write-ahead log of the modifications done to a tree since its last
+checkpoint.
+
+Each record holds the after-images of all pages modified by a single
+operation, along with the pages allocated and deallocated by it and the
+resulting root page ID. Redoing the records in order on top of the state of the
+last checkpoint thus restores the state after the last logged operation,
+regardless of which pages had been written to disk in the meantime.
+
+Records are checksummed, such that a record which was only partially written
+during a crash is detected and discarded during recovery.
+
+Each record is numbered with a log sequence number (LSN). A checkpoint stores
+the LSN of the last record along with the meta data of the disk before the log
+gets truncated, such that records which are already part of the stored state
+are skipped if the process crashes in between.
+*/
+type WAL struct {
+	file *os.File
+	size int64
+	// LSN of the last record appended.
+	lsn uint64
+	// Whether syncing appended records is left to the caller, see sync.
+	deferSync bool
+}
+
+// walRecord is a single record of the write-ahead log.
+type walRecord struct {
+	lsn         uint64
+	root        PageID
+	allocated   []PageID
+	deallocated []PageID
+	pages       []*Page
+}
+
+// recoverableDisk is implemented by disks whose state can be recovered from a
+// write-ahead log.
+type recoverableDisk interface {
+	Disk
+
+	// redoAllocate repeats the allocation of a page, unless it is
+	// allocated already. An error is returned if the disk would have
+	// allocated a different page.
+	redoAllocate(PageID) error
+	// redoDeallocate repeats the deallocation of a page, unless it is
+	// free already.
+	redoDeallocate(PageID) error
+	// storeMetaData persists the meta data of the disk. If durable is
+	// set, all pages written so far are synced to stable storage before
+	// the meta data referencing them is written and synced.
+	storeMetaData(durable bool) error
+	// checkpointLSN returns the LSN of the last log record which is part
+	// of the stored meta data.
+	checkpointLSN() uint64
+	// setCheckpointLSN sets the LSN to store along with the meta data the
+	// next time it is stored.
+	setCheckpointLSN(uint64)
+	// sync flushes all pages written since they were last synced to
+	// stable storage.
+	sync() error
+}
+
+// openWAL opens the write-ahead log in the given directory, creating it if
+// it does not exist yet.
+func openWAL(directory string) (*WAL, error) {
+	file, err := os.OpenFile(filepath.Join(directory, walFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("IO error while opening write-ahead log: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("IO error while reading size of write-ahead log: %v", err)
+	}
+
+	return &WAL{file: file, size: info.Size()}, nil
+}
+
+// append assigns the next LSN to a record and appends it to the log, and
+// syncs it to disk unless syncing is deferred.
+func (w *WAL) append(record *walRecord) error {
+	record.lsn = w.lsn + 1
+	payload := record.encode()
+	data := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	copy(data[walHeaderSize:], payload)
+
+	if _, err := w.file.Write(data); err != nil {
+		return fmt.Errorf("IO error while appending to write-ahead log: %v", err)
+	}
+	w.size += int64(len(data))
+	w.lsn = record.lsn
+
+	if w.deferSync {
+		return nil
+	}
+
+	return w.sync()
+}
+
+// sync flushes all records appended to the log to stable storage.
+func (w *WAL) sync() error {
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("IO error while syncing write-ahead log: %v", err)
+	}
+
+	return nil
+}
+
+// replay calls fn for each complete record of the log, in order.
+//
+// Reading stops at the first incomplete or corrupt record, which is expected
+// to be the last one, written during a crash. Returns the number of records
+// replayed.
+func (w *WAL) replay(fn func(*walRecord) error) (int, error) {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("IO error while reading write-ahead log: %v", err)
+	}
+	reader := bufio.NewReader(w.file)
+
+	count := 0
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return count, nil
+			}
+			return count, fmt.Errorf("IO error while reading write-ahead log: %v", err)
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if int64(length) > w.size {
+			// Length must have been torn, too.
+			return count, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return count, nil
+			}
+			return count, fmt.Errorf("IO error while reading write-ahead log: %v", err)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return count, nil
+		}
+
+		record, err := decodeWALRecord(payload)
+		if err != nil {
+			return count, nil
+		}
+		if err := fn(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// truncate removes all records from the log.
+func (w *WAL) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("IO error while truncating write-ahead log: %v", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("IO error while syncing write-ahead log: %v", err)
+	}
+	w.size = 0
+
+	return nil
+}
+
+// Close closes the log file.
+func (w *WAL) Close() error {
+	return w.file.Close()
+}
+
+// encode encodes the record into a byte slice.
+func (r *walRecord) encode() []byte {
+	// 8 bytes LSN
+	// 4 bytes root page ID
+	// 4 bytes count and 4 bytes per ID for allocated and deallocated pages
+	// 4 bytes count and 4 + PageDataSize bytes per page image
+	size := 8 + 4 + 4 + 4*len(r.allocated) + 4 + 4*len(r.deallocated) + 4 + (4+PageDataSize)*len(r.pages)
+	data := make([]byte, 0, size)
+
+	data = appendUint32(data, uint32(r.lsn>>32))
+	data = appendUint32(data, uint32(r.lsn))
+	data = appendUint32(data, uint32(r.root))
+	for _, ids := range [][]PageID{r.allocated, r.deallocated} {
+		data = appendUint32(data, uint32(len(ids)))
+		for _, id := range ids {
+			data = appendUint32(data, uint32(id))
+		}
+	}
+	data = appendUint32(data, uint32(len(r.pages)))
+	for _, page := range r.pages {
+		data = appendUint32(data, uint32(page.id))
+		data = append(data, page.data[:]...)
+	}
+
+	return data
+}
+
+// appendUint32 appends a big endian encoded uint32 to a byte slice.
+func appendUint32(data []byte, value uint32) []byte {
+	return append(data, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+// decodeWALRecord decodes a record previously encoded with encode.
+func decodeWALRecord(data []byte) (*walRecord, error) {
+	invalid := errors.New("invalid write-ahead log record")
+	next := func() (uint32, error) {
+		if len(data) < 4 {
+			return 0, invalid
+		}
+		value := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		return value, nil
+	}
+	nextIDs := func() ([]PageID, error) {
+		count, err := next()
+		if err != nil || int(count) > len(data)/4 {
+			return nil, invalid
+		}
+		ids := make([]PageID, count)
+		for i := range ids {
+			id, _ := next()
+			ids[i] = PageID(id)
+		}
+		return ids, nil
+	}
+
+	record := &walRecord{}
+	if len(data) < 8 {
+		return nil, invalid
+	}
+	record.lsn = binary.BigEndian.Uint64(data)
+	data = data[8:]
+
+	root, err := next()
+	if err != nil {
+		return nil, err
+	}
+	record.root = PageID(root)
+
+	if record.allocated, err = nextIDs(); err != nil {
+		return nil, err
+	}
+	if record.deallocated, err = nextIDs(); err != nil {
+		return nil, err
+	}
+
+	count, err := next()
+	if err != nil || int(count) != len(data)/(4+PageDataSize) || len(data)%(4+PageDataSize) != 0 {
+		return nil, invalid
+	}
+	record.pages = make([]*Page, count)
+	for i := range record.pages {
+		id, _ := next()
+		page := newPage(PageID(id))
+		copy(page.data[:], data[:PageDataSize])
+		data = data[PageDataSize:]
+		record.pages[i] = page
+	}
+
+	return record, nil
+}
+
+// openWAL opens the write-ahead log of the tree. If recover is set, the
+// records of the log are redone first, otherwise the log is discarded.
+// Either way the tree gets checkpointed, such that the log starts out empty.
+func (t *BTree) openWAL(recover bool) error {
+	if _, ok := t.bufferPool.disk.(recoverableDisk); !ok {
+		return fmt.Errorf("Disk of type %T does not support a write-ahead log", t.bufferPool.disk)
+	}
+
+	wal, err := openWAL(t.directory)
+	if err != nil {
+		return err
+	}
+	wal.lsn = t.bufferPool.disk.(recoverableDisk).checkpointLSN()
+	t.wal = wal
+
+	if recover {
+		return t.recover()
+	}
+
+	return t.checkpoint()
+}
+
+// recover redoes the records of the write-ahead log on top of the state of the
+// last checkpoint. It must be called before the tree is loaded.
+//
+// Records up to the LSN stored by the disk are already part of its state, as
+// the process crashed after the checkpoint stored the meta data of the disk,
+// but before the log was truncated. Only their root is taken, as the meta data
+// of the tree might not have been stored yet.
+func (t *BTree) recover() error {
+	disk := t.bufferPool.disk.(recoverableDisk)
+
+	root, err := t.loadMetaData()
+	if err != nil {
+		return err
+	}
+
+	checkpoint := disk.checkpointLSN()
+	replayed, err := t.wal.replay(func(record *walRecord) error {
+		root = record.root
+		if record.lsn <= checkpoint {
+			return nil
+		}
+		t.wal.lsn = record.lsn
+
+		for _, id := range record.allocated {
+			if err := disk.redoAllocate(id); err != nil {
+				return err
+			}
+		}
+		for _, page := range record.pages {
+			if err := disk.WritePage(page); err != nil {
+				return err
+			}
+		}
+		for _, id := range record.deallocated {
+			if err := disk.redoDeallocate(id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to recover from write-ahead log: %v", err)
+	}
+
+	if replayed > 0 {
+		disk.setCheckpointLSN(t.wal.lsn)
+		if err := disk.storeMetaData(true); err != nil {
+			return err
+		}
+		if err := t.writeMetaData(root, true); err != nil {
+			return err
+		}
+	}
+
+	return t.wal.truncate()
+}
+
+// checkpoint persists all pages as well as the meta data of the tree and its
+// disk to stable storage, and truncates the write-ahead log.
+func (t *BTree) checkpoint() error {
+	t.bufferPool.disk.(recoverableDisk).setCheckpointLSN(t.wal.lsn)
+	if err := t.flush(); err != nil {
+		return err
+	}
+
+	t.loggedRootID = t.rootPage.id
+	t.loggedRoot = *t.rootPage.data
+
+	return t.wal.truncate()
+}
+
+// logged runs an operation modifying the tree. If the tree has a write-ahead
+// log, all pages modified by the operation get appended to it. Once done, the
+// modifications are made durable as required by the durability of the tree.
+//
+// If appending to the log fails, the modifications remain in memory but are
+// not durable, in which case the tree should be closed.
+func (t *BTree) logged(op func() error) error {
+	if err := t.runLogged(op); err != nil {
+		return err
+	}
+
+	return t.commit()
+}
+
+// runLogged runs an operation modifying the tree, appending all pages
+// modified by it to the write-ahead log if the tree has one.
+func (t *BTree) runLogged(op func() error) error {
+	t.isolation.RLock()
+	defer t.isolation.RUnlock()
+
+	if t.wal == nil {
+		return op()
+	}
+
+	t.logging.Lock()
+	defer t.logging.Unlock()
+
+	t.bufferPool.beginCapture(true, false)
+
+	return t.logCapture(op())
+}
+
+// logCapture appends all pages captured since beginCapture to the write-ahead
+// log, and releases the capture. err is the result of the captured operation,
+// which gets returned along with any error of logging it.
+func (t *BTree) logCapture(err error) error {
+	record := t.bufferPool.endCapture()
+	// Other than all other pages the root stays pinned, so it's never
+	// captured when modified.
+	record.root = t.rootPage.id
+	rootChanged := t.rootPage.id != t.loggedRootID || *t.rootPage.data != t.loggedRoot
+	if rootChanged && !record.contains(t.rootPage.id) {
+		image := newPage(t.rootPage.id)
+		*image.data = *t.rootPage.data
+		record.pages = append(record.pages, image)
+	}
+
+	if rootChanged || len(record.pages) > 0 || len(record.allocated) > 0 || len(record.deallocated) > 0 {
+		if logErr := t.wal.append(record); logErr != nil {
+			t.bufferPool.releaseCapture()
+			if err != nil {
+				return fmt.Errorf("%v; additionally unable to log modifications: %v", err, logErr)
+			}
+			return fmt.Errorf("Unable to log modifications: %v", logErr)
+		}
+		t.loggedRootID = t.rootPage.id
+		t.loggedRoot = *t.rootPage.data
+	}
+	t.bufferPool.releaseCapture()
+
+	if t.wal.size > walCheckpointSize {
+		if cpErr := t.checkpoint(); cpErr != nil && err == nil {
+			err = cpErr
+		}
+	}
+
+	return err
+}
+
+// contains returns whether the record holds an image of the page with the
+// given ID.
+func (r *walRecord) contains(id PageID) bool {
+	for _, page := range r.pages {
+		if page.id == id {
+			return true
+		}
+	}
+
+	return false
+}
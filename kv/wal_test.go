@@ -0,0 +1,323 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+// crashAndRecover abandons the tree without closing it, as if the process had
+// crashed, and opens it again.
+func crashAndRecover(t *testing.T, tree *BTree, config KvStoreConfig) *BTree {
+	tree.wal.Close()
+
+	recovered := &BTree{}
+	if err := recovered.Open(config); err != nil {
+		t.Fatalf("Error recovering tree: %v", err)
+	}
+
+	return recovered
+}
+
+func TestWALRecoversPuts(t *testing.T) {
+	// Little memory, such that pages get evicted to disk in between
+	// checkpoints.
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: false})
+
+	keys := make([]uint64, 5_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	large := randomBytes(3*OverflowDataSize, 1)
+	if err := tree.PutBytes(0, large); err != nil {
+		t.Fatalf("Error putting large value: %v", err)
+	}
+
+	tree = crashAndRecover(t, tree, config)
+
+	for _, key := range keys {
+		value, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting key %d after recovery: %v", key, err)
+		}
+		if value != [10]byte{byte(key)} {
+			t.Errorf("Got value %v for key %d after recovery", value, key)
+		}
+	}
+	value, err := tree.GetBytes(0)
+	if err != nil {
+		t.Fatalf("Error getting large value after recovery: %v", err)
+	}
+	if !bytes.Equal(value, large) {
+		t.Errorf("Got unexpected large value after recovery")
+	}
+}
+
+func TestWALRecoversDeletes(t *testing.T) {
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: false})
+
+	keys := make([]uint64, 5_000)
+	util.FillAsc(keys, 1)
+	util.Shuffle(keys)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Error closing tree: %v", err)
+	}
+	if err := tree.Open(config); err != nil {
+		t.Fatalf("Error opening tree: %v", err)
+	}
+
+	// Deleting most keys merges nodes, deallocating pages which were part
+	// of the tree at the last checkpoint.
+	deleted, kept := keys[:4_900], keys[4_900:]
+	for _, key := range deleted {
+		if err := tree.Delete(key); err != nil {
+			t.Fatalf("Error deleting key %d: %v", key, err)
+		}
+	}
+
+	tree = crashAndRecover(t, tree, config)
+
+	for _, key := range deleted {
+		if _, err := tree.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Expected ErrKeyNotFound for deleted key %d after recovery; got %v", key, err)
+		}
+	}
+	for _, key := range kept {
+		if _, err := tree.Get(key); err != nil {
+			t.Fatalf("Error getting key %d after recovery: %v", key, err)
+		}
+	}
+
+	// Pages must have been recycled consistently, such that the tree
+	// remains usable.
+	for _, key := range deleted {
+		if err := tree.Put(key, [10]byte{1}); err != nil {
+			t.Fatalf("Error putting key %d after recovery: %v", key, err)
+		}
+	}
+	tree = crashAndRecover(t, tree, config)
+	k, _ := tree.TraverseAll()
+	if len(k) != len(keys) {
+		t.Errorf("Found %d keys after second recovery; expected %d", len(k), len(keys))
+	}
+}
+
+func TestWALRecoversCrashDuringCheckpoint(t *testing.T) {
+	// Crashes once the checkpoint stored the meta data of the disk, and
+	// the tree as well if storeRoot is set, but before the log was
+	// truncated.
+	crashes := []struct {
+		name      string
+		storeRoot bool
+	}{
+		{"BeforeTreeMetaData", false},
+		{"BeforeTruncation", true},
+	}
+
+	for _, storage := range []StorageEngine{StoragePageFiles, StorageSingleFile, StorageMmap} {
+		for _, crash := range crashes {
+			t.Run(fmt.Sprintf("%v/%s", storage, crash.name), func(t *testing.T) {
+				tree, config := helper.GetInstance(t, KvStoreConfig{
+					MemorySize:           16 * PageSize,
+					DisableWriteAheadLog: false,
+					Storage:              storage,
+				})
+
+				// Deleting keys deallocates pages allocated
+				// since the last checkpoint, which get reused
+				// by the free list.
+				keys := make([]uint64, 5_000)
+				util.FillAsc(keys, 1)
+				util.Shuffle(keys)
+				for _, key := range keys {
+					if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+						t.Fatalf("Error putting key %d: %v", key, err)
+					}
+				}
+				deleted, kept := keys[:2_500], keys[2_500:]
+				for _, key := range deleted {
+					if err := tree.Delete(key); err != nil {
+						t.Fatalf("Error deleting key %d: %v", key, err)
+					}
+				}
+
+				disk := tree.bufferPool.disk.(recoverableDisk)
+				disk.setCheckpointLSN(tree.wal.lsn)
+				if errs := tree.bufferPool.FlushAllPages(); len(errs) != 0 {
+					t.Fatalf("Errors flushing pages: %v", errs)
+				}
+				if err := disk.storeMetaData(true); err != nil {
+					t.Fatalf("Error storing disk meta data: %v", err)
+				}
+				if crash.storeRoot {
+					if err := tree.storeMetaData(); err != nil {
+						t.Fatalf("Error storing tree meta data: %v", err)
+					}
+				}
+
+				if disk, ok := disk.(*SingleFileDisk); ok {
+					disk.file.Close()
+				}
+				tree = crashAndRecover(t, tree, config)
+				defer tree.Close()
+
+				for _, key := range deleted {
+					if _, err := tree.Get(key); !errors.Is(err, ErrKeyNotFound) {
+						t.Fatalf("Expected ErrKeyNotFound for deleted key %d after recovery; got %v", key, err)
+					}
+				}
+				for _, key := range kept {
+					if _, err := tree.Get(key); err != nil {
+						t.Fatalf("Error getting key %d after recovery: %v", key, err)
+					}
+				}
+
+				// Pages must not have been freed twice, such
+				// that reusing them keeps all keys intact.
+				for _, key := range deleted {
+					if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+						t.Fatalf("Error putting key %d after recovery: %v", key, err)
+					}
+				}
+				found, values := tree.TraverseAll()
+				if len(found) != len(keys) {
+					t.Fatalf("Found %d keys after recovery; expected %d", len(found), len(keys))
+				}
+				for i, key := range found {
+					if values[i] != [10]byte{byte(key)} {
+						t.Fatalf("Got value %v for key %d after recovery", values[i], key)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWALLogsValueLargerThanBufferPool(t *testing.T) {
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize})
+
+	// The overflow pages of the value get evicted before being logged.
+	large := randomBytes(64*OverflowDataSize, 1)
+	if err := tree.PutBytes(1, large); err != nil {
+		t.Fatalf("Error putting value larger than buffer pool: %v", err)
+	}
+	if value, err := tree.GetBytes(1); err != nil || !bytes.Equal(value, large) {
+		t.Fatalf("Expected large value; got %dB, %v", len(value), err)
+	}
+
+	tree = crashAndRecover(t, tree, config)
+	defer tree.Close()
+
+	if value, err := tree.GetBytes(1); err != nil || !bytes.Equal(value, large) {
+		t.Fatalf("Expected large value after recovery; got %dB, %v", len(value), err)
+	}
+}
+
+func TestWALRejectsTransactionLargerThanBufferPool(t *testing.T) {
+	tree, _ := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize})
+	defer tree.Close()
+
+	keys := make([]uint64, 40*NumLeafKeys)
+	util.FillAsc(keys, 1)
+	for _, key := range keys {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+
+	// Deleting a key from every leaf modifies more existing pages than
+	// fit into the buffer pool.
+	tx := tree.Begin()
+	for i := 0; i < len(keys); i += NumLeafKeys / 2 {
+		if err := tx.Delete(keys[i]); err != nil {
+			t.Fatalf("Error deleting key %d: %v", keys[i], err)
+		}
+	}
+	err := tx.Commit()
+	if err == nil || !strings.Contains(err.Error(), "modified by the current operation") {
+		t.Fatalf("Expected error about too many modified pages; got %v", err)
+	}
+
+	for _, key := range keys {
+		if value, err := tree.Get(key); err != nil || value != [10]byte{byte(key)} {
+			t.Fatalf("Expected value %d for key %d; got %v, %v", byte(key), key, value, err)
+		}
+	}
+}
+
+func TestWALIgnoresTornRecord(t *testing.T) {
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: false})
+
+	for key := uint64(1); key <= 100; key++ {
+		if err := tree.Put(key, [10]byte{byte(key)}); err != nil {
+			t.Fatalf("Error putting key %d: %v", key, err)
+		}
+	}
+	tree.wal.Close()
+
+	// Simulate a record which was only partially written when crashing.
+	path := filepath.Join(config.WorkingDirectory, walFile)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Error opening write-ahead log: %v", err)
+	}
+	file.Write([]byte{0, 0, 0x10, 0, 0xde, 0xad, 0xbe, 0xef, 1, 2, 3})
+	file.Close()
+
+	recovered := &BTree{}
+	if err := recovered.Open(config); err != nil {
+		t.Fatalf("Error recovering tree: %v", err)
+	}
+	for key := uint64(1); key <= 100; key++ {
+		if _, err := recovered.Get(key); err != nil {
+			t.Fatalf("Error getting key %d after recovery: %v", key, err)
+		}
+	}
+}
+
+func TestWALIsTruncatedOnClose(t *testing.T) {
+	tree, config := helper.GetInstance(t, KvStoreConfig{MemorySize: 16 * PageSize, DisableWriteAheadLog: false})
+
+	if err := tree.Put(1, [10]byte{1}); err != nil {
+		t.Fatalf("Error putting key: %v", err)
+	}
+	if tree.wal.size == 0 {
+		t.Errorf("Expected put to be logged")
+	}
+
+	// Failing operations don't modify anything, so aren't logged.
+	size := tree.wal.size
+	if err := tree.Put(1, [10]byte{2}); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("Expected ErrKeyExists; got %v", err)
+	}
+	if tree.wal.size != size {
+		t.Errorf("Expected failing put not to be logged")
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Error closing tree: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(config.WorkingDirectory, walFile))
+	if err != nil {
+		t.Fatalf("Error reading write-ahead log: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("Expected write-ahead log to be empty after closing; has %dB", info.Size())
+	}
+}
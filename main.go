@@ -3,18 +3,29 @@ package main
 import (
 	"bufio"
 	"encoding/hex"
+	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/tobiasfamos/KVStore/kv"
+	"github.com/tobiasfamos/KVStore/server"
 )
 
 const memoryLimit = 100_000_000 // 100 MB
 
 func main() {
 	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "fsck" {
+		fsck(args[1:])
+	}
+	if len(args) > 0 && args[0] == "serve" {
+		serve(args[1:])
+	}
 	if c := len(args); c != 2 {
 		help()
 	}
@@ -35,12 +46,6 @@ func main() {
 			os.Exit(0)
 		}
 	}
-
-	err = cli.Close()
-	if err != nil {
-		abort(fmt.Sprintf("Error closing KV store: %v\n", err))
-	}
-
 }
 
 func prompt(label string) string {
@@ -107,7 +112,7 @@ func (cli *CLI) Handle(cmd string) (string, bool) {
 			return fmt.Sprintf("Invalid key %s: %v", keyString, err), true
 		}
 
-		val, err := cli.store.Get(key)
+		val, err := cli.store.GetBytes(key)
 		if err != nil {
 			return fmt.Sprintf("Error retrieving key: %v", err), true
 		}
@@ -136,18 +141,12 @@ func (cli *CLI) Handle(cmd string) (string, bool) {
 			return fmt.Sprintf("Invalid hex-encoded string: %v", err), true
 		}
 
-		if len(val) > 10 {
-			return fmt.Sprintf("Value must be 10 bytes at most, was %d", len(val)), true
-		}
-
-		valAry := [10]byte{}
-		copy(valAry[:], val)
-		err = cli.store.Put(key, valAry)
+		err = cli.store.PutBytes(key, val)
 		if err != nil {
 			return fmt.Sprintf("Error storing key: %v", err), true
 		}
 
-		return fmt.Sprintf("Successfully stored %d = %x", key, valAry), true
+		return fmt.Sprintf("Successfully stored %d = %x", key, val), true
 
 	case "exit":
 		err := cli.Close()
@@ -176,8 +175,115 @@ func (cli *CLI) Help() string {
 	return out
 }
 
+// fsck checks the KV store in the directory given by args, printing the
+// report. Exits with status 1 if the store is not consistent.
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	reclaim := flags.Bool("reclaim", false, "add leaked and orphaned pages to the free list")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		help()
+	}
+
+	dir := flags.Arg(0)
+	fmt.Printf("Checking KV store in %s\n", dir)
+	report, err := kv.Check(kv.KvStoreConfig{WorkingDirectory: dir}, *reclaim)
+	if err != nil {
+		abort(fmt.Sprintf("Error checking KV store: %v", err))
+	}
+
+	fmt.Print(report)
+	if !report.OK() && !report.Reclaimed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// serve serves the KV store in the directory given by args over the network,
+// until interrupted.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	create := flags.Bool("create", false, "create a new KV store rather than opening an existing one")
+	respAddr := flags.String("resp", "localhost:6379", "address to serve the Redis protocol on, none if empty")
+	httpAddr := flags.String("http", "", "address to serve HTTP on, none if empty")
+	memcachedAddr := flags.String("memcached", "", "address to serve the memcached protocol on, none if empty")
+	binaryAddr := flags.String("binary", "", "address to serve the binary protocol on, none if empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		help()
+	}
+
+	dir := flags.Arg(0)
+	mode := "open"
+	if *create {
+		mode = "create"
+	}
+	fmt.Printf("Loading KV store from %s\n", dir)
+	cli, err := NewCLI(dir, mode)
+	if err != nil {
+		abort(fmt.Sprintf("Error loading KV store: %v\nMake sure the target directory exists.\n", err))
+	}
+
+	protocols := []struct {
+		name   string
+		addr   string
+		server networkServer
+	}{
+		{"Redis protocol", *respAddr, server.NewRESPServer(cli.store)},
+		{"HTTP", *httpAddr, server.NewHTTPServer(cli.store)},
+		{"memcached protocol", *memcachedAddr, server.NewMemcachedServer(cli.store)},
+		{"binary protocol", *binaryAddr, server.NewBinaryServer(cli.store)},
+	}
+
+	var servers []networkServer
+	errs := make(chan error, len(protocols))
+	for _, p := range protocols {
+		if p.addr == "" {
+			continue
+		}
+
+		l, err := net.Listen("tcp", p.addr)
+		if err != nil {
+			for _, s := range servers {
+				s.Close()
+			}
+			cli.Close()
+			abort(fmt.Sprintf("Error listening on %s: %v", p.addr, err))
+		}
+		servers = append(servers, p.server)
+		go func(s networkServer) { errs <- s.Serve(l) }(p.server)
+		fmt.Printf("Serving %s on %s\n", p.name, l.Addr())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signals:
+	case err := <-errs:
+		fmt.Printf("Error serving KV store: %v\n", err)
+	}
+
+	for _, s := range servers {
+		s.Close()
+	}
+	if err := cli.Close(); err != nil {
+		abort(fmt.Sprintf("Error closing KV store: %v", err))
+	}
+	fmt.Println("KV store successfully closed")
+	os.Exit(0)
+}
+
+// networkServer serves a KV store over the network.
+type networkServer interface {
+	Serve(net.Listener) error
+	Close() error
+}
+
 func help() {
 	fmt.Println("Usage: ./KVStore <create|open> <persistence_directory>")
+	fmt.Println("       ./KVStore fsck [-reclaim] <persistence_directory>")
+	fmt.Println("       ./KVStore serve [-create] [-resp <address>] [-http <address>] [-memcached <address>]")
+	fmt.Println("                      [-binary <address>] <persistence_directory>")
 	os.Exit(2)
 }
 
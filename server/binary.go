@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+// maxBinaryFrameSize is the maximum size of a frame, excluding its length.
+const maxBinaryFrameSize = 64 << 20
+
+// Types of frames sent by clients.
+const (
+	binaryGet        byte = 0x01
+	binaryPut        byte = 0x02
+	binaryDelete     byte = 0x03
+	binaryBatchPut   byte = 0x04
+	binaryStats      byte = 0x05
+	binaryScan       byte = 0x06
+	binaryScanMore   byte = 0x07
+	binaryScanCancel byte = 0x08
+	binaryTreeStats  byte = 0x09
+)
+
+// Types of frames sent by the server.
+const (
+	binaryOK       byte = 0x80
+	binaryNotFound byte = 0x81
+	binaryExists   byte = 0x82
+	binaryError    byte = 0x83
+	binaryItem     byte = 0x84
+)
+
+// Modes of binaryPut.
+const (
+	binaryModePut    byte = 0
+	binaryModeUpsert byte = 1
+	binaryModeUpdate byte = 2
+)
+
+// binaryProtocolError is an error in the input of a client, after which the
+// connection is closed.
+type binaryProtocolError string
+
+func (e binaryProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+/*
+BinaryServer serves a BTree over a compact binary protocol.
+
+Each message is a frame, consisting of its size as 32-bit integer, a byte
+giving the type of the frame, and the payload of the type, whose size is implied
+by that of the frame. All integers are unsigned and big-endian. Clients send
+one of the following requests, each of which is answered by the server with a
+single frame, except for Scan:
+
+	Get       0x01  key u64
+	Put       0x02  key u64, mode u8, value
+	Delete    0x03  key u64
+	BatchPut  0x04  count u32, count * (key u64, value [10]byte)
+	Stats     0x05
+	Scan      0x06  id u32, from u64, to u64, window u32
+	TreeStats 0x09
+
+Put stores a new item with mode 0, stores or replaces it with mode 1, and only
+replaces it with mode 2. The server answers with one of
+
+	OK       0x80  payload depending on the request
+	NotFound 0x81
+	Exists   0x82
+	Error    0x83  message
+
+where OK holds the value for Get, a status byte for each item of BatchPut, being
+OK, Exists or Error, and the statistics of the tree as JSON object for Stats and
+TreeStats. Stats covers the buffer pool and the storage only, while TreeStats
+includes the shape of the tree and its number of keys, walking the whole tree
+while blocking modifications.
+
+Scan streams the items with a key in the inclusive range [from, to] as Item
+frames, followed by OK once all of them have been sent, or Error if scanning
+fails:
+
+	Item     0x84  key u64, value
+
+Scans are flow controlled: the server sends no more items than the client has
+granted. The window of Scan grants the first items, and the client grants more
+with ScanMore for the id of the scan, or stops the scan early with ScanCancel:
+
+	ScanMore   0x07  id u32, count u32
+	ScanCancel 0x08  id u32
+
+While a scan streams, the client must not send any other requests. Grants for a
+scan which already ended are ignored, so clients may grant more items ahead of
+time. The items are read from the tree as they are sent, so no page is pinned
+while waiting for the client.
+
+Requests of a client are processed in order, and replies to pipelined requests
+are sent once all of them have been processed. Malformed frames yield an Error,
+after which the connection is closed.
+*/
+type BinaryServer struct {
+	tree  *kv.BTree
+	conns connServer
+}
+
+// NewBinaryServer creates a server for the given tree, which must be open.
+func NewBinaryServer(tree *kv.BTree) *BinaryServer {
+	return &BinaryServer{tree: tree}
+}
+
+// ListenAndServe listens on the TCP address and serves clients connecting to
+// it. See Serve.
+func (s *BinaryServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve serves clients connecting to the listener, until the listener fails
+// or the server is closed. The listener is closed afterwards. Returns
+// ErrServerClosed once the server has been closed.
+func (s *BinaryServer) Serve(l net.Listener) error {
+	return s.conns.serve(l, s.handle)
+}
+
+// Close stops all listeners and stops reading requests. Each connection is
+// closed once the requests read from it have been replied to, while a scan
+// waiting for more items to be granted ends right away. The tree is not closed.
+func (s *BinaryServer) Close() error {
+	return s.conns.close()
+}
+
+// binaryConn is a connection of a binary protocol client.
+type binaryConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// handle processes the requests of a client until it disconnects.
+func (s *BinaryServer) handle(conn net.Conn) {
+	c := &binaryConn{bufio.NewReader(conn), bufio.NewWriter(conn)}
+
+	for {
+		kind, payload, err := readFrame(c.r)
+		if err == nil {
+			err = s.execute(c, kind, payload)
+		}
+		if err != nil {
+			var protocolErr binaryProtocolError
+			if errors.As(err, &protocolErr) {
+				writeFrame(c.w, binaryError, []byte(protocolErr.Error()))
+				c.w.Flush()
+			}
+			return
+		}
+
+		// Replies to pipelined requests are sent all at once.
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// binaryRequests are the requests of the binary protocol by their type, along
+// with the size of their payload, or the minimum size if negative. Each
+// returns an error if the connection is to be closed.
+var binaryRequests = map[byte]struct {
+	size   int
+	handle func(s *BinaryServer, c *binaryConn, payload []byte) error
+}{
+	binaryGet:       {8, (*BinaryServer).get},
+	binaryPut:       {-9, (*BinaryServer).put},
+	binaryDelete:    {8, (*BinaryServer).delete},
+	binaryBatchPut:  {-4, (*BinaryServer).batchPut},
+	binaryStats:     {0, (*BinaryServer).stats},
+	binaryScan:      {24, (*BinaryServer).scan},
+	binaryTreeStats: {0, (*BinaryServer).treeStats},
+}
+
+// execute processes a single request.
+func (s *BinaryServer) execute(c *binaryConn, kind byte, payload []byte) error {
+	if kind == binaryScanMore || kind == binaryScanCancel {
+		// Grants or cancellations of a scan which already ended.
+		return nil
+	}
+
+	req, ok := binaryRequests[kind]
+	if !ok {
+		return binaryProtocolError(fmt.Sprintf("unknown request type 0x%02x", kind))
+	}
+	if (req.size >= 0 && len(payload) != req.size) || (req.size < 0 && len(payload) < -req.size) {
+		return binaryProtocolError(fmt.Sprintf("invalid payload size %d of request type 0x%02x", len(payload), kind))
+	}
+
+	return req.handle(s, c, payload)
+}
+
+func (s *BinaryServer) get(c *binaryConn, payload []byte) error {
+	value, err := s.tree.GetBytes(binary.BigEndian.Uint64(payload))
+	if err == nil {
+		err = checkFrameSize(value)
+	}
+	if err != nil {
+		return c.writeResult(err)
+	}
+
+	return writeFrame(c.w, binaryOK, value)
+}
+
+func (s *BinaryServer) put(c *binaryConn, payload []byte) error {
+	key, mode, value := binary.BigEndian.Uint64(payload), payload[8], payload[9:]
+
+	var err error
+	switch mode {
+	case binaryModePut:
+		err = s.tree.PutBytes(key, value)
+	case binaryModeUpsert:
+		err = s.tree.UpsertBytes(key, value)
+	case binaryModeUpdate:
+		err = s.tree.UpdateBytes(key, value)
+	default:
+		return binaryProtocolError(fmt.Sprintf("unknown put mode %d", mode))
+	}
+
+	return c.writeResult(err)
+}
+
+func (s *BinaryServer) delete(c *binaryConn, payload []byte) error {
+	return c.writeResult(s.tree.Delete(binary.BigEndian.Uint64(payload)))
+}
+
+// batchPut stores fixed-size items with PutBatch, and replies with the status
+// of each of them.
+func (s *BinaryServer) batchPut(c *binaryConn, payload []byte) error {
+	const itemSize = 8 + 10
+
+	count := binary.BigEndian.Uint32(payload)
+	payload = payload[4:]
+	if uint64(len(payload)) != uint64(count)*itemSize {
+		return binaryProtocolError(fmt.Sprintf("invalid payload size of batch of %d items", count))
+	}
+
+	items := make([]kv.BatchItem, count)
+	for i := range items {
+		item := payload[i*itemSize:]
+		items[i].Key = binary.BigEndian.Uint64(item)
+		copy(items[i].Value[:], item[8:itemSize])
+	}
+
+	statuses := make([]byte, count)
+	for i := range statuses {
+		statuses[i] = binaryOK
+	}
+	for i, err := range s.tree.PutBatch(items) {
+		switch {
+		case errors.Is(err, kv.ErrKeyExists):
+			statuses[i] = binaryExists
+		case err != nil:
+			statuses[i] = binaryError
+		}
+	}
+
+	return writeFrame(c.w, binaryOK, statuses)
+}
+
+func (s *BinaryServer) stats(c *binaryConn, _ []byte) error {
+	stats, err := s.tree.Summary()
+	return s.writeStats(c, stats, err)
+}
+
+func (s *BinaryServer) treeStats(c *binaryConn, _ []byte) error {
+	stats, err := s.tree.Stats()
+	return s.writeStats(c, stats, err)
+}
+
+func (s *BinaryServer) writeStats(c *binaryConn, stats kv.TreeStats, err error) error {
+	if err != nil {
+		return c.writeResult(err)
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return c.writeResult(err)
+	}
+
+	return writeFrame(c.w, binaryOK, data)
+}
+
+// scan streams the items of a range, sending no more of them than granted by
+// the client. See BinaryServer.
+func (s *BinaryServer) scan(c *binaryConn, payload []byte) error {
+	id := binary.BigEndian.Uint32(payload)
+	from := binary.BigEndian.Uint64(payload[4:])
+	to := binary.BigEndian.Uint64(payload[12:])
+	credit := uint64(binary.BigEndian.Uint32(payload[20:]))
+
+	cursor := s.tree.Cursor()
+	defer cursor.Close()
+
+	for ok := cursor.Seek(from); ok && cursor.Key() <= to; ok = cursor.Next() {
+		// Control frames are read as soon as they arrive, so a
+		// cancellation takes effect before the window is used up.
+		for credit == 0 || c.r.Buffered() > 0 {
+			if credit == 0 {
+				if err := c.w.Flush(); err != nil {
+					return err
+				}
+			}
+
+			more, cancelled, err := c.readScanControl(id)
+			if err != nil {
+				return err
+			}
+			if cancelled {
+				return writeFrame(c.w, binaryOK)
+			}
+			credit += more
+		}
+
+		value, err := cursor.ValueBytes()
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			// Deleted since the cursor copied its leaf.
+			continue
+		}
+		if err == nil {
+			err = checkFrameSize(value)
+		}
+		if err != nil {
+			return c.writeResult(err)
+		}
+
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], cursor.Key())
+		if err := writeFrame(c.w, binaryItem, key[:], value); err != nil {
+			return err
+		}
+		credit--
+	}
+
+	return c.writeResult(cursor.Err())
+}
+
+// readScanControl reads a control frame sent during a scan, returning the
+// number of items granted, or whether the scan was cancelled. Control frames
+// for other scans are ignored.
+func (c *binaryConn) readScanControl(id uint32) (uint64, bool, error) {
+	kind, payload, err := readFrame(c.r)
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch kind {
+	case binaryScanMore:
+		if len(payload) != 8 {
+			return 0, false, binaryProtocolError(fmt.Sprintf("invalid payload size %d of request type 0x%02x", len(payload), kind))
+		}
+		if binary.BigEndian.Uint32(payload) != id {
+			return 0, false, nil
+		}
+		return uint64(binary.BigEndian.Uint32(payload[4:])), false, nil
+	case binaryScanCancel:
+		if len(payload) != 4 {
+			return 0, false, binaryProtocolError(fmt.Sprintf("invalid payload size %d of request type 0x%02x", len(payload), kind))
+		}
+		return 0, binary.BigEndian.Uint32(payload) == id, nil
+	}
+
+	return 0, false, binaryProtocolError(fmt.Sprintf("unexpected request type 0x%02x during scan", kind))
+}
+
+// checkFrameSize returns an error if a value does not fit into a frame along
+// with its key, as may be the case for values stored over other protocols.
+func checkFrameSize(value []byte) error {
+	if len(value) > maxBinaryFrameSize-9 {
+		return fmt.Errorf("Value of %dB exceeds the maximum frame size", len(value))
+	}
+
+	return nil
+}
+
+// writeResult writes the reply to a request without payload, based on the
+// error of processing it.
+func (c *binaryConn) writeResult(err error) error {
+	switch {
+	case err == nil:
+		return writeFrame(c.w, binaryOK)
+	case errors.Is(err, kv.ErrKeyNotFound):
+		return writeFrame(c.w, binaryNotFound)
+	case errors.Is(err, kv.ErrKeyExists):
+		return writeFrame(c.w, binaryExists)
+	}
+
+	return writeFrame(c.w, binaryError, []byte(err.Error()))
+}
+
+// readFrame reads a frame, returning its type and payload.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > maxBinaryFrameSize {
+		return 0, nil, binaryProtocolError(fmt.Sprintf("invalid frame size %d", size))
+	}
+	payload, err := readSized(r, int(size-1))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[4], payload, nil
+}
+
+// writeFrame writes a frame of the given type, whose payload is the
+// concatenation of the given parts.
+func writeFrame(w *bufio.Writer, kind byte, parts ...[]byte) error {
+	size := 1
+	for _, part := range parts {
+		size += len(part)
+	}
+
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:], uint32(size))
+	header[4] = kind
+	w.Write(header[:])
+	for _, part := range parts {
+		w.Write(part)
+	}
+
+	// Errors are sticky, so the last write reports any of them.
+	_, err := w.Write(nil)
+	return err
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+// binaryTestClient sends frames to a binary protocol server and reads its
+// replies.
+type binaryTestClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// startBinaryServer serves a new tree with a binary protocol server, and
+// connects a client to it.
+func startBinaryServer(t *testing.T) *binaryTestClient {
+	tree, _ := helper.GetInstance(t, kv.KvStoreConfig{MemorySize: 64 * kv.PageSize})
+	t.Cleanup(func() { tree.Close() })
+	server := NewBinaryServer(tree)
+	l := listen(t)
+	done := make(chan error)
+	go func() { done <- server.Serve(l) }()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expected ErrServerClosed from Serve; got %v", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &binaryTestClient{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+}
+
+// send writes a frame whose payload is the concatenation of the parts.
+func (c *binaryTestClient) send(t *testing.T, kind byte, parts ...[]byte) {
+	t.Helper()
+
+	writeFrame(c.w, kind, parts...)
+	if err := c.w.Flush(); err != nil {
+		t.Fatalf("Error sending frame: %v", err)
+	}
+}
+
+// receive reads the next frame.
+func (c *binaryTestClient) receive(t *testing.T) (byte, []byte) {
+	t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	kind, payload, err := readFrame(c.r)
+	if err != nil {
+		t.Fatalf("Error receiving frame: %v", err)
+	}
+
+	return kind, payload
+}
+
+// do sends a request, and returns its reply.
+func (c *binaryTestClient) do(t *testing.T, kind byte, parts ...[]byte) (byte, []byte) {
+	t.Helper()
+
+	c.send(t, kind, parts...)
+	return c.receive(t)
+}
+
+func u32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func u64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func TestBinaryOperations(t *testing.T) {
+	client := startBinaryServer(t)
+
+	large := bytes.Repeat([]byte("0123456789"), kv.PageSize)
+	tests := []struct {
+		kind     byte
+		parts    [][]byte
+		expected byte
+		payload  []byte
+	}{
+		{binaryGet, [][]byte{u64(1)}, binaryNotFound, nil},
+		{binaryPut, [][]byte{u64(1), {binaryModePut}, []byte("one")}, binaryOK, nil},
+		{binaryPut, [][]byte{u64(1), {binaryModePut}, []byte("uno")}, binaryExists, nil},
+		{binaryGet, [][]byte{u64(1)}, binaryOK, []byte("one")},
+		{binaryPut, [][]byte{u64(2), {binaryModeUpdate}, []byte("two")}, binaryNotFound, nil},
+		{binaryPut, [][]byte{u64(2), {binaryModeUpsert}, []byte("two")}, binaryOK, nil},
+		{binaryPut, [][]byte{u64(2), {binaryModeUpdate}, []byte("deux")}, binaryOK, nil},
+		{binaryGet, [][]byte{u64(2)}, binaryOK, []byte("deux")},
+		{binaryPut, [][]byte{u64(3), {binaryModePut}, large}, binaryOK, nil},
+		{binaryGet, [][]byte{u64(3)}, binaryOK, large},
+		{binaryPut, [][]byte{u64(4), {binaryModePut}}, binaryOK, nil},
+		{binaryGet, [][]byte{u64(4)}, binaryOK, nil},
+		{binaryDelete, [][]byte{u64(1)}, binaryOK, nil},
+		{binaryDelete, [][]byte{u64(1)}, binaryNotFound, nil},
+		{binaryScanMore, [][]byte{u32(7), u32(10)}, binaryOK, nil},
+	}
+
+	for _, test := range tests {
+		if test.kind == binaryScanMore {
+			// Grants outside of a scan are ignored, not replied to.
+			client.send(t, test.kind, test.parts...)
+			test.kind, test.parts = binaryDelete, [][]byte{u64(2)}
+		}
+		kind, payload := client.do(t, test.kind, test.parts...)
+		if kind != test.expected || !bytes.Equal(payload, test.payload) {
+			t.Errorf("Expected 0x%02x with %d bytes for request 0x%02x; got 0x%02x with %d bytes: %.40q", test.expected, len(test.payload), test.kind, kind, len(payload), payload)
+		}
+	}
+}
+
+func TestBinaryBatchPut(t *testing.T) {
+	client := startBinaryServer(t)
+	client.do(t, binaryPut, u64(5), []byte{binaryModePut}, []byte("five"))
+
+	var batch []byte
+	for key := uint64(1); key <= 1_000; key++ {
+		value := [10]byte{byte(key), byte(key >> 8)}
+		batch = append(append(batch, u64(key)...), value[:]...)
+	}
+	kind, statuses := client.do(t, binaryBatchPut, u32(1_000), batch)
+	if kind != binaryOK || len(statuses) != 1_000 {
+		t.Fatalf("Expected status of each item; got 0x%02x with %d bytes", kind, len(statuses))
+	}
+	for i, status := range statuses {
+		expected := binaryOK
+		if i == 4 {
+			expected = binaryExists
+		}
+		if status != expected {
+			t.Errorf("Expected status 0x%02x for item %d; got 0x%02x", expected, i+1, status)
+		}
+	}
+
+	if _, value := client.do(t, binaryGet, u64(300)); !bytes.Equal(value, []byte{44, 1, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Got wrong value %v", value)
+	}
+
+	kind, _ = client.do(t, binaryBatchPut, u32(2), batch[:18])
+	if kind != binaryError {
+		t.Errorf("Expected error for truncated batch; got 0x%02x", kind)
+	}
+	if _, err := client.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed after protocol error; got %v", err)
+	}
+}
+
+func TestBinaryStats(t *testing.T) {
+	client := startBinaryServer(t)
+	client.do(t, binaryPut, u64(1), []byte{binaryModePut}, []byte("one"))
+
+	for _, tc := range []struct {
+		kind   byte
+		keys   uint
+		height int
+	}{{binaryStats, 0, 0}, {binaryTreeStats, 1, 2}} {
+		kind, payload := client.do(t, tc.kind)
+		var stats kv.TreeStats
+		if err := json.Unmarshal(payload, &stats); kind != binaryOK || err != nil {
+			t.Fatalf("Expected stats for 0x%02x; got 0x%02x (%v)", tc.kind, kind, err)
+		}
+		if stats.Keys != tc.keys || stats.Height != tc.height || stats.BufferPool.Frames == 0 {
+			t.Errorf("Expected stats of tree with one key for 0x%02x; got %+v", tc.kind, stats)
+		}
+	}
+}
+
+// fillBinary stores the given number of items with consecutive keys starting
+// at 1, whose value is their key.
+func fillBinary(t *testing.T, client *binaryTestClient, n uint64) {
+	var batch []byte
+	for key := uint64(1); key <= n; key++ {
+		var value [10]byte
+		binary.BigEndian.PutUint64(value[:], key)
+		batch = append(append(batch, u64(key)...), value[:]...)
+	}
+	if kind, _ := client.do(t, binaryBatchPut, u32(uint32(n)), batch); kind != binaryOK {
+		t.Fatalf("Error storing items: 0x%02x", kind)
+	}
+}
+
+// receiveItems receives the given number of items of a scan, expecting
+// consecutive keys starting at from.
+func (c *binaryTestClient) receiveItems(t *testing.T, from uint64, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		kind, payload := c.receive(t)
+		if kind != binaryItem || len(payload) != 18 {
+			t.Fatalf("Expected item; got 0x%02x with %d bytes", kind, len(payload))
+		}
+		key := binary.BigEndian.Uint64(payload)
+		if key != from+uint64(i) || binary.BigEndian.Uint64(payload[8:]) != key {
+			t.Fatalf("Expected item %d; got %d = %v", from+uint64(i), key, payload[8:])
+		}
+	}
+}
+
+// expectSilence checks that no frame arrives for a while.
+func (c *binaryTestClient) expectSilence(t *testing.T) {
+	t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.r.Peek(1); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected no frame beyond the window; got %v", err)
+	}
+}
+
+func TestBinaryScan(t *testing.T) {
+	client := startBinaryServer(t)
+	fillBinary(t, client, 1_000)
+
+	// Only as many items as granted are sent.
+	client.send(t, binaryScan, u32(1), u64(11), u64(910), u32(100))
+	client.receiveItems(t, 11, 100)
+	client.expectSilence(t)
+
+	// Grants for other scans are ignored.
+	client.send(t, binaryScanMore, u32(2), u32(1_000))
+	client.expectSilence(t)
+
+	client.send(t, binaryScanMore, u32(1), u32(500))
+	client.send(t, binaryScanMore, u32(1), u32(500))
+	client.receiveItems(t, 111, 800)
+	if kind, _ := client.receive(t); kind != binaryOK {
+		t.Fatalf("Expected end of scan; got 0x%02x", kind)
+	}
+
+	// Grants in excess of the scan are ignored after it ended.
+	client.send(t, binaryScanMore, u32(1), u32(100))
+	if kind, value := client.do(t, binaryGet, u64(5)); kind != binaryOK || len(value) != 10 {
+		t.Errorf("Expected value after scan; got 0x%02x", kind)
+	}
+
+	client.send(t, binaryScan, u32(3), u64(2_000), u64(3_000), u32(10))
+	if kind, _ := client.receive(t); kind != binaryOK {
+		t.Errorf("Expected empty scan; got 0x%02x", kind)
+	}
+}
+
+func TestBinaryScanCancel(t *testing.T) {
+	client := startBinaryServer(t)
+	fillBinary(t, client, 1_000)
+
+	client.send(t, binaryScan, u32(1), u64(0), u64(1_000), u32(10))
+	client.receiveItems(t, 1, 10)
+	client.send(t, binaryScanCancel, u32(1))
+	if kind, _ := client.receive(t); kind != binaryOK {
+		t.Fatalf("Expected end of cancelled scan; got 0x%02x", kind)
+	}
+
+	// A cancellation arriving within the window ends the scan early.
+	writeFrame(client.w, binaryScan, u32(2), u64(0), u64(1_000), u32(1_000))
+	client.send(t, binaryScanCancel, u32(2))
+	received := 0
+	for kind := binaryItem; kind == binaryItem; received++ {
+		kind, _ = client.receive(t)
+	}
+	if received > 1_000 {
+		t.Errorf("Expected scan to end; got %d frames", received)
+	}
+
+	if kind, _ := client.do(t, binaryDelete, u64(1)); kind != binaryOK {
+		t.Errorf("Expected delete after cancelled scan; got 0x%02x", kind)
+	}
+
+	client.send(t, binaryScan, u32(3), u64(0), u64(1_000), u32(0))
+	client.send(t, binaryGet, u64(1))
+	if kind, _ := client.receive(t); kind != binaryError {
+		t.Errorf("Expected protocol error for request during scan; got 0x%02x", kind)
+	}
+}
+
+func TestBinaryReadFrame(t *testing.T) {
+	var frame bytes.Buffer
+	value := bytes.Repeat([]byte{7}, 3*readChunkSize)
+	w := bufio.NewWriter(&frame)
+	writeFrame(w, binaryPut, u64(1), []byte{binaryModePut}, value)
+	w.Flush()
+	if kind, payload, err := readFrame(bufio.NewReader(&frame)); err != nil || kind != binaryPut || !bytes.Equal(payload[9:], value) {
+		t.Errorf("Expected Put frame with %dB value; got 0x%02x, %v", len(value), kind, err)
+	}
+
+	// A size announced without sending the frame fails once the input ends,
+	// without allocating memory for it.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	header := append(u32(maxBinaryFrameSize), binaryPut)
+	if _, _, err := readFrame(bufio.NewReader(bytes.NewReader(header))); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF for truncated frame; got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Expected little memory to be allocated for truncated frame; got %dB", allocated)
+	}
+}
@@ -0,0 +1,463 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+const (
+	// maxHTTPValueSize is the maximum size of a request body.
+	maxHTTPValueSize = 64 << 20
+	// defaultRangeLimit is the number of items returned by a range request
+	// unless specified by its limit, which must not exceed maxRangeLimit.
+	defaultRangeLimit = 100
+	maxRangeLimit     = 10_000
+)
+
+// valueEncoding is the representation of a value within an HTTP request or
+// response.
+type valueEncoding int
+
+const (
+	// encodingJSON is a JSON object, with the value encoded as base64
+	// string.
+	encodingJSON valueEncoding = iota
+	// encodingRaw is the value itself.
+	encodingRaw
+	// encodingHex and encodingBase64 are the value as hex or base64 text.
+	encodingHex
+	encodingBase64
+)
+
+// contentType returns the media type of representations in the encoding.
+func (e valueEncoding) contentType() string {
+	switch e {
+	case encodingRaw:
+		return "application/octet-stream"
+	case encodingHex:
+		return "text/plain; encoding=hex"
+	case encodingBase64:
+		return "text/plain; encoding=base64"
+	}
+
+	return "application/json"
+}
+
+// parseEncoding returns the encoding of a media type, and whether it is
+// supported. Wildcards are resolved to the default encoding of their type.
+func parseEncoding(mediaType string, params map[string]string) (valueEncoding, bool) {
+	switch mediaType {
+	case "application/json", "application/*", "*/*":
+		return encodingJSON, true
+	case "application/octet-stream":
+		return encodingRaw, true
+	case "text/plain", "text/*":
+		switch params["encoding"] {
+		case "", "hex":
+			return encodingHex, true
+		case "base64":
+			return encodingBase64, true
+		}
+	}
+
+	return 0, false
+}
+
+// httpError is an error response, with the status code it is sent with.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+// statusOf returns the status code an error is responded with.
+func statusOf(err error) int {
+	var httpErr *httpError
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr.status
+	case errors.Is(err, kv.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, kv.ErrKeyExists):
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
+
+/*
+HTTPServer serves a BTree over HTTP, with the following endpoints:
+
+	GET    /keys/{key}                     value of an item
+	PUT    /keys/{key}[?overwrite=true]    store an item
+	DELETE /keys/{key}                     delete an item
+	GET    /keys?from=&to=&limit=          items with keys in [from, to]
+	GET    /stats[?tree=true]              statistics of the tree
+
+Values of single items are represented according to the Accept and Content-Type
+headers, either as raw octets (application/octet-stream), as hex or base64 text
+(text/plain; encoding=hex or text/plain; encoding=base64), or as JSON object
+{"key": 1, "value": "<base64>"} (application/json, the default).
+
+PUT accepts the same representations, ignoring the key within JSON objects. It
+inserts a new item, responding with 409 Conflict if it exists already, unless
+it may overwrite it. Missing items are responded with 404 Not Found.
+Errors are responded as JSON object {"error": "<message>"}.
+
+Ranges are responded as JSON, holding up to limit items and the key to continue
+at if there are more. The tree may be modified in between requests for a range.
+
+Statistics cover the buffer pool and the storage by default. The shape of the
+tree and its number of keys are only included if requested with tree=true, as
+collecting them walks the whole tree while blocking modifications.
+*/
+type HTTPServer struct {
+	tree   *kv.BTree
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+// NewHTTPServer creates a server for the given tree, which must be open.
+func NewHTTPServer(tree *kv.BTree) *HTTPServer {
+	s := &HTTPServer{tree: tree, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/keys", s.handleRange)
+	s.mux.HandleFunc("/keys/", s.handleKey)
+	s.mux.HandleFunc("/stats", s.handleStats)
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// ServeHTTP handles a single request, such that the server may be used as
+// handler of another http.Server.
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on the TCP address and serves requests to it. See
+// Serve.
+func (s *HTTPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve serves requests to the listener, until the listener fails or the
+// server is closed. The listener is closed afterwards. Returns
+// ErrServerClosed once the server has been closed.
+func (s *HTTPServer) Serve(l net.Listener) error {
+	err := s.server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ErrServerClosed
+	}
+
+	return err
+}
+
+// Close stops all listeners, closes idle connections, and waits for the
+// requests in progress to be responded to, using http.Server.Shutdown. The tree
+// is not closed.
+func (s *HTTPServer) Close() error {
+	return s.server.Shutdown(context.Background())
+}
+
+// handleKey handles requests to a single item.
+func (s *HTTPServer) handleKey(w http.ResponseWriter, r *http.Request) {
+	key, err := parseKey(strings.TrimPrefix(r.URL.Path, "/keys/"))
+	if err != nil {
+		writeHTTPError(w, &httpError{http.StatusBadRequest, err.Error()})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.get(w, r, key)
+	case http.MethodPut:
+		s.put(w, r, key)
+	case http.MethodDelete:
+		if err := s.tree.Delete(key); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeHTTPError(w, &httpError{http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method)})
+	}
+}
+
+func (s *HTTPServer) get(w http.ResponseWriter, r *http.Request, key uint64) {
+	encoding, err := negotiate(r.Header.Get("Accept"))
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	value, err := s.tree.GetBytes(key)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	var body []byte
+	switch encoding {
+	case encodingJSON:
+		body, err = json.Marshal(httpItem{key, value})
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+	case encodingRaw:
+		body = value
+	case encodingHex:
+		body = []byte(hex.EncodeToString(value))
+	case encodingBase64:
+		body = []byte(base64.StdEncoding.EncodeToString(value))
+	}
+
+	w.Header().Set("Content-Type", encoding.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Vary", "Accept")
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// put stores an item, overwriting an existing one only if requested.
+func (s *HTTPServer) put(w http.ResponseWriter, r *http.Request, key uint64) {
+	value, err := readValue(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("overwrite") == "true" {
+		if err := s.tree.UpsertBytes(key, value); err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := s.tree.PutBytes(key, value); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// httpRange is the response to a range request.
+type httpRange struct {
+	Items []httpItem `json:"items"`
+	// Key to continue at, if there are more items.
+	Next *uint64 `json:"next,omitempty"`
+}
+
+// httpItem is an item represented as JSON, with the value as base64 string.
+type httpItem struct {
+	Key   uint64 `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// handleRange responds with the items with keys in the requested range.
+func (s *HTTPServer) handleRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeHTTPError(w, &httpError{http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method)})
+		return
+	}
+
+	query := r.URL.Query()
+	from, to := uint64(0), uint64(math.MaxUint64)
+	limit := defaultRangeLimit
+	var err error
+	if param := query.Get("from"); param != "" {
+		if from, err = parseKey(param); err != nil {
+			writeHTTPError(w, &httpError{http.StatusBadRequest, err.Error()})
+			return
+		}
+	}
+	if param := query.Get("to"); param != "" {
+		if to, err = parseKey(param); err != nil {
+			writeHTTPError(w, &httpError{http.StatusBadRequest, err.Error()})
+			return
+		}
+	}
+	if param := query.Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > maxRangeLimit {
+			msg := fmt.Sprintf("Invalid limit %q: must be between 1 and %d", param, maxRangeLimit)
+			writeHTTPError(w, &httpError{http.StatusBadRequest, msg})
+			return
+		}
+	}
+
+	response := httpRange{Items: []httpItem{}}
+	c := s.tree.Cursor()
+	defer c.Close()
+	for ok := c.Seek(from); ok && c.Key() <= to; ok = c.Next() {
+		if len(response.Items) == limit {
+			next := c.Key()
+			response.Next = &next
+			break
+		}
+
+		value, err := c.ValueBytes()
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			// Deleted since the cursor copied its leaf.
+			continue
+		}
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		response.Items = append(response.Items, httpItem{c.Key(), value})
+	}
+	if err := c.Err(); err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *HTTPServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeHTTPError(w, &httpError{http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed", r.Method)})
+		return
+	}
+
+	stats, err := s.tree.Summary()
+	if r.URL.Query().Get("tree") == "true" {
+		stats, err = s.tree.Stats()
+	}
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// negotiate returns the encoding of a value to respond with, preferring the
+// ones given first among those of equal quality. Returns an error if none of
+// the accepted media types is supported.
+func negotiate(accept string) (valueEncoding, error) {
+	if strings.TrimSpace(accept) == "" {
+		return encodingJSON, nil
+	}
+
+	best, bestQuality := valueEncoding(0), 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		encoding, ok := parseEncoding(mediaType, params)
+		if !ok {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+
+	if bestQuality == 0 {
+		return 0, &httpError{http.StatusNotAcceptable, fmt.Sprintf("None of the accepted media types %q is supported", accept)}
+	}
+
+	return best, nil
+}
+
+// readValue reads the value from the body of a request, according to its
+// content type. Bodies without content type are taken as raw octets.
+func readValue(r *http.Request) ([]byte, error) {
+	encoding := encodingRaw
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		var ok bool
+		if err == nil && !strings.Contains(mediaType, "*") {
+			encoding, ok = parseEncoding(mediaType, params)
+		}
+		if !ok {
+			return nil, &httpError{http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported content type %q", contentType)}
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxHTTPValueSize+1))
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("Unable to read value: %v", err)}
+	}
+	if len(body) > maxHTTPValueSize {
+		return nil, &httpError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Value exceeds %dB", maxHTTPValueSize)}
+	}
+
+	var value []byte
+	switch encoding {
+	case encodingJSON:
+		var item httpItem
+		err = json.Unmarshal(body, &item)
+		value = item.Value
+	case encodingRaw:
+		value = body
+	case encodingHex:
+		value, err = hex.DecodeString(strings.TrimSpace(string(body)))
+	case encodingBase64:
+		value, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+	}
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("Invalid value: %v", err)}
+	}
+
+	return value, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
+
+// writeHTTPError responds with an error, with the status code matching it.
+func writeHTTPError(w http.ResponseWriter, err error) {
+	writeJSON(w, statusOf(err), map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+// startHTTPServer serves a new tree with an HTTP server.
+func startHTTPServer(t *testing.T) *httptest.Server {
+	tree, _ := helper.GetInstance(t, kv.KvStoreConfig{MemorySize: 64 * kv.PageSize})
+	t.Cleanup(func() { tree.Close() })
+	server := httptest.NewServer(NewHTTPServer(tree))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// request sends a request, and returns the status code, content type and
+// body of the response.
+func request(t *testing.T, method, url, header, body string) (int, string, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	if header != "" {
+		name, value, _ := strings.Cut(header, ": ")
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+
+	return resp.StatusCode, resp.Header.Get("Content-Type"), string(data)
+}
+
+func TestHTTPKeys(t *testing.T) {
+	server := startHTTPServer(t)
+	url := server.URL + "/keys/"
+
+	tests := []struct {
+		method, path, header, body string
+		status                     int
+		contentType, response      string
+	}{
+		{"GET", "1", "", "", 404, "application/json", `{"error":"key not found"}` + "\n"},
+		{"PUT", "1", "", "hello", 201, "", ""},
+		{"PUT", "1", "", "again", 409, "application/json", `{"error":"key already exists"}` + "\n"},
+		{"GET", "1", "", "", 200, "application/json", `{"key":1,"value":"aGVsbG8="}`},
+		{"GET", "1", "Accept: application/octet-stream", "", 200, "application/octet-stream", "hello"},
+		{"GET", "1", "Accept: text/plain", "", 200, "text/plain; encoding=hex", "68656c6c6f"},
+		{"GET", "1", "Accept: text/plain; encoding=base64", "", 200, "text/plain; encoding=base64", "aGVsbG8="},
+		{"GET", "1", "Accept: image/png, text/plain; q=0.5, application/octet-stream; q=0.8", "", 200, "application/octet-stream", "hello"},
+		{"GET", "1", "Accept: image/png", "", 406, "application/json", ""},
+		{"PUT", "2", "Content-Type: text/plain; encoding=hex", "776f726c64\n", 201, "", ""},
+		{"PUT", "3", "Content-Type: text/plain; encoding=base64", "d29ybGQ=", 201, "", ""},
+		{"PUT", "4", "Content-Type: application/json", `{"value":"d29ybGQ="}`, 201, "", ""},
+		{"GET", "2", "Accept: application/octet-stream", "", 200, "application/octet-stream", "world"},
+		{"GET", "3", "Accept: application/octet-stream", "", 200, "application/octet-stream", "world"},
+		{"GET", "4", "Accept: application/octet-stream", "", 200, "application/octet-stream", "world"},
+		{"PUT", "5", "Content-Type: text/plain; encoding=hex", "xyz", 400, "application/json", ""},
+		{"PUT", "5", "Content-Type: image/png", "", 415, "application/json", ""},
+		{"PUT", "1?overwrite=true", "", "bye", 204, "", ""},
+		{"GET", "1", "Accept: application/octet-stream", "", 200, "application/octet-stream", "bye"},
+		{"DELETE", "1", "", "", 204, "", ""},
+		{"DELETE", "1", "", "", 404, "application/json", ""},
+		{"GET", "one", "", "", 400, "application/json", ""},
+		{"POST", "1", "", "", 405, "application/json", ""},
+	}
+
+	for _, test := range tests {
+		status, contentType, body := request(t, test.method, url+test.path, test.header, test.body)
+		if status != test.status || contentType != test.contentType {
+			t.Errorf("Expected %d (%s) for %s %s; got %d (%s): %s", test.status, test.contentType, test.method, test.path, status, contentType, body)
+		}
+		if test.response != "" && body != test.response {
+			t.Errorf("Expected response %q for %s %s; got %q", test.response, test.method, test.path, body)
+		}
+	}
+}
+
+func TestHTTPLargeValue(t *testing.T) {
+	server := startHTTPServer(t)
+
+	value := strings.Repeat("0123456789", kv.PageSize)
+	status, _, _ := request(t, "PUT", server.URL+"/keys/1", "", value)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected large value to be stored; got %d", status)
+	}
+	_, _, body := request(t, "GET", server.URL+"/keys/1", "Accept: application/octet-stream", "")
+	if body != value {
+		t.Errorf("Got wrong large value of %dB", len(body))
+	}
+}
+
+func TestHTTPRange(t *testing.T) {
+	server := startHTTPServer(t)
+	for key := 1; key <= 25; key++ {
+		request(t, "PUT", server.URL+"/keys/"+strconv.Itoa(key), "", "v"+strconv.Itoa(key))
+	}
+
+	var items []httpItem
+	url := server.URL + "/keys?from=3&to=22&limit=8"
+	for pages := 1; ; pages++ {
+		status, _, body := request(t, "GET", url, "", "")
+		if status != http.StatusOK {
+			t.Fatalf("Expected range; got %d: %s", status, body)
+		}
+
+		var page httpRange
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatalf("Error decoding range: %v", err)
+		}
+		items = append(items, page.Items...)
+		if page.Next == nil {
+			if pages != 3 {
+				t.Errorf("Expected 3 pages; got %d", pages)
+			}
+			break
+		}
+		url = server.URL + "/keys?to=22&limit=8&from=" + strconv.FormatUint(*page.Next, 10)
+	}
+
+	if len(items) != 20 {
+		t.Fatalf("Expected 20 items; got %d", len(items))
+	}
+	for i, item := range items {
+		key := uint64(i + 3)
+		if item.Key != key || string(item.Value) != "v"+strconv.FormatUint(key, 10) {
+			t.Errorf("Expected item %d at index %d; got %d = %q", key, i, item.Key, item.Value)
+		}
+	}
+
+	for _, query := range []string{"from=x", "to=-1", "limit=0", "limit=100000"} {
+		if status, _, _ := request(t, "GET", server.URL+"/keys?"+query, "", ""); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s; got %d", query, status)
+		}
+	}
+}
+
+func TestHTTPStats(t *testing.T) {
+	server := startHTTPServer(t)
+	request(t, "PUT", server.URL+"/keys/1", "", "one")
+
+	for _, tc := range []struct {
+		path   string
+		keys   uint
+		height int
+	}{{"/stats", 0, 0}, {"/stats?tree=true", 1, 2}} {
+		status, contentType, body := request(t, "GET", server.URL+tc.path, "", "")
+		if status != http.StatusOK || contentType != "application/json" {
+			t.Fatalf("Expected stats for %s; got %d (%s)", tc.path, status, contentType)
+		}
+
+		var stats kv.TreeStats
+		if err := json.Unmarshal([]byte(body), &stats); err != nil {
+			t.Fatalf("Error decoding stats: %v", err)
+		}
+		if stats.Keys != tc.keys || stats.Height != tc.height || stats.BufferPool.Frames != 64 {
+			t.Errorf("Expected stats of tree with one key for %s; got %+v", tc.path, stats)
+		}
+	}
+}
+
+func TestHTTPServerClose(t *testing.T) {
+	tree, _ := helper.GetInstance(t, kv.KvStoreConfig{MemorySize: 64 * kv.PageSize})
+	t.Cleanup(func() { tree.Close() })
+	server := NewHTTPServer(tree)
+	l := listen(t)
+	done := make(chan error)
+	go func() { done <- server.Serve(l) }()
+
+	status, _, _ := request(t, "GET", "http://"+l.Addr().String()+"/keys/1", "", "")
+	if status != http.StatusNotFound {
+		t.Errorf("Expected 404; got %d", status)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Error closing server: %v", err)
+	}
+	if err := <-done; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Expected ErrServerClosed from Serve; got %v", err)
+	}
+}
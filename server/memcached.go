@@ -0,0 +1,573 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+const (
+	// maxMemcachedLineLength is the maximum size of a command line, which
+	// may hold many keys for get.
+	maxMemcachedLineLength = 64 << 10
+	// maxMemcachedValueSize is the maximum size of a value stored.
+	maxMemcachedValueSize = 64 << 20
+	// memcachedVersion is the version of memcached reported to clients.
+	memcachedVersion = "1.6.0"
+	// memcachedLockStripes is the number of locks serializing modifications
+	// of the same key.
+	memcachedLockStripes = 64
+	// memcachedFlagsSize is the size of the flags stored in front of the
+	// data of each value.
+	memcachedFlagsSize = 4
+)
+
+// memcachedFatalError is an error in the input of a client, after which the
+// connection is closed as the rest of the input cannot be made sense of.
+type memcachedFatalError string
+
+func (e memcachedFatalError) Error() string {
+	return string(e)
+}
+
+/*
+MemcachedServer serves a BTree over the ASCII protocol of memcached, such that
+memcached clients can use it.
+
+Supported commands are get, gets, set, add, replace, delete, incr, decr, stats,
+version and quit. Keys must be given as decimal numbers, as the tree only holds
+integer keys. add stores new items only, like Put, set stores items regardless
+of whether they exist, and replace only replaces the values of existing ones.
+
+Items never expire, so expiration times are accepted but ignored. The 32-bit
+flags of each item are stored as big-endian prefix of its value, in front of
+the data given by the client. Other protocols serving the same tree therefore
+see the flags as part of the value. Values too short to hold flags, as stored
+over other protocols, are returned as data with flags of 0. The CAS unique
+returned by gets is a hash of the data, as there is no cas command relying on
+it.
+
+stats reports statistics of the server and of the storage of the tree, which
+are cheap to collect. The number of items and the shape of the tree are only
+reported by "stats tree", as they require reading the whole tree, during which
+all other commands block.
+
+Modifications of the same key are serialized among the clients of the server,
+so incr and decr are atomic with respect to all of its commands, but not with
+respect to other servers on the same tree.
+*/
+type MemcachedServer struct {
+	// Number of clients connected, ever connected, and commands processed
+	// by outcome. Must only be accessed atomically.
+	connectedClients int64
+	totalConnections uint64
+	cmdGet           uint64
+	cmdSet           uint64
+	getHits          uint64
+	getMisses        uint64
+	deleteHits       uint64
+	deleteMisses     uint64
+	incrHits         uint64
+	incrMisses       uint64
+	decrHits         uint64
+	decrMisses       uint64
+
+	started time.Time
+	locks   [memcachedLockStripes]sync.Mutex
+
+	tree  *kv.BTree
+	conns connServer
+}
+
+// NewMemcachedServer creates a server for the given tree, which must be open.
+func NewMemcachedServer(tree *kv.BTree) *MemcachedServer {
+	return &MemcachedServer{tree: tree, started: time.Now()}
+}
+
+// ListenAndServe listens on the TCP address and serves clients connecting to
+// it. See Serve.
+func (s *MemcachedServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve serves clients connecting to the listener, until the listener fails
+// or the server is closed. The listener is closed afterwards. Returns
+// ErrServerClosed once the server has been closed.
+func (s *MemcachedServer) Serve(l net.Listener) error {
+	return s.conns.serve(l, s.handle)
+}
+
+// Close stops all listeners and stops reading commands, closing each
+// connection after replying to the commands already read from it. The tree is
+// not closed.
+func (s *MemcachedServer) Close() error {
+	return s.conns.close()
+}
+
+// memcachedConn is a connection of a memcached client.
+type memcachedConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+
+	// Whether the current command is not to be replied to.
+	noreply bool
+}
+
+// handle processes the commands of a client until it disconnects.
+func (s *MemcachedServer) handle(conn net.Conn) {
+	atomic.AddInt64(&s.connectedClients, 1)
+	atomic.AddUint64(&s.totalConnections, 1)
+	defer atomic.AddInt64(&s.connectedClients, -1)
+
+	c := &memcachedConn{
+		r: bufio.NewReaderSize(conn, maxMemcachedLineLength),
+		w: bufio.NewWriter(conn),
+	}
+
+	for {
+		quit, err := s.execute(c)
+		if err != nil {
+			var fatalErr memcachedFatalError
+			if errors.As(err, &fatalErr) {
+				c.w.WriteString("CLIENT_ERROR " + fatalErr.Error() + "\r\n")
+				c.w.Flush()
+			}
+			return
+		}
+
+		// Replies to pipelined commands are sent all at once.
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// memcachedCommands are the commands of the memcached server by their name.
+// Each returns an error if the connection is to be closed.
+var memcachedCommands = map[string]func(s *MemcachedServer, c *memcachedConn, args []string) error{
+	"get":     (*MemcachedServer).get,
+	"gets":    (*MemcachedServer).get,
+	"set":     (*MemcachedServer).store,
+	"add":     (*MemcachedServer).store,
+	"replace": (*MemcachedServer).store,
+	"delete":  (*MemcachedServer).delete,
+	"incr":    (*MemcachedServer).incrDecr,
+	"decr":    (*MemcachedServer).incrDecr,
+	"stats":   (*MemcachedServer).stats,
+	"version": (*MemcachedServer).version,
+}
+
+// execute reads and processes a single command, and returns whether the
+// connection is to be closed.
+func (s *MemcachedServer) execute(c *memcachedConn) (bool, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return false, memcachedFatalError("line too long")
+	}
+	if err != nil {
+		return false, err
+	}
+
+	args := strings.Fields(string(line))
+	c.noreply = false
+	if len(args) == 0 {
+		c.writeLine("ERROR")
+		return false, nil
+	}
+	if args[0] == "quit" {
+		return true, nil
+	}
+
+	cmd, ok := memcachedCommands[args[0]]
+	if !ok {
+		c.writeLine("ERROR")
+		return false, nil
+	}
+
+	return false, cmd(s, c, args)
+}
+
+// writeLine writes a reply, unless the command is not to be replied to.
+func (c *memcachedConn) writeLine(reply string) {
+	if !c.noreply {
+		c.w.WriteString(reply + "\r\n")
+	}
+}
+
+func (c *memcachedConn) writeClientError(msg string) {
+	c.writeLine("CLIENT_ERROR " + msg)
+}
+
+// writeServerError writes an error of the tree, which must not span multiple
+// lines.
+func (c *memcachedConn) writeServerError(err error) {
+	c.writeLine("SERVER_ERROR " + strings.ReplaceAll(err.Error(), "\r\n", " "))
+}
+
+// writeStats writes statistics as STAT lines, terminated by END.
+func (c *memcachedConn) writeStats(fields [][2]interface{}) {
+	for _, field := range fields {
+		c.writeLine(fmt.Sprintf("STAT %v %v", field[0], field[1]))
+	}
+	c.writeLine("END")
+}
+
+// lock locks the stripe of a key, serializing its modifications. The returned
+// function unlocks it again.
+func (s *MemcachedServer) lock(key uint64) func() {
+	mu := &s.locks[key%memcachedLockStripes]
+	mu.Lock()
+
+	return mu.Unlock
+}
+
+// get replies with the value of each key found. gets adds the CAS unique of
+// each value.
+func (s *MemcachedServer) get(c *memcachedConn, args []string) error {
+	if len(args) < 2 {
+		c.writeLine("ERROR")
+		return nil
+	}
+
+	keys := make([]uint64, len(args)-1)
+	for i, arg := range args[1:] {
+		var err error
+		if keys[i], err = parseKey(arg); err != nil {
+			c.writeClientError(err.Error())
+			return nil
+		}
+	}
+
+	// Values are collected first, as the reply must not be interrupted by
+	// an error.
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		var err error
+		atomic.AddUint64(&s.cmdGet, 1)
+		values[i], err = s.tree.GetBytes(key)
+		switch {
+		case errors.Is(err, kv.ErrKeyNotFound):
+			atomic.AddUint64(&s.getMisses, 1)
+		case err != nil:
+			c.writeServerError(err)
+			return nil
+		default:
+			atomic.AddUint64(&s.getHits, 1)
+		}
+	}
+
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		flags, data := splitFlags(value)
+		header := fmt.Sprintf("VALUE %s %d %d", args[1+i], flags, len(data))
+		if args[0] == "gets" {
+			header += " " + strconv.FormatUint(casUnique(data), 10)
+		}
+		c.writeLine(header)
+		c.w.Write(data)
+		c.w.WriteString("\r\n")
+	}
+	c.writeLine("END")
+
+	return nil
+}
+
+// casUnique returns the CAS unique of the data of a value.
+func casUnique(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+
+	return h.Sum64()
+}
+
+// splitFlags splits a stored value into its flags and data.
+func splitFlags(value []byte) (uint32, []byte) {
+	if len(value) < memcachedFlagsSize {
+		return 0, value
+	}
+
+	return binary.BigEndian.Uint32(value), value[memcachedFlagsSize:]
+}
+
+/*
+store processes the storage commands set, add and replace, given as
+
+	<command> <key> <flags> <exptime> <bytes> [noreply]
+
+followed by a data block of the given size. The data block is read before
+validating the other arguments, so the connection remains usable if they are
+invalid. The data is stored behind the flags.
+*/
+func (s *MemcachedServer) store(c *memcachedConn, args []string) error {
+	if len(args) != 5 && len(args) != 6 {
+		c.writeLine("ERROR")
+		return nil
+	}
+	c.noreply = len(args) == 6 && args[5] == "noreply"
+
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 {
+		return memcachedFatalError("bad data chunk")
+	}
+	if size > maxMemcachedValueSize {
+		if _, err := io.CopyN(io.Discard, c.r, int64(size)+2); err != nil {
+			return err
+		}
+		c.writeLine("SERVER_ERROR object too large for cache")
+		return nil
+	}
+
+	value := make([]byte, memcachedFlagsSize+size+2)
+	if _, err := io.ReadFull(c.r, value[memcachedFlagsSize:]); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(value, []byte("\r\n")) {
+		return memcachedFatalError("bad data chunk")
+	}
+	value = value[:memcachedFlagsSize+size]
+
+	key, err := parseKey(args[1])
+	if err != nil {
+		c.writeClientError(err.Error())
+		return nil
+	}
+	flags, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil || (len(args) == 6 && !c.noreply) {
+		c.writeClientError("bad command line format")
+		return nil
+	}
+	binary.BigEndian.PutUint32(value, uint32(flags))
+	if _, err := strconv.ParseInt(args[3], 10, 64); err != nil {
+		c.writeClientError("bad command line format")
+		return nil
+	}
+
+	store := s.tree.UpsertBytes
+	switch args[0] {
+	case "add":
+		store = s.tree.PutBytes
+	case "replace":
+		store = s.tree.UpdateBytes
+	}
+
+	atomic.AddUint64(&s.cmdSet, 1)
+	unlock := s.lock(key)
+	err = store(key, value)
+	unlock()
+
+	switch {
+	case errors.Is(err, kv.ErrKeyExists), errors.Is(err, kv.ErrKeyNotFound):
+		c.writeLine("NOT_STORED")
+	case err != nil:
+		c.writeServerError(err)
+	default:
+		c.writeLine("STORED")
+	}
+	return nil
+}
+
+// delete deletes an item, given as
+//
+//	delete <key> [0] [noreply]
+//
+// where the optional 0 is the delay accepted by earlier versions of memcached.
+func (s *MemcachedServer) delete(c *memcachedConn, args []string) error {
+	if len(args) > 2 && args[len(args)-1] == "noreply" {
+		c.noreply = true
+		args = args[:len(args)-1]
+	}
+	if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "0") {
+		c.writeClientError("bad command line format.  Usage: delete <key> [noreply]")
+		return nil
+	}
+
+	key, err := parseKey(args[1])
+	if err != nil {
+		c.writeClientError(err.Error())
+		return nil
+	}
+
+	unlock := s.lock(key)
+	err = s.tree.Delete(key)
+	unlock()
+
+	switch {
+	case errors.Is(err, kv.ErrKeyNotFound):
+		atomic.AddUint64(&s.deleteMisses, 1)
+		c.writeLine("NOT_FOUND")
+	case err != nil:
+		c.writeServerError(err)
+	default:
+		atomic.AddUint64(&s.deleteHits, 1)
+		c.writeLine("DELETED")
+	}
+	return nil
+}
+
+/*
+incrDecr increments or decrements the value of an item, given as
+
+	<incr|decr> <key> <delta> [noreply]
+
+The data of the value must be a decimal unsigned 64-bit integer. Incrementing
+wraps around at 2^64, while decrementing stops at 0. The flags are kept.
+Replies with the new value.
+*/
+func (s *MemcachedServer) incrDecr(c *memcachedConn, args []string) error {
+	if len(args) != 3 && len(args) != 4 {
+		c.writeLine("ERROR")
+		return nil
+	}
+	c.noreply = len(args) == 4 && args[3] == "noreply"
+
+	key, err := parseKey(args[1])
+	if err != nil {
+		c.writeClientError(err.Error())
+		return nil
+	}
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		c.writeClientError("invalid numeric delta argument")
+		return nil
+	}
+
+	hits, misses := &s.incrHits, &s.incrMisses
+	if args[0] == "decr" {
+		hits, misses = &s.decrHits, &s.decrMisses
+	}
+
+	unlock := s.lock(key)
+	defer unlock()
+
+	var data []byte
+	value, err := s.tree.GetBytes(key)
+	if err == nil {
+		var flags uint32
+		var n uint64
+		flags, data = splitFlags(value)
+		n, err = strconv.ParseUint(string(bytes.TrimRight(data, " ")), 10, 64)
+		if err != nil {
+			c.writeClientError("cannot increment or decrement non-numeric value")
+			return nil
+		}
+
+		switch {
+		case args[0] == "incr":
+			n += delta
+		case n < delta:
+			n = 0
+		default:
+			n -= delta
+		}
+		value = make([]byte, memcachedFlagsSize, memcachedFlagsSize+20)
+		binary.BigEndian.PutUint32(value, flags)
+		value = strconv.AppendUint(value, n, 10)
+		data = value[memcachedFlagsSize:]
+		err = s.tree.UpdateBytes(key, value)
+	}
+
+	switch {
+	case errors.Is(err, kv.ErrKeyNotFound):
+		atomic.AddUint64(misses, 1)
+		c.writeLine("NOT_FOUND")
+	case err != nil:
+		c.writeServerError(err)
+	default:
+		atomic.AddUint64(hits, 1)
+		c.writeLine(string(data))
+	}
+	return nil
+}
+
+// stats replies with general statistics of the server and the storage of the
+// tree, or with statistics of the shape of the tree and its items for "stats
+// tree". The latter read the whole tree, blocking other commands meanwhile.
+// Other groups of statistics are not supported.
+func (s *MemcachedServer) stats(c *memcachedConn, args []string) error {
+	switch {
+	case len(args) == 2 && args[1] == "tree":
+		return s.treeStats(c)
+	case len(args) > 1:
+		c.writeLine("ERROR")
+		return nil
+	}
+
+	stats, err := s.tree.Summary()
+	if err != nil {
+		c.writeServerError(err)
+		return nil
+	}
+
+	now := time.Now()
+	fields := [][2]interface{}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(s.started).Seconds())},
+		{"time", now.Unix()},
+		{"version", memcachedVersion},
+		{"curr_connections", atomic.LoadInt64(&s.connectedClients)},
+		{"total_connections", atomic.LoadUint64(&s.totalConnections)},
+		{"cmd_get", atomic.LoadUint64(&s.cmdGet)},
+		{"cmd_set", atomic.LoadUint64(&s.cmdSet)},
+		{"get_hits", atomic.LoadUint64(&s.getHits)},
+		{"get_misses", atomic.LoadUint64(&s.getMisses)},
+		{"delete_hits", atomic.LoadUint64(&s.deleteHits)},
+		{"delete_misses", atomic.LoadUint64(&s.deleteMisses)},
+		{"incr_hits", atomic.LoadUint64(&s.incrHits)},
+		{"incr_misses", atomic.LoadUint64(&s.incrMisses)},
+		{"decr_hits", atomic.LoadUint64(&s.decrHits)},
+		{"decr_misses", atomic.LoadUint64(&s.decrMisses)},
+		{"bytes", stats.BytesOnDisk},
+		{"buffer_pool_hits", stats.BufferPool.Hits},
+		{"buffer_pool_misses", stats.BufferPool.Misses},
+	}
+	c.writeStats(fields)
+
+	return nil
+}
+
+// treeStats replies with statistics of the shape of the tree and its items.
+func (s *MemcachedServer) treeStats(c *memcachedConn) error {
+	stats, err := s.tree.Stats()
+	if err != nil {
+		c.writeServerError(err)
+		return nil
+	}
+
+	c.writeStats([][2]interface{}{
+		{"curr_items", stats.Keys},
+		{"tree_height", stats.Height},
+		{"tree_internal_pages", stats.InternalPages},
+		{"tree_leaf_pages", stats.LeafPages},
+		{"tree_overflow_pages", stats.OverflowPages},
+		{"tree_fill_factor", strconv.FormatFloat(stats.FillFactor, 'f', 4, 64)},
+	})
+
+	return nil
+}
+
+func (s *MemcachedServer) version(c *memcachedConn, _ []string) error {
+	c.writeLine("VERSION " + memcachedVersion)
+	return nil
+}
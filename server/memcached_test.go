@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+// memcachedTestClient sends raw input to a memcached server and reads its
+// replies.
+type memcachedTestClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startMemcachedServer serves a new tree with a memcached server, and connects
+// a client to it.
+func startMemcachedServer(t *testing.T) *memcachedTestClient {
+	tree, _ := helper.GetInstance(t, kv.KvStoreConfig{MemorySize: 64 * kv.PageSize})
+	t.Cleanup(func() { tree.Close() })
+	server := NewMemcachedServer(tree)
+	l := listen(t)
+	done := make(chan error)
+	go func() { done <- server.Serve(l) }()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expected ErrServerClosed from Serve; got %v", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &memcachedTestClient{conn, bufio.NewReader(conn)}
+}
+
+// exchange sends the input and reads as many bytes as expected in reply.
+func (c *memcachedTestClient) exchange(t *testing.T, input string, size int) string {
+	t.Helper()
+
+	if _, err := c.conn.Write([]byte(input)); err != nil {
+		t.Fatalf("Error sending input: %v", err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, size)
+	n, err := io.ReadFull(c.r, reply)
+	if err != nil {
+		t.Errorf("Error reading reply to %q: %v", input, err)
+	}
+
+	return string(reply[:n])
+}
+
+func TestMemcachedCommands(t *testing.T) {
+	client := startMemcachedServer(t)
+
+	large := strings.Repeat("x", 3*kv.PageSize)
+	tests := []struct {
+		input, expected string
+	}{
+		{"version\r\n", "VERSION 1.6.0\r\n"},
+		{"get 1\r\n", "END\r\n"},
+		{"set 1 0 0 3\r\none\r\n", "STORED\r\n"},
+		{"get 1\r\n", "VALUE 1 0 3\r\none\r\nEND\r\n"},
+		{"add 1 0 0 3\r\nuno\r\n", "NOT_STORED\r\n"},
+		{"add 2 0 0 3\r\ntwo\r\n", "STORED\r\n"},
+		{"replace 3 0 0 5\r\nthree\r\n", "NOT_STORED\r\n"},
+		{"replace 2 0 0 4\r\ndeux\r\n", "STORED\r\n"},
+		{"set 1 0 3600 4\r\neins\r\n", "STORED\r\n"},
+		{"get 1 2 3 002\r\n", "VALUE 1 0 4\r\neins\r\nVALUE 2 0 4\r\ndeux\r\nVALUE 002 0 4\r\ndeux\r\nEND\r\n"},
+		{"gets 1\r\n", fmt.Sprintf("VALUE 1 0 4 %d\r\neins\r\nEND\r\n", casUnique([]byte("eins")))},
+		{fmt.Sprintf("set 3 0 0 %d\r\n%s\r\n", len(large), large), "STORED\r\n"},
+		{"get 3\r\n", fmt.Sprintf("VALUE 3 0 %d\r\n%s\r\nEND\r\n", len(large), large)},
+		{"set 4 0 0 0\r\n\r\n", "STORED\r\n"},
+		{"get 4\r\n", "VALUE 4 0 0\r\n\r\nEND\r\n"},
+		{"delete 1\r\n", "DELETED\r\n"},
+		{"delete 1\r\n", "NOT_FOUND\r\n"},
+		{"delete 2 0\r\n", "DELETED\r\n"},
+		{"set 5 0 0 2\r\n10\r\n", "STORED\r\n"},
+		{"incr 5 5\r\n", "15\r\n"},
+		{"decr 5 3\r\n", "12\r\n"},
+		{"decr 5 100\r\n", "0\r\n"},
+		{"incr 5 18446744073709551615\r\n", "18446744073709551615\r\n"},
+		{"incr 5 2\r\n", "1\r\n"},
+		{"incr 6 1\r\n", "NOT_FOUND\r\n"},
+		{"incr 3 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{"incr 5 x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"set 6 0 0 1 noreply\r\na\r\nincr 5 1 noreply\r\ndelete 4 noreply\r\nget 6 5 4\r\n", "VALUE 6 0 1\r\na\r\nVALUE 5 0 1\r\n2\r\nEND\r\n"},
+		{"set 7 4294967295 0 1\r\na\r\n", "STORED\r\n"},
+		{"get 7\r\n", "VALUE 7 4294967295 1\r\na\r\nEND\r\n"},
+		{"set 8 42 0 2\r\n10\r\nincr 8 1\r\n", "STORED\r\n11\r\n"},
+		{"gets 8\r\n", fmt.Sprintf("VALUE 8 42 2 %d\r\n11\r\nEND\r\n", casUnique([]byte("11")))},
+		{"set 9 4294967296 0 1\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"set key 0 0 1\r\na\r\n", `CLIENT_ERROR Invalid key "key": keys must be unsigned 64-bit integers` + "\r\n"},
+		{"set 7 0 0 1 always\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"get\r\n", "ERROR\r\n"},
+		{"cas 1 0 0 1 1\r\n", "ERROR\r\n"},
+		{"\r\n", "ERROR\r\n"},
+		{"stats items\r\n", "ERROR\r\n"},
+	}
+
+	for _, test := range tests {
+		if reply := client.exchange(t, test.input, len(test.expected)); reply != test.expected {
+			t.Errorf("Expected %q for %q; got %q", test.expected, test.input, reply)
+		}
+	}
+
+	client.exchange(t, "quit\r\n", 0)
+	if _, err := client.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed after quit; got %v", err)
+	}
+}
+
+func TestMemcachedStats(t *testing.T) {
+	client := startMemcachedServer(t)
+	client.exchange(t, "set 1 0 0 3\r\none\r\nget 1 2\r\n", len("STORED\r\nVALUE 1 0 3\r\none\r\nEND\r\n"))
+
+	client.conn.Write([]byte("stats\r\n"))
+	var stats []string
+	for {
+		line, err := client.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading stats: %v", err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		stats = append(stats, strings.TrimSuffix(line, "\r\n"))
+	}
+
+	all := strings.Join(stats, "\n")
+	for _, expected := range []string{"STAT cmd_get 2", "STAT cmd_set 1", "STAT get_hits 1", "STAT get_misses 1", "STAT curr_connections 1"} {
+		if !strings.Contains(all, expected+"\n") {
+			t.Errorf("Expected stats to contain %q; got:\n%s", expected, all)
+		}
+	}
+	if strings.Contains(all, "curr_items") {
+		t.Errorf("Expected stats not to read the tree; got:\n%s", all)
+	}
+
+	expected := "STAT curr_items 1\r\nSTAT tree_height 2\r\n"
+	if reply := client.exchange(t, "stats tree\r\n", len(expected)); reply != expected {
+		t.Errorf("Expected tree stats to start with %q; got %q", expected, reply)
+	}
+}
+
+func TestMemcachedBadDataChunk(t *testing.T) {
+	client := startMemcachedServer(t)
+
+	expected := "CLIENT_ERROR bad data chunk\r\n"
+	if reply := client.exchange(t, "set 1 0 0 2\r\nabc\r\n", len(expected)); reply != expected {
+		t.Errorf("Expected %q; got %q", expected, reply)
+	}
+	if _, err := client.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed after bad data chunk; got %v", err)
+	}
+}
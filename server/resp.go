@@ -0,0 +1,689 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tobiasfamos/KVStore/kv"
+	"github.com/tobiasfamos/KVStore/util"
+)
+
+const (
+	// maxRESPArrayLength is the maximum number of arguments of a command.
+	// Only up to respPreallocArgs of them are allocated upfront.
+	maxRESPArrayLength = 1 << 20
+	respPreallocArgs   = 64
+	// maxRESPBulkLength is the maximum size of a single argument.
+	maxRESPBulkLength = 512 << 20
+	// maxRESPInlineLength is the maximum size of an inline command.
+	maxRESPInlineLength = 64 << 10
+
+	// defaultScanCount is the number of keys returned by SCAN unless
+	// specified by COUNT, which is capped at maxScanCount.
+	defaultScanCount = 10
+	maxScanCount     = 10_000
+	// maxMSETAttempts is the number of times MSET is attempted if other
+	// clients modify the same keys concurrently.
+	maxMSETAttempts = 3
+)
+
+// respProtocolError is an error in the input of a client, after which the
+// connection is closed.
+type respProtocolError string
+
+func (e respProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+/*
+RESPServer serves a BTree over the Redis serialization protocol (RESP2), such
+that Redis clients can use it.
+
+Supported commands are GET, SET, DEL, EXISTS, MGET, MSET, SCAN, DBSIZE, PING,
+ECHO, INFO, SELECT and QUIT. Keys must be given as decimal numbers, as the tree
+only holds integer keys. With redis-benchmark this is the case using the
+__rand_int__ placeholder as key, e.g.
+
+	redis-benchmark -r 1000000 -n 100000 SET __rand_int__ 0123456789
+
+INFO only reports the Tree and Keyspace sections if they are requested by name
+or with "everything", as they require reading the whole tree, during which all
+other commands block.
+
+Commands of a client are processed in order, and replies to pipelined commands
+are sent once all of them have been processed. Commands of different clients
+are processed concurrently.
+*/
+type RESPServer struct {
+	// Number of clients connected, ever connected, and commands processed.
+	// Must only be accessed atomically.
+	connectedClients  int64
+	totalConnections  uint64
+	commandsProcessed uint64
+
+	tree  *kv.BTree
+	conns connServer
+}
+
+// NewRESPServer creates a server for the given tree, which must be open.
+func NewRESPServer(tree *kv.BTree) *RESPServer {
+	return &RESPServer{tree: tree}
+}
+
+// ListenAndServe listens on the TCP address and serves clients connecting to
+// it. See Serve.
+func (s *RESPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve serves clients connecting to the listener, until the listener fails
+// or the server is closed. The listener is closed afterwards. Returns
+// ErrServerClosed once the server has been closed.
+func (s *RESPServer) Serve(l net.Listener) error {
+	return s.conns.serve(l, s.handle)
+}
+
+// Close stops all listeners and stops reading commands. Each connection is
+// closed once the commands read from it have been replied to. The tree is not
+// closed.
+func (s *RESPServer) Close() error {
+	return s.conns.close()
+}
+
+// handle processes the commands of a client until it disconnects.
+func (s *RESPServer) handle(conn net.Conn) {
+	atomic.AddInt64(&s.connectedClients, 1)
+	atomic.AddUint64(&s.totalConnections, 1)
+	defer atomic.AddInt64(&s.connectedClients, -1)
+
+	r := &respReader{bufio.NewReaderSize(conn, maxRESPInlineLength)}
+	w := &respWriter{bufio.NewWriter(conn)}
+
+	for {
+		args, err := r.readCommand()
+		if err != nil {
+			var protocolErr respProtocolError
+			if errors.As(err, &protocolErr) {
+				w.writeError(protocolErr.Error())
+				w.Flush()
+			}
+			return
+		}
+
+		quit := false
+		if len(args) > 0 {
+			atomic.AddUint64(&s.commandsProcessed, 1)
+			quit = s.execute(w, args)
+		}
+
+		// Replies to pipelined commands are sent all at once.
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// respCommand is a command of the RESP server.
+type respCommand struct {
+	// Number of arguments including the name of the command. A negative
+	// arity is the minimum number of arguments.
+	arity  int
+	handle func(s *RESPServer, w *respWriter, args [][]byte)
+}
+
+// respCommands are the commands of the RESP server by their lower case name.
+// QUIT is handled by the connection itself.
+var respCommands = map[string]respCommand{
+	"get":    {2, (*RESPServer).get},
+	"set":    {-3, (*RESPServer).set},
+	"del":    {-2, (*RESPServer).del},
+	"exists": {-2, (*RESPServer).exists},
+	"mget":   {-2, (*RESPServer).mget},
+	"mset":   {-3, (*RESPServer).mset},
+	"scan":   {-2, (*RESPServer).scan},
+	"dbsize": {1, (*RESPServer).dbsize},
+	"ping":   {-1, (*RESPServer).ping},
+	"echo":   {2, (*RESPServer).echo},
+	"info":   {-1, (*RESPServer).info},
+	"select": {2, (*RESPServer).selectDB},
+}
+
+// execute processes a single command, and returns whether the connection is
+// to be closed.
+func (s *RESPServer) execute(w *respWriter, args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	if name == "quit" {
+		w.writeSimple("OK")
+		return true
+	}
+
+	cmd, ok := respCommands[name]
+	if !ok {
+		w.writeError(fmt.Sprintf("unknown command '%s'", args[0]))
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.writeError(fmt.Sprintf("wrong number of arguments for '%s' command", name))
+		return false
+	}
+
+	cmd.handle(s, w, args)
+	return false
+}
+
+func (s *RESPServer) get(w *respWriter, args [][]byte) {
+	key, err := parseKey(string(args[1]))
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+
+	value, err := s.tree.GetBytes(key)
+	switch {
+	case errors.Is(err, kv.ErrKeyNotFound):
+		w.writeNull()
+	case err != nil:
+		w.writeError(err.Error())
+	default:
+		w.writeBulk(value)
+	}
+}
+
+// set stores an item, overwriting any existing one. With NX the item is only
+// stored if none exists, and with XX only if one does.
+func (s *RESPServer) set(w *respWriter, args [][]byte) {
+	key, err := parseKey(string(args[1]))
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+
+	store := s.tree.UpsertBytes
+	if len(args) > 3 {
+		option := strings.ToLower(string(args[3]))
+		switch {
+		case len(args) > 4:
+			// NX and XX exclude each other, and no other options
+			// are supported.
+			w.writeError("syntax error")
+			return
+		case option == "nx":
+			store = s.tree.PutBytes
+		case option == "xx":
+			store = s.tree.UpdateBytes
+		default:
+			w.writeError("syntax error")
+			return
+		}
+	}
+
+	err = store(key, args[2])
+	switch {
+	case errors.Is(err, kv.ErrKeyExists), errors.Is(err, kv.ErrKeyNotFound):
+		w.writeNull()
+	case err != nil:
+		w.writeError(err.Error())
+	default:
+		w.writeSimple("OK")
+	}
+}
+
+// del deletes items, replying with the number of items deleted.
+func (s *RESPServer) del(w *respWriter, args [][]byte) {
+	keys, err := parseKeys(args[1:])
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		err := s.tree.Delete(key)
+		if err == nil {
+			deleted++
+		} else if !errors.Is(err, kv.ErrKeyNotFound) {
+			w.writeError(err.Error())
+			return
+		}
+	}
+
+	w.writeInt(int64(deleted))
+}
+
+// exists replies with the number of keys given which exist, counting keys
+// given multiple times as often.
+func (s *RESPServer) exists(w *respWriter, args [][]byte) {
+	keys, err := parseKeys(args[1:])
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+
+	found := 0
+	for _, key := range keys {
+		_, err := s.tree.Get(key)
+		if err == nil || errors.Is(err, kv.ErrValueTooLarge) {
+			found++
+		} else if !errors.Is(err, kv.ErrKeyNotFound) {
+			w.writeError(err.Error())
+			return
+		}
+	}
+
+	w.writeInt(int64(found))
+}
+
+func (s *RESPServer) mget(w *respWriter, args [][]byte) {
+	keys, err := parseKeys(args[1:])
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		values[i], err = s.tree.GetBytes(key)
+		if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+			w.writeError(err.Error())
+			return
+		}
+		found[i] = err == nil
+	}
+
+	w.writeArray(len(values))
+	for i, value := range values {
+		if found[i] {
+			w.writeBulk(value)
+		} else {
+			w.writeNull()
+		}
+	}
+}
+
+// mset stores multiple items at once, overwriting existing ones. Either all
+// or none of them are stored.
+func (s *RESPServer) mset(w *respWriter, args [][]byte) {
+	if len(args)%2 != 1 {
+		w.writeError("wrong number of arguments for 'mset' command")
+		return
+	}
+
+	keys := make([]uint64, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		key, err := parseKey(string(args[i]))
+		if err != nil {
+			w.writeError(err.Error())
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	var err error
+	for attempt := 0; attempt < maxMSETAttempts; attempt++ {
+		tx := s.tree.Begin()
+		for i, key := range keys {
+			if err = tx.Delete(key); err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+				break
+			}
+			if err = tx.PutBytes(key, args[2+2*i]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+
+		// Committing fails if other clients inserted or deleted any of
+		// the keys in the meantime.
+		if !errors.Is(err, kv.ErrKeyExists) && !errors.Is(err, kv.ErrKeyNotFound) {
+			break
+		}
+	}
+
+	if err != nil {
+		w.writeError(err.Error())
+	} else {
+		w.writeSimple("OK")
+	}
+}
+
+/*
+scan iterates over the keys in ascending order. The cursor is the key to
+continue at, and 0 once all keys have been returned.
+
+MATCH filters the keys returned by a glob pattern, applied to their decimal
+representation after up to COUNT keys have been read. As COUNT is merely a hint,
+larger values are capped at maxScanCount.
+*/
+func (s *RESPServer) scan(w *respWriter, args [][]byte) {
+	from, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		w.writeError("invalid cursor")
+		return
+	}
+
+	count := defaultScanCount
+	pattern := ""
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.writeError("syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				w.writeError("value is not an integer or out of range")
+				return
+			}
+			count = util.Min(count, maxScanCount)
+		case "match":
+			pattern = string(args[i+1])
+			if _, err := path.Match(pattern, ""); err != nil {
+				w.writeError("invalid pattern")
+				return
+			}
+		default:
+			w.writeError("syntax error")
+			return
+		}
+	}
+
+	var keys []uint64
+	next := uint64(0)
+	err = s.tree.Scan(from, math.MaxUint64, func(key uint64, _ [10]byte) bool {
+		if len(keys) == count {
+			next = key
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+
+	var matched [][]byte
+	for _, key := range keys {
+		name := strconv.FormatUint(key, 10)
+		if ok, _ := path.Match(pattern, name); pattern == "" || ok {
+			matched = append(matched, []byte(name))
+		}
+	}
+
+	w.writeArray(2)
+	w.writeBulk([]byte(strconv.FormatUint(next, 10)))
+	w.writeArray(len(matched))
+	for _, name := range matched {
+		w.writeBulk(name)
+	}
+}
+
+// dbsize replies with the number of items in the tree, which are counted by
+// scanning all of them.
+func (s *RESPServer) dbsize(w *respWriter, _ [][]byte) {
+	count, err := s.countKeys()
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+
+	w.writeInt(int64(count))
+}
+
+func (s *RESPServer) countKeys() (uint64, error) {
+	count := uint64(0)
+	err := s.tree.Scan(0, math.MaxUint64, func(uint64, [10]byte) bool {
+		count++
+		return true
+	})
+
+	return count, err
+}
+
+func (s *RESPServer) ping(w *respWriter, args [][]byte) {
+	switch len(args) {
+	case 1:
+		w.writeSimple("PONG")
+	case 2:
+		w.writeBulk(args[1])
+	default:
+		w.writeError("wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *RESPServer) echo(w *respWriter, args [][]byte) {
+	w.writeBulk(args[1])
+}
+
+// selectDB accepts only database 0, as the tree is the only database.
+func (s *RESPServer) selectDB(w *respWriter, args [][]byte) {
+	if string(args[1]) != "0" {
+		w.writeError("DB index is out of range")
+		return
+	}
+
+	w.writeSimple("OK")
+}
+
+// info replies with information about the server and the tree, in the
+// sections given, or the default ones.
+//
+// The Tree and Keyspace sections require reading the whole tree, blocking all
+// other commands meanwhile, so they are only included if requested by name or
+// with "everything".
+func (s *RESPServer) info(w *respWriter, args [][]byte) {
+	requested := make(map[string]bool)
+	for _, arg := range args[1:] {
+		requested[strings.ToLower(string(arg))] = true
+	}
+	all := len(requested) == 0 || requested["all"] || requested["default"] || requested["everything"]
+	walk := requested["tree"] || requested["keyspace"] || requested["everything"]
+
+	stats, err := s.tree.Summary()
+	if walk {
+		stats, err = s.tree.Stats()
+	}
+	if err != nil {
+		w.writeError(err.Error())
+		return
+	}
+	pool := stats.BufferPool
+
+	sections := []struct {
+		name   string
+		walk   bool
+		fields [][2]interface{}
+	}{
+		{"Server", false, [][2]interface{}{
+			// Clients may check the version for supported commands.
+			{"redis_version", "7.0.0"},
+			{"redis_mode", "standalone"},
+		}},
+		{"Clients", false, [][2]interface{}{
+			{"connected_clients", atomic.LoadInt64(&s.connectedClients)},
+		}},
+		{"Stats", false, [][2]interface{}{
+			{"total_connections_received", atomic.LoadUint64(&s.totalConnections)},
+			{"total_commands_processed", atomic.LoadUint64(&s.commandsProcessed)},
+			{"buffer_pool_frames", pool.Frames},
+			{"buffer_pool_cached_pages", pool.CachedPages},
+			{"buffer_pool_hits", pool.Hits},
+			{"buffer_pool_misses", pool.Misses},
+			{"buffer_pool_evictions", pool.Evictions},
+			{"buffer_pool_dirty_flushes", pool.DirtyFlushes},
+		}},
+		{"Storage", false, [][2]interface{}{
+			{"bytes_on_disk", stats.BytesOnDisk},
+			{"page_files", stats.PageFiles},
+			{"free_pages", stats.FreePages},
+		}},
+		{"Tree", true, [][2]interface{}{
+			{"height", stats.Height},
+			{"internal_pages", stats.InternalPages},
+			{"leaf_pages", stats.LeafPages},
+			{"overflow_pages", stats.OverflowPages},
+			{"fill_factor", strconv.FormatFloat(stats.FillFactor, 'f', 4, 64)},
+		}},
+		{"Keyspace", true, [][2]interface{}{
+			{"db0", fmt.Sprintf("keys=%d,expires=0,avg_ttl=0", stats.Keys)},
+		}},
+	}
+
+	var b bytes.Buffer
+	for _, section := range sections {
+		included := all && (!section.walk || requested["everything"])
+		if !included && !requested[strings.ToLower(section.name)] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", section.name)
+		for _, field := range section.fields {
+			fmt.Fprintf(&b, "%v:%v\r\n", field[0], field[1])
+		}
+	}
+
+	w.writeBulk(b.Bytes())
+}
+
+// parseKeys parses keys given as decimal numbers.
+func parseKeys(args [][]byte) ([]uint64, error) {
+	keys := make([]uint64, len(args))
+	for i, arg := range args {
+		var err error
+		if keys[i], err = parseKey(string(arg)); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// respReader reads commands sent by RESP clients.
+type respReader struct {
+	*bufio.Reader
+}
+
+/*
+readCommand reads the next command, given as array of bulk strings, or inline
+as a line of space-separated arguments. Returns the arguments of the command,
+which are empty for empty lines.
+
+Malformed input yields a respProtocolError.
+*/
+func (r *respReader) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = []byte(field)
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxRESPArrayLength {
+		return nil, respProtocolError("invalid multibulk length")
+	}
+
+	args := make([][]byte, 0, util.Max(util.Min(n, respPreallocArgs), 0))
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, respProtocolError(fmt.Sprintf("expected '$', got %q", line))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxRESPBulkLength {
+			return nil, respProtocolError("invalid bulk length")
+		}
+
+		arg, err := readSized(r, size+2)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, respProtocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, arg[:size])
+	}
+
+	return args, nil
+}
+
+// readLine reads a line terminated by LF or CRLF, excluding the terminator.
+func (r *respReader) readLine() ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, respProtocolError("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return line, nil
+}
+
+// respWriter writes replies to RESP clients. Writing errors are reported by
+// Flush.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w *respWriter) writeSimple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// writeError writes an error reply, which must not span multiple lines.
+func (w *respWriter) writeError(msg string) {
+	w.WriteString("-ERR " + strings.ReplaceAll(msg, "\r\n", " ") + "\r\n")
+}
+
+func (w *respWriter) writeInt(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) writeBulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// writeNull writes the null bulk string, replied for missing items.
+func (w *respWriter) writeNull() {
+	w.WriteString("$-1\r\n")
+}
+
+// writeArray writes the header of an array of n elements, which must be
+// written right after.
+func (w *respWriter) writeArray(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tobiasfamos/KVStore/kv"
+)
+
+var helper = kv.TestHelper{}
+
+func TestMain(m *testing.M) {
+	// Initialze helper before running test, and call its cleanup before
+	// terminating.
+	helper.Initialize()
+	result := m.Run()
+	helper.Cleanup()
+
+	os.Exit(result)
+}
+
+// listen returns a listener on a free port of the loopback interface.
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+
+	return l
+}
+
+// respError is an error reply of a RESP server.
+type respError string
+
+// respTestClient sends commands to a RESP server and parses its replies.
+type respTestClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startRESPServer serves a new tree with a RESP server, and connects a
+// client to it.
+func startRESPServer(t *testing.T) (*RESPServer, *respTestClient) {
+	tree, _ := helper.GetInstance(t, kv.KvStoreConfig{MemorySize: 64 * kv.PageSize})
+	t.Cleanup(func() { tree.Close() })
+	server := NewRESPServer(tree)
+	l := listen(t)
+	done := make(chan error)
+	go func() { done <- server.Serve(l) }()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expected ErrServerClosed from Serve; got %v", err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return server, &respTestClient{conn, bufio.NewReader(conn)}
+}
+
+// send writes a command as array of bulk strings.
+func (c *respTestClient) send(t *testing.T, args ...string) {
+	t.Helper()
+
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		t.Fatalf("Error sending command: %v", err)
+	}
+}
+
+// do sends a command and returns its reply.
+func (c *respTestClient) do(t *testing.T, args ...string) interface{} {
+	t.Helper()
+
+	c.send(t, args...)
+	return c.reply(t)
+}
+
+// reply reads a reply, returning simple and bulk strings as string, integers
+// as int64, arrays as []interface{}, errors as respError and null as nil.
+func (c *respTestClient) reply(t *testing.T) interface{} {
+	t.Helper()
+
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return respError(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			t.Fatalf("Error reading bulk string: %v", err)
+		}
+		return string(data[:size])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		elements := make([]interface{}, n)
+		for i := range elements {
+			elements[i] = c.reply(t)
+		}
+		return elements
+	}
+
+	t.Fatalf("Got invalid reply %q", line)
+	return nil
+}
+
+func TestRESPCommands(t *testing.T) {
+	_, client := startRESPServer(t)
+
+	large := strings.Repeat("x", 3*kv.PageSize)
+	tests := []struct {
+		args     []string
+		expected interface{}
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"ping", "hello"}, "hello"},
+		{[]string{"ECHO", "hello"}, "hello"},
+		{[]string{"GET", "1"}, nil},
+		{[]string{"SET", "1", "one"}, "OK"},
+		{[]string{"GET", "1"}, "one"},
+		{[]string{"SET", "1", "uno"}, "OK"},
+		{[]string{"GET", "1"}, "uno"},
+		{[]string{"SET", "1", "eins", "NX"}, nil},
+		{[]string{"SET", "2", "zwei", "XX"}, nil},
+		{[]string{"SET", "2", "two", "nx"}, "OK"},
+		{[]string{"SET", "2", "deux", "xx"}, "OK"},
+		{[]string{"SET", "3", large}, "OK"},
+		{[]string{"GET", "3"}, large},
+		{[]string{"SET", "4", ""}, "OK"},
+		{[]string{"MGET", "1", "2", "3", "4", "5"}, []interface{}{"uno", "deux", large, "", nil}},
+		{[]string{"EXISTS", "1", "3", "5", "1"}, int64(3)},
+		{[]string{"MSET", "5", "five", "1", "one"}, "OK"},
+		{[]string{"MGET", "1", "5"}, []interface{}{"one", "five"}},
+		{[]string{"DBSIZE"}, int64(5)},
+		{[]string{"DEL", "1", "3", "6"}, int64(2)},
+		{[]string{"DBSIZE"}, int64(3)},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"SELECT", "1"}, respError("ERR DB index is out of range")},
+		{[]string{"GET", "key:1"}, respError(`ERR Invalid key "key:1": keys must be unsigned 64-bit integers`)},
+		{[]string{"GET"}, respError("ERR wrong number of arguments for 'get' command")},
+		{[]string{"MSET", "1"}, respError("ERR wrong number of arguments for 'mset' command")},
+		{[]string{"MSET", "1", "a", "2"}, respError("ERR wrong number of arguments for 'mset' command")},
+		{[]string{"SET", "1", "a", "EX", "10"}, respError("ERR syntax error")},
+		{[]string{"FLUSHALL"}, respError("ERR unknown command 'FLUSHALL'")},
+		{[]string{"QUIT"}, "OK"},
+	}
+
+	for _, test := range tests {
+		if reply := client.do(t, test.args...); !reflect.DeepEqual(reply, test.expected) {
+			t.Errorf("Expected %q for %v; got %q", test.expected, test.args, reply)
+		}
+	}
+
+	if _, err := client.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed after QUIT; got %v", err)
+	}
+}
+
+func TestRESPPipelining(t *testing.T) {
+	_, client := startRESPServer(t)
+
+	// All commands are sent before reading any reply, both as arrays and
+	// inline.
+	for i := 0; i < 1_000; i++ {
+		client.send(t, "SET", strconv.Itoa(i), strconv.Itoa(2*i))
+	}
+	client.conn.Write([]byte("GET 10\r\n\r\nPING\n"))
+
+	for i := 0; i < 1_000; i++ {
+		if reply := client.reply(t); reply != "OK" {
+			t.Fatalf("Expected OK for command %d; got %q", i, reply)
+		}
+	}
+	if reply := client.reply(t); reply != "20" {
+		t.Errorf("Expected value 20 for inline GET; got %q", reply)
+	}
+	if reply := client.reply(t); reply != "PONG" {
+		t.Errorf("Expected PONG for inline PING; got %q", reply)
+	}
+}
+
+func TestRESPScan(t *testing.T) {
+	_, client := startRESPServer(t)
+
+	for i := 1; i <= 25; i++ {
+		client.do(t, "SET", strconv.Itoa(i), "v")
+	}
+
+	var keys []interface{}
+	cursor := "0"
+	for scans := 0; ; scans++ {
+		reply := client.do(t, "SCAN", cursor, "COUNT", "10").([]interface{})
+		cursor = reply[0].(string)
+		keys = append(keys, reply[1].([]interface{})...)
+		if cursor == "0" {
+			if scans != 2 {
+				t.Errorf("Expected 3 scans; got %d", scans+1)
+			}
+			break
+		}
+	}
+	if len(keys) != 25 || keys[0] != "1" || keys[24] != "25" {
+		t.Errorf("Expected keys 1 through 25; got %v", keys)
+	}
+
+	// COUNT is capped rather than allocated for.
+	all := client.do(t, "SCAN", "0", "COUNT", "9223372036854775807").([]interface{})
+	if all[0] != "0" || len(all[1].([]interface{})) != 25 {
+		t.Errorf("Expected all keys for huge COUNT; got %v", all)
+	}
+
+	reply := client.do(t, "SCAN", "0", "MATCH", "1*", "COUNT", "100")
+	expected := []interface{}{"0", []interface{}{"1", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19"}}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("Expected %v scanning matching keys; got %v", expected, reply)
+	}
+}
+
+func TestRESPInfo(t *testing.T) {
+	_, client := startRESPServer(t)
+	client.do(t, "SET", "1", "one")
+
+	info, _ := client.do(t, "INFO").(string)
+	for _, expected := range []string{"# Server", "connected_clients:1", "# Storage"} {
+		if !strings.Contains(info, expected) {
+			t.Errorf("Expected info to contain %q; got:\n%s", expected, info)
+		}
+	}
+	// Reading the whole tree must be asked for.
+	if strings.Contains(info, "# Tree") || strings.Contains(info, "# Keyspace") {
+		t.Errorf("Expected default info not to read the tree; got:\n%s", info)
+	}
+
+	info, _ = client.do(t, "INFO", "everything").(string)
+	for _, expected := range []string{"# Server", "db0:keys=1,", "height:2"} {
+		if !strings.Contains(info, expected) {
+			t.Errorf("Expected info to contain %q; got:\n%s", expected, info)
+		}
+	}
+
+	info, _ = client.do(t, "INFO", "keyspace").(string)
+	if info != "# Keyspace\r\ndb0:keys=1,expires=0,avg_ttl=0\r\n" {
+		t.Errorf("Expected only keyspace section; got:\n%s", info)
+	}
+}
+
+func TestRESPProtocolError(t *testing.T) {
+	_, client := startRESPServer(t)
+
+	client.conn.Write([]byte("*1\r\n+PING\r\n"))
+	if reply, ok := client.reply(t).(respError); !ok || !strings.HasPrefix(string(reply), "ERR Protocol error") {
+		t.Errorf("Expected protocol error; got %q", reply)
+	}
+	if _, err := client.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed after protocol error; got %v", err)
+	}
+}
+
+func TestRESPReadCommand(t *testing.T) {
+	large := strings.Repeat("x", 3*readChunkSize+1)
+	input := "*2\r\n$3\r\nSET\r\n$" + strconv.Itoa(len(large)) + "\r\n" + large + "\r\n"
+	r := &respReader{bufio.NewReader(strings.NewReader(input))}
+	if args, err := r.readCommand(); err != nil || len(args) != 2 || string(args[1]) != large {
+		t.Errorf("Expected command with %dB argument; got %d arguments, %v", len(large), len(args), err)
+	}
+
+	// Sizes announced without sending the data fail once the input ends,
+	// without allocating memory for them.
+	for _, input := range []string{"*1048576\r\n$1\r\nx\r\n", "*1\r\n$536870912\r\nx"} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		r := &respReader{bufio.NewReader(strings.NewReader(input))}
+		if _, err := r.readCommand(); err != io.ErrUnexpectedEOF && err != io.EOF {
+			t.Errorf("Expected unexpected EOF for %q; got %v", input, err)
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("Expected little memory to be allocated for %q; got %dB", input, allocated)
+		}
+	}
+}
+
+func TestRESPServerClose(t *testing.T) {
+	server, client := startRESPServer(t)
+	client.do(t, "PING")
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Error closing server: %v", err)
+	}
+	if _, err := client.r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed with server; got %v", err)
+	}
+}
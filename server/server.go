@@ -0,0 +1,190 @@
+/*
+Package server exposes a kv.BTree to other processes over the network.
+
+Each protocol is served by its own server type, all of which serve a single
+tree and may be used concurrently on the same tree. Keys are the unsigned 64-bit
+integer keys of the tree, and values arbitrary byte strings.
+*/
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve once the server has been closed.
+var ErrServerClosed = errors.New("server closed")
+
+// closeGracePeriod is the time given to handlers to write their replies once
+// the server is closed, before writing fails.
+const closeGracePeriod = 5 * time.Second
+
+// readChunkSize is the size up to which readSized allocates its buffer
+// upfront.
+const readChunkSize = 64 << 10
+
+// aLongTimeAgo is a deadline in the past, interrupting any pending read.
+var aLongTimeAgo = time.Unix(1, 0)
+
+/*
+connServer accepts connections on any number of listeners, and handles each of
+them in its own goroutine.
+
+Close closes all listeners and stops reading from all connections, such that
+each handler returns once it processed the input read so far and waits for
+more. Replies still being written get closeGracePeriod to reach the client.
+Each connection is closed once its handler returned.
+*/
+type connServer struct {
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+
+	handlers sync.WaitGroup
+}
+
+// serve accepts connections on the listener until it fails or the server is
+// closed, calling handle for each of them. The connection is closed once
+// handle returns. Returns ErrServerClosed once the server has been closed.
+func (s *connServer) serve(l net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]bool)
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// track registers a connection, unless the server has been closed.
+func (s *connServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	s.handlers.Add(1)
+
+	return true
+}
+
+// untrack closes and unregisters a connection whose handler returned.
+func (s *connServer) untrack(conn net.Conn) {
+	conn.Close()
+
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+func (s *connServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// close closes all listeners, interrupts reading from all connections, and
+// waits for all handlers to return.
+func (s *connServer) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	// Handlers fail to read further commands, but replies to those read
+	// already are still written.
+	deadline := time.Now().Add(closeGracePeriod)
+	for conn := range s.conns {
+		conn.SetReadDeadline(aLongTimeAgo)
+		conn.SetWriteDeadline(deadline)
+	}
+	s.mu.Unlock()
+
+	s.handlers.Wait()
+
+	return err
+}
+
+// parseKey parses a key given as decimal number.
+func parseKey(s string) (uint64, error) {
+	key, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid key %q: keys must be unsigned 64-bit integers", s)
+	}
+
+	return key, nil
+}
+
+// readSized reads exactly size bytes. Larger buffers grow as the data arrives
+// rather than being allocated upfront, such that clients announcing large sizes
+// make the server allocate no more memory than they actually send.
+func readSized(r io.Reader, size int) ([]byte, error) {
+	if size <= readChunkSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(readChunkSize)
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}